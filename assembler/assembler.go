@@ -0,0 +1,493 @@
+// Package assembler turns 6502 source into bytes, using the opcode table of
+// the cpu6502 core. The syntax is the ca65 subset that the disassembler
+// writes, with a .bank directive to place code in a PRG bank.
+package assembler
+
+import (
+	"fmt"
+	"nes-emu/cpu6502"
+	"regexp"
+	"strings"
+)
+
+// BankSize - the size of the PRG banks .bank selects, the iNES PRG unit
+const BankSize = 0x4000
+
+// Program - the result of assembling a source
+type Program struct {
+	// the assembled bytes from offset 0. Gaps are filled with zero
+	Bytes []byte
+
+	// every label and constant. Cheap locals are stored as global@local
+	Symbols map[string]int
+}
+
+type assembler struct {
+	symbols map[string]int
+
+	// addressing modes picked for each line in the first pass, so both
+	// passes give instructions the same size
+	modes map[int]cpu6502.Addressing
+
+	lastPass bool
+	lineNo   int
+
+	// current address and where in the output it goes
+	pc, pos int
+
+	// the bank being filled, or -1 before any .bank. The first .org in a
+	// bank sets the address its first byte is at
+	bank       int
+	bankOrigin int
+
+	// the last label not starting with @, which scopes cheap locals
+	scope string
+
+	out     []byte
+	written []bool
+}
+
+// Assemble - assembles source into a Program.
+//
+// Source is one statement a line with ; comments. Lines can start with
+// labels like name: and cheap local labels like @loop:, which are only
+// seen between two normal labels. Constants are defined with name = expr.
+// Directives are:
+//
+//	.org addr         sets the current address
+//	.bank n           puts what follows in 16KB PRG bank n
+//	.byte expr, ...   bytes, strings in double quotes give one byte a character
+//	.word expr, ...   little endian words
+//	.res count, fill  count bytes of fill, zero by default
+//	.setcpu "6502"    accepted and ignored
+//
+// Outside a bank each .org carries on where the last byte went. Inside
+// one the output is placed by address, so .org can skip ahead to the
+// vectors. Operands with a: or z: force absolute or zero page addressing.
+func Assemble(source string) (*Program, error) {
+	a := &assembler{
+		symbols: make(map[string]int),
+		modes:   make(map[int]cpu6502.Addressing),
+	}
+	lines := strings.Split(source, "\n")
+
+	// the first pass finds the labels, the second can then resolve everything
+	for pass := 0; pass < 2; pass++ {
+		a.lastPass = pass == 1
+		a.pc, a.pos, a.bank, a.bankOrigin, a.scope = 0, 0, -1, -1, ""
+		a.out, a.written = nil, nil
+
+		for i, line := range lines {
+			a.lineNo = i
+			if err := a.statement(line); err != nil {
+				return nil, fmt.Errorf("line %d: %v", i+1, err)
+			}
+		}
+	}
+
+	return &Program{Bytes: a.out, Symbols: a.symbols}, nil
+}
+
+var (
+	labelPattern    = regexp.MustCompile(`^\s*([A-Za-z_@][A-Za-z0-9_@]*):`)
+	constantPattern = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_]*)\s*=(.*)$`)
+)
+
+// statement - assembles one line
+func (a *assembler) statement(line string) error {
+	line = stripComment(line)
+
+	for {
+		match := labelPattern.FindStringSubmatch(line)
+		if match == nil {
+			break
+		}
+		if err := a.define(match[1], a.pc); err != nil {
+			return err
+		}
+		if !strings.HasPrefix(match[1], "@") {
+			a.scope = match[1]
+		}
+		line = line[len(match[0]):]
+	}
+
+	if match := constantPattern.FindStringSubmatch(line); match != nil {
+		value, known, err := a.eval(strings.TrimSpace(match[2]))
+		if err != nil || !known {
+			// defined in the last pass once what it refers to is known
+			return err
+		}
+		return a.define(match[1], value)
+	}
+
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return nil
+	}
+
+	fields := strings.SplitN(line, " ", 2)
+	if tab := strings.IndexByte(fields[0], '\t'); tab >= 0 {
+		fields = []string{fields[0][:tab], fields[0][tab+1:]}
+	}
+	operand := ""
+	if len(fields) == 2 {
+		operand = strings.TrimSpace(fields[1])
+	}
+
+	if strings.HasPrefix(fields[0], ".") {
+		return a.directive(strings.ToLower(fields[0]), operand)
+	}
+
+	return a.instruction(fields[0], operand)
+}
+
+// stripComment - drops everything after a ; that isn't in quotes
+func stripComment(line string) string {
+	quote := byte(0)
+	for i := 0; i < len(line); i++ {
+		switch c := line[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == ';':
+			return line[:i]
+		}
+	}
+
+	return line
+}
+
+// symbolName - the name a symbol is stored under, with cheap locals
+// scoped by the label before them
+func (a *assembler) symbolName(name string) string {
+	if strings.HasPrefix(name, "@") {
+		return a.scope + name
+	}
+
+	return name
+}
+
+func (a *assembler) define(name string, value int) error {
+	key := a.symbolName(name)
+
+	if old, ok := a.symbols[key]; ok && !a.lastPass {
+		return fmt.Errorf("%s is already defined as $%04X", name, old)
+	}
+	a.symbols[key] = value
+
+	return nil
+}
+
+func (a *assembler) lookup(name string) (int, bool) {
+	value, ok := a.symbols[a.symbolName(name)]
+
+	return value, ok
+}
+
+// emit - writes bytes at the current position and moves past them
+func (a *assembler) emit(data ...byte) error {
+	if a.bank >= 0 && a.pos+len(data) > (a.bank+1)*BankSize {
+		return fmt.Errorf("bank %d is full", a.bank)
+	}
+
+	for _, value := range data {
+		for len(a.out) <= a.pos {
+			a.out = append(a.out, 0)
+			a.written = append(a.written, false)
+		}
+		if a.written[a.pos] {
+			return fmt.Errorf("$%04X is written twice", a.pc)
+		}
+
+		a.out[a.pos], a.written[a.pos] = value, true
+		a.pos++
+		a.pc++
+	}
+
+	return nil
+}
+
+func (a *assembler) directive(name, operand string) error {
+	switch name {
+	case ".setcpu":
+		if operand != `"6502"` && operand != `"6502X"` {
+			return fmt.Errorf("only the 6502 is supported, not %s", operand)
+		}
+		return nil
+
+	case ".org":
+		addr, known, err := a.eval(operand)
+		if err != nil {
+			return err
+		}
+		if !known {
+			return fmt.Errorf(".org needs a value that is already known")
+		}
+
+		if a.bank >= 0 {
+			if a.bankOrigin < 0 {
+				a.bankOrigin = addr
+			}
+			if addr < a.bankOrigin {
+				return fmt.Errorf(".org $%04X is before the start of bank %d at $%04X", addr, a.bank, a.bankOrigin)
+			}
+			a.pos = a.bank*BankSize + addr - a.bankOrigin
+		}
+		a.pc = addr
+		return nil
+
+	case ".bank":
+		bank, known, err := a.eval(operand)
+		if err != nil {
+			return err
+		}
+		if !known || bank < 0 {
+			return fmt.Errorf("bad bank %s", operand)
+		}
+		a.bank, a.bankOrigin, a.pos = bank, -1, bank*BankSize
+		return nil
+
+	case ".byte", ".db":
+		for _, arg := range splitArgs(operand) {
+			if strings.HasPrefix(arg, `"`) {
+				if len(arg) < 2 || !strings.HasSuffix(arg, `"`) {
+					return fmt.Errorf("unterminated string %s", arg)
+				}
+				if err := a.emit([]byte(arg[1 : len(arg)-1])...); err != nil {
+					return err
+				}
+				continue
+			}
+
+			value, err := a.value(arg, -0x80, 0xFF)
+			if err != nil {
+				return err
+			}
+			if err := a.emit(uint8(value)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case ".word", ".dw", ".addr":
+		for _, arg := range splitArgs(operand) {
+			value, err := a.value(arg, 0, 0xFFFF)
+			if err != nil {
+				return err
+			}
+			if err := a.emit(uint8(value), uint8(value>>8)); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case ".res":
+		args := splitArgs(operand)
+		if len(args) < 1 || len(args) > 2 {
+			return fmt.Errorf(".res takes a count and an optional fill")
+		}
+		count, known, err := a.eval(args[0])
+		if err != nil {
+			return err
+		}
+		if !known || count < 0 {
+			return fmt.Errorf("bad .res count %s", args[0])
+		}
+		fill := 0
+		if len(args) == 2 {
+			if fill, err = a.value(args[1], -0x80, 0xFF); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < count; i++ {
+			if err := a.emit(uint8(fill)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	return fmt.Errorf("unknown directive %s", name)
+}
+
+// value - evaluates an operand that has to fit between min and max
+func (a *assembler) value(text string, min, max int) (int, error) {
+	value, _, err := a.eval(text)
+	if err != nil {
+		return 0, err
+	}
+	if a.lastPass && (value < min || value > max) {
+		return 0, fmt.Errorf("%s is out of range", text)
+	}
+
+	return value, nil
+}
+
+// splitArgs - splits on commas outside quotes and brackets
+func splitArgs(operand string) []string {
+	var args []string
+
+	depth, quote, start := 0, byte(0), 0
+	for i := 0; i < len(operand); i++ {
+		switch c := operand[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			args = append(args, strings.TrimSpace(operand[start:i]))
+			start = i + 1
+		}
+	}
+
+	if rest := strings.TrimSpace(operand[start:]); rest != "" || len(args) > 0 {
+		args = append(args, rest)
+	}
+
+	return args
+}
+
+// instruction - picks the addressing mode from the operand's form and
+// emits the opcode and operand
+func (a *assembler) instruction(mnemonic, operand string) error {
+	has := func(mode cpu6502.Addressing) bool {
+		_, ok := cpu6502.Opcode(mnemonic, mode)
+		return ok
+	}
+
+	known := false
+	for mode := cpu6502.Implied; mode <= cpu6502.Relative; mode++ {
+		known = known || has(mode)
+	}
+	if !known {
+		return fmt.Errorf("unknown instruction %s", mnemonic)
+	}
+
+	lower := strings.ToLower(operand)
+	var mode cpu6502.Addressing
+	var expr string
+
+	switch {
+	case operand == "" || lower == "a":
+		mode, expr = cpu6502.Implied, ""
+		if has(cpu6502.Accumulator) {
+			mode = cpu6502.Accumulator
+		}
+
+	case strings.HasPrefix(operand, "#"):
+		mode, expr = cpu6502.Immediate, operand[1:]
+
+	case has(cpu6502.Relative):
+		mode, expr = cpu6502.Relative, operand
+
+	case strings.HasPrefix(operand, "(") && strings.HasSuffix(lower, ",x)"):
+		mode, expr = cpu6502.IndirectX, operand[1:len(operand)-3]
+
+	case strings.HasPrefix(operand, "(") && strings.HasSuffix(strings.Replace(lower, " ", "", -1), "),y"):
+		mode, expr = cpu6502.IndirectY, operand[1:strings.LastIndex(operand, ")")]
+
+	case strings.HasPrefix(operand, "(") && strings.HasSuffix(operand, ")") && has(cpu6502.Indirect):
+		mode, expr = cpu6502.Indirect, operand[1:len(operand)-1]
+
+	default:
+		var err error
+		if mode, expr, err = a.directMode(operand, has); err != nil {
+			return err
+		}
+	}
+
+	opcode, ok := cpu6502.Opcode(mnemonic, mode)
+	if !ok {
+		return fmt.Errorf("%s can't take %s", mnemonic, operand)
+	}
+
+	if expr == "" {
+		return a.emit(opcode)
+	}
+
+	switch mode {
+	case cpu6502.Relative:
+		target, _, err := a.eval(expr)
+		if err != nil {
+			return err
+		}
+		offset := target - (a.pc + 2)
+		if a.lastPass && (offset < -128 || offset > 127) {
+			return fmt.Errorf("branch to $%04X is out of range", target)
+		}
+		return a.emit(opcode, uint8(offset))
+
+	case cpu6502.Immediate, cpu6502.ZeroPage, cpu6502.ZeroPageX, cpu6502.ZeroPageY, cpu6502.IndirectX, cpu6502.IndirectY:
+		min := 0
+		if mode == cpu6502.Immediate {
+			min = -0x80
+		}
+		value, err := a.value(expr, min, 0xFF)
+		if err != nil {
+			return err
+		}
+		return a.emit(opcode, uint8(value))
+	}
+
+	value, err := a.value(expr, 0, 0xFFFF)
+	if err != nil {
+		return err
+	}
+
+	return a.emit(opcode, uint8(value), uint8(value>>8))
+}
+
+// directMode - the zero page or absolute mode for an operand like
+// expr, expr,x or expr,y. Zero page is used when the value is known to
+// fit in the first pass, unless a: says otherwise.
+func (a *assembler) directMode(operand string, has func(cpu6502.Addressing) bool) (cpu6502.Addressing, string, error) {
+	zeroPage, absolute := cpu6502.ZeroPage, cpu6502.Absolute
+
+	expr := operand
+	if args := splitArgs(operand); len(args) == 2 {
+		expr = args[0]
+		switch strings.ToLower(args[1]) {
+		case "x":
+			zeroPage, absolute = cpu6502.ZeroPageX, cpu6502.AbsoluteX
+		case "y":
+			zeroPage, absolute = cpu6502.ZeroPageY, cpu6502.AbsoluteY
+		default:
+			return 0, "", fmt.Errorf("bad index in %s", operand)
+		}
+	}
+
+	mode := absolute
+	lower := strings.ToLower(expr)
+	forced := strings.HasPrefix(lower, "a:") || strings.HasPrefix(lower, "z:")
+	if forced {
+		expr = expr[2:]
+		if lower[0] == 'z' {
+			mode = zeroPage
+		}
+	}
+
+	if a.lastPass {
+		return a.modes[a.lineNo], expr, nil
+	}
+
+	if !forced {
+		if value, known, err := a.eval(expr); err == nil && known && value >= 0 && value < 0x100 && has(zeroPage) {
+			mode = zeroPage
+		}
+	}
+	if !has(mode) {
+		mode = absolute
+	}
+
+	a.modes[a.lineNo] = mode
+	return mode, expr, nil
+}
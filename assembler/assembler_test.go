@@ -0,0 +1,112 @@
+package assembler
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestAssemble(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		expected []byte
+	}{
+		{"implied and accumulator", "clc\nasl\nlsr a", []byte{0x18, 0x0A, 0x4A}},
+		{"immediate", "lda #$10\nldx #%101\nldy #'A'\nadc #-1", []byte{0xA9, 0x10, 0xA2, 0x05, 0xA0, 0x41, 0x69, 0xFF}},
+		{"zero page and absolute", "lda $10\nlda $1234\nlda a:$10\nsta $10,x\nldx $10,y", []byte{0xA5, 0x10, 0xAD, 0x34, 0x12, 0xAD, 0x10, 0x00, 0x95, 0x10, 0xB6, 0x10}},
+		{"no zero page form", "lda $10,y", []byte{0xB9, 0x10, 0x00}},
+		{"indirect", "jmp ($0200)\nlda ($10,x)\nsta ($20),y", []byte{0x6C, 0x00, 0x02, 0xA1, 0x10, 0x91, 0x20}},
+		{"forward label is absolute", ".org $10\nlda later\nlater: rts", []byte{0xAD, 0x13, 0x00, 0x60}},
+		{"branches", ".org $8000\nloop: dex\nbne loop\nbeq done\nnop\ndone:", []byte{0xCA, 0xD0, 0xFD, 0xF0, 0x01, 0xEA}},
+		{"expressions", "ptr = $10\nlda #<table\nldx #>table\nsta ptr+1\nlda #(2+3)*4\n.org $1234\ntable:", []byte{0xA9, 0x34, 0xA2, 0x12, 0x85, 0x11, 0xA9, 0x14}},
+		{"current address", ".org $C000\njmp *", []byte{0x4C, 0x00, 0xC0}},
+		{"data", ".byte \"NES\",$1A, 1\n.word $1234, done-1\n.res 2, $FF\ndone:", []byte{'N', 'E', 'S', 0x1A, 0x01, 0x34, 0x12, 0x0A, 0x00, 0xFF, 0xFF}},
+		{"cheap locals", "a1:\n@x: jmp @x\nb1:\n@x: jmp @x", []byte{0x4C, 0x00, 0x00, 0x4C, 0x03, 0x00}},
+		{"comments", "lda #';' ; load a semicolon\n.byte \";\" ; and another", []byte{0xA9, ';', ';'}},
+		{"documented opcode wins", "nop\nsbc #1", []byte{0xEA, 0xE9, 0x01}},
+		{"unofficial", "lax $10", []byte{0xA7, 0x10}},
+	}
+
+	for _, test := range tests {
+		program, err := Assemble(test.source)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !bytes.Equal(program.Bytes, test.expected) {
+			t.Errorf("%s: expected % X but got % X", test.name, test.expected, program.Bytes)
+		}
+	}
+}
+
+func TestAssembleBanks(t *testing.T) {
+	program, err := Assemble(`
+		.bank 1
+		.org $C000
+	reset:
+		jmp reset
+		.org $FFFC
+		.word reset
+
+		.bank 0
+		.org $8000
+		.byte 1, 2`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// output stops after the last byte written
+	if len(program.Bytes) != 2*BankSize-2 {
+		t.Fatalf("Expected the vector at the end of bank 1, got %d bytes", len(program.Bytes))
+	}
+	if program.Symbols["reset"] != 0xC000 {
+		t.Errorf("Expected reset at C000, got %04X", program.Symbols["reset"])
+	}
+
+	expected := map[int]byte{0x0000: 1, 0x0001: 2, 0x4000: 0x4C, 0x4001: 0x00, 0x4002: 0xC0, 0x7FFC: 0x00, 0x7FFD: 0xC0}
+	for pos, value := range expected {
+		if program.Bytes[pos] != value {
+			t.Errorf("Expected %02X at %04X, got %02X", value, pos, program.Bytes[pos])
+		}
+	}
+}
+
+func TestAssembleErrors(t *testing.T) {
+	tests := []struct {
+		source string
+		err    string
+	}{
+		{"lda missing", "line 1: undefined symbol missing"},
+		{"foo #1", "line 1: unknown instruction foo"},
+		{"x:\nx:", "line 2: x is already defined"},
+		{"lda $10,z", "line 1: bad index"},
+		{"ldx $10,x", "line 1: ldx can't take $10,x"},
+		{"lda #$100", "line 1: $100 is out of range"},
+		{".org $8000\nbne far\n.res 200\nfar:", "line 2: branch to $80CA is out of range"},
+		{".bank 0\n.org $C000\n.res $4001", "line 3: bank 0 is full"},
+		{".bank 0\n.org $C000\nnop\n.org $C000\nnop", "line 5: $C000 is written twice"},
+		{".fill 1", "line 1: unknown directive .fill"},
+	}
+
+	for _, test := range tests {
+		_, err := Assemble(test.source)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: expected an error containing %q, got %v", test.source, test.err, err)
+		}
+	}
+}
+
+func TestINES(t *testing.T) {
+	image := INES([]byte{0xEA}, nil, 1)
+
+	if string(image[0:4]) != "NES\x1A" || image[4] != 1 || image[5] != 1 || image[6] != 0x10 || image[7] != 0 {
+		t.Errorf("Bad header % X", image[0:16])
+	}
+	if len(image) != 16+0x4000+0x2000 {
+		t.Errorf("Expected one PRG and one CHR bank, got %d bytes", len(image))
+	}
+	if image[16] != 0xEA {
+		t.Errorf("Expected PRG right after the header")
+	}
+}
@@ -0,0 +1,231 @@
+package assembler
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// expression - parses and evaluates one expression. Operators follow C
+// precedence, with < and > in front of a value taking its low and high
+// byte, and * on its own being the current address.
+type expression struct {
+	a    *assembler
+	text string
+	pos  int
+
+	// a symbol in the expression isn't defined yet
+	unknown bool
+}
+
+// eval - the value of text. Undefined symbols are an error in the last
+// pass, and count as 0 with unknown set before that.
+func (a *assembler) eval(text string) (int, bool, error) {
+	e := &expression{a: a, text: text}
+
+	value, err := e.binary(0)
+	if err != nil {
+		return 0, false, err
+	}
+
+	e.skipSpace()
+	if e.pos < len(e.text) {
+		return 0, false, fmt.Errorf("unexpected %q in expression %q", e.text[e.pos:], text)
+	}
+
+	return value, !e.unknown, nil
+}
+
+var precedence = []map[string]func(x, y int) (int, error){
+	{"|": func(x, y int) (int, error) { return x | y, nil }},
+	{"^": func(x, y int) (int, error) { return x ^ y, nil }},
+	{"&": func(x, y int) (int, error) { return x & y, nil }},
+	{
+		"<<": func(x, y int) (int, error) { return x << uint(y), nil },
+		">>": func(x, y int) (int, error) { return x >> uint(y), nil },
+	},
+	{
+		"+": func(x, y int) (int, error) { return x + y, nil },
+		"-": func(x, y int) (int, error) { return x - y, nil },
+	},
+	{
+		"*": func(x, y int) (int, error) { return x * y, nil },
+		"/": func(x, y int) (int, error) {
+			if y == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			return x / y, nil
+		},
+		"%": func(x, y int) (int, error) {
+			if y == 0 {
+				return 0, fmt.Errorf("division by zero")
+			}
+			return x % y, nil
+		},
+	},
+}
+
+func (e *expression) skipSpace() {
+	for e.pos < len(e.text) && (e.text[e.pos] == ' ' || e.text[e.pos] == '\t') {
+		e.pos++
+	}
+}
+
+// operator - the operator of this precedence level at pos, if there is one
+func (e *expression) operator(level int) (string, bool) {
+	e.skipSpace()
+	rest := e.text[e.pos:]
+
+	for _, op := range []string{"<<", ">>"} {
+		if strings.HasPrefix(rest, op) {
+			_, ok := precedence[level][op]
+			return op, ok
+		}
+	}
+
+	if len(rest) > 0 {
+		op := rest[:1]
+		_, ok := precedence[level][op]
+		return op, ok
+	}
+
+	return "", false
+}
+
+func (e *expression) binary(level int) (int, error) {
+	if level == len(precedence) {
+		return e.unary()
+	}
+
+	x, err := e.binary(level + 1)
+	if err != nil {
+		return 0, err
+	}
+
+	for {
+		op, ok := e.operator(level)
+		if !ok {
+			return x, nil
+		}
+		e.pos += len(op)
+
+		y, err := e.binary(level + 1)
+		if err != nil {
+			return 0, err
+		}
+		if x, err = precedence[level][op](x, y); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (e *expression) unary() (int, error) {
+	e.skipSpace()
+	if e.pos == len(e.text) {
+		return 0, fmt.Errorf("expression %q ends early", e.text)
+	}
+
+	op := e.text[e.pos]
+	switch op {
+	case '-', '~', '<', '>', '+':
+		e.pos++
+		x, err := e.unary()
+		switch op {
+		case '-':
+			x = -x
+		case '~':
+			x = ^x
+		case '<':
+			x &= 0xFF
+		case '>':
+			x = (x >> 8) & 0xFF
+		}
+		return x, err
+	}
+
+	return e.primary()
+}
+
+func (e *expression) primary() (int, error) {
+	text := e.text[e.pos:]
+
+	switch c := text[0]; {
+	case c == '(':
+		e.pos++
+		x, err := e.binary(0)
+		if err != nil {
+			return 0, err
+		}
+		e.skipSpace()
+		if e.pos == len(e.text) || e.text[e.pos] != ')' {
+			return 0, fmt.Errorf("missing ) in expression %q", e.text)
+		}
+		e.pos++
+		return x, nil
+
+	case c == '*':
+		e.pos++
+		return e.a.pc, nil
+
+	case c == '\'':
+		if len(text) < 3 || text[2] != '\'' {
+			return 0, fmt.Errorf("bad character constant in %q", e.text)
+		}
+		e.pos += 3
+		return int(text[1]), nil
+
+	case c == '$' || c == '%':
+		base := 16
+		if c == '%' {
+			base = 2
+		}
+		digits := e.scan(1, func(c byte) bool { return isHexDigit(c) })
+		value, err := strconv.ParseInt(digits, base, 64)
+		if err != nil {
+			return 0, fmt.Errorf("bad number %q", text[:1+len(digits)])
+		}
+		return int(value), nil
+
+	case c >= '0' && c <= '9':
+		digits := e.scan(0, func(c byte) bool { return c >= '0' && c <= '9' })
+		value, err := strconv.ParseInt(digits, 10, 64)
+		return int(value), err
+
+	case isSymbolStart(c):
+		name := e.scan(0, isSymbolChar)
+		value, ok := e.a.lookup(name)
+		if !ok {
+			if e.a.lastPass {
+				return 0, fmt.Errorf("undefined symbol %s", name)
+			}
+			e.unknown = true
+		}
+		return value, nil
+	}
+
+	return 0, fmt.Errorf("unexpected %q in expression %q", text, e.text)
+}
+
+// scan - moves past skip characters and then everything matching accept,
+// returning what was accepted
+func (e *expression) scan(skip int, accept func(c byte) bool) string {
+	e.pos += skip
+	start := e.pos
+	for e.pos < len(e.text) && accept(e.text[e.pos]) {
+		e.pos++
+	}
+
+	return e.text[start:e.pos]
+}
+
+func isHexDigit(c byte) bool {
+	return c >= '0' && c <= '9' || c >= 'a' && c <= 'f' || c >= 'A' && c <= 'F'
+}
+
+func isSymbolStart(c byte) bool {
+	return c == '_' || c == '@' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+func isSymbolChar(c byte) bool {
+	return isSymbolStart(c) || c >= '0' && c <= '9'
+}
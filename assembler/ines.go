@@ -0,0 +1,27 @@
+package assembler
+
+// INES - wraps PRG rom in an iNES image that CreateCartridge accepts. PRG
+// is padded with zero to a whole number of 16KB banks, and an 8KB CHR bank
+// is added if chr is empty so the PPU has pattern tables to read.
+func INES(prg, chr []byte, mapper uint8) []byte {
+	prgBanks := (len(prg) + BankSize - 1) / BankSize
+	if prgBanks == 0 {
+		prgBanks = 1
+	}
+	if len(chr) == 0 {
+		chr = make([]byte, 0x2000)
+	}
+	chrBanks := (len(chr) + 0x1FFF) / 0x2000
+
+	image := make([]byte, 16+prgBanks*BankSize+chrBanks*0x2000)
+	copy(image, "NES\x1A")
+	image[4] = uint8(prgBanks)
+	image[5] = uint8(chrBanks)
+	image[6] = mapper << 4
+	image[7] = mapper & 0xF0
+
+	copy(image[16:], prg)
+	copy(image[16+prgBanks*BankSize:], chr)
+
+	return image
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"io"
+	"log"
+	"nes-emu/hardware"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var coverageCmd = &cobra.Command{
+	Use:   "coverage ROM [CDL]",
+	Short: "Write an HTML report of the code and graphics a code/data log shows were used.",
+	Long: `Reads CDL, an FCEUX style code/data log recorded with --cdl, and writes
+an HTML report of ROM: how much of each PRG bank ran or was read, each bank's
+disassembly with the code that never ran marked, and which CHR tiles were
+drawn. CDL defaults to the rom's name with .cdl on the end instead.
+
+Logs build up over sessions, so play with --cdl pointing at the same file
+each time to see everything that's been reached.`,
+	Args: cobra.RangeArgs(1, 2),
+	RunE: runCoverage,
+}
+
+func init() {
+	coverageCmd.Flags().StringP("output", "o", "coverage.html", "write the report to FILE.")
+	rootCmd.AddCommand(coverageCmd)
+}
+
+func runCoverage(cmd *cobra.Command, args []string) error {
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return err
+	}
+
+	cdlFile := strings.TrimSuffix(args[0], filepath.Ext(args[0])) + ".cdl"
+	if len(args) > 1 {
+		cdlFile = args[1]
+	}
+
+	cart, err := createCartridge(cmd, args[0])
+	if err != nil {
+		return err
+	}
+
+	nes := hardware.NewNES()
+	if err := nes.LoadCartridge(cart); err != nil {
+		return err
+	}
+	cdl := hardware.NewCodeDataLogger(nes)
+
+	file, err := os.Open(cdlFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := cdl.Load(file); err != nil {
+		return err
+	}
+
+	var options hardware.DisasmOptions
+	if options.Symbols, err = loadSymbols(cmd, args[0], &cart); err != nil {
+		return err
+	}
+
+	return writeFile(output, func(w io.Writer) error {
+		return hardware.WriteCoverage(&cart, cdl, args[0], w, options)
+	})
+}
+
+// initCDL - attaches a code/data logger to nes if --cdl was given, adding
+// to the log in the file if there is one. The returned func writes it out.
+func initCDL(cmd *cobra.Command, nes *hardware.NES) (func(), error) {
+	cdlFile, _ := cmd.Flags().GetString("cdl")
+	if cdlFile == "" || nes.CART == nil {
+		return func() {}, nil
+	}
+
+	cdl := hardware.NewCodeDataLogger(nes)
+	if err := cdl.LoadFile(cdlFile); err != nil {
+		return nil, err
+	}
+
+	return func() {
+		if err := writeFile(cdlFile, cdl.Write); err != nil {
+			log.Println(err)
+		}
+	}, nil
+}
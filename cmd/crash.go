@@ -0,0 +1,133 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/faiface/pixel"
+	"github.com/faiface/pixel/imdraw"
+	"github.com/faiface/pixel/pixelgl"
+	"github.com/faiface/pixel/text"
+	"github.com/spf13/cobra"
+	"golang.org/x/image/colornames"
+	"golang.org/x/image/font/basicfont"
+	"log"
+	"nes-emu/hardware"
+	"strings"
+)
+
+// initDiagnostics - attaches crash and hang detection to nes unless
+// --history is 0. Returns where bundles go, "" when it's off.
+func initDiagnostics(cmd *cobra.Command, nes *hardware.NES) string {
+	history, _ := cmd.Flags().GetInt("history")
+	if history <= 0 {
+		return ""
+	}
+
+	d := hardware.NewDiagnostics(nes, history)
+	d.HangFrames, _ = cmd.Flags().GetUint64("hang-frames")
+	d.DetectRAMCode, _ = cmd.Flags().GetBool("detect-ram-code")
+
+	crashDir, _ := cmd.Flags().GetString("crash-dir")
+
+	return crashDir
+}
+
+// runFrameSafely - runs a frame, turning a panic in the emulator into a
+// crash the diagnostics report, when they're attached
+func runFrameSafely(nes *hardware.NES, runFrame func() bool) (running bool) {
+	if nes.Diagnostics == nil {
+		return runFrame()
+	}
+
+	defer func() {
+		if value := recover(); value != nil {
+			nes.Diagnostics.Recover(value)
+			running = true
+		}
+	}()
+
+	return runFrame()
+}
+
+// crashScreen - the error shown over the last frame once the game has
+// crashed, in place of exiting
+type crashScreen struct {
+	err   *hardware.Crash
+	imd   *imdraw.IMDraw
+	atlas *text.Atlas
+	lines []string
+}
+
+// newCrashScreen - writes the diagnostic bundle to dir and sets up the
+// error to show
+func newCrashScreen(dir string, d *hardware.Diagnostics) *crashScreen {
+	crash := d.Err()
+	log.Printf("game crashed: %v", crash)
+
+	lines := append([]string{"The game has crashed:", ""}, wrapText(crash.Error(), 34)...)
+	if path, err := d.WriteBundle(dir); err != nil {
+		log.Printf("couldn't write the diagnostic bundle: %v", err)
+		lines = append(lines, "", "The diagnostic bundle couldn't", "be written.")
+	} else {
+		log.Printf("diagnostic bundle written to %s", path)
+		lines = append(lines, "", "Diagnostics written to")
+		lines = append(lines, wrapText(path, 34)...)
+	}
+	lines = append(lines, "", "Close the window to quit.")
+
+	return &crashScreen{
+		err:   crash,
+		imd:   imdraw.New(nil),
+		atlas: text.NewAtlas(basicfont.Face7x13, text.ASCII),
+		lines: lines,
+	}
+}
+
+// draw - dims the frame and writes the error over it. It's drawn in the
+// frame's coordinates, so it scales with it.
+func (c *crashScreen) draw(win *pixelgl.Window) {
+	center := win.Bounds().Center()
+
+	c.imd.Clear()
+	c.imd.Color = pixel.RGBA{R: 0, G: 0, B: 0, A: 0.8}
+	c.imd.Push(center.Add(pixel.V(-128, -120)), center.Add(pixel.V(128, 120)))
+	c.imd.Rectangle(0)
+	c.imd.Draw(win)
+
+	txt := text.New(center.Add(pixel.V(-120, 100)), c.atlas)
+	txt.Color = colornames.White
+	for _, line := range c.lines {
+		fmt.Fprintln(txt, line)
+	}
+	txt.Draw(win, pixel.IM)
+}
+
+// wrapText - splits s into lines of at most width, at spaces where it can
+func wrapText(s string, width int) []string {
+	var lines []string
+	line := ""
+	for _, word := range strings.Fields(s) {
+		for len(word) > width {
+			if line != "" {
+				lines = append(lines, line)
+				line = ""
+			}
+			lines = append(lines, word[:width])
+			word = word[width:]
+		}
+
+		switch {
+		case line == "":
+			line = word
+		case len(line)+1+len(word) <= width:
+			line += " " + word
+		default:
+			lines = append(lines, line)
+			line = word
+		}
+	}
+	if line != "" {
+		lines = append(lines, line)
+	}
+
+	return lines
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"log"
+	"nes-emu/hardware"
+	"net"
+)
+
+var dapCmd = &cobra.Command{
+	Use:   "dap",
+	Short: "Serve the Debug Adapter Protocol for debugging in an editor.",
+	Long: `Listens on a localhost port for Debug Adapter Protocol clients, like
+VS Code with a launch configuration of "debugServer": 4711. Each client
+launches a rom with
+
+  "program": "game.nes",
+  "debugInfo": "game.dbg",
+  "stopOnEntry": true
+
+debugInfo is a ca65 debug file from ld65 --dbgfile, and defaults to the
+rom's name with .dbg if that exists. With it, breakpoints can be set on
+lines of the .s files and stack frames show the source. Function
+breakpoints take an address, like $C000. Sessions are served one at a
+time, with no sound.`,
+	Args: cobra.NoArgs,
+	Run:  serveDAP,
+}
+
+func init() {
+	dapCmd.Flags().Int("port", 4711, "port to listen on.")
+	dapCmd.Flags().Bool("headless", false, "run without a window.")
+	rootCmd.AddCommand(dapCmd)
+}
+
+func serveDAP(cmd *cobra.Command, args []string) {
+	port, _ := cmd.Flags().GetInt("port")
+	headless, _ := cmd.Flags().GetBool("headless")
+	scalingFactor, _ := cmd.Flags().GetInt("scale")
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	log.Printf("debug adapter listening on %s", listener.Addr())
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		session := hardware.NewDAPSession(conn)
+		session.InitNES = func(nes *hardware.NES) {
+			nes.APU.InitAPU(false)
+			nes.PPU.InitFrame(scalingFactor)
+		}
+
+		if session.Launch() {
+			log.Printf("debugging for %s", conn.RemoteAddr())
+			if headless {
+				session.Run()
+			} else {
+				runInWindow(session.NES(), scalingFactor, "", func() bool {
+					session.RunFrame()
+					return session.Poll()
+				})
+				session.Terminate()
+			}
+		}
+
+		conn.Close()
+	}
+}
@@ -0,0 +1,71 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"io"
+	"nes-emu/hardware"
+	"os"
+)
+
+var disasmCmd = &cobra.Command{
+	Use:   "disasm ROM",
+	Short: "Disassemble a rom into ca65 source.",
+	Long: `Writes ROM out as ca65 source that assembles back to the same file.
+Code is found by following the reset, NMI and IRQ vectors through branches,
+calls and jump tables, and everything else is kept as data. With --frames
+the rom is also run headless first, and every instruction it ran is
+disassembled as code too.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runDisasm,
+}
+
+func init() {
+	disasmCmd.Flags().StringP("output", "o", "", "write the source to FILE instead of stdout.")
+	disasmCmd.Flags().Int("frames", 0, "run the rom for this many frames to find more code.")
+	rootCmd.AddCommand(disasmCmd)
+}
+
+func runDisasm(cmd *cobra.Command, args []string) error {
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return err
+	}
+	frames, err := cmd.Flags().GetInt("frames")
+	if err != nil {
+		return err
+	}
+
+	cart, err := createCartridge(cmd, args[0])
+	if err != nil {
+		return err
+	}
+
+	var options hardware.DisasmOptions
+	if options.Symbols, err = loadSymbols(cmd, args[0], &cart); err != nil {
+		return err
+	}
+
+	if frames > 0 {
+		nes := hardware.NewNES()
+		if err := nes.LoadCartridge(cart); err != nil {
+			return err
+		}
+		nes.APU.InitAPU(false)
+		nes.PPU.InitFrame(1)
+		nes.Reset()
+
+		options.Executed = hardware.ExecutedCode(nes, frames)
+	}
+
+	var w io.Writer = cmd.OutOrStdout()
+	if output != "" {
+		file, err := os.Create(output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	return hardware.Disassemble(&cart, w, options)
+}
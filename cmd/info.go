@@ -0,0 +1,85 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"nes-emu/hardware"
+	"os"
+)
+
+var infoCmd = &cobra.Command{
+	Use:   "info ROM",
+	Short: "Show what a rom's header says, and what the game database corrects it to.",
+	Long: `Prints ROM's header bytes and what they decode to, the hashes of its PRG
+and CHR rom, and, when the dump is in the --gamedb database, its title,
+board and the header the emulator runs it with instead.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runInfo,
+}
+
+func init() {
+	rootCmd.AddCommand(infoCmd)
+}
+
+func runInfo(cmd *cobra.Command, args []string) error {
+	cart, err := createCartridge(cmd, args[0])
+	if err != nil {
+		return err
+	}
+
+	header := cart.HeaderBytes()
+	fmt.Printf("file:     %s\n", args[0])
+	for _, patch := range cart.Patches {
+		fmt.Printf("patch:    %s\n", patch)
+	}
+	if cart.FileHeader.UNIF {
+		fmt.Println("header:   none, the rom is UNIF")
+	} else {
+		fmt.Printf("header:   % X\n", header[:])
+	}
+	fmt.Printf("          %v\n", cart.FileHeader)
+	fmt.Printf("CRC32:    %08X\n", cart.CRC32)
+	fmt.Printf("SHA-1:    %X\n", cart.SHA1)
+
+	if cart.Title != "" {
+		fmt.Printf("title:    %s\n", cart.Title)
+	}
+	if cart.Board != "" {
+		fmt.Printf("board:    %s\n", cart.Board)
+	}
+
+	switch {
+	case !cart.InGameDB():
+		fmt.Println("database: not found, running with the header as it is")
+	case cart.Header == cart.FileHeader:
+		fmt.Println("database: the header is right")
+	default:
+		fmt.Printf("database: %v\n", cart.Header)
+	}
+	if cart.DefaultExpansion != 0 {
+		fmt.Printf("expansion: %d\n", cart.DefaultExpansion)
+	}
+
+	return nil
+}
+
+// loadGameDB - the database given with --gamedb, nil without one
+func loadGameDB(cmd *cobra.Command) (*hardware.GameDB, error) {
+	dbFile, _ := cmd.Flags().GetString("gamedb")
+	if dbFile == "" {
+		return nil, nil
+	}
+
+	file, err := os.Open(dbFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	db, err := hardware.ParseGameDB(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", dbFile, err)
+	}
+
+	return db, nil
+}
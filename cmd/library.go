@@ -0,0 +1,169 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"nes-emu/hardware"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var libraryCmd = &cobra.Command{
+	Use:   "library",
+	Short: "Catalog a collection of roms.",
+}
+
+var libraryScanCmd = &cobra.Command{
+	Use:   "scan DIR",
+	Short: "List every rom under a directory, checked against a DAT.",
+	Long: `Walks DIR for roms, loose, zipped or gzipped, and writes a catalog of
+them: title, region, mapper, board, battery, whether --dat has them as
+verified, good or bad dumps, and whether the emulator supports the mapper.
+--dat takes a No-Intro or GoodNES style XML DAT, headered or headerless.
+
+A count of roms by mapper, most common first, is printed after, to show
+which mappers matter for the collection.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runLibraryScan,
+}
+
+func init() {
+	libraryScanCmd.Flags().String("dat", "", "check the roms against the XML DAT in FILE.")
+	libraryScanCmd.Flags().String("format", "", "write the catalog as json or csv, by default going by --output's extension, or json.")
+	libraryScanCmd.Flags().StringP("output", "o", "", "write the catalog to FILE instead of stdout.")
+	libraryCmd.AddCommand(libraryScanCmd)
+	rootCmd.AddCommand(libraryCmd)
+}
+
+func runLibraryScan(cmd *cobra.Command, args []string) error {
+	datFile, _ := cmd.Flags().GetString("dat")
+	format, _ := cmd.Flags().GetString("format")
+	output, _ := cmd.Flags().GetString("output")
+
+	if format == "" {
+		format = "json"
+		if strings.EqualFold(filepath.Ext(output), ".csv") {
+			format = "csv"
+		}
+	}
+	if format != "json" && format != "csv" {
+		return fmt.Errorf("unknown format %q, expected json or csv", format)
+	}
+
+	var dat *hardware.DAT
+	if datFile != "" {
+		file, err := os.Open(datFile)
+		if err != nil {
+			return err
+		}
+		dat, err = hardware.ParseDAT(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("%s: %w", datFile, err)
+		}
+	}
+
+	db, err := loadGameDB(cmd)
+	if err != nil {
+		return err
+	}
+
+	entries, err := hardware.ScanLibrary(args[0], dat, db)
+	if err != nil {
+		return err
+	}
+
+	write := writeLibraryJSON
+	if format == "csv" {
+		write = writeLibraryCSV
+	}
+	if output == "" {
+		err = write(os.Stdout, entries)
+	} else {
+		err = writeFile(output, func(w io.Writer) error { return write(w, entries) })
+	}
+	if err != nil {
+		return err
+	}
+
+	printMapperCounts(os.Stderr, entries)
+
+	return nil
+}
+
+func writeLibraryJSON(w io.Writer, entries []hardware.LibraryEntry) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+
+	return encoder.Encode(entries)
+}
+
+func writeLibraryCSV(w io.Writer, entries []hardware.LibraryEntry) error {
+	out := csv.NewWriter(w)
+	out.Write([]string{"file", "title", "region", "format", "mapper", "submapper", "board", "battery",
+		"crc32", "sha1", "status", "supported", "error"})
+
+	for _, e := range entries {
+		out.Write([]string{e.File, e.Title, e.Region, e.Format, strconv.Itoa(int(e.Mapper)), strconv.Itoa(int(e.Submapper)),
+			e.Board, strconv.FormatBool(e.Battery), e.CRC32, e.SHA1, e.Status, strconv.FormatBool(e.Supported), e.Error})
+	}
+
+	out.Flush()
+	return out.Error()
+}
+
+// printMapperCounts - how many roms use each mapper, most first
+func printMapperCounts(w io.Writer, entries []hardware.LibraryEntry) {
+	counts := make(map[uint16]int)
+	boards := make(map[string]int)
+	unreadable := 0
+	for _, e := range entries {
+		switch {
+		case e.Error != "":
+			unreadable++
+		case e.Mapper == hardware.UnknownMapper:
+			boards[e.Board]++
+		default:
+			counts[e.Mapper]++
+		}
+	}
+
+	mappers := make([]uint16, 0, len(counts))
+	for mapper := range counts {
+		mappers = append(mappers, mapper)
+	}
+	sort.Slice(mappers, func(i, j int) bool {
+		if counts[mappers[i]] != counts[mappers[j]] {
+			return counts[mappers[i]] > counts[mappers[j]]
+		}
+		return mappers[i] < mappers[j]
+	})
+
+	fmt.Fprintf(w, "%d roms\n", len(entries))
+	for _, mapper := range mappers {
+		supported := "not supported"
+		if hardware.SupportedMapper(mapper) {
+			supported = "supported"
+		}
+		fmt.Fprintf(w, "  mapper %3d: %5d  %s\n", mapper, counts[mapper], supported)
+	}
+
+	// UNIF boards there's no mapper number for, by name
+	names := make([]string, 0, len(boards))
+	for board := range boards {
+		names = append(names, board)
+	}
+	sort.Strings(names)
+	for _, board := range names {
+		fmt.Fprintf(w, "  board %s: %5d  not supported\n", board, boards[board])
+	}
+	if unreadable > 0 {
+		fmt.Fprintf(w, "  unreadable: %5d\n", unreadable)
+	}
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"nes-emu/hardware"
+)
+
+var patchCmd = &cobra.Command{
+	Use:   "patch",
+	Short: "Make patches for romhacks.",
+	Long: `Roms are patched as they're loaded, by .ips, .ups and .bps files with the
+rom's name next to it, or by those given with --patch. The subcommands make
+patches of your own.`,
+}
+
+var patchCreateCmd = &cobra.Command{
+	Use:   "create ORIGINAL MODIFIED OUT",
+	Short: "Write a BPS patch that turns one rom into another.",
+	Long: `Writes OUT, a BPS patch that turns ORIGINAL into MODIFIED. The patch
+holds the checksums of both, so it won't apply to any other rom.`,
+	Args: cobra.ExactArgs(3),
+	RunE: runPatchCreate,
+}
+
+func init() {
+	patchCmd.AddCommand(patchCreateCmd)
+	rootCmd.AddCommand(patchCmd)
+}
+
+func runPatchCreate(cmd *cobra.Command, args []string) error {
+	original, err := ioutil.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	modified, err := ioutil.ReadFile(args[1])
+	if err != nil {
+		return err
+	}
+
+	patch := hardware.CreateBPS(original, modified)
+	if err := ioutil.WriteFile(args[2], patch, 0644); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %d byte patch to %s\n", len(patch), args[2])
+
+	return nil
+}
+
+// createCartridge - loads gameName, or the --rom-entry file in it if it's
+// a zip archive, patched with the files given with --patch, or if there
+// are none, those named after it next to it, and with its header corrected
+// from the --gamedb database
+func createCartridge(cmd *cobra.Command, gameName string) (hardware.Cartridge, error) {
+	var options hardware.LoadOptions
+	options.Entry, _ = cmd.Flags().GetString("rom-entry")
+	options.Patches, _ = cmd.Flags().GetStringSlice("patch")
+	if len(options.Patches) == 0 {
+		options.Patches = hardware.FindPatches(gameName)
+	}
+
+	var err error
+	if options.GameDB, err = loadGameDB(cmd); err != nil {
+		return hardware.Cartridge{}, err
+	}
+
+	return hardware.OpenCartridge(gameName, options)
+}
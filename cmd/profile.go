@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"fmt"
+	"github.com/spf13/cobra"
+	"io"
+	"log"
+	"nes-emu/hardware"
+	"os"
+)
+
+var profileCmd = &cobra.Command{
+	Use:   "profile ROM",
+	Short: "Run a rom headless and write a pprof profile of its 6502 code.",
+	Long: `Runs ROM without a window for a number of frames, counting the cycles
+spent at each PC and in each JSR call stack, and writes them as a pprof
+profile. Look at it with go tool pprof, e.g. go tool pprof -http : cpu.pprof
+for a flame graph. Routines are named from symbol files when there are any,
+otherwise like the disassembler names them.
+
+The frames whose NMI handler runs past the end of vblank are listed, and
+--frame-budgets writes how every frame spent its cycles.`,
+	Args: cobra.ExactArgs(1),
+	RunE: runProfile,
+}
+
+func init() {
+	profileCmd.Flags().IntP("frames", "f", 600, "number of frames to run.")
+	profileCmd.Flags().StringP("output", "o", "cpu.pprof", "write the profile to FILE.")
+	rootCmd.AddCommand(profileCmd)
+}
+
+func runProfile(cmd *cobra.Command, args []string) error {
+	frames, err := cmd.Flags().GetInt("frames")
+	if err != nil {
+		return err
+	}
+	output, err := cmd.Flags().GetString("output")
+	if err != nil {
+		return err
+	}
+	budgetsFile, err := cmd.Flags().GetString("frame-budgets")
+	if err != nil {
+		return err
+	}
+
+	cart, err := createCartridge(cmd, args[0])
+	if err != nil {
+		return err
+	}
+
+	nes := hardware.NewNES()
+	if err := nes.LoadCartridge(cart); err != nil {
+		return err
+	}
+	nes.APU.InitAPU(false)
+	nes.PPU.InitFrame(1)
+	nes.Reset()
+
+	if nes.Symbols, err = loadSymbols(cmd, args[0], &cart); err != nil {
+		return err
+	}
+	profiler := hardware.NewProfiler()
+	nes.Profiler = profiler
+
+	for i := 0; i < frames && !nes.CPU.Halted(); i++ {
+		for !nes.PPU.FrameReady {
+			nes.Step()
+		}
+		nes.PPU.FrameReady = false
+	}
+
+	if err := writeFile(output, profiler.WriteProfile); err != nil {
+		return err
+	}
+	if budgetsFile != "" {
+		if err := writeFile(budgetsFile, profiler.WriteFrames); err != nil {
+			return err
+		}
+	}
+
+	overruns := profiler.Overruns()
+	for _, budget := range overruns {
+		fmt.Fprintf(cmd.OutOrStdout(), "frame %d: NMI handler ran %d cycles past vblank\n", budget.Frame, budget.Overrun)
+	}
+	fmt.Fprintf(cmd.OutOrStdout(), "%d of %d frames overran vblank, profile written to %s\n", len(overruns), len(profiler.Frames()), output)
+
+	return nil
+}
+
+// initProfile - attaches a profiler to nes if --profile or --frame-budgets
+// was given. The returned func writes them out.
+func initProfile(cmd *cobra.Command, nes *hardware.NES) func() {
+	profileFile, _ := cmd.Flags().GetString("profile")
+	budgetsFile, _ := cmd.Flags().GetString("frame-budgets")
+	if profileFile == "" && budgetsFile == "" {
+		return func() {}
+	}
+
+	profiler := hardware.NewProfiler()
+	nes.Profiler = profiler
+
+	return func() {
+		if profileFile != "" {
+			if err := writeFile(profileFile, profiler.WriteProfile); err != nil {
+				log.Println(err)
+			}
+		}
+		if budgetsFile != "" {
+			if err := writeFile(budgetsFile, profiler.WriteFrames); err != nil {
+				log.Println(err)
+			}
+		}
+	}
+}
+
+// writeFile - creates filename and has write fill it
+func writeFile(filename string, write func(w io.Writer) error) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := write(file); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
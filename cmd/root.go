@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"bufio"
 	"errors"
 	"fmt"
 	"github.com/faiface/pixel"
@@ -13,6 +14,8 @@ import (
 	"log"
 	"nes-emu/hardware"
 	"os"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -23,7 +26,7 @@ var rootCmd = &cobra.Command{
 	Short: "nes-emu is Arte's NES emulator.",
 	Long: `A`,
 	Args: func(cmd *cobra.Command, args []string) error {
-		if len(os.Args) < 1 {
+		if len(args) < 1 {
 			return errors.New("requires nes rom as first argument")
 		}
 
@@ -35,11 +38,28 @@ var rootCmd = &cobra.Command{
 func init() {
 	rootCmd.PersistentFlags().IntP("scale", "s", 1, "integer scaling factor for the screen.")
 	rootCmd.PersistentFlags().BoolP("log", "l", false, "log CPU instruction output to file.")
+	rootCmd.PersistentFlags().String("trace", "", "write a nestest style trace of every instruction to FILE.")
+	rootCmd.PersistentFlags().String("trace-pc", "", "only trace instructions in an address range, e.g. C000-C0FF.")
+	rootCmd.PersistentFlags().String("trace-frames", "", "only trace during a range of frames, e.g. 60-120.")
+	rootCmd.PersistentFlags().String("profile", "", "write a pprof profile of the 6502 code run to FILE on exit.")
+	rootCmd.PersistentFlags().String("frame-budgets", "", "write the cycles each frame and its NMI handler took to FILE on exit.")
+	rootCmd.PersistentFlags().String("cdl", "", "log the PRG and CHR rom used to FILE in FCEUX's .cdl format, adding to what's there.")
+	rootCmd.PersistentFlags().StringSlice("symbols", nil, "load labels from .dbg, .nl or .mlb FILEs, besides any found next to the rom.")
+	rootCmd.PersistentFlags().String("crash-dir", ".", "write a diagnostic bundle to a new directory in DIR when the game crashes or hangs.")
+	rootCmd.PersistentFlags().Int("history", 256, "instructions to keep for the crash history, 0 to turn crash detection off.")
+	rootCmd.PersistentFlags().Uint64("hang-frames", 120, "frames without an NMI before a game that had them is taken to have hung, 0 to never.")
+	rootCmd.PersistentFlags().String("rom-entry", "", "load the rom NAME from a zip archive, instead of the first .nes, .fds, .nsf or .unf in it.")
+	rootCmd.PersistentFlags().StringSlice("patch", nil, "apply IPS, UPS or BPS FILEs to the rom in order, instead of any named after it next to it.")
+	rootCmd.PersistentFlags().String("gamedb", "", "correct rom headers from FILE, the NES 2.0 XML database or one laid out like it.")
+	rootCmd.PersistentFlags().String("save-dir", "", "keep battery saves in DIR instead of next to the rom.")
+	rootCmd.PersistentFlags().Bool("detect-ram-code", false, "treat running code from RAM as a crash, for games that never do it.")
 }
 
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
-		fmt.Println(err)
+		if !errors.Is(err, errTraceDiverged) {
+			fmt.Println(err)
+		}
 		os.Exit(1)
 	}
 }
@@ -56,42 +76,124 @@ func configAndRunNES(cmd *cobra.Command, args []string) {
 		panic("invalid scaling factor")
 	}
 
-	cfg := pixelgl.WindowConfig{
-		Title:  "Arte's NES Emulator",
-		Bounds: pixel.R(0, 0, float64(256 * scalingFactor), float64(240 * scalingFactor)),
-		VSync:  false,
-	}
-
-	gameName := os.Args[1]
+	gameName := args[0]
 
-	win, err := pixelgl.NewWindow(cfg)
-	if err != nil {
-		panic(err)
+	debug, _ := cmd.Flags().GetBool("debug")
+	headless, _ := cmd.Flags().GetBool("headless")
+	if headless {
+		if !debug {
+			log.Fatalln("--headless needs --debug")
+		}
+		runHeadlessDebugger(cmd, gameName)
+		return
 	}
 
 	nes := hardware.NewNES()
 
-	cart, err := hardware.CreateCartridge(gameName)
+	cart, err := createCartridge(cmd, gameName)
+	if err == nil {
+		err = nes.LoadCartridge(cart)
+	}
 
 	if err != nil {
 		log.Println(err)
 	} else {
-		nes.LoadCartridge(cart)
-		nes.CPU.Reset()
+		logHeader(&cart)
+
+		// only the NTSC NES is emulated
+		if cart.Timing != hardware.TimingNTSC && cart.Timing != hardware.TimingMulti {
+			log.Printf("%s is made for %s consoles, it will run at NTSC speed", gameName, cart.Timing)
+		}
+		if cart.Console != hardware.ConsoleNES {
+			log.Printf("%s is made for the %s, which isn't emulated", gameName, cart.Console)
+		}
+
+		nes.Reset()
+
+		if nes.Symbols, err = loadSymbols(cmd, gameName, &cart); err != nil {
+			log.Fatalln(err)
+		}
 	}
 
-	// initialize the apu
-	nes.APU.InitAPU(true)
+	closeTrace, err := initTrace(cmd, nes)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer closeTrace()
+	defer initProfile(cmd, nes)()
+
+	closeCDL, err := initCDL(cmd, nes)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer closeCDL()
+
+	flushSave, err := initSave(cmd, nes, gameName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer flushSave(true)
+
+	// initialize the apu, the game still runs without sound
+	if err := nes.APU.InitAPU(true); err != nil {
+		log.Println(err)
+	}
 
 	// init ppu frame
 	nes.PPU.InitFrame(scalingFactor)
 
+	var console *hardware.DebugConsole
+	var commands <-chan string
+	if debug {
+		console, commands = startDebugConsole(nes)
+	}
+
+	// the debugger stops on these itself
+	crashDir := ""
+	if !debug {
+		crashDir = initDiagnostics(cmd, nes)
+	}
+
+	var numOfInstructions uint = 0
+
+	runInWindow(nes, scalingFactor, crashDir, func() bool {
+		if console != nil {
+			if !console.Poll(commands) {
+				return false
+			}
+			console.RunFrame()
+		} else {
+			runNEStoFrame(*nes, &numOfInstructions)
+		}
+		flushSave(false)
+
+		return true
+	})
+}
+
+// runInWindow - shows nes in a window, calling runFrame to run each frame
+// until the window is closed or runFrame returns false. If its diagnostics
+// catch a crash, the bundle is written to crashDir and the window stops
+// on an error.
+func runInWindow(nes *hardware.NES, scalingFactor int, crashDir string, runFrame func() bool) {
+	cfg := pixelgl.WindowConfig{
+		Title:  "Arte's NES Emulator",
+		Bounds: pixel.R(0, 0, float64(256 * scalingFactor), float64(240 * scalingFactor)),
+		VSync:  false,
+	}
+
+	win, err := pixelgl.NewWindow(cfg)
+	if err != nil {
+		panic(err)
+	}
+	defer win.Destroy()
+
 	var (
-		numOfInstructions uint = 0
 		frames = 0
+		haltReported = false
+		crash *crashScreen
 		us = time.Tick(16666 * time.Microsecond)
 		second = time.Tick(time.Second)
-		lastFPS = 0
 	)
 
 	cam := pixel.IM.Scaled(win.Bounds().Center(), float64(scalingFactor))
@@ -100,9 +202,21 @@ func configAndRunNES(cmd *cobra.Command, args []string) {
 	for !win.Closed() {
 		imd.Clear()
 
-		nes.CPU.CheckControllerPresses(win)
+		nes.JOY1.CheckControllerPresses(win)
+
+		if crash == nil {
+			if !runFrameSafely(nes, runFrame) {
+				break
+			}
+			if d := nes.Diagnostics; d != nil && d.Err() != nil {
+				crash = newCrashScreen(crashDir, d)
+			}
+		}
 
-		runNEStoFrame(*nes, &numOfInstructions, lastFPS)
+		if nes.CPU.Halted() && !haltReported && crash == nil {
+			log.Println(nes.CPU.Err())
+			haltReported = true
+		}
 
 		pic := pixel.PictureDataFromImage(nes.PPU.Frame)
 
@@ -112,6 +226,10 @@ func configAndRunNES(cmd *cobra.Command, args []string) {
 
 		sprite.Draw(win, pixel.IM.Moved(win.Bounds().Center()))
 
+		if crash != nil {
+			crash.draw(win)
+		}
+
 		win.SetMatrix(cam)
 
 		win.Update()
@@ -120,8 +238,13 @@ func configAndRunNES(cmd *cobra.Command, args []string) {
 
 		select {
 		case <-second:
-			win.SetTitle(fmt.Sprintf("FPS: %d %s", frames, cfg.Title))
-			lastFPS = frames
+			title := fmt.Sprintf("FPS: %d %s", frames, cfg.Title)
+			if crash != nil {
+				title += " - " + crash.err.Reason
+			} else if nes.CPU.Halted() {
+				title += fmt.Sprintf(" - CPU halted at $%04X", nes.CPU.PC)
+			}
+			win.SetTitle(title)
 			frames = 0
 		default:
 		}
@@ -129,6 +252,99 @@ func configAndRunNES(cmd *cobra.Command, args []string) {
 	<-us
 }
 
+// initTrace - attaches a tracer to nes if --trace was given.
+// The returned func flushes and closes the trace file.
+func initTrace(cmd *cobra.Command, nes *hardware.NES) (func(), error) {
+	traceFile, _ := cmd.Flags().GetString("trace")
+	if traceFile == "" {
+		return func() {}, nil
+	}
+
+	file, err := os.Create(traceFile)
+	if err != nil {
+		return nil, err
+	}
+	out := bufio.NewWriter(file)
+	tracer := hardware.NewTracer(out)
+
+	if pcRange, _ := cmd.Flags().GetString("trace-pc"); pcRange != "" {
+		start, end, err := parseRange(pcRange, 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --trace-pc: %v", err)
+		}
+		tracer.SetPCRange(uint16(start), uint16(end))
+	}
+
+	if frameRange, _ := cmd.Flags().GetString("trace-frames"); frameRange != "" {
+		start, end, err := parseRange(frameRange, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --trace-frames: %v", err)
+		}
+		tracer.SetFrameRange(start, end)
+	}
+
+	nes.Tracer = tracer
+
+	return func() {
+		if err := tracer.Err(); err != nil {
+			log.Println(err)
+		}
+		out.Flush()
+		file.Close()
+	}, nil
+}
+
+// loadSymbols - loads the symbol files next to the rom and any given with
+// --symbols. Returns nil if there are none.
+func loadSymbols(cmd *cobra.Command, gameName string, cart *hardware.Cartridge) (*hardware.Symbols, error) {
+	files, _ := cmd.Flags().GetStringSlice("symbols")
+	files = append(hardware.FindSymbolFiles(gameName), files...)
+	if len(files) == 0 {
+		return nil, nil
+	}
+
+	symbols := hardware.NewSymbols()
+	for _, file := range files {
+		if err := symbols.Load(file, cart); err != nil {
+			return nil, err
+		}
+	}
+
+	return symbols, nil
+}
+
+// parseRange - parses START-END, or a single number, in the given base
+func parseRange(s string, base, bitSize int) (uint64, uint64, error) {
+	parts := strings.SplitN(s, "-", 2)
+
+	start, err := strconv.ParseUint(strings.TrimSpace(parts[0]), base, bitSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(parts) == 1 {
+		return start, start, nil
+	}
+
+	end, err := strconv.ParseUint(strings.TrimSpace(parts[1]), base, bitSize)
+	if err != nil {
+		return 0, 0, err
+	}
+	if end < start {
+		return 0, 0, fmt.Errorf("%s ends before it starts", s)
+	}
+
+	return start, end, nil
+}
+
+// logHeader - logs the header the cartridge is run with, and what the
+// file said if the game database corrected it
+func logHeader(cart *hardware.Cartridge) {
+	if cart.Header != cart.FileHeader {
+		log.Printf("%s: correcting the header from the game database, it says %v", cart.Title, cart.FileHeader)
+	}
+	log.Println(cart.Header)
+}
+
 func initLogOutput() {
 	logFile, err := os.OpenFile("log.txt", os.O_CREATE | os.O_RDWR, 0666)
 	if err != nil {
@@ -138,27 +354,15 @@ func initLogOutput() {
 	log.SetOutput(mw)
 }
 
-func runNESInstruction(nes hardware.NES, numOfInstructions *uint, lastFPS int) {
-	opcode := nes.CPU.Read8(nes.CPU.PC)
-	instr := hardware.Instructions[opcode]
-
-	nes.CPU.RunInstruction(instr, false)
-	nes.PPU.RunPPUCycles(uint16(3 * instr.Cycles))
-	nes.APU.RunAPUCycles(uint16(instr.Cycles), lastFPS)
-
-	inVBlank := (nes.CPU.Memory[0x2002]>>7)&1 == 1
-	NMIEnabled := (nes.CPU.Memory[0x2000]>>7)&1 == 1
+func runNESInstruction(nes hardware.NES, numOfInstructions *uint) {
+	nes.Step()
 
 	*numOfInstructions++
-
-	if inVBlank && NMIEnabled && !nes.PPU.NmiOccurred {
-		nes.CPU.HandleNMI()
-	}
 }
 
-func runNEStoFrame(nes hardware.NES, numOfInstructions *uint, lastFPS int) {
+func runNEStoFrame(nes hardware.NES, numOfInstructions *uint) {
 	for !nes.PPU.FrameReady {
-		runNESInstruction(nes, numOfInstructions, lastFPS)
+		runNESInstruction(nes, numOfInstructions)
 	}
 
 	nes.PPU.FrameReady = false
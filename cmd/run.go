@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/spf13/cobra"
+	"log"
+	"nes-emu/hardware"
+	"os"
+)
+
+var runCmd = &cobra.Command{
+	Use:   "run ROM",
+	Short: "Run a rom, optionally under the debugger.",
+	Long: `Runs ROM in a window, the same as nes-emu ROM. With --debug the machine
+starts paused and is driven by commands typed on stdin, alongside the
+window or, with --headless, without one. Type help for the commands.`,
+	Args: cobra.ExactArgs(1),
+	Run:  configAndRunNES,
+}
+
+func init() {
+	runCmd.Flags().Bool("debug", false, "start paused with a debugger console on stdin.")
+	runCmd.Flags().Bool("headless", false, "run the debugger without a window.")
+	rootCmd.AddCommand(runCmd)
+}
+
+// startDebugConsole - attaches a debugger to nes and starts reading
+// commands from stdin. The channel closes at the end of stdin.
+func startDebugConsole(nes *hardware.NES) (*hardware.DebugConsole, <-chan string) {
+	console := hardware.NewDebugConsole(hardware.NewDebugger(nes), os.Stdout)
+
+	commands := make(chan string)
+	go func() {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			commands <- scanner.Text()
+		}
+		close(commands)
+	}()
+
+	fmt.Println("debugger paused at reset, type help for commands")
+	console.Report()
+
+	return console, commands
+}
+
+// runHeadlessDebugger - runs gameName under the debugger with no window or sound
+func runHeadlessDebugger(cmd *cobra.Command, gameName string) {
+	cart, err := createCartridge(cmd, gameName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	logHeader(&cart)
+
+	nes := hardware.NewNES()
+	if err := nes.LoadCartridge(cart); err != nil {
+		log.Fatalln(err)
+	}
+	nes.APU.InitAPU(false)
+	nes.PPU.InitFrame(1)
+	nes.Reset()
+
+	if nes.Symbols, err = loadSymbols(cmd, gameName, &cart); err != nil {
+		log.Fatalln(err)
+	}
+
+	closeTrace, err := initTrace(cmd, nes)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer closeTrace()
+	defer initProfile(cmd, nes)()
+
+	closeCDL, err := initCDL(cmd, nes)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer closeCDL()
+
+	flushSave, err := initSave(cmd, nes, gameName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	defer flushSave(true)
+
+	console, commands := startDebugConsole(nes)
+	console.Run(commands)
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+	"log"
+	"nes-emu/hardware"
+	"time"
+)
+
+// saveInterval - how often battery ram is written out while running, at
+// most
+const saveInterval = 5 * time.Second
+
+// initSave - loads gameName's .sav file into nes's battery backed ram, from
+// --save-dir or next to the rom. The returned func writes it back when it's
+// changed, if saveInterval has passed since it last did or final is set.
+func initSave(cmd *cobra.Command, nes *hardware.NES, gameName string) (func(final bool), error) {
+	if nes.CART == nil {
+		return func(bool) {}, nil
+	}
+
+	saveDir, _ := cmd.Flags().GetString("save-dir")
+	save, err := hardware.NewBatterySave(nes.CART, hardware.SaveFilename(gameName, saveDir))
+	if err != nil || save == nil {
+		return func(bool) {}, err
+	}
+
+	last := time.Now()
+	return func(final bool) {
+		if !final && time.Since(last) < saveInterval {
+			return
+		}
+		last = time.Now()
+
+		if err := save.Flush(); err != nil {
+			log.Println(err)
+		}
+	}, nil
+}
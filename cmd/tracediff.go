@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"github.com/spf13/cobra"
+	"nes-emu/hardware"
+	"os"
+)
+
+var traceDiffCmd = &cobra.Command{
+	Use:   "tracediff ROM TRACE",
+	Short: "Run a rom headless and stop where it first differs from a reference trace.",
+	Long: `Runs ROM without a window and compares every instruction against TRACE,
+a nestest, Mesen or FCEUX style log. The cpu starts from the state on the
+first line of the trace. At the first difference it prints the instructions
+around it, the registers and flags that differ and the last memory writes.`,
+	Args: cobra.ExactArgs(2),
+	RunE: runTraceDiff,
+}
+
+// errTraceDiverged - the rom didn't follow the trace. The difference has
+// already been printed, so Execute only sets the exit code.
+var errTraceDiverged = errors.New("the trace diverged")
+
+func init() {
+	traceDiffCmd.Flags().IntP("window", "w", 10, "number of instructions and writes of context to show.")
+	rootCmd.AddCommand(traceDiffCmd)
+}
+
+func runTraceDiff(cmd *cobra.Command, args []string) error {
+	window, err := cmd.Flags().GetInt("window")
+	if err != nil {
+		return err
+	}
+
+	cart, err := createCartridge(cmd, args[0])
+	if err != nil {
+		return err
+	}
+
+	traceFile, err := os.Open(args[1])
+	if err != nil {
+		return err
+	}
+	defer traceFile.Close()
+
+	reference, err := hardware.ReadTrace(traceFile)
+	if err != nil {
+		return err
+	}
+
+	nes := hardware.NewNES()
+	if err := nes.LoadCartridge(cart); err != nil {
+		return err
+	}
+	nes.APU.InitAPU(false)
+	nes.PPU.InitFrame(1)
+	nes.Reset()
+
+	divergence := hardware.DiffTrace(nes, reference, window)
+	if divergence != nil {
+		fmt.Fprint(cmd.OutOrStdout(), divergence)
+		cmd.SilenceErrors, cmd.SilenceUsage = true, true
+		return errTraceDiverged
+	}
+
+	fmt.Fprintf(cmd.OutOrStdout(), "all %d instructions match\n", len(reference))
+	return nil
+}
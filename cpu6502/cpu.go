@@ -0,0 +1,288 @@
+package cpu6502
+
+import (
+	"errors"
+	"fmt"
+)
+
+// interrupt vectors
+const (
+	nmiVector   = 0xFFFA
+	resetVector = 0xFFFC
+	irqVector   = 0xFFFE
+)
+
+// ErrCPUHalted - the cpu has stopped, and only Reset gets it going again.
+// Err says why with a *HaltError wrapping it.
+var ErrCPUHalted = errors.New("cpu halted")
+
+// HaltError - why the cpu halted, and where
+type HaltError struct {
+	Reason string
+	PC     uint16
+
+	// PC with its name, if AddrName gave one
+	where string
+}
+
+func (e *HaltError) Error() string {
+	return fmt.Sprintf("%v: %s, at %s", ErrCPUHalted, e.Reason, e.where)
+}
+
+func (e *HaltError) Unwrap() error {
+	return ErrCPUHalted
+}
+
+// Bus - what the cpu reads and writes through. Every cycle of an
+// instruction is a separate call, including dummy reads and writes.
+type Bus interface {
+	Read8(addr uint16) uint8
+	Write8(addr uint16, value uint8)
+}
+
+// Variant - which flavour of 6502 the core behaves as
+type Variant uint8
+
+const (
+	// Ricoh2A03 - the NES cpu. The D flag can be set but BCD arithmetic is wired off
+	Ricoh2A03 Variant = iota
+
+	// MOS6502 - a stock NMOS 6502 with BCD arithmetic in ADC and SBC
+	MOS6502
+)
+
+type Cpu struct {
+	// Program Counter
+	PC uint16
+
+	// Stack Pointer
+	SP uint8
+
+	// Accumulator
+	A uint8
+
+	// Index Register X
+	X uint8
+
+	// Index Register Y
+	Y uint8
+
+	// Processor Status
+	// 7 6 5 4 3 2 1 0
+	// N V   B D I Z C
+	P uint8
+
+	// Address bus the cpu reads and writes through
+	Bus Bus
+
+	// which 6502 this is
+	Variant Variant
+
+	//totalCycles
+	totalCycles uint64
+
+	// cycles added to the current instruction by page crossings and branches
+	extraCycles uint8
+
+	// IRQ sources currently asserting the IRQ line
+	irqLine uint8
+
+	// NMI edge seen and waiting to be serviced
+	nmiPending bool
+
+	// I flag as polled at the end of the last instruction. CLI, SEI and PLP
+	// change I after the poll, so their effect is delayed one instruction.
+	irqInhibit bool
+
+	// last thing run was BRK or an IRQ, so an NMI arriving now takes over its vector fetch
+	hijackable bool
+
+	// a taken branch that stayed on its page polled before its last cycle,
+	// so an IRQ that came up while it ran waits another instruction
+	irqDelayed bool
+
+	// the bus access in progress is a dummy read or write
+	dummy bool
+
+	// a KIL opcode or something it couldn't run stopped the cpu, PC is
+	// left on it
+	halted bool
+	err    *HaltError
+
+	// AddrName - names an address in error messages, like reset+3
+	// (main.s:12). Addresses are only shown in hex when it's nil or
+	// returns "".
+	AddrName func(addr uint16) string
+}
+
+// NewCpu - creates a cpu of the given variant on bus. Call Reset once
+// the reset vector is mapped.
+func NewCpu(bus Bus, variant Variant) *Cpu {
+	cpu := &Cpu{Bus: bus, Variant: variant}
+	cpu.setCpuInitialState()
+
+	return cpu
+}
+
+func (cpu *Cpu) setCpuInitialState() {
+	// Set initial flags
+	cpu.P = 0x24
+
+	// initialize the stack pointer
+	cpu.SP = 0xFD
+
+	cpu.irqInhibit = true
+	cpu.nmiPending = false
+	cpu.hijackable = false
+	cpu.irqDelayed = false
+	cpu.halted = false
+	cpu.err = nil
+}
+
+func (cpu *Cpu) Reset() {
+	// Read first instruction address location
+	firstInstruction := cpu.Read16(resetVector)
+
+	// Set the PC to be at the address
+	cpu.PC = firstInstruction
+
+	cpu.setCpuInitialState()
+
+	// the reset sequence takes as long as an interrupt
+	cpu.totalCycles += 7
+}
+
+// Step - fetches the opcode at PC and runs it, or services a pending
+// interrupt. Returns the number of cycles taken.
+func (cpu *Cpu) Step() uint8 {
+	opcode := cpu.Read8(cpu.PC)
+
+	return cpu.RunInstruction(Instructions[opcode], false)
+}
+
+// where - addr in hex, with its name if it has one
+func (cpu *Cpu) where(addr uint16) string {
+	if cpu.AddrName != nil {
+		if name := cpu.AddrName(addr); name != "" {
+			return fmt.Sprintf("$%04X %s", addr, name)
+		}
+	}
+
+	return fmt.Sprintf("$%04X", addr)
+}
+
+// Cycles - the number of cycles run since the cpu was created
+func (cpu *Cpu) Cycles() uint64 {
+	return cpu.totalCycles
+}
+
+// Halted - reports whether a KIL opcode has jammed the cpu, or it hit
+// something it couldn't run. PC is left pointing at the opcode, and only
+// Reset gets it running again.
+func (cpu *Cpu) Halted() bool {
+	return cpu.halted
+}
+
+// Err - why the cpu halted, a *HaltError wrapping ErrCPUHalted. It's
+// nil while the cpu is running.
+func (cpu *Cpu) Err() error {
+	if cpu.err == nil {
+		return nil
+	}
+
+	return cpu.err
+}
+
+// halt - stops the cpu at PC instead of taking the whole program down,
+// so whatever is running it can report what led up to it
+func (cpu *Cpu) halt(reason string) {
+	cpu.halted = true
+	cpu.err = &HaltError{Reason: reason, PC: cpu.PC, where: cpu.where(cpu.PC)}
+}
+
+// InterruptPending - reports whether the next Step services an
+// interrupt instead of running the instruction at PC
+func (cpu *Cpu) InterruptPending() bool {
+	if cpu.halted {
+		return false
+	}
+
+	return cpu.nmiPending || cpu.irqLine != 0 && !cpu.irqInhibit && !cpu.irqDelayed
+}
+
+// HandleNMI - signals an NMI edge, which is serviced before the next instruction
+func (cpu *Cpu) HandleNMI() {
+	cpu.nmiPending = true
+}
+
+// NMIPending - reports whether an NMI edge is waiting to be serviced
+func (cpu *Cpu) NMIPending() bool {
+	return cpu.nmiPending
+}
+
+// SetIRQ - asserts the IRQ line on behalf of source. Sources are bits
+// chosen by the machine, the line stays asserted while any are set.
+func (cpu *Cpu) SetIRQ(source uint8) {
+	cpu.irqLine |= source
+}
+
+// ClearIRQ - releases the IRQ line on behalf of source
+func (cpu *Cpu) ClearIRQ(source uint8) {
+	cpu.irqLine &= ^source
+}
+
+// IRQAsserted - reports whether any source is holding the IRQ line
+func (cpu *Cpu) IRQAsserted() bool {
+	return cpu.irqLine != 0
+}
+
+// pollInterrupts - services a pending NMI or IRQ at an instruction boundary.
+// Returns the cycles used and whether an interrupt was taken.
+func (cpu *Cpu) pollInterrupts() (uint8, bool) {
+	irqDelayed := cpu.irqDelayed
+	cpu.irqDelayed = false
+
+	if cpu.nmiPending {
+		cpu.nmiPending = false
+
+		// BRK and IRQ have already pushed the return address and status,
+		// so the NMI only replaces the vector they were about to fetch
+		if cpu.hijackable {
+			cpu.hijackable = false
+			cpu.PC = cpu.Read16(nmiVector)
+			return 0, true
+		}
+
+		cpu.interrupt(nmiVector, false)
+		cpu.hijackable = false
+		cpu.totalCycles += 7
+		return 7, true
+	}
+
+	if cpu.irqLine != 0 && !cpu.irqInhibit && !irqDelayed {
+		cpu.interrupt(irqVector, false)
+		cpu.totalCycles += 7
+		return 7, true
+	}
+
+	return 0, false
+}
+
+// interrupt - runs the interrupt sequence shared by BRK, IRQ and NMI
+func (cpu *Cpu) interrupt(vector uint16, brk bool) {
+	// Push current pc to the stack
+	cpu.Push16(cpu.PC)
+
+	// push current processor status to the stack, B is only set for BRK
+	if brk {
+		cpu.Push8(cpu.P | 0x30)
+	} else {
+		cpu.Push8((cpu.P | 0x20) & 0xEF)
+	}
+
+	cpu.setInterrupt()
+	cpu.irqInhibit = true
+	cpu.hijackable = true
+
+	cpu.PC = cpu.Read16(vector)
+}
@@ -0,0 +1,122 @@
+package cpu6502
+
+import (
+	"errors"
+	"testing"
+)
+
+// flatBus is 64KB of ram with nothing else on it
+type flatBus [0x10000]uint8
+
+func (bus *flatBus) Read8(addr uint16) uint8 {
+	return bus[addr]
+}
+
+func (bus *flatBus) Write8(addr uint16, value uint8) {
+	bus[addr] = value
+}
+
+// newTestCpu loads prg at $0200 and resets into it
+func newTestCpu(variant Variant, prg []byte) *Cpu {
+	bus := &flatBus{}
+	copy(bus[0x200:], prg)
+	bus[resetVector], bus[resetVector+1] = 0x00, 0x02
+
+	cpu := NewCpu(bus, variant)
+	cpu.Reset()
+
+	return cpu
+}
+
+// runProgram steps until PC falls off the end of prg
+func runProgram(cpu *Cpu, prg []byte) {
+	for cpu.PC < 0x200+uint16(len(prg)) {
+		cpu.Step()
+	}
+}
+
+func TestStepUsesBus(t *testing.T) {
+	// 0200 LDA #$42
+	// 0202 STA $1234
+	// 0205 INC $1234
+	prg := []byte{0xA9, 0x42, 0x8D, 0x34, 0x12, 0xEE, 0x34, 0x12}
+	cpu := newTestCpu(Ricoh2A03, prg)
+
+	start := cpu.Cycles()
+	cycles := 0
+	for cpu.PC < 0x200+uint16(len(prg)) {
+		cycles += int(cpu.Step())
+	}
+
+	if v := cpu.Read8(0x1234); v != 0x43 {
+		t.Errorf("Expected 43 at 1234, got %02x", v)
+	}
+	if cycles != 12 || cpu.Cycles()-start != 12 {
+		t.Errorf("Expected 12 cycles, got %d and %d total", cycles, cpu.Cycles()-start)
+	}
+}
+
+func TestDecimalMode(t *testing.T) {
+	tests := []struct {
+		name    string
+		variant Variant
+		prg     []byte
+		a, p    uint8
+	}{
+		// SED, CLC, LDA #$09, ADC #$01
+		{"ADC", MOS6502, []byte{0xF8, 0x18, 0xA9, 0x09, 0x69, 0x01}, 0x10, 0x2C},
+		// SED, CLC, LDA #$99, ADC #$01 - Z comes from the binary sum
+		{"ADC carry", MOS6502, []byte{0xF8, 0x18, 0xA9, 0x99, 0x69, 0x01}, 0x00, 0xAD},
+		// SED, CLC, LDA #$79, ADC #$01 - V and N from the unadjusted sum
+		{"ADC overflow", MOS6502, []byte{0xF8, 0x18, 0xA9, 0x79, 0x69, 0x01}, 0x80, 0xEC},
+		// SED, SEC, LDA #$50, SBC #$25
+		{"SBC", MOS6502, []byte{0xF8, 0x38, 0xA9, 0x50, 0xE9, 0x25}, 0x25, 0x2D},
+		// SED, SEC, LDA #$00, SBC #$01
+		{"SBC borrow", MOS6502, []byte{0xF8, 0x38, 0xA9, 0x00, 0xE9, 0x01}, 0x99, 0xAC},
+		// SED, CLC, LDA #$09, ADC #$01 - the 2A03 ignores D
+		{"2A03 ADC", Ricoh2A03, []byte{0xF8, 0x18, 0xA9, 0x09, 0x69, 0x01}, 0x0A, 0x2C},
+		// SED, SEC, LDA #$00, SBC #$01
+		{"2A03 SBC", Ricoh2A03, []byte{0xF8, 0x38, 0xA9, 0x00, 0xE9, 0x01}, 0xFF, 0xAC},
+	}
+
+	for _, test := range tests {
+		cpu := newTestCpu(test.variant, test.prg)
+		runProgram(cpu, test.prg)
+
+		if cpu.A != test.a || cpu.P != test.p {
+			t.Errorf("%s: expected A:%02x P:%02x but got A:%02x P:%02x", test.name, test.a, test.p, cpu.A, cpu.P)
+		}
+	}
+}
+
+func TestHalt(t *testing.T) {
+	// 0200 NOP
+	// 0201 KIL
+	cpu := newTestCpu(Ricoh2A03, []byte{0xEA, 0x02})
+	cpu.Step()
+	if cpu.Err() != nil {
+		t.Fatalf("Expected no error while running, got %v", cpu.Err())
+	}
+
+	cpu.Step()
+	var halt *HaltError
+	if !cpu.Halted() || !errors.Is(cpu.Err(), ErrCPUHalted) || !errors.As(cpu.Err(), &halt) || halt.PC != 0x201 {
+		t.Errorf("Expected the cpu to halt at $0201, got %v", cpu.Err())
+	}
+	if cpu.Err().Error() != "cpu halted: jammed by KIL opcode $02, at $0201" {
+		t.Errorf("Unexpected error %q", cpu.Err())
+	}
+
+	// an instruction with an addressing mode that doesn't exist stops the
+	// cpu where it is instead of exiting
+	cpu.Reset()
+	cpu.RunInstruction(instruction{assemblyCode: "NOP", code: NOP, bytes: 1, mode: 0xFF}, false)
+	if !errors.As(cpu.Err(), &halt) || halt.PC != 0x200 {
+		t.Errorf("Expected a halt at $0200, got %v", cpu.Err())
+	}
+
+	cpu.Reset()
+	if cpu.Halted() || cpu.Err() != nil {
+		t.Errorf("Expected reset to clear the halt")
+	}
+}
@@ -0,0 +1,210 @@
+package cpu6502
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Addressing - an opcode's addressing mode, as seen from outside the core
+type Addressing uint8
+
+const (
+	Implied Addressing = iota
+	Accumulator
+	Immediate
+	ZeroPage
+	ZeroPageX
+	ZeroPageY
+	Absolute
+	AbsoluteX
+	AbsoluteY
+	Indirect
+	IndirectX
+	IndirectY
+	Relative
+)
+
+var addressingModes = map[uint8]Addressing{
+	A:    Accumulator,
+	abs:  Absolute,
+	absX: AbsoluteX,
+	absY: AbsoluteY,
+	imm:  Immediate,
+	impl: Implied,
+	ind:  Indirect,
+	indX: IndirectX,
+	indY: IndirectY,
+	rel:  Relative,
+	zpg:  ZeroPage,
+	zpgX: ZeroPageX,
+	zpgY: ZeroPageY,
+}
+
+// Flow - how an instruction hands control on
+type Flow uint8
+
+const (
+	// FlowNext - carries on with the next instruction
+	FlowNext Flow = iota
+
+	// FlowBranch - either the target or the next instruction
+	FlowBranch
+
+	// FlowJump - JMP to the target
+	FlowJump
+
+	// FlowJumpIndirect - JMP through the pointer at the operand
+	FlowJumpIndirect
+
+	// FlowCall - JSR to the target, usually returning to the next instruction
+	FlowCall
+
+	// FlowReturn - RTS or RTI, the destination comes off the stack
+	FlowReturn
+
+	// FlowStop - BRK or KIL, nothing after it is known to run
+	FlowStop
+)
+
+// Decoded - one instruction as it sits in memory
+type Decoded struct {
+	Addr       uint16
+	Opcode     uint8
+	Code       uint8
+	Mnemonic   string
+	Size       uint8
+	Addressing Addressing
+
+	// the 8 or 16 bit operand as encoded
+	Operand uint16
+
+	// address the operand refers to. For branches this is the resolved target
+	Target uint16
+
+	Flow Flow
+}
+
+// Decode - decodes the instruction at addr, reading through peek
+func Decode(addr uint16, peek func(addr uint16) uint8) Decoded {
+	instr := Instructions[peek(addr)]
+
+	d := Decoded{
+		Addr:       addr,
+		Opcode:     instr.opcode,
+		Code:       instr.code,
+		Mnemonic:   instr.assemblyCode,
+		Size:       instr.bytes,
+		Addressing: addressingModes[instr.mode],
+	}
+
+	switch d.Size {
+	case 2:
+		d.Operand = uint16(peek(addr + 1))
+	case 3:
+		d.Operand = uint16(peek(addr+2))<<8 | uint16(peek(addr+1))
+	}
+
+	d.Target = d.Operand
+	if d.Addressing == Relative {
+		d.Target = addr + 2 + uint16(int8(d.Operand))
+	}
+
+	switch d.Code {
+	case BCC, BCS, BEQ, BMI, BNE, BPL, BVC, BVS:
+		d.Flow = FlowBranch
+	case JMP:
+		d.Flow = FlowJump
+		if d.Addressing == Indirect {
+			d.Flow = FlowJumpIndirect
+		}
+	case JSR:
+		d.Flow = FlowCall
+	case RTS, RTI:
+		d.Flow = FlowReturn
+	case BRK, KIL:
+		d.Flow = FlowStop
+	}
+
+	return d
+}
+
+// Unofficial - reports whether the instruction is outside the documented set
+func (d Decoded) Unofficial() bool {
+	return Unofficial(d.Opcode)
+}
+
+// Format - the instruction in ca65 syntax. label names addresses the
+// operand refers to, returning "" to leave the address as a number.
+// Absolute operands in the zero page are forced with a: so they
+// assemble to the same bytes.
+func (d Decoded) Format(label func(addr uint16) string) string {
+	mnemonic := strings.ToLower(d.Mnemonic)
+
+	address := func(width int) string {
+		if name := label(d.Target); name != "" {
+			return name
+		}
+		if width == 2 {
+			return fmt.Sprintf("$%02X", d.Operand)
+		}
+		if d.Operand < 0x100 && d.Addressing != Indirect {
+			return fmt.Sprintf("a:$%04X", d.Operand)
+		}
+		return fmt.Sprintf("$%04X", d.Target)
+	}
+
+	var operand string
+	switch d.Addressing {
+	case Accumulator:
+		operand = "a"
+	case Immediate:
+		operand = fmt.Sprintf("#$%02X", d.Operand)
+	case ZeroPage:
+		operand = address(2)
+	case ZeroPageX:
+		operand = address(2) + ",x"
+	case ZeroPageY:
+		operand = address(2) + ",y"
+	case Absolute:
+		operand = address(4)
+	case AbsoluteX:
+		operand = address(4) + ",x"
+	case AbsoluteY:
+		operand = address(4) + ",y"
+	case Indirect:
+		operand = "(" + address(4) + ")"
+	case IndirectX:
+		operand = fmt.Sprintf("($%02X,x)", d.Operand)
+	case IndirectY:
+		operand = fmt.Sprintf("($%02X),y", d.Operand)
+	case Relative:
+		operand = address(4)
+	}
+
+	if operand == "" {
+		return mnemonic
+	}
+
+	return mnemonic + " " + operand
+}
+
+// Opcode - the opcode for mnemonic in the given addressing mode. Where
+// more than one opcode fits, the documented one wins.
+func Opcode(mnemonic string, addressing Addressing) (uint8, bool) {
+	mnemonic = strings.ToUpper(mnemonic)
+
+	found := false
+	var opcode uint8
+	for i := range Instructions {
+		instr := Instructions[i]
+		if instr.code == KIL || instr.assemblyCode != mnemonic || addressingModes[instr.mode] != addressing {
+			continue
+		}
+
+		if !found || Unofficial(opcode) && !Unofficial(instr.opcode) {
+			opcode, found = instr.opcode, true
+		}
+	}
+
+	return opcode, found
+}
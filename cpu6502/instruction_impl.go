@@ -1,7 +1,7 @@
-package hardware
+package cpu6502
 
 import (
-	"errors"
+	"fmt"
 	"log"
 )
 
@@ -80,20 +80,61 @@ func (cpu *Cpu) clearDecimal() {
 }
 
 func (cpu *Cpu) doRelativeBranch(value uint8) {
+	oldPC := cpu.PC
+
 	if value >= 0x80 {
 		cpu.PC = cpu.PC + uint16(value) - 0x100
 	} else {
 		cpu.PC = cpu.PC + uint16(value)
 	}
+
+	// a taken branch costs one more cycle, and another if it lands on a different page
+	cpu.extraCycles++
+	if !samePage(oldPC, cpu.PC) {
+		cpu.extraCycles++
+	} else if cpu.irqLine == 0 {
+		// without the page fix up, interrupts were polled before the last cycle
+		cpu.irqDelayed = true
+	}
+}
+
+func samePage(a, b uint16) bool {
+	return a&0xFF00 == b&0xFF00
+}
+
+// hasPageCrossPenalty - reports whether the instruction takes an extra cycle
+// when its indexed address crosses a page. Stores and read-modify-write
+// instructions always take the extra cycle, so it is already in their base count.
+func hasPageCrossPenalty(instr instruction) bool {
+	switch instr.code {
+	case ADC, AND, CMP, EOR, LAS, LAX, LDA, LDX, LDY, NOP, ORA, SBC:
+		return true
+	}
+
+	return false
 }
 
-func (cpu *Cpu) RunInstruction(instr instruction, doLog bool) {
-	var instrByteArr []byte
-	for i := uint8(0); i < instr.bytes; i++ {
-		instrByteArr = append(instrByteArr, cpu.Read8(cpu.PC + uint16(i)))
+// RunInstruction - executes a single instruction and returns the number of
+// cycles it took, including page crossing and branch penalties.
+// If an interrupt is pending it is serviced instead, and instr is left for the next call.
+func (cpu *Cpu) RunInstruction(instr instruction, doLog bool) uint8 {
+	// a jammed cpu never fetches again, it only burns cycles until reset
+	if cpu.halted {
+		cpu.totalCycles++
+		return 1
 	}
+
+	if cycles, taken := cpu.pollInterrupts(); taken {
+		return cycles
+	}
+
 	if doLog {
-		log.Printf("%x %+v %x PC:%x A: %x SP: %x X: %x Y: %x P: %x PPUADDR: %x PPUDATA: %x",
+		var instrByteArr []byte
+		for i := uint8(0); i < instr.bytes; i++ {
+			instrByteArr = append(instrByteArr, cpu.Read8(cpu.PC + uint16(i)))
+		}
+
+		log.Printf("%x %+v %x PC:%x A: %x SP: %x X: %x Y: %x P: %x",
 			cpu.PC,
 			instr,
 			instrByteArr,
@@ -102,13 +143,18 @@ func (cpu *Cpu) RunInstruction(instr instruction, doLog bool) {
 			cpu.SP,
 			cpu.X,
 			cpu.Y,
-			cpu.P,
-			cpu.Memory[0x2006],
-			cpu.Memory[0x2007],)
+			cpu.P,)
 	}
 
 	var addr uint16
 	var arg uint8
+	var pageCrossed bool
+	var indexed bool
+	var unCarriedAddr uint16
+
+	cpu.extraCycles = 0
+	cpu.hijackable = false
+	prevP := cpu.P
 
 	switch instr.mode {
 	case A:
@@ -131,9 +177,13 @@ func (cpu *Cpu) RunInstruction(instr instruction, doLog bool) {
 	case absX:
 		arg := cpu.Read16(cpu.PC + 1)
 		addr = arg + uint16(cpu.X)
+		pageCrossed = !samePage(arg, addr)
+		indexed, unCarriedAddr = true, arg&0xFF00|addr&0xFF
 	case absY:
 		arg := cpu.Read16(cpu.PC + 1)
 		addr = arg + uint16(cpu.Y)
+		pageCrossed = !samePage(arg, addr)
+		indexed, unCarriedAddr = true, arg&0xFF00|addr&0xFF
 	case ind:
 		arg := cpu.Read16(cpu.PC + 1)
 
@@ -158,20 +208,33 @@ func (cpu *Cpu) RunInstruction(instr instruction, doLog bool) {
 	case indY:
 		arg = cpu.Read8(cpu.PC + 1)
 		addrLocation := uint16(arg)
+		var baseAddr uint16
 		if addrLocation == 0xFF {
 			lowByte := cpu.Read8(0xFF)
 			highByte := cpu.Read8(0x00)
-			addr = uint16(lowByte) | (uint16(highByte) << 8) + uint16(cpu.Y)
+			baseAddr = uint16(lowByte) | (uint16(highByte) << 8)
 		} else {
-			addr = cpu.Read16(addrLocation) + uint16(cpu.Y)
+			baseAddr = cpu.Read16(addrLocation)
 		}
+		addr = baseAddr + uint16(cpu.Y)
+		pageCrossed = !samePage(baseAddr, addr)
+		indexed, unCarriedAddr = true, baseAddr&0xFF00|addr&0xFF
 	case rel:
 		arg = cpu.Read8(cpu.PC + 1)
 		addr = 0
 	case impl:
 		addr = 0
 	default:
-		log.Fatal(errors.New("Fatal: " + string(instr.mode) + " is not a valid addressing mode."))
+		cpu.halt(fmt.Sprintf("%d is not a valid addressing mode", instr.mode))
+		cpu.totalCycles++
+		return 1
+	}
+
+	// indexed modes read the address before the carry into the high byte
+	// is fixed. Reads only do it when the page is crossed, stores and
+	// read-modify-write instructions always do it
+	if indexed && (pageCrossed || !hasPageCrossPenalty(instr)) {
+		cpu.dummyRead(unCarriedAddr)
 	}
 
 	// increment the pc based on instruction size
@@ -184,9 +247,23 @@ func (cpu *Cpu) RunInstruction(instr instruction, doLog bool) {
 	case AND:
 		value := cpu.getValue(instr.mode, addr, arg)
 		cpu.AND(instr, addr, value)
+	case ALR:
+		value := cpu.getValue(instr.mode, addr, arg)
+		cpu.ALR(instr, addr, value)
+	case ANC:
+		value := cpu.getValue(instr.mode, addr, arg)
+		cpu.ANC(instr, addr, value)
+	case ARR:
+		value := cpu.getValue(instr.mode, addr, arg)
+		cpu.ARR(instr, addr, value)
 	case ASL:
 		value := cpu.getValue(instr.mode, addr, arg)
 		cpu.ASL(instr, addr, value)
+	case AXA:
+		cpu.AXA(instr, addr)
+	case AXS:
+		value := cpu.getValue(instr.mode, addr, arg)
+		cpu.AXS(instr, addr, value)
 	case BCC:
 		value := cpu.getValue(instr.mode, addr, arg)
 		cpu.BCC(instr, addr, value)
@@ -261,6 +338,11 @@ func (cpu *Cpu) RunInstruction(instr instruction, doLog bool) {
 		cpu.JMP(instr, addr)
 	case JSR:
 		cpu.JSR(instr, addr)
+	case KIL:
+		cpu.KIL(instr)
+	case LAS:
+		value := cpu.getValue(instr.mode, addr, arg)
+		cpu.LAS(instr, addr, value)
 	case LAX:
 		value := cpu.getValue(instr.mode, addr, arg)
 		cpu.LAX(instr, addr, value)
@@ -316,6 +398,10 @@ func (cpu *Cpu) RunInstruction(instr instruction, doLog bool) {
 		cpu.SED()
 	case SEI:
 		cpu.SEI()
+	case SHX:
+		cpu.SHX(instr, addr)
+	case SHY:
+		cpu.SHY(instr, addr)
 	case SLO:
 		value := cpu.getValue(instr.mode, addr, arg)
 		cpu.SLO(instr, addr, value)
@@ -328,6 +414,8 @@ func (cpu *Cpu) RunInstruction(instr instruction, doLog bool) {
 		cpu.STX(instr, addr)
 	case STY:
 		cpu.STY(instr, addr)
+	case TAS:
+		cpu.TAS(instr, addr)
 	case TAX:
 		cpu.TAX()
 	case TAY:
@@ -340,11 +428,32 @@ func (cpu *Cpu) RunInstruction(instr instruction, doLog bool) {
 		cpu.TXS()
 	case TYA:
 		cpu.TYA()
+	case XAA:
+		value := cpu.getValue(instr.mode, addr, arg)
+		cpu.XAA(instr, addr, value)
+	default:
+		cpu.PC -= uint16(instr.bytes)
+		cpu.halt(fmt.Sprintf("%s is not a valid instruction code", instr.assemblyCode))
+		cpu.totalCycles++
+		return 1
+	}
+
+	if pageCrossed && hasPageCrossPenalty(instr) {
+		cpu.extraCycles++
+	}
+
+	// interrupts are polled before CLI, SEI and PLP update the I flag
+	switch instr.code {
+	case CLI, SEI, PLP:
+		cpu.irqInhibit = getBit(prevP, 2) == 1
 	default:
-		log.Fatal(errors.New("Fatal: " + string(instr.assemblyCode) + " is not a valid instruction code."))
+		cpu.irqInhibit = getBit(cpu.P, 2) == 1
 	}
 
-	cpu.totalCycles += uint64(instr.Cycles)
+	cycles := instr.Cycles + cpu.extraCycles
+	cpu.totalCycles += uint64(cycles)
+
+	return cycles
 }
 
 func (cpu *Cpu) getValue(addressingMode uint8, addr uint16, arg uint8) uint8 {
@@ -378,16 +487,87 @@ func (cpu *Cpu) getValue(addressingMode uint8, addr uint16, arg uint8) uint8 {
 	case impl:
 		value = 0
 	default:
-		log.Fatal(errors.New("Fatal: " + string(addressingMode) + " is not a valid addressing mode."))
+		cpu.halt(fmt.Sprintf("%d is not a valid addressing mode", addressingMode))
 	}
 
 	return value
 }
 
+// ALR - ands the acc with the value, then shifts the acc right
+func (cpu *Cpu) ALR(instr instruction, addr uint16, value uint8) {
+	cpu.A &= value
+	cpu.setCHelper(getBit(cpu.A, 0))
+	cpu.A >>= 1
+
+	cpu.setZHelper(cpu.A)
+	cpu.setNHelper(cpu.A)
+}
+
+// ANC - ands the acc with the value, then copies N into C
+func (cpu *Cpu) ANC(instr instruction, addr uint16, value uint8) {
+	cpu.A &= value
+
+	cpu.setZHelper(cpu.A)
+	cpu.setNHelper(cpu.A)
+	cpu.setCHelper(getBit(cpu.A, 7))
+}
+
 // ADC - Add with Carry
 // Performs addition with the accumulator and carry bit.
 // Sets flags accordingly ZCN
 func (cpu *Cpu) ADC(instr instruction, addr uint16, value uint8) {
+	if cpu.decimalMode() {
+		cpu.adcDecimal(value)
+	} else {
+		cpu.adcBinary(value)
+	}
+}
+
+// decimalMode - BCD arithmetic is on when D is set, unless the variant has it wired off
+func (cpu *Cpu) decimalMode() bool {
+	return cpu.Variant == MOS6502 && getBit(cpu.P, 3) == 1
+}
+
+// adcDecimal - NMOS BCD addition. Z comes from the binary sum,
+// N and V from the sum before the high digit is adjusted
+func (cpu *Cpu) adcDecimal(value uint8) {
+	carry := uint16(getBit(cpu.P, 0))
+	a, v := uint16(cpu.A), uint16(value)
+
+	low := (a & 0x0F) + (v & 0x0F) + carry
+	if low > 0x09 {
+		low += 0x06
+	}
+
+	high := (a >> 4) + (v >> 4)
+	if low > 0x0F {
+		high++
+	}
+
+	cpu.setZHelper(uint8(a + v + carry))
+
+	partial := uint8(high<<4 | low&0x0F)
+	cpu.setNHelper(partial)
+	if (cpu.A^partial)&^(cpu.A^value)&0x80 > 0 {
+		cpu.setOverflow()
+	} else {
+		cpu.clearOverflow()
+	}
+
+	if high > 0x09 {
+		high += 0x06
+	}
+
+	if high > 0x0F {
+		cpu.setCarry()
+	} else {
+		cpu.clearCarry()
+	}
+
+	cpu.A = uint8(high<<4 | low&0x0F)
+}
+
+func (cpu *Cpu) adcBinary(value uint8) {
 	// Calculate the result
 	result := cpu.A + value + getBit(cpu.P, 0)
 	
@@ -447,6 +627,33 @@ func (cpu *Cpu) AND(instr instruction, addr uint16, value uint8) {
 	cpu.A = result
 }
 
+// ARR - ands the acc with the value, then rotates the acc right.
+// C comes from bit 6 of the result and V from bit 6 xor bit 5
+func (cpu *Cpu) ARR(instr instruction, addr uint16, value uint8) {
+	cpu.A = ((cpu.A & value) >> 1) | (getBit(cpu.P, 0) << 7)
+
+	cpu.setZHelper(cpu.A)
+	cpu.setNHelper(cpu.A)
+	cpu.setCHelper(getBit(cpu.A, 6))
+	if getBit(cpu.A, 6)^getBit(cpu.A, 5) == 1 {
+		cpu.setOverflow()
+	} else {
+		cpu.clearOverflow()
+	}
+}
+
+// AXA - stores acc and x and the high byte of the address plus one
+func (cpu *Cpu) AXA(instr instruction, addr uint16) {
+	cpu.unstableStore(addr, cpu.Y, cpu.A&cpu.X)
+}
+
+// AXS - sets x to acc and x minus the value, without borrow. Flags are set like CMP
+func (cpu *Cpu) AXS(instr instruction, addr uint16, value uint8) {
+	result := cpu.A & cpu.X
+	cpu.cmpVals(result, value)
+	cpu.X = result - value
+}
+
 // ASL - Arithmetic Shift Left
 // Shifts bits in the acc or the memory one bit left
 // sets flags ZCN
@@ -461,7 +668,7 @@ func (cpu *Cpu) ASL(instr instruction, addr uint16, value uint8) {
 		cpu.A = result
 	} else {
 		result = value << 1
-		cpu.Write8(addr, result)
+		cpu.writeRMW(addr, value, result)
 	}
 
 	newBit7 = getBit(result, 7)
@@ -572,15 +779,11 @@ func (cpu *Cpu) BPL(instr instruction, addr uint16, value uint8) {
 // forces generation of an interrupt request
 // sets break command flag
 func (cpu *Cpu) BRK(instr instruction, addr uint16, value uint8) {
-	// push program counter and processor status to stack
-	cpu.Push16(cpu.PC + 1)
+	// the byte after BRK is padding, so the return address skips it
+	cpu.PC++
 
-	cpu.setBreak()
-	cpu.Push8(cpu.P | 0x30)
-
-	cpu.setInterrupt()
-	
-	cpu.PC = cpu.Read16(0xFFFE)
+	// push program counter and processor status to stack
+	cpu.interrupt(irqVector, true)
 }
 
 // BVC - Branch if overflow clear
@@ -680,14 +883,14 @@ func (cpu *Cpu) setNHelper(value uint8) {
 // DCP - Decrement from memory with C
 func (cpu *Cpu) DCP(instr instruction, addr uint16, value uint8) {
 	result := value - 1
-	cpu.Write8(addr, result)
+	cpu.writeRMW(addr, value, result)
 	cpu.cmpVals(cpu.A, result)
 }
 
 // DEC - Decrement from memory
 func (cpu *Cpu) DEC(instr instruction, addr uint16, value uint8) {
 	result := value - 1
-	cpu.Write8(addr, result)
+	cpu.writeRMW(addr, value, result)
 	
 	cpu.setZHelper(result)
 	cpu.setNHelper(result)
@@ -723,7 +926,7 @@ func (cpu *Cpu) EOR(instr instruction, addr uint16, value uint8) {
 // INC - Increment from memory
 func (cpu *Cpu) INC(instr instruction, addr uint16, value uint8) {
 	result := value + 1
-	cpu.Write8(addr, result)
+	cpu.writeRMW(addr, value, result)
 	
 	cpu.setZHelper(result)
 	cpu.setNHelper(result)
@@ -781,6 +984,23 @@ func (cpu *Cpu) JSR(instr instruction, addr uint16) {
 	cpu.PC = addr
 }
 
+// KIL - jams the cpu. It stops fetching instructions until it is reset
+func (cpu *Cpu) KIL(instr instruction) {
+	cpu.PC -= uint16(instr.bytes)
+	cpu.halt(fmt.Sprintf("jammed by KIL opcode $%02X", instr.opcode))
+}
+
+// LAS - ands the value with the stack pointer and loads it into acc, x and sp
+func (cpu *Cpu) LAS(instr instruction, addr uint16, value uint8) {
+	result := value & cpu.SP
+	cpu.A = result
+	cpu.X = result
+	cpu.SP = result
+
+	cpu.setZHelper(result)
+	cpu.setNHelper(result)
+}
+
 // LAX - load acc and Y with mem location
 func (cpu *Cpu) LAX(instr instruction, addr uint16, value uint8) {
 	cpu.A = value
@@ -825,7 +1045,7 @@ func (cpu *Cpu) LSR(instr instruction, addr uint16, value uint8) {
 		cpu.A = result
 	} else {
 		result = value >> 1
-		cpu.Write8(addr, result)
+		cpu.writeRMW(addr, value, result)
 	}
 	
 	// Set the carry flag old bit 7 is 1
@@ -889,12 +1109,12 @@ func (cpu *Cpu) RLA(instr instruction, addr uint16, value uint8) {
 
 	result = (value << 1) | getBit(cpu.P, 0)
 	cpu.setCHelper(oldBit7)
-	cpu.setNHelper(result)
-	cpu.setZHelper(result)
 
-	cpu.Write8(addr, result)
+	cpu.writeRMW(addr, value, result)
 
 	cpu.A &= result
+	cpu.setNHelper(cpu.A)
+	cpu.setZHelper(cpu.A)
 }
 
 // ROL - rotate left
@@ -910,7 +1130,7 @@ func (cpu *Cpu) ROL(instr instruction, addr uint16, value uint8) {
 	if instr.mode == A {
 		cpu.A = result
 	} else {
-		cpu.Write8(addr, result)
+		cpu.writeRMW(addr, value, result)
 	}
 }
 
@@ -927,30 +1147,22 @@ func (cpu *Cpu) ROR(instr instruction, addr uint16, value uint8) {
 	if instr.mode == A {
 		cpu.A = result
 	} else {
-		cpu.Write8(addr, result)
+		cpu.writeRMW(addr, value, result)
 	}
 }
 
 // RRA - rotate memory right, then add to the acc
 func (cpu *Cpu) RRA(instr instruction, addr uint16, value uint8) {
-	oldBit7 := getBit(value, 7)
+	oldBit0 := getBit(value, 0)
 	var result uint8
 
-	result = (value >> 1) | getBit(cpu.P, 0)
-	cpu.setCHelper(oldBit7)
-	cpu.setNHelper(result)
-	cpu.setZHelper(result)
-
-	cpu.Write8(addr, result)
+	result = (value >> 1) | (getBit(cpu.P, 0) << 7)
+	cpu.setCHelper(oldBit0)
 
-	cpu.A += result
+	cpu.writeRMW(addr, value, result)
 
-	// Set the overflow flag
-	if ((cpu.A ^ result) & (value ^ result) & 0x80) > 0 {
-		cpu.setOverflow()
-	} else {
-		cpu.clearOverflow()
-	}
+	// the carry out of the rotate feeds the add
+	cpu.ADC(instr, addr, result)
 }
 
 // RTI - return from interrupt
@@ -980,8 +1192,25 @@ func (cpu *Cpu) SAX(instr instruction, addr uint16) {
 
 // SBC - Subtract with Carry
 func (cpu *Cpu) SBC(instr instruction, addr uint16, value uint8) {
-	// TODO: understand why this can be implemented like this
-	cpu.ADC(instr, addr, ^value)
+	a, borrow := cpu.A, 1-getBit(cpu.P, 0)
+
+	// A - M - B is A + ^M + C in two's complement, and the NMOS
+	// chip sets all the flags from the binary result in decimal mode too
+	cpu.adcBinary(^value)
+
+	if cpu.decimalMode() {
+		low := int(a&0x0F) - int(value&0x0F) - int(borrow)
+		high := int(a>>4) - int(value>>4)
+		if low < 0 {
+			low -= 0x06
+			high--
+		}
+		if high < 0 {
+			high -= 0x06
+		}
+
+		cpu.A = uint8(high<<4 | low&0x0F)
+	}
 }
 
 // SEC - Set Carry Flag
@@ -1000,11 +1229,21 @@ func (cpu *Cpu) SEI() {
 	cpu.setInterrupt()
 }
 
+// SHX - stores x and the high byte of the address plus one
+func (cpu *Cpu) SHX(instr instruction, addr uint16) {
+	cpu.unstableStore(addr, cpu.Y, cpu.X)
+}
+
+// SHY - stores y and the high byte of the address plus one
+func (cpu *Cpu) SHY(instr instruction, addr uint16) {
+	cpu.unstableStore(addr, cpu.X, cpu.Y)
+}
+
 // SLO - shifts memory left, then ors acc with memory
 func (cpu *Cpu) SLO(instr instruction, addr uint16, value uint8) {
 	oldBit7 := getBit(value, 7)
 	result := value << 1
-	cpu.Write8(addr, result)
+	cpu.writeRMW(addr, value, result)
 	cpu.A |= result
 
 	cpu.setCHelper(oldBit7)
@@ -1014,16 +1253,30 @@ func (cpu *Cpu) SLO(instr instruction, addr uint16, value uint8) {
 
 // SRE - shifts memory right, then XORS acc with memory
 func (cpu *Cpu) SRE(instr instruction, addr uint16, value uint8) {
-	oldBit7 := getBit(value, 7)
+	oldBit0 := getBit(value, 0)
 	result := value >> 1
-	cpu.Write8(addr, result)
+	cpu.writeRMW(addr, value, result)
 	cpu.A ^= result
 
-	cpu.setCHelper(oldBit7)
+	cpu.setCHelper(oldBit0)
 	cpu.setZHelper(cpu.A)
 	cpu.setNHelper(cpu.A)
 }
 
+// unstableStore - SHX, SHY, AXA and TAS and the value with the high byte
+// of the base address plus one. When the index crosses a page the address
+// high byte is replaced by the value that gets written.
+func (cpu *Cpu) unstableStore(addr uint16, index uint8, value uint8) {
+	base := addr - uint16(index)
+	value &= uint8(base>>8) + 1
+
+	if !samePage(base, addr) {
+		addr = uint16(value)<<8 | addr&0xFF
+	}
+
+	cpu.Write8(addr, value)
+}
+
 // STA - store acc in memory
 func (cpu *Cpu) STA(instr instruction, addr uint16) {
 	cpu.Write8(addr, cpu.A)
@@ -1039,6 +1292,12 @@ func (cpu *Cpu) STY(instr instruction, addr uint16) {
 	cpu.Write8(addr, cpu.Y)
 }
 
+// TAS - sets sp to acc and x, then stores it like AXA
+func (cpu *Cpu) TAS(instr instruction, addr uint16) {
+	cpu.SP = cpu.A & cpu.X
+	cpu.unstableStore(addr, cpu.Y, cpu.SP)
+}
+
 // TAX - transfer acc to X
 func (cpu *Cpu) TAX() {
 	cpu.X = cpu.A
@@ -1081,3 +1340,12 @@ func (cpu *Cpu) TYA() {
 	cpu.setZHelper(cpu.A)
 	cpu.setNHelper(cpu.A)
 }
+
+// XAA - ands x and the value into the acc. The acc bits are unstable on
+// real chips, this uses the common $EE magic constant
+func (cpu *Cpu) XAA(instr instruction, addr uint16, value uint8) {
+	cpu.A = (cpu.A | 0xEE) & cpu.X & value
+
+	cpu.setZHelper(cpu.A)
+	cpu.setNHelper(cpu.A)
+}
@@ -1,4 +1,4 @@
-package hardware
+package cpu6502
 
 type instruction struct {
 	// Assembly Language Form
@@ -294,7 +294,7 @@ var Instructions = [256]instruction{
 		ORA,
 		0x0D,
 		3,
-		3,
+		4,
 		abs,},
 	// ASL - Absolute
 	instruction{
@@ -344,14 +344,14 @@ var Instructions = [256]instruction{
 		2,
 		8,
 		indY,},
-	// NOP - Zero Page
+	// NOP - Zero Page X
 	instruction{
 		"NOP",
 		NOP,
 		0x14,
 		2,
 		4,
-		zpg,},
+		zpgX,},
 	// ORA - Zero Page X
 	instruction{
 		"ORA",
@@ -550,7 +550,7 @@ var Instructions = [256]instruction{
 		AND,
 		0x2D,
 		3,
-		6,
+		4,
 		abs,},
 	// ROL - Absolute
 	instruction{
@@ -624,14 +624,14 @@ var Instructions = [256]instruction{
 		2,
 		6,
 		zpgX,},
-	// RLA - (Indrect), Y
+	// RLA - Zero Page X
 	instruction{
 		"RLA",
 		RLA,
 		0x37,
 		2,
 		6,
-		indY,},
+		zpgX,},
 	// SEC - Implied
 	instruction{
 		"SEC",
@@ -670,8 +670,8 @@ var Instructions = [256]instruction{
 		NOP,
 		0x3C,
 		3,
-		2,
-		impl,},
+		4,
+		absX,},
 	// AND - Absolute X
 	instruction{
 		"AND",
@@ -710,12 +710,12 @@ var Instructions = [256]instruction{
 		EOR,
 		0x41,
 		2,
-		5,
+		6,
 		indX,},
-	// EOR - Implied
+	// KIL - Implied
 	instruction{
-		"EOR",
-		EOR,
+		"KIL",
+		KIL,
 		0x42,
 		1,
 		0,
@@ -1102,7 +1102,7 @@ var Instructions = [256]instruction{
 		KIL,
 		0x72,
 		1,
-		9,
+		0,
 		impl,},
 	// RRA - (Indirect), Y
 	instruction{
@@ -1126,7 +1126,7 @@ var Instructions = [256]instruction{
 		ADC,
 		0x75,
 		2,
-		3,
+		4,
 		zpgX,},
 	// ROR - Zero Page X
 	instruction{
@@ -1367,7 +1367,7 @@ var Instructions = [256]instruction{
 		0x93,
 		2,
 		6,
-		abs,},
+		indY,},
 	// STY - Zero Page X 
 	instruction{
 		"STY",
@@ -1456,21 +1456,21 @@ var Instructions = [256]instruction{
 		3,
 		5,
 		absY,},
-	// EOR - Absolute 
+	// AXA - Absolute Y
 	instruction{
-		"EOR",
-		EOR,
+		"AXA",
+		AXA,
 		0x9F,
 		3,
-		4,
-		abs,},
+		5,
+		absY,},
 	// LDY - Immediate 
 	instruction{
 		"LDY",
 		LDY,
 		0xA0,
 		2,
-		3,
+		2,
 		imm,},
 	// LDA - (Indirect, X) 
 	instruction{
@@ -1838,7 +1838,7 @@ var Instructions = [256]instruction{
 		DEC,
 		0xCE,
 		3,
-		3,
+		6,
 		abs,},
 	// DCP - Absolute 
 	instruction{
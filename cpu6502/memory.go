@@ -0,0 +1,71 @@
+package cpu6502
+
+func (cpu *Cpu) Read8(addr uint16) uint8 {
+	return cpu.Bus.Read8(addr)
+}
+
+// Read16 - reads a little endian word as two separate bus reads.
+// Reading $FFFF wraps around to $0000 for the high byte.
+func (cpu *Cpu) Read16(addr uint16) uint16 {
+	low := cpu.Read8(addr)
+	high := cpu.Read8(addr + 1)
+
+	return uint16(high)<<8 | uint16(low)
+}
+
+func (cpu *Cpu) Write8(addr uint16, value uint8) {
+	cpu.Bus.Write8(addr, value)
+}
+
+// dummyRead - a read made only for its timing, whose value is thrown away
+func (cpu *Cpu) dummyRead(addr uint16) {
+	cpu.dummy = true
+	cpu.Read8(addr)
+	cpu.dummy = false
+}
+
+// DummyAccess - reports whether the bus access in progress is a dummy read
+// or write, made for its timing or side effects rather than the value
+func (cpu *Cpu) DummyAccess() bool {
+	return cpu.dummy
+}
+
+// writeRMW - read-modify-write instructions write the unmodified value
+// back on the cycle before they write the result
+func (cpu *Cpu) writeRMW(addr uint16, value, result uint8) {
+	cpu.dummy = true
+	cpu.Write8(addr, value)
+	cpu.dummy = false
+	cpu.Write8(addr, result)
+}
+
+// Write16 - writes a little endian word as two separate bus writes
+func (cpu *Cpu) Write16(addr, value uint16) {
+	cpu.Write8(addr, uint8(value&0xFF))
+	cpu.Write8(addr+1, uint8(value>>8))
+}
+
+func (cpu *Cpu) Push16(value uint16) {
+	high, low := uint8(value>>8), uint8(value&0xFF)
+
+	cpu.Push8(high)
+	cpu.Push8(low)
+}
+
+func (cpu *Cpu) Push8(value uint8) {
+	cpu.Write8(0x100|uint16(cpu.SP), value)
+	cpu.SP--
+}
+
+func (cpu *Cpu) Pop16() uint16 {
+	low := cpu.Pop8()
+	high := cpu.Pop8()
+
+	return uint16(high)<<8 | uint16(low)
+}
+
+func (cpu *Cpu) Pop8() uint8 {
+	cpu.SP++
+
+	return cpu.Read8(0x100 | uint16(cpu.SP))
+}
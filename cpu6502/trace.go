@@ -0,0 +1,125 @@
+package cpu6502
+
+import (
+	"fmt"
+	"strings"
+)
+
+// nestest spells a couple of the unofficial mnemonics differently
+var traceMnemonics = map[uint8]string{
+	ISC: "ISB",
+}
+
+// Unofficial - reports whether opcode is outside the documented instruction set
+func Unofficial(opcode uint8) bool {
+	instr := Instructions[opcode]
+
+	switch instr.code {
+	case NOP:
+		return opcode != 0xEA
+	case SBC:
+		return opcode == 0xEB
+	case LAX, SAX, DCP, ISC, SLO, RLA, SRE, RRA,
+		ANC, ALR, ARR, XAA, AXA, TAS, SHY, SHX, LAS, AXS, KIL:
+		return true
+	}
+
+	return false
+}
+
+// TraceLine - the nestest log line for the instruction at PC, from the
+// address up to the stack pointer. Operands are resolved through peek,
+// which must not have side effects on the machine.
+func (cpu *Cpu) TraceLine(peek func(addr uint16) uint8) string {
+	instr := Instructions[peek(cpu.PC)]
+
+	var raw []string
+	for i := uint8(0); i < instr.bytes; i++ {
+		raw = append(raw, fmt.Sprintf("%02X", peek(cpu.PC+uint16(i))))
+	}
+
+	marker := ' '
+	if Unofficial(instr.opcode) {
+		marker = '*'
+	}
+
+	return fmt.Sprintf("%04X  %-8s %c%-32sA:%02X X:%02X Y:%02X P:%02X SP:%02X",
+		cpu.PC,
+		strings.Join(raw, " "),
+		marker,
+		cpu.traceDisassembly(instr, peek),
+		cpu.A,
+		cpu.X,
+		cpu.Y,
+		cpu.P,
+		cpu.SP)
+}
+
+// traceDisassembly - the instruction with its operand, the effective
+// address and the value there, as it is before the instruction runs
+func (cpu *Cpu) traceDisassembly(instr instruction, peek func(addr uint16) uint8) string {
+	mnemonic := instr.assemblyCode
+	if name, ok := traceMnemonics[instr.code]; ok {
+		mnemonic = name
+	}
+
+	peek16 := func(low, high uint16) uint16 {
+		return uint16(peek(high))<<8 | uint16(peek(low))
+	}
+
+	// zero page pointers wrap inside the zero page
+	peekZpg16 := func(addr uint8) uint16 {
+		return peek16(uint16(addr), uint16(addr+1))
+	}
+
+	arg8 := peek(cpu.PC + 1)
+	arg16 := peek16(cpu.PC+1, cpu.PC+2)
+
+	var operand string
+	switch instr.mode {
+	case A:
+		operand = "A"
+	case imm:
+		operand = fmt.Sprintf("#$%02X", arg8)
+	case zpg:
+		operand = fmt.Sprintf("$%02X = %02X", arg8, peek(uint16(arg8)))
+	case zpgX:
+		addr := arg8 + cpu.X
+		operand = fmt.Sprintf("$%02X,X @ %02X = %02X", arg8, addr, peek(uint16(addr)))
+	case zpgY:
+		addr := arg8 + cpu.Y
+		operand = fmt.Sprintf("$%02X,Y @ %02X = %02X", arg8, addr, peek(uint16(addr)))
+	case abs:
+		if instr.code == JMP || instr.code == JSR {
+			operand = fmt.Sprintf("$%04X", arg16)
+		} else {
+			operand = fmt.Sprintf("$%04X = %02X", arg16, peek(arg16))
+		}
+	case absX:
+		addr := arg16 + uint16(cpu.X)
+		operand = fmt.Sprintf("$%04X,X @ %04X = %02X", arg16, addr, peek(addr))
+	case absY:
+		addr := arg16 + uint16(cpu.Y)
+		operand = fmt.Sprintf("$%04X,Y @ %04X = %02X", arg16, addr, peek(addr))
+	case ind:
+		// the pointer's high byte doesn't carry into the next page
+		target := peek16(arg16, arg16&0xFF00|(arg16+1)&0xFF)
+		operand = fmt.Sprintf("($%04X) = %04X", arg16, target)
+	case indX:
+		pointer := arg8 + cpu.X
+		addr := peekZpg16(pointer)
+		operand = fmt.Sprintf("($%02X,X) @ %02X = %04X = %02X", arg8, pointer, addr, peek(addr))
+	case indY:
+		base := peekZpg16(arg8)
+		addr := base + uint16(cpu.Y)
+		operand = fmt.Sprintf("($%02X),Y = %04X @ %04X = %02X", arg8, base, addr, peek(addr))
+	case rel:
+		operand = fmt.Sprintf("$%04X", cpu.PC+2+uint16(int8(arg8)))
+	}
+
+	if operand == "" {
+		return mnemonic
+	}
+
+	return mnemonic + " " + operand
+}
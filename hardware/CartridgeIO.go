@@ -1,15 +1,18 @@
 package hardware
 
-import (
-	"encoding/binary"
-	"log"
-)
-
+// CartridgeIO - a mapper. read8 and write8 take PPU addresses below $2000
+// for CHR rom or ram, and cpu addresses from $6000.
 type CartridgeIO interface {
 	read8(addr uint16) uint8
-	read16(addr uint16) uint16
 	write8(addr uint16, value uint8)
 	initCartIO(cartridge *Cartridge)
+
+	// offset into PRG rom that addr currently reads from, -1 if it isn't PRG rom
+	prgOffset(addr uint16) int
+
+	// offset into CHR rom that PPU address addr currently reads from, -1
+	// if it isn't CHR rom
+	chrOffset(addr uint16) int
 }
 
 type Mapper0CIO struct {
@@ -17,13 +20,13 @@ type Mapper0CIO struct {
 }
 
 func (m *Mapper0CIO) setMirrorStyle() {
-	mirrorFlag := m.cartridge.flags6 & 1
-
-	switch mirrorFlag {
-	case 0:
-		m.cartridge.mirrorStyle = horizontal
-	case 1:
+	switch {
+	case m.cartridge.FourScreen:
+		m.cartridge.mirrorStyle = fourScreen
+	case m.cartridge.VerticalMirroring:
 		m.cartridge.mirrorStyle = vertical
+	default:
+		m.cartridge.mirrorStyle = horizontal
 	}
 }
 
@@ -34,36 +37,46 @@ func (m *Mapper0CIO) initCartIO(cartridge *Cartridge) {
 
 func (m *Mapper0CIO) read8(addr uint16) uint8 {
 	if addr < 0x2000 {
+		if m.cartridge.chrRomBlocks == 0 {
+			return m.cartridge.readCHRRAM(addr)
+		}
 		return m.cartridge.chrRom[addr]
 	} else if addr >= 0x6000 && addr < 0x8000 {
-		return m.cartridge.nes.CPU.Memory[addr]
-	} else if addr >= 0x8000 {
-		if m.cartridge.prgRomBlocks == 1 {
-			return m.cartridge.prgRom[(addr - 0x8000) % 0x4000]
-		} else if m.cartridge.prgRomBlocks == 2 {
-			return m.cartridge.prgRom[(addr - 0x8000)]
-		}
+		return m.cartridge.readRAM(addr)
+	} else if offset := m.prgOffset(addr); offset >= 0 {
+		return m.cartridge.prgRom[offset]
 	}
 
 	return 0
 }
 
-func (m *Mapper0CIO) read16(addr uint16) uint16 {
-	if addr >= 0x8000 {
-		if m.cartridge.prgRomBlocks == 1 {
-			return binary.LittleEndian.Uint16(m.cartridge.prgRom[(addr - 0x8000) % 0x4000 : (addr - 0x8000) % 0x4000 + 2])
-		} else if m.cartridge.prgRomBlocks == 2 {
-			return binary.LittleEndian.Uint16(m.cartridge.prgRom[(addr - 0x8000) : (addr - 0x8000) + 2])
-		}
+func (m *Mapper0CIO) prgOffset(addr uint16) int {
+	if addr < 0x8000 {
+		return -1
+	}
 
+	if m.cartridge.prgRomBlocks == 1 {
+		return int(addr - 0x8000) % 0x4000
+	} else if m.cartridge.prgRomBlocks == 2 {
+		return int(addr - 0x8000)
 	}
 
-	return binary.LittleEndian.Uint16(m.cartridge.nes.CPU.Memory[addr : addr + 2])
+	return -1
+}
+
+func (m *Mapper0CIO) chrOffset(addr uint16) int {
+	if int(addr) >= len(m.cartridge.chrRom) {
+		return -1
+	}
+
+	return int(addr)
 }
 
 func (m *Mapper0CIO) write8(addr uint16, value uint8) {
-	if addr >= 0x6000 && addr < 0x8000 {
-		m.cartridge.nes.CPU.Memory[addr] = value
+	if addr < 0x2000 {
+		m.cartridge.writeCHRRAM(addr, value)
+	} else if addr >= 0x6000 && addr < 0x8000 {
+		m.cartridge.writeRAM(addr, value)
 	}
 }
 
@@ -142,113 +155,76 @@ func (m *Mapper1CIO) initCartIO(cartridge *Cartridge) {
 func (m *Mapper1CIO) read8(addr uint16) uint8 {
 	if addr < 0x2000 {
 		if m.cartridge.chrRomBlocks == 0 {
-			return m.cartridge.nes.PPU.Memory[addr]
-		} else {
-			numOf4kbBlocks := m.cartridge.chrRomBlocks * 2
-			switch m.chrRomBankMode {
-			case chrBankMode0:
-				truncOffsetAddr := addr & 0x1FFF
-				baseAddrIdx := m.chrBank0 & 0xE // ignore last bit in 8kb mode
-				return m.cartridge.chrRom[uint32(baseAddrIdx % numOf4kbBlocks) * 0x1000 + uint32(truncOffsetAddr)]
-			case chrBankMode1:
-				truncOffsetAddr := addr & 0x1FFF
-				if truncOffsetAddr < 0x1000 {
-					baseAddrIdx := m.chrBank0
-					return m.cartridge.chrRom[uint32(baseAddrIdx % numOf4kbBlocks) * 0x1000 + uint32(truncOffsetAddr)]
-				} else {
-					baseAddrIdx := m.chrBank1
-					return m.cartridge.chrRom[uint32(baseAddrIdx % numOf4kbBlocks) * 0x1000 + uint32(truncOffsetAddr & 0xFFF)]
-				}
-			}
+			return m.cartridge.readCHRRAM(addr)
+		} else if offset := m.chrOffset(addr); offset >= 0 {
+			return m.cartridge.chrRom[offset]
 		}
 	} else if addr >= 0x6000 && addr < 0x8000 {
-		return m.cartridge.nes.CPU.Memory[addr]
-	} else if addr >= 0x8000 {
-		switch m.prgRomBankMode {
-		case prgBankMode0, prgBankMode1:
-			truncOffsetAddr := addr & 0x7FFF
-			baseAddrIdx := m.prgBank & 0xE // ignore last bit in 32kb mode
-			return m.cartridge.prgRom[uint32(baseAddrIdx % m.cartridge.prgRomBlocks) * 0x4000 + uint32(truncOffsetAddr)]
-		case prgBankMode2:
-			truncOffsetAddr := addr & 0x7FFF
-			if truncOffsetAddr < 0x4000 {
-				return m.cartridge.prgRom[truncOffsetAddr]
-			} else {
-				baseAddrIdx := m.prgBank & 0xF
-				return m.cartridge.prgRom[uint32(baseAddrIdx % m.cartridge.prgRomBlocks) * 0x4000 + uint32(truncOffsetAddr & 0x3FFF)]
-			}
-		case prgBankMode3:
-			truncOffsetAddr := addr & 0x7FFF
-			if truncOffsetAddr < 0x4000 {
-				baseAddrIdx := m.prgBank & 0xF
-				return m.cartridge.prgRom[uint32(baseAddrIdx % m.cartridge.prgRomBlocks) * 0x4000 + uint32(truncOffsetAddr)]
-			} else {
-				return m.cartridge.prgRom[uint32(m.cartridge.prgRomBlocks - 1) * 0x4000 + uint32(truncOffsetAddr & 0x3FFF)]
-			}
-		default:
-			log.Fatalf("Invalid prg bank mode %d", m.prgRomBankMode)
+		if !m.ramEnabled() {
+			return m.cartridge.nes.CPU.Bus.OpenBus()
 		}
+		return m.cartridge.readRAM(addr)
+	} else if offset := m.prgOffset(addr); offset >= 0 {
+		return m.cartridge.prgRom[offset]
 	}
 	return 0
 }
 
-func (m *Mapper1CIO) read16(addr uint16) uint16 {
-	if addr < 0x2000 {
-		if m.cartridge.chrRomBlocks == 0 {
-			return binary.LittleEndian.Uint16(m.cartridge.nes.PPU.Memory[addr:addr + 2])
+func (m *Mapper1CIO) prgOffset(addr uint16) int {
+	if addr < 0x8000 {
+		return -1
+	}
+
+	switch m.prgRomBankMode {
+	case prgBankMode0, prgBankMode1:
+		truncOffsetAddr := addr & 0x7FFF
+		baseAddrIdx := m.prgBank & 0xE // ignore last bit in 32kb mode
+		return int(baseAddrIdx % m.cartridge.prgRomBlocks) * 0x4000 + int(truncOffsetAddr)
+	case prgBankMode2:
+		truncOffsetAddr := addr & 0x7FFF
+		if truncOffsetAddr < 0x4000 {
+			return int(truncOffsetAddr)
 		} else {
-			numOf4kbBlocks := m.cartridge.chrRomBlocks
-			switch m.chrRomBankMode {
-			case chrBankMode0:
-				truncOffsetAddr := addr & 0x1FFF
-				baseAddrIdx := m.chrBank0 & 0xE // ignore last bit in 8kb mode
-				baseAddr := uint32(baseAddrIdx % numOf4kbBlocks) * 0x1000
-				return binary.LittleEndian.Uint16(m.cartridge.chrRom[baseAddr + uint32(truncOffsetAddr): baseAddr + uint32(truncOffsetAddr) + 2])
-			case chrBankMode1:
-				truncOffsetAddr := addr & 0x1FFF
-				if truncOffsetAddr < 0x1000 {
-					baseAddrIdx := m.chrBank0
-					baseAddr := uint32(baseAddrIdx % numOf4kbBlocks) * 0x1000
-					return binary.LittleEndian.Uint16(m.cartridge.chrRom[baseAddr + uint32(truncOffsetAddr):baseAddr + uint32(truncOffsetAddr) + 2])
-				} else {
-					baseAddrIdx := m.chrBank1
-					baseAddr := uint32(baseAddrIdx % numOf4kbBlocks) * 0x1000
-					return binary.LittleEndian.Uint16(m.cartridge.chrRom[baseAddr + uint32(truncOffsetAddr) : baseAddr + uint32(truncOffsetAddr) + 2])
-				}
-			}
+			baseAddrIdx := m.prgBank & 0xF
+			return int(baseAddrIdx % m.cartridge.prgRomBlocks) * 0x4000 + int(truncOffsetAddr & 0x3FFF)
 		}
-	} else if addr >= 0x8000 {
-		switch m.prgRomBankMode {
-		case prgBankMode0, prgBankMode1:
-			truncOffsetAddr := addr & 0x7FFF
-			baseAddrIdx := m.prgBank & 0xE // ignore last bit in 32kb mode
-			baseAddr := uint32(baseAddrIdx % m.cartridge.prgRomBlocks) * 0x4000
-			return binary.LittleEndian.Uint16(m.cartridge.prgRom[baseAddr + uint32(truncOffsetAddr) : baseAddr + uint32(truncOffsetAddr) + 2])
-		case prgBankMode2:
-			truncOffsetAddr := addr & 0x7FFF
-			if truncOffsetAddr < 0x4000 {
-				return binary.LittleEndian.Uint16(m.cartridge.prgRom[truncOffsetAddr : truncOffsetAddr + 2])
-			} else {
-				baseAddrIdx := m.prgBank & 0xF
-				baseAddr := uint32(baseAddrIdx % m.cartridge.prgRomBlocks) * 0x4000
-				return binary.LittleEndian.Uint16(m.cartridge.prgRom[baseAddr + uint32(truncOffsetAddr & 0x3FFF) : baseAddr + uint32(truncOffsetAddr & 0x3FFF) + 2])
-			}
-		case prgBankMode3:
-			truncOffsetAddr := addr & 0x7FFF
-			if truncOffsetAddr < 0x4000 {
-				baseAddrIdx := m.prgBank & 0xF
-				baseAddr := uint32(baseAddrIdx % m.cartridge.prgRomBlocks) * 0x4000
-				return binary.LittleEndian.Uint16(m.cartridge.prgRom[baseAddr + uint32(truncOffsetAddr) : baseAddr + uint32(truncOffsetAddr) + 2])
-			} else {
-				baseAddr := uint32(m.cartridge.prgRomBlocks - 1) * 0x4000
-				return binary.LittleEndian.Uint16(m.cartridge.prgRom[baseAddr + uint32(truncOffsetAddr & 0x3FFF) : baseAddr + uint32(truncOffsetAddr & 0x3FFF) + 2])
-			}
-		default:
-			log.Fatalf("Invalid prg bank mode %d", m.prgRomBankMode)
+	case prgBankMode3:
+		truncOffsetAddr := addr & 0x7FFF
+		if truncOffsetAddr < 0x4000 {
+			baseAddrIdx := m.prgBank & 0xF
+			return int(baseAddrIdx % m.cartridge.prgRomBlocks) * 0x4000 + int(truncOffsetAddr)
+		} else {
+			return int(m.cartridge.prgRomBlocks - 1) * 0x4000 + int(truncOffsetAddr & 0x3FFF)
 		}
 	}
 
-	return binary.LittleEndian.Uint16(m.cartridge.nes.CPU.Memory[addr : addr + 2])
+	return -1
+}
+
+func (m *Mapper1CIO) chrOffset(addr uint16) int {
+	if addr >= 0x2000 || m.cartridge.chrRomBlocks == 0 {
+		return -1
+	}
+
+	numOf4kbBlocks := m.cartridge.chrRomBlocks * 2
+	switch m.chrRomBankMode {
+	case chrBankMode0:
+		baseAddrIdx := m.chrBank0 & 0xE // ignore last bit in 8kb mode
+		return int(baseAddrIdx % numOf4kbBlocks) * 0x1000 + int(addr)
+	case chrBankMode1:
+		if addr < 0x1000 {
+			return int(m.chrBank0 % numOf4kbBlocks) * 0x1000 + int(addr)
+		}
+		return int(m.chrBank1 % numOf4kbBlocks) * 0x1000 + int(addr & 0xFFF)
+	}
+
+	return -1
+}
+
+// ramEnabled - bit 4 of the PRG bank register turns PRG ram off, on
+// MMC1B and later
+func (m *Mapper1CIO) ramEnabled() bool {
+	return m.prgBank&0x10 == 0
 }
 
 func (m *Mapper1CIO) setMirrorStyle() {
@@ -291,10 +267,20 @@ func (m *Mapper1CIO) setRegister(addr uint16, regValue byte) {
 }
 
 func (m *Mapper1CIO) write8(addr uint16, value uint8) {
-	if addr >= 0x6000 && addr < 0x8000 {
-		m.cartridge.nes.CPU.Memory[addr] = value
+	if addr < 0x2000 {
+		m.cartridge.writeCHRRAM(addr, value)
+	} else if addr >= 0x6000 && addr < 0x8000 {
+		if m.ramEnabled() {
+			m.cartridge.writeRAM(addr, value)
+		}
 	} else if addr >= 0x8000 {
-		isReset := getBit(value, 7) == 1
+		// the serial port ignores a write on the cycle after another one,
+		// so the double write of INC $8000 only resets
+		if m.cartridge.nes.CPU.Bus.ConsecutiveWrite() {
+			return
+		}
+
+		isReset := value&0x80 != 0
 		isFifthWrite := m.shiftReg & 1 == 1
 
 		m.shiftReg = (m.shiftReg >> 1) | ((value & 1) << 4)
@@ -303,6 +289,12 @@ func (m *Mapper1CIO) write8(addr uint16, value uint8) {
 			m.setRegister(addr, m.shiftReg)
 		}
 
+		if isReset {
+			// reset also locks the last prg bank at $C000
+			m.controlBank |= 0xC
+			m.setBankModes()
+		}
+
 		if isReset || isFifthWrite {
 			m.shiftReg = 0x10
 		}
@@ -0,0 +1,116 @@
+package hardware
+
+import (
+	"nes-emu/assembler"
+	"testing"
+)
+
+// newTestMMC1 makes a 32KB MMC1 cart with prg running from the fixed bank at $C000
+func newTestMMC1(prg []byte) *NES {
+	nes := NewNES()
+
+	rom := make([]byte, 0x8000)
+	rom[0] = 0xFF
+	copy(rom[0x4000:], prg)
+	rom[0x7FFC], rom[0x7FFD] = 0x00, 0xC0
+
+	nes.LoadCartridge(Cartridge{prgRomBlocks: 2, prgRom: rom, chrRomBlocks: 1, chrRom: make([]byte, 0x2000), mapperType: mmc1})
+	nes.CPU.Reset()
+
+	return nes
+}
+
+func TestMMC1IgnoresConsecutiveWrite(t *testing.T) {
+	// C000 LDA #$01
+	// C002 STA $8000
+	// C005 INC $8000 - writes $FF then $00 on the next cycle
+	prg := []byte{0xA9, 0x01, 0x8D, 0x00, 0x80, 0xEE, 0x00, 0x80}
+	nes := newTestMMC1(prg)
+	mapper := nes.CARTIO.(*Mapper1CIO)
+
+	stepCpu(nes)
+	stepCpu(nes)
+	if mapper.shiftReg != 0x18 {
+		t.Fatalf("Expected one bit in the shift register: %02x", mapper.shiftReg)
+	}
+
+	stepCpu(nes)
+	if mapper.shiftReg != 0x10 {
+		t.Errorf("Expected INC to only reset the shift register: %02x", mapper.shiftReg)
+	}
+	if mapper.prgRomBankMode != prgBankMode3 {
+		t.Errorf("Expected reset to fix the last bank. Mode: %d", mapper.prgRomBankMode)
+	}
+}
+
+func TestMMC1SeparateWrites(t *testing.T) {
+	// C000 LDA #$01
+	// C002 STA $8000
+	// C005 STA $8000
+	prg := []byte{0xA9, 0x01, 0x8D, 0x00, 0x80, 0x8D, 0x00, 0x80}
+	nes := newTestMMC1(prg)
+	mapper := nes.CARTIO.(*Mapper1CIO)
+
+	stepCpu(nes)
+	stepCpu(nes)
+	stepCpu(nes)
+	if mapper.shiftReg != 0x1C {
+		t.Errorf("Expected both writes to shift in. Shift register: %02x", mapper.shiftReg)
+	}
+}
+
+// chrRAMTestSource - writes $5A to CHR ram at PPU $0010, with rendering on
+// so the PPU fetches from the pattern tables
+const chrRAMTestSource = `
+	.bank 0
+	.org $C000
+reset:
+	lda #$00
+	sta $2006
+	lda #$10
+	sta $2006
+	lda #$5A
+	sta $2007
+	lda #$1E
+	sta $2001
+forever:
+	jmp forever
+
+	.org $FFFA
+	.word reset, reset, reset`
+
+func TestNROMCHRRAM(t *testing.T) {
+	program, err := assembler.Assemble(chrRAMTestSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	image := assembler.INES(program.Bytes, nil, mapper0)
+
+	// no CHR rom, so 8KB of CHR ram
+	ines := append([]byte(nil), image[:16+0x4000]...)
+	ines[5] = 0
+	unif := unifImage("MAPR", []byte("NES-NROM-128\x00"), "PRG0", image[16:16+0x4000])
+
+	for name, rom := range map[string][]byte{"iNES": ines, "UNIF": unif} {
+		cart, err := CreateCartridgeFromBytes(rom)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		nes := NewNES()
+		if err := nes.LoadCartridge(cart); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		nes.APU.InitAPU(false)
+		nes.PPU.InitFrame(1)
+		nes.Reset()
+
+		for i := 0; i < 2; i++ {
+			if err := nes.RunFrame(); err != nil {
+				t.Fatalf("%s: %v", name, err)
+			}
+		}
+		if len(nes.CART.chrRam) != 0x2000 || nes.PPU.Read8(0x0010) != 0x5A {
+			t.Errorf("%s: expected $5A written through to 8KB of CHR ram, got $%02X", name, nes.PPU.Read8(0x0010))
+		}
+	}
+}
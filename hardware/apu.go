@@ -1,8 +1,8 @@
 package hardware
 
 import (
+	"fmt"
 	"github.com/hajimehoshi/oto"
-	"log"
 )
 
 type Apu struct {
@@ -12,6 +12,9 @@ type Apu struct {
 	audioContext *oto.Context
 	audioDevice *oto.Player
 
+	// last values written to $4000-$4017
+	registers [0x18]uint8
+
 	// cycle counter
 	cyclesPast uint8
 	Cyclelimit uint8
@@ -30,6 +33,7 @@ type Apu struct {
 	sequenceClockCounter uint8
 	sequencerMode uint8
 	sequenceInterrupt bool
+	frameInterrupt bool
 	sequenceCounter uint32
 	cyclesPerSequence uint32
 
@@ -121,17 +125,21 @@ var lengthTable = [32]uint8{
 	12, 16, 24, 18, 48, 20, 96, 22, 192, 24, 72, 26, 16, 28, 32, 30,
 }
 
-func (apu *Apu) InitAPU(initContext bool) {
+// InitAPU - resets the channels, and opens the audio device if
+// initContext is set. If it can't be opened the APU runs silently.
+func (apu *Apu) InitAPU(initContext bool) error {
 	// init audio player
 	apu.Cyclelimit = 40
 
+	var err error
 	if initContext {
-		context, err := oto.NewContext(44100, 1, 1, 4096);
-		if err != nil {
-			log.Fatal("Audio could not be initialized")
+		var context *oto.Context
+		context, err = oto.NewContext(44100, 1, 1, 4096);
+		if err == nil {
+			apu.audioDevice = context.NewPlayer()
+		} else {
+			err = fmt.Errorf("audio could not be initialized: %v", err)
 		}
-
-		apu.audioDevice = context.NewPlayer()
 	}
 	apu.enableDMC = false
 	apu.enableNoise = false
@@ -159,6 +167,67 @@ func (apu *Apu) InitAPU(initContext bool) {
 
 	apu.populatePulseTable()
 	apu.populateTNDTable()
+
+	return err
+}
+
+// reg - the last value written to an APU register
+func (apu *Apu) reg(addr uint16) uint8 {
+	return apu.registers[addr-0x4000]
+}
+
+// read8 - only $4015 can be read, everything else is open bus
+func (apu *Apu) read8(addr uint16) uint8 {
+	if addr == 0x4015 {
+		return apu.readStatus()
+	}
+
+	return apu.nes.CPU.Bus.OpenBus()
+}
+
+func (apu *Apu) peek8(addr uint16) uint8 {
+	if addr == 0x4015 {
+		return apu.status()
+	}
+
+	return apu.nes.CPU.Bus.OpenBus()
+}
+
+func (apu *Apu) write8(addr uint16, value uint8) {
+	apu.registers[addr-0x4000] = value
+
+	switch addr {
+	case 0x4001:
+		apu.sweep1.setSweepValues(value)
+	case 0x4003:
+		apu.pulse1.setTargetTimer()
+	case 0x4005:
+		apu.sweep2.setSweepValues(value)
+	case 0x4007:
+		apu.pulse2.setTargetTimer()
+	case 0x4008:
+		apu.triangle.setLinearCounterValues(value)
+	case 0x400B:
+		apu.triangle.linearReload = true
+		if apu.enableTriangle {
+			apu.triangle.setLengthCounter(value)
+		}
+	case 0x4015:
+		apu.enablePulseChannel1 = (value >> 0) & 1 == 1
+		if !apu.enablePulseChannel1 {
+			apu.pulse1.lengthTimer = 0
+		}
+		apu.enablePulseChannel2 = (value >> 1) & 1 == 1
+		if !apu.enablePulseChannel2 {
+			apu.pulse2.lengthTimer = 0
+		}
+		apu.enableTriangle = (value >> 2) & 1 == 1
+		if !apu.enableTriangle {
+			apu.triangle.lengthCounter = 0
+		}
+	case 0x4017:
+		apu.setFrameCounterValues(value)
+	}
 }
 
 func (apu *Apu) setFrameCounterValues(frameCounterValue uint8) {
@@ -166,12 +235,60 @@ func (apu *Apu) setFrameCounterValues(frameCounterValue uint8) {
 	apu.sequenceInterrupt = ((frameCounterValue >> 6) & 0x01) != 0
 	apu.sequenceCounter = apu.cyclesPerSequence
 
+	// setting the inhibit flag acknowledges a pending frame interrupt
+	if apu.sequenceInterrupt {
+		apu.clearFrameInterrupt()
+	}
+
 	if apu.sequencerMode == 1 {
 		apu.quarterFrame()
 		apu.halfFrame()
 	}
 }
 
+// setFrameInterrupt - raises the frame counter IRQ unless it is inhibited
+func (apu *Apu) setFrameInterrupt() {
+	if !apu.sequenceInterrupt {
+		apu.frameInterrupt = true
+		apu.nes.CPU.SetIRQ(IRQFrameCounter)
+	}
+}
+
+func (apu *Apu) clearFrameInterrupt() {
+	apu.frameInterrupt = false
+	apu.nes.CPU.ClearIRQ(IRQFrameCounter)
+}
+
+// readStatus - reads 0x4015, reporting which length counters are running.
+// Reading it acknowledges the frame interrupt.
+func (apu *Apu) readStatus() uint8 {
+	status := apu.status()
+
+	apu.clearFrameInterrupt()
+
+	return status
+}
+
+// status - $4015 as it would read, without acknowledging the frame IRQ
+func (apu *Apu) status() uint8 {
+	var status uint8
+
+	if apu.pulse1.lengthTimer > 0 {
+		status |= 0x01
+	}
+	if apu.pulse2.lengthTimer > 0 {
+		status |= 0x02
+	}
+	if apu.triangle.lengthCounter > 0 {
+		status |= 0x04
+	}
+	if apu.frameInterrupt {
+		status |= 0x40
+	}
+
+	return status
+}
+
 func (triangle *Triangle) setLinearCounterValues(linearCounterValue uint8) {
 	triangle.linearControl = (linearCounterValue >> 7) & 0x01 == 1
 	triangle.lengthEnabled = !triangle.linearControl
@@ -182,13 +299,13 @@ func (triangle *Triangle) setLengthCounter(value uint8) {
 }
 
 func (triangle *Triangle) reloadLinearCounter() {
-	triangle.linearCounter = triangle.apu.nes.CPU.Memory[triangle.countersAddr] & 0x7F
+	triangle.linearCounter = triangle.apu.reg(triangle.countersAddr) & 0x7F
 }
 
 func (triangle *Triangle) getTriangleTimer() uint16 {
 	baseAddr := triangle.baseAddr
-	low := uint16(triangle.apu.nes.CPU.Memory[baseAddr])
-	high := uint16(triangle.apu.nes.CPU.Memory[baseAddr + 1] & 0x07)
+	low := uint16(triangle.apu.reg(baseAddr))
+	high := uint16(triangle.apu.reg(baseAddr + 1) & 0x07)
 
 	return (high << 8) | low
 }
@@ -248,8 +365,8 @@ func (sweep *Sweep) sweepRun() {
 }
 
 func (apu *Apu) getPulseTimer(baseAddr uint16) uint16{
-	low := uint16(apu.nes.CPU.Memory[baseAddr + 2])
-	high := uint16(apu.nes.CPU.Memory[baseAddr + 3] & 0x07)
+	low := uint16(apu.reg(baseAddr + 2))
+	high := uint16(apu.reg(baseAddr + 3) & 0x07)
 
 	return (high << 8) | low
 }
@@ -288,12 +405,12 @@ func (apu *Apu) out(s1, s2, t, n, d uint8) float64 {
 }
 
 func (pulse *Pulse) getDuty() uint8 {
-	duty := uint8((pulse.apu.nes.CPU.Memory[pulse.baseAddr] >> 6) & 3)
+	duty := uint8((pulse.apu.reg(pulse.baseAddr) >> 6) & 3)
 	return duty
 }
 
 func (pulse *Pulse) getVolume() uint8 {
-	volume := uint8((pulse.apu.nes.CPU.Memory[pulse.baseAddr] >> 0) & 0xF)
+	volume := uint8((pulse.apu.reg(pulse.baseAddr) >> 0) & 0xF)
 	return volume
 }
 
@@ -306,8 +423,8 @@ func (pulse *Pulse) out() uint8 {
 
 func (pulse *Pulse) getPulTimer() uint16{
 	baseAddr := pulse.baseAddr
-	low := uint16(pulse.apu.nes.CPU.Memory[baseAddr + 2])
-	high := uint16(pulse.apu.nes.CPU.Memory[baseAddr + 3] & 0x07)
+	low := uint16(pulse.apu.reg(baseAddr + 2))
+	high := uint16(pulse.apu.reg(baseAddr + 3) & 0x07)
 
 	return (high << 8) | low
 }
@@ -315,12 +432,12 @@ func (pulse *Pulse) getPulTimer() uint16{
 func (pulse *Pulse) setTargetTimer() {
 	pulse.targetTimer = pulse.getPulTimer()
 	pulse.curTimer = pulse.targetTimer
-	pulse.lengthTimer = lengthTable[pulse.apu.nes.CPU.Memory[pulse.baseAddr + 3] >> 3 & 0x1F]
+	pulse.lengthTimer = lengthTable[pulse.apu.reg(pulse.baseAddr + 3) >> 3 & 0x1F]
 }
 
 func (pulse *Pulse) getHalt() bool {
 	baseAddr := pulse.baseAddr
-	return ((pulse.apu.nes.CPU.Memory[baseAddr] >> 5) & 0x01) == 0x01
+	return ((pulse.apu.reg(baseAddr) >> 5) & 0x01) == 0x01
 }
 
 func (pulse *Pulse) pulseRun() uint8 {
@@ -433,6 +550,7 @@ func (apu *Apu) sequenceClockCounterRun() {
 			case 3:
 				apu.quarterFrame()
 				apu.halfFrame()
+				apu.setFrameInterrupt()
 			default:
 			}
 			apu.sequenceClockCounter = (apu.sequenceClockCounter + 1) % 4
@@ -452,7 +570,7 @@ func (apu *Apu) averageSoundSamples() float64 {
 	return sum / float64(apu.Cyclelimit)
 }
 
-func (apu *Apu) RunAPUCycles(numOfCycles uint16, lastFPS int) {
+func (apu *Apu) RunAPUCycles(numOfCycles uint16) {
 	for i := uint16(0); i < numOfCycles; i++ {
 		if apu.triangle.linearCounter > 0 {
 			apu.triangle.triangleRun()
@@ -466,7 +584,9 @@ func (apu *Apu) RunAPUCycles(numOfCycles uint16, lastFPS int) {
 
 		if apu.cyclesPast >= apu.Cyclelimit {
 			apu.cyclesPast = 0
-			apu.audioDevice.Write([]byte{byte(apu.averageSoundSamples() * 0xFF)})
+			if apu.audioDevice != nil {
+				apu.audioDevice.Write([]byte{byte(apu.averageSoundSamples() * 0xFF)})
+			}
 			apu.audioSamples = apu.audioSamples[:0]
 		} else {
 			apu.audioSamples = append(apu.audioSamples, apu.soundOut)
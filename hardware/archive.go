@@ -0,0 +1,91 @@
+package hardware
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// ErrNoROM - a zip archive has no rom in it, or not the one asked for
+var ErrNoROM = errors.New("no rom in archive")
+
+// maxUnpackedSize - the most an archived rom can unpack to, well past
+// any real rom, so a corrupt or malicious archive can't fill memory
+const maxUnpackedSize = 64 << 20
+
+// romExtensions - the entries a zip archive is searched for
+var romExtensions = []string{".nes", ".fds", ".nsf", ".unf", ".unif"}
+
+// unpackROM - the rom in data, unzipping or gunzipping it going by its
+// magic number. entry picks the file from a zip archive.
+func unpackROM(data []byte, entry string) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		return unzipROM(data, entry)
+	case bytes.HasPrefix(data, []byte{0x1F, 0x8B}):
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return readLimited(r)
+	}
+
+	if entry != "" {
+		return nil, fmt.Errorf("%w: %s was asked for, but the rom isn't zipped", ErrNoROM, entry)
+	}
+
+	return data, nil
+}
+
+// unzipROM - the entry in a zip archive, or the first rom
+func unzipROM(data []byte, entry string) ([]byte, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, file := range archive.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		if entry != "" && file.Name != entry && path.Base(file.Name) != entry {
+			continue
+		}
+		if entry == "" && !hasExtension(file.Name, romExtensions) {
+			continue
+		}
+
+		r, err := file.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return readLimited(r)
+	}
+
+	if entry != "" {
+		return nil, fmt.Errorf("%w: no %s in the archive", ErrNoROM, entry)
+	}
+
+	return nil, fmt.Errorf("%w: no %s file in the archive", ErrNoROM, strings.Join(romExtensions, ", "))
+}
+
+// readLimited - all of r, refusing more than maxUnpackedSize
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxUnpackedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxUnpackedSize {
+		return nil, fmt.Errorf("%w: more than %s", ErrBadHeader, formatSize(maxUnpackedSize))
+	}
+
+	return data, nil
+}
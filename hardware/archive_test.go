@@ -0,0 +1,82 @@
+package hardware
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"nes-emu/assembler"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// zipImage - a zip archive of the files, in order
+func zipImage(t *testing.T, files ...interface{}) []byte {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for i := 0; i < len(files); i += 2 {
+		f, err := w.Create(files[i].(string))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write(files[i+1].([]byte))
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestLoadArchives(t *testing.T) {
+	first := assembler.INES([]byte{0x01}, nil, mapper0)
+	second := assembler.INES([]byte{0x02}, nil, mapper0)
+
+	archive := zipImage(t,
+		"readme.txt", []byte("not a rom"),
+		"roms/first.NES", first,
+		"roms/second.nes", second)
+
+	var gzipped bytes.Buffer
+	w := gzip.NewWriter(&gzipped)
+	w.Write(second)
+	w.Close()
+
+	dir := t.TempDir()
+	zipFile, gzFile := filepath.Join(dir, "set.zip"), filepath.Join(dir, "game.nes.gz")
+	os.WriteFile(zipFile, archive, 0644)
+	os.WriteFile(gzFile, gzipped.Bytes(), 0644)
+
+	tests := []struct {
+		name  string
+		load  func() (Cartridge, error)
+		first byte
+	}{
+		{"zip", func() (Cartridge, error) { return CreateCartridge(zipFile) }, 0x01},
+		{"zip entry", func() (Cartridge, error) { return OpenCartridge(zipFile, LoadOptions{Entry: "second.nes"}) }, 0x02},
+		{"zip path", func() (Cartridge, error) { return OpenCartridge(zipFile, LoadOptions{Entry: "roms/second.nes"}) }, 0x02},
+		{"gzip", func() (Cartridge, error) { return CreateCartridge(gzFile) }, 0x02},
+		{"bytes", func() (Cartridge, error) { return CreateCartridgeFromBytes(first) }, 0x01},
+		{"zip bytes", func() (Cartridge, error) { return CreateCartridgeFromBytes(archive) }, 0x01},
+		{"reader", func() (Cartridge, error) { return CreateCartridgeFromReader(bytes.NewReader(gzipped.Bytes())) }, 0x02},
+	}
+
+	for _, test := range tests {
+		cart, err := test.load()
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if cart.prgRom[0] != test.first {
+			t.Errorf("%s: expected the rom starting $%02X, got $%02X", test.name, test.first, cart.prgRom[0])
+		}
+	}
+
+	if _, err := OpenCartridge(zipFile, LoadOptions{Entry: "third.nes"}); !errors.Is(err, ErrNoROM) {
+		t.Errorf("Expected a missing entry to be refused, got %v", err)
+	}
+	if _, err := CreateCartridgeFromBytes(zipImage(t, "readme.txt", []byte("no roms"))); !errors.Is(err, ErrNoROM) {
+		t.Errorf("Expected an archive without roms to be refused, got %v", err)
+	}
+}
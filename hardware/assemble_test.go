@@ -0,0 +1,78 @@
+package hardware
+
+import (
+	"nes-emu/assembler"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// assembleROM assembles source into an NROM rom file, test.nes in a
+// temporary directory
+func assembleROM(t *testing.T, source string) (string, *assembler.Program) {
+	program, err := assembler.Assemble(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filename := filepath.Join(t.TempDir(), "test.nes")
+	if err := os.WriteFile(filename, assembler.INES(program.Bytes, nil, mapper0), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return filename, program
+}
+
+// assembleNES assembles source into an NROM cartridge and resets a
+// headless NES into it
+func assembleNES(t *testing.T, source string) (*NES, *assembler.Program) {
+	filename, program := assembleROM(t, source)
+
+	cart, err := CreateCartridge(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nes := NewNES()
+	if err := nes.LoadCartridge(cart); err != nil {
+		t.Fatal(err)
+	}
+	nes.APU.InitAPU(false)
+	nes.PPU.InitFrame(1)
+	nes.Reset()
+
+	return nes, program
+}
+
+func TestAssembledNMI(t *testing.T) {
+	nes, _ := assembleNES(t, `
+		.bank 0
+		.org $C000
+	reset:
+		ldx #$FF
+		txs
+		lda #0
+		sta $10
+	@vblank:
+		bit $2002
+		bpl @vblank
+		lda #$80
+		sta $2000
+	loop:
+		jmp loop
+	nmi:
+		inc $10
+	irq:
+		rti
+
+		.org $FFFA
+		.word nmi, reset, irq`)
+
+	for nes.PPU.frameCount < 4 {
+		nes.Step()
+	}
+
+	if count := nes.CPU.Bus.Peek8(0x10); count < 2 || count > 3 {
+		t.Errorf("Expected an NMI each frame after the first, got %d in 4 frames", count)
+	}
+}
@@ -0,0 +1,49 @@
+package hardware
+
+// callTracker - keeps a call stack by watching for JSRs, BRKs and
+// interrupts going in, and the stack pointer coming back up past them
+type callTracker struct {
+	frames []Frame
+
+	// the instruction about to run, as seen by before
+	from     uint16
+	sp       uint8
+	kind     FrameKind
+	entering bool
+}
+
+// before - notes whether the instruction or interrupt about to run
+// enters a routine
+func (c *callTracker) before(cpu *Cpu) {
+	c.from, c.sp = cpu.PC, cpu.SP
+
+	c.kind, c.entering = FrameCall, false
+	switch {
+	case cpu.Halted():
+	case cpu.InterruptPending():
+		c.kind, c.entering = FrameIRQ, true
+		if cpu.NMIPending() {
+			c.kind = FrameNMI
+		}
+	default:
+		switch cpu.Bus.Peek8(cpu.PC) {
+		case jsrOpcode:
+			c.kind, c.entering = FrameCall, true
+		case brkOpcode:
+			c.kind, c.entering = FrameBRK, true
+		}
+	}
+}
+
+// after - pops the frames returned from and pushes the one entered, once
+// the step seen by before has run
+func (c *callTracker) after(cpu *Cpu) {
+	// RTS, RTI and anything else that unwinds the stack past a frame
+	for len(c.frames) > 0 && cpu.SP >= c.frames[len(c.frames)-1].SP {
+		c.frames = c.frames[:len(c.frames)-1]
+	}
+
+	if c.entering {
+		c.frames = append(c.frames, Frame{c.kind, c.from, cpu.PC, c.sp})
+	}
+}
@@ -1,14 +1,63 @@
 package hardware
 
 import (
+	"bytes"
+	"crypto/sha1"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"nes-emu/cpu6502"
+)
+
+// errors from loading and running a cartridge, wrapped with the details
+var (
+	// ErrBadHeader - the rom's header isn't one that can be loaded
+	ErrBadHeader = errors.New("bad rom header")
+
+	// ErrTruncatedROM - the rom is shorter than its header says
+	ErrTruncatedROM = errors.New("truncated rom")
+
+	// ErrUnsupportedMapper - the rom's mapper isn't emulated
+	ErrUnsupportedMapper = errors.New("unsupported mapper")
+
+	// ErrCPUHalted - a KIL opcode, or something the cpu couldn't run,
+	// has stopped it. The NES needs a reset.
+	ErrCPUHalted = cpu6502.ErrCPUHalted
+)
+
+// the 512 byte trainer some iNES roms have, loaded into cartridge ram
+const (
+	trainerSize = 0x200
+	trainerAddr = 0x7000
 )
 
 type Cartridge struct {
 	nes *NES
 
+	// what the header says, for mappers and the frontend to set
+	// themselves up from
+	Header
+
+	// FileHeader - what the header in the file says, before the game
+	// database corrected it
+	FileHeader Header
+
+	// the hashes of PRG rom followed by CHR rom, that the game database
+	// knows dumps by
+	CRC32 uint32
+	SHA1  [sha1.Size]byte
+
+	// the game's title and board from the game database or the UNIF
+	// image, empty when neither has them
+	Title string
+	Board string
+
+	game *dbGame
+
+	// Patches - the patch files applied to the rom, in order
+	Patches []string
+
 	// Constant for ines headers
 	nesLabel [4]byte
 
@@ -18,6 +67,10 @@ type Cartridge struct {
 	// Size of the CHR rom in 8KB chunks
 	chrRomBlocks byte
 
+	// the header as loaded. NES 2.0 sizes can't be rebuilt from the
+	// block counts above.
+	nes20Header [16]byte
+
 	// Flags 6
 	flags6 byte
 
@@ -42,8 +95,22 @@ type Cartridge struct {
 	// actual chrRom data
 	chrRom []byte
 
+	// PRG and CHR rom as long as the file has them, before they're padded
+	// out to whole banks
+	prgSize, chrSize int
+
+	// trainer from before PRG rom, if flags 6 has one
+	trainer []byte
+
+	// cartridge ram at $6000-$7FFF, kept in a .sav file when there's a
+	// battery. Smaller ram is mirrored through the window.
+	prgRam []byte
+
+	// pattern table ram at PPU $0000-$1FFF, when there's no CHR rom
+	chrRam []byte
+
 	//Mapper type
-	mapperType byte
+	mapperType uint16
 
 	//Mirroring style
 	mirrorStyle byte
@@ -61,80 +128,291 @@ const (
 	mmc1 = iota
 )
 
-func (c *Cartridge) setMapperType() {
-	mapperLow := (c.flags6 & 0xF0) >> 4
-	mapperHigh := c.flags7 & 0xF0
+// UnknownMapper - the mapper of a UNIF board with no iNES mapper number
+// known for it, past the 12 bits NES 2.0 has
+const UnknownMapper = 0xFFFF
+
+// SupportedMapper - whether LoadCartridge has a CartridgeIO for mapper
+func SupportedMapper(mapper uint16) bool {
+	switch mapper {
+	case mapper0, mmc1:
+		return true
+	}
+
+	return false
+}
+
+// HeaderBytes - the 16 byte iNES or NES 2.0 header the cartridge was
+// loaded from
+func (c *Cartridge) HeaderBytes() [16]byte {
+	if c.NES20 {
+		return c.nes20Header
+	}
 
-	c.mapperType = mapperHigh | mapperLow
+	var h [16]byte
+
+	copy(h[0:4], c.nesLabel[:])
+	h[4] = c.prgRomBlocks
+	h[5] = c.chrRomBlocks
+	h[6] = c.flags6
+	h[7] = c.flags7
+	h[8] = c.prgRamBlocks
+	h[9] = c.flags9
+	h[10] = c.flags10
+	copy(h[11:16], c.zeroBuffer[:])
+
+	return h
 }
 
-func CreateCartridge(filename string) (Cartridge, error) {
-	// Read nes rom into memory
-	rom, err := ioutil.ReadFile(filename)
+// CreateCartridge - loads an iNES, NES 2.0 or UNIF rom file, which can be
+// zipped or gzipped, applying IPS, UPS or BPS patches to it in order
+func CreateCartridge(filename string, patches ...string) (Cartridge, error) {
+	return OpenCartridge(filename, LoadOptions{Patches: patches})
+}
 
-	romNoHeader := rom[16:len(rom)]
+// LoadOptions - how OpenCartridge loads a rom
+type LoadOptions struct {
+	// Entry - the file to load from a zip archive, by its name or path in
+	// it. The first rom in it if empty.
+	Entry string
+
+	// Patches - IPS, UPS or BPS files to apply, in order
+	Patches []string
+
+	// GameDB - known dumps to correct the header from. The header is
+	// used as it is if nil.
+	GameDB *GameDB
+}
+
+// OpenCartridge - loads a rom file, unpacking it first if it's zipped or
+// gzipped
+func OpenCartridge(filename string, options LoadOptions) (Cartridge, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return Cartridge{}, err
+	}
+
+	rom, err := unpackROM(data, options.Entry)
+	if err != nil {
+		return Cartridge{}, fmt.Errorf("%s: %w", filename, err)
+	}
+
+	for _, patchFile := range options.Patches {
+		patch, err := ioutil.ReadFile(patchFile)
+		if err != nil {
+			return Cartridge{}, err
+		}
+		if rom, err = ApplyPatch(rom, patch); err != nil {
+			return Cartridge{}, fmt.Errorf("%s: %w", patchFile, err)
+		}
+	}
+
+	c, err := loadROM(rom)
+	if err != nil {
+		return c, fmt.Errorf("%s: %w", filename, err)
+	}
+	c.Patches = options.Patches
+	c.correctHeader(options.GameDB)
+
+	return c, nil
+}
+
+// CreateCartridgeFromReader - loads a rom read from r, which can be
+// zipped or gzipped
+func CreateCartridgeFromReader(r io.Reader) (Cartridge, error) {
+	data, err := readLimited(r)
+	if err != nil {
+		return Cartridge{}, err
+	}
+
+	return CreateCartridgeFromBytes(data)
+}
+
+// CreateCartridgeFromBytes - loads a rom image held in memory, which can
+// be zipped or gzipped
+func CreateCartridgeFromBytes(data []byte) (Cartridge, error) {
+	rom, err := unpackROM(data, "")
+	if err != nil {
+		return Cartridge{}, err
+	}
 
+	return loadROM(rom)
+}
+
+// InGameDB - whether the game database it was loaded with knows the dump
+func (c *Cartridge) InGameDB() bool {
+	return c.game != nil
+}
+
+// loadROM - loads a UNIF image, going by its magic number, or otherwise
+// an iNES one
+func loadROM(rom []byte) (Cartridge, error) {
+	if bytes.HasPrefix(rom, []byte("UNIF")) {
+		return loadUNIF(rom)
+	}
+
+	return loadINES(rom)
+}
+
+// loadINES - splits an iNES image into its header, trainer, PRG and CHR rom,
+// checking the header's sizes against the image
+func loadINES(rom []byte) (Cartridge, error) {
 	var c Cartridge
 
-	// If file read was unsuccessful, log it
+	if len(rom) < 16 {
+		return c, fmt.Errorf("%w: %d bytes is too short for an iNES header", ErrTruncatedROM, len(rom))
+	}
+
+	header, err := parseHeader(rom[:16], len(rom))
 	if err != nil {
-		log.Fatal("Something went wrong during file read. Error: " + err.Error())
-	} else {
-		copy(c.nesLabel[:], rom[0:4])
-
-		// Make sure this is an NES rom
-		if string(c.nesLabel[:]) == "NES" + string(0x1a) {
-			c.prgRomBlocks = rom[4]
-			c.chrRomBlocks = rom[5]
-			c.flags6 = rom[6]
-			c.flags7 = rom[7]
-			c.prgRamBlocks = rom[8]
-			c.flags9 = rom[9]
-			c.flags10 = rom[10]
-			copy(c.zeroBuffer[:], rom[11:15])
-
-			c.setMapperType()
-			log.Printf("Mapper type %d", c.mapperType)
-
-			// load chr and prg rom data
-			log.Println(c.prgRomBlocks, c.chrRomBlocks)
-
-			prgEndAddr := 0x4000 * uint(c.prgRomBlocks)
-
-			if c.prgRomBlocks > 0 {
-				c.prgRom = romNoHeader[0:prgEndAddr]
-			}
-
-			if c.chrRomBlocks > 0 {
-				c.chrRom = romNoHeader[prgEndAddr:prgEndAddr + (0x2000 * uint(c.chrRomBlocks))]
-			}
-                        
-		} else {
-			log.Println("This is not a valid NES rom.")
-			return c, errors.New("This is not a valid NES rom.")
+		return c, err
+	}
+	c.Header = header
+	c.FileHeader = header
+	c.mapperType = header.Mapper
+
+	copy(c.nesLabel[:], rom[0:4])
+	copy(c.nes20Header[:], rom[0:16])
+	c.prgRomBlocks = rom[4]
+	c.chrRomBlocks = rom[5]
+	c.flags6 = rom[6]
+	c.flags7 = rom[7]
+	c.prgRamBlocks = rom[8]
+	c.flags9 = rom[9]
+	c.flags10 = rom[10]
+	copy(c.zeroBuffer[:], rom[11:16])
+
+	if header.PRGROMSize == 0 {
+		return c, fmt.Errorf("%w: no PRG rom", ErrBadHeader)
+	}
+
+	data := rom[16:]
+
+	// the trainer goes before PRG rom, and is loaded at $7000
+	if header.Trainer {
+		if len(data) < trainerSize {
+			return c, fmt.Errorf("%w: %d bytes is too short for the trainer", ErrTruncatedROM, len(rom))
 		}
+		c.trainer = data[:trainerSize]
+		data = data[trainerSize:]
+	}
+
+	prgSize, chrSize := header.PRGROMSize, header.CHRROMSize
+	if len(data) < prgSize+chrSize {
+		return c, fmt.Errorf("%w: the header gives %s of PRG rom and %s of CHR rom, but there are only %d bytes after it",
+			ErrTruncatedROM, formatSize(prgSize), formatSize(chrSize), len(data))
+	}
+
+	if err := c.setROM(data[:prgSize], data[prgSize:prgSize+chrSize]); err != nil {
+		return c, err
 	}
 
 	return c, nil
 }
 
-func (nes *NES) LoadCartridge(cartridge Cartridge) {
-	nes.CART = &cartridge
-	nes.CART.nes = nes
+// setROM - splits prg and chr rom into banks and hashes them, for looking
+// the dump up in a game database
+func (c *Cartridge) setROM(prg, chr []byte) error {
+	// the mappers count in whole banks
+	prgBanks := (len(prg) + 0x3FFF) / 0x4000
+	chrBanks := (len(chr) + 0x1FFF) / 0x2000
+	if prgBanks > 0xFF || chrBanks > 0xFF {
+		return fmt.Errorf("%w: %s of PRG rom and %s of CHR rom is more than can be banked",
+			ErrUnsupportedMapper, formatSize(len(prg)), formatSize(len(chr)))
+	}
+	c.prgRomBlocks, c.chrRomBlocks = byte(prgBanks), byte(chrBanks)
+
+	c.CRC32, c.SHA1 = romHashes(prg, chr)
+
+	// NES 2.0 sizes needn't be whole banks, so they're padded out
+	c.prgSize, c.chrSize = len(prg), len(chr)
+	c.prgRom = padROM(prg, prgBanks*0x4000)
+	if len(chr) > 0 {
+		c.chrRom = padROM(chr, chrBanks*0x2000)
+	}
+
+	return nil
+}
+
+// padROM - rom padded with zeros to size
+func padROM(rom []byte, size int) []byte {
+	if len(rom) == size {
+		return rom
+	}
+
+	padded := make([]byte, size)
+	copy(padded, rom)
+
+	return padded
+}
+
+// LoadCartridge - plugs cartridge into the NES, mapping it onto the bus
+func (nes *NES) LoadCartridge(cartridge Cartridge) error {
+	var cartIO CartridgeIO
 
 	switch cartridge.mapperType {
 	case mapper0:
 		mapper := &Mapper0CIO{}
 		mapper.initCartIO(&cartridge)
-		nes.CARTIO = mapper
+		cartIO = mapper
 		//copy(nes.PPU.Memory[0:0x2000], cartridge.chrRom[0:0x2000])
 	case mmc1:
 		mapper := &Mapper1CIO{}
 		mapper.initCartIO(&cartridge)
-		nes.CARTIO = mapper
+		cartIO = mapper
 		//copy(nes.PPU.Memory[0:0x2000], cartridge.chrRom[0:0x2000])
 
+	case UnknownMapper:
+		return fmt.Errorf("%w: UNIF board %s", ErrUnsupportedMapper, cartridge.Board)
 	default:
-		log.Fatalf("Unsupported mapper %d", cartridge.mapperType)
+		return fmt.Errorf("%w %d", ErrUnsupportedMapper, cartridge.mapperType)
+	}
+
+	nes.CART = &cartridge
+	nes.CART.nes = nes
+	nes.CARTIO = cartIO
+
+	if nes.CART.prgRam == nil {
+		nes.CART.prgRam = make([]byte, nes.CART.prgRAMSize())
+	}
+	// trainers always get 8KB of ram
+	if nes.CART.trainer != nil {
+		copy(nes.CART.prgRam[trainerAddr-0x6000:], nes.CART.trainer)
 	}
+
+	if nes.CART.chrRam == nil && len(nes.CART.chrRom) == 0 {
+		nes.CART.chrRam = make([]byte, nes.CART.chrRAMSize())
+	}
+
+	nes.CPU.Bus.Register(0x6000, 0xFFFF, nes.CARTIO)
+
+	return nil
+}
+
+// chrRAMSize - how much CHR ram the header asks for, 8KB if it doesn't say
+func (c *Cartridge) chrRAMSize() int {
+	if size := c.CHRRAMSize + c.CHRNVRAMSize; size > 0 {
+		return size
+	}
+
+	return 0x2000
+}
+
+// readCHRRAM - the CHR ram at PPU address addr, mirrored when it's
+// smaller than the pattern tables
+func (c *Cartridge) readCHRRAM(addr uint16) uint8 {
+	if len(c.chrRam) == 0 {
+		return 0
+	}
+
+	return c.chrRam[int(addr)%len(c.chrRam)]
+}
+
+// writeCHRRAM - CHR rom ignores writes
+func (c *Cartridge) writeCHRRAM(addr uint16, value uint8) {
+	if len(c.chrRam) == 0 {
+		return
+	}
+
+	c.chrRam[int(addr)%len(c.chrRam)] = value
 }
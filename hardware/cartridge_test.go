@@ -0,0 +1,100 @@
+package hardware
+
+import (
+	"errors"
+	"nes-emu/assembler"
+	"testing"
+)
+
+func TestLoadINESErrors(t *testing.T) {
+	image := assembler.INES(nil, nil, mapper0)
+
+	withTrainer := append([]byte(nil), image...)
+	withTrainer[6] |= 0x04
+
+	noPRG := append([]byte(nil), image...)
+	noPRG[4] = 0
+
+	tests := []struct {
+		name string
+		rom  []byte
+		err  error
+	}{
+		{"empty", nil, ErrTruncatedROM},
+		{"short header", image[:10], ErrTruncatedROM},
+		{"not iNES", append([]byte("NES!"), image[4:]...), ErrBadHeader},
+		{"no PRG rom", noPRG, ErrBadHeader},
+		{"short PRG rom", image[:0x3000], ErrTruncatedROM},
+		{"short CHR rom", image[:len(image)-1], ErrTruncatedROM},
+		// the trainer pushes the rest 512 bytes past the end
+		{"trainer", withTrainer, ErrTruncatedROM},
+		{"short trainer", withTrainer[:0x100], ErrTruncatedROM},
+	}
+
+	for _, test := range tests {
+		if _, err := loadINES(test.rom); !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+
+	if _, err := loadINES(image); err != nil {
+		t.Errorf("Expected the image to load, got %v", err)
+	}
+}
+
+func TestUnsupportedMapper(t *testing.T) {
+	cart, err := loadINES(assembler.INES(nil, nil, 4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nes := NewNES()
+	if err := nes.LoadCartridge(cart); !errors.Is(err, ErrUnsupportedMapper) || err.Error() != "unsupported mapper 4" {
+		t.Errorf("Expected mapper 4 to be unsupported, got %v", err)
+	}
+	if nes.CART != nil {
+		t.Errorf("Expected the cartridge to be left out")
+	}
+}
+
+func TestTrainer(t *testing.T) {
+	image := assembler.INES(nil, nil, mapper0)
+
+	trainer := make([]byte, trainerSize)
+	trainer[0], trainer[trainerSize-1] = 0x12, 0x34
+	rom := append(append(append([]byte(nil), image[:16]...), trainer...), image[16:]...)
+	rom[6] |= 0x04
+	// PRG rom starts after the trainer
+	rom[16+trainerSize] = 0x56
+
+	cart, err := loadINES(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nes := NewNES()
+	if err := nes.LoadCartridge(cart); err != nil {
+		t.Fatal(err)
+	}
+
+	bus := nes.CPU.Bus
+	if bus.Peek8(0x7000) != 0x12 || bus.Peek8(0x71FF) != 0x34 || bus.Peek8(0x8000) != 0x56 {
+		t.Errorf("Expected the trainer at $7000 and PRG rom after it, got $%02X $%02X $%02X",
+			bus.Peek8(0x7000), bus.Peek8(0x71FF), bus.Peek8(0x8000))
+	}
+}
+
+func TestRunFrameHalted(t *testing.T) {
+	nes, _ := assembleNES(t, `
+		.bank 0
+		.org $C000
+	reset:
+		nop
+		.byte $02
+
+		.org $FFFA
+		.word reset, reset, reset`)
+
+	if err := nes.RunFrame(); !errors.Is(err, ErrCPUHalted) {
+		t.Errorf("Expected the KIL to halt the cpu, got %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package hardware
+
+import (
+	"fmt"
+	"io"
+	"nes-emu/cpu6502"
+	"os"
+)
+
+// what a byte of PRG rom was used for, as FCEUX's code/data log has it.
+// Bits 2 and 3 hold which 8KB of $8000-$FFFF it was last used at.
+const (
+	CDLCode         = 0x01
+	CDLData         = 0x02
+	CDLIndirectCode = 0x10
+	CDLIndirectData = 0x20
+
+	// DMC sample data. The APU doesn't fetch samples yet, so it's only
+	// ever there from logs made by other emulators.
+	CDLPCM = 0x40
+
+	cdlBankShift = 2
+	cdlBankMask  = 0x0C
+)
+
+// what a byte of CHR rom was used for. The PPU's background and sprite
+// fetches are both written out as rendered, FCEUX has no bits for them.
+const (
+	CDLRendered = 0x01
+	CDLRead     = 0x02
+
+	CDLBackground = 0x04
+	CDLSprite     = 0x08
+
+	cdlCHRFileMask = CDLRendered | CDLRead
+)
+
+// CodeDataLogger - records what every byte of PRG and CHR rom has been
+// used for, for FCEUX style .cdl files and coverage reports. Created
+// with NewCodeDataLogger, which attaches it to a NES.
+type CodeDataLogger struct {
+	PRG []uint8
+	CHR []uint8
+
+	nes *NES
+
+	// the instruction being run, and the reads it's made from PRG rom
+	stepping bool
+	instr    cpu6502.Decoded
+	reads    []uint16
+}
+
+// NewCodeDataLogger - attaches a logger to nes, which must have its
+// cartridge loaded
+func NewCodeDataLogger(nes *NES) *CodeDataLogger {
+	cdl := &CodeDataLogger{
+		PRG: make([]uint8, len(nes.CART.prgRom)),
+		CHR: make([]uint8, len(nes.CART.chrRom)),
+		nes: nes,
+	}
+
+	nes.CPU.Bus.RegisterRead(0x8000, 0xFFFF, &cdlReader{cdl, nes.CARTIO})
+	nes.CDL = cdl
+
+	return cdl
+}
+
+// cdlReader - sits between the cpu and PRG rom, noting the reads made
+type cdlReader struct {
+	cdl  *CodeDataLogger
+	cart CartridgeIO
+}
+
+func (r *cdlReader) read8(addr uint16) uint8 {
+	// dummy reads of indexed addresses before the carry is fixed aren't
+	// the game using the byte
+	if r.cdl.stepping && !r.cdl.nes.CPU.DummyAccess() {
+		r.cdl.reads = append(r.cdl.reads, addr)
+	}
+
+	return r.cart.read8(addr)
+}
+
+func (r *cdlReader) peek8(addr uint16) uint8 {
+	return r.cart.read8(addr)
+}
+
+func (r *cdlReader) write8(addr uint16, value uint8) {
+	r.cart.write8(addr, value)
+}
+
+// before - notes the instruction about to run
+func (cdl *CodeDataLogger) before(nes *NES) {
+	cdl.stepping = true
+	cdl.reads = cdl.reads[:0]
+
+	cdl.instr = cpu6502.Decoded{}
+	if !nes.CPU.InterruptPending() && !nes.CPU.Halted() {
+		cdl.instr = cpu6502.Decode(nes.CPU.PC, nes.CPU.Bus.Peek8)
+	}
+}
+
+// after - marks the instruction's bytes as code and what else it read
+// from PRG rom as data
+func (cdl *CodeDataLogger) after(nes *NES) {
+	cdl.stepping = false
+	instr := cdl.instr
+
+	for i := uint16(0); i < uint16(instr.Size); i++ {
+		cdl.markPRG(instr.Addr+i, CDLCode)
+	}
+
+	flags := uint8(CDLData)
+	if instr.Addressing == cpu6502.IndirectX || instr.Addressing == cpu6502.IndirectY {
+		flags |= CDLIndirectData
+	}
+	for _, addr := range cdl.reads {
+		// the instruction's own bytes are fetched, not read as data
+		if instr.Size > 0 && addr-instr.Addr < uint16(instr.Size) {
+			continue
+		}
+		cdl.markPRG(addr, flags)
+	}
+
+	if instr.Flow == cpu6502.FlowJumpIndirect {
+		cdl.markPRG(nes.CPU.PC, CDLIndirectCode)
+	}
+}
+
+// markPRG - sets flags on the PRG rom byte at cpu address addr, along
+// with the 8KB window it was seen in
+func (cdl *CodeDataLogger) markPRG(addr uint16, flags uint8) {
+	offset := cdl.nes.CARTIO.prgOffset(addr)
+	if offset < 0 || offset >= len(cdl.PRG) {
+		return
+	}
+
+	cdl.PRG[offset] = cdl.PRG[offset]&^cdlBankMask | flags | uint8(addr>>13&3)<<cdlBankShift
+}
+
+// markCHR - sets flags on size bytes of CHR rom from PPU address addr
+func (cdl *CodeDataLogger) markCHR(addr uint16, size int, flags uint8) {
+	for i := 0; i < size; i++ {
+		offset := cdl.nes.CARTIO.chrOffset(addr + uint16(i))
+		if offset >= 0 && offset < len(cdl.CHR) {
+			cdl.CHR[offset] |= flags
+		}
+	}
+}
+
+// Load - merges in a code/data log written before, so coverage builds up
+// over several sessions
+func (cdl *CodeDataLogger) Load(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(data) != len(cdl.PRG)+len(cdl.CHR) {
+		return fmt.Errorf("code/data log is %d bytes, expected %d for this rom", len(data), len(cdl.PRG)+len(cdl.CHR))
+	}
+
+	for i, flags := range data[:len(cdl.PRG)] {
+		if cdl.PRG[i] == 0 {
+			cdl.PRG[i] = flags
+		} else {
+			cdl.PRG[i] |= flags &^ cdlBankMask
+		}
+	}
+	for i, flags := range data[len(cdl.PRG):] {
+		cdl.CHR[i] |= flags
+	}
+
+	return nil
+}
+
+// LoadFile - merges in filename if it exists
+func (cdl *CodeDataLogger) LoadFile(filename string) error {
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := cdl.Load(file); err != nil {
+		return fmt.Errorf("%s: %v", filename, err)
+	}
+
+	return nil
+}
+
+// Write - writes the log in FCEUX's .cdl format, PRG rom then CHR rom
+func (cdl *CodeDataLogger) Write(w io.Writer) error {
+	chr := make([]uint8, len(cdl.CHR))
+	for i, flags := range cdl.CHR {
+		chr[i] = flags & cdlCHRFileMask
+	}
+
+	if _, err := w.Write(cdl.PRG); err != nil {
+		return err
+	}
+	_, err := w.Write(chr)
+
+	return err
+}
@@ -0,0 +1,182 @@
+package hardware
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+// cdlTestSource - reads a table directly and through a pointer, reads
+// CHR through PPUDATA, turns the background on and jumps through a
+// vector. The branch to never isn't taken. PPUDATA reads give the byte
+// before the address, so it takes two to get to $0100.
+const cdlTestSource = `
+	.bank 0
+	.org $C000
+reset:
+	ldx #$FF
+	txs
+	ldx #1
+	lda table,x
+	lda #<table
+	sta $00
+	lda #>table
+	sta $01
+	ldy #2
+	lda ($00),y
+	lda #$01
+	sta $2006
+	lda #$00
+	sta $2006
+	lda $2007
+	lda $2007
+	lda #$08
+	sta $2001
+	lda #1
+	beq never
+	jmp (vector)
+never:
+	inc $0300
+	rts
+target:
+	jmp target
+table:
+	.byte 1, 2, 3, 4
+vector:
+	.word target
+
+	.org $FFFA
+	.word reset, reset, reset`
+
+func newTestCDL(t *testing.T) (*NES, *CodeDataLogger, map[string]int) {
+	nes, program := assembleNES(t, cdlTestSource)
+	cdl := NewCodeDataLogger(nes)
+
+	for frame := 0; frame < 2; frame++ {
+		for !nes.PPU.FrameReady {
+			nes.Step()
+		}
+		nes.PPU.FrameReady = false
+	}
+
+	offsets := map[string]int{}
+	for name, addr := range program.Symbols {
+		offsets[name] = int(addr) - 0xC000
+	}
+
+	return nes, cdl, offsets
+}
+
+func TestCodeDataLogger(t *testing.T) {
+	_, cdl, offsets := newTestCDL(t)
+
+	// code at $C000-$DFFF has 2 in the bank bits
+	const c000 = 2 << cdlBankShift
+	tests := []struct {
+		name   string
+		offset int
+		flags  uint8
+	}{
+		{"reset", 0, CDLCode | c000},
+		{"reset", 1, CDLCode | c000},
+		{"table", 0, 0},
+		{"table", 1, CDLData | c000},
+		{"table", 2, CDLData | CDLIndirectData | c000},
+		{"table", 3, 0},
+		{"vector", 0, CDLData | c000},
+		{"vector", 1, CDLData | c000},
+		{"target", 0, CDLCode | CDLIndirectCode | c000},
+		{"never", 0, 0},
+	}
+	for _, test := range tests {
+		if flags := cdl.PRG[offsets[test.name]+test.offset]; flags != test.flags {
+			t.Errorf("%s+%d: expected flags $%02X, got $%02X", test.name, test.offset, test.flags, flags)
+		}
+	}
+
+	if cdl.CHR[0x100] != CDLRead {
+		t.Errorf("Expected CHR $0100 to be read through PPUDATA, got $%02X", cdl.CHR[0x100])
+	}
+	if cdl.CHR[0] != CDLRendered|CDLBackground || cdl.CHR[0x10] != 0 {
+		t.Errorf("Expected only tile 0 to be drawn as background, got $%02X $%02X", cdl.CHR[0], cdl.CHR[0x10])
+	}
+
+	out := &bytes.Buffer{}
+	if err := cdl.Write(out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != len(cdl.PRG)+len(cdl.CHR) || out.Bytes()[len(cdl.PRG)] != CDLRendered {
+		t.Errorf("Expected PRG then CHR flags with only FCEUX's CHR bits")
+	}
+
+	// a log from another session adds to this one
+	nes, _ := assembleNES(t, cdlTestSource)
+	merged := NewCodeDataLogger(nes)
+	merged.PRG[offsets["never"]] = CDLCode
+	if err := merged.Load(bytes.NewReader(out.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if merged.PRG[offsets["never"]] != CDLCode || merged.PRG[offsets["table"]+2] != cdl.PRG[offsets["table"]+2] {
+		t.Errorf("Expected the logs to be merged")
+	}
+	if err := merged.Load(bytes.NewReader(out.Bytes()[1:])); err == nil {
+		t.Errorf("Expected a log of the wrong size to be refused")
+	}
+}
+
+func TestWriteCoverage(t *testing.T) {
+	nes, cdl, _ := newTestCDL(t)
+
+	out := &bytes.Buffer{}
+	if err := WriteCoverage(nes.CART, cdl, "/roms/test.nes", out, DisasmOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	report := out.String()
+
+	for _, want := range []string{
+		"<title>Coverage of test.nes</title>",
+		`<span class="executed">    lda ($00),y`,
+		`<span class="never">    inc $0300`,
+		`<span class="read">    .byte $01,$02,$03,$04`,
+		"2 instructions found by disassembly never ran",
+		`<div class="tile background" title="$00000 tile $00: background">`,
+		`<div class="tile read" title="$00100 tile $10: read">`,
+	} {
+		if !strings.Contains(report, want) {
+			t.Errorf("Expected %q in the report", want)
+		}
+	}
+}
+
+func TestCodeDataLoggerSkipsDummyReads(t *testing.T) {
+	// the page crossing read of $C208 reads $C108 before the carry is
+	// fixed
+	nes, _ := assembleNES(t, `
+	.bank 0
+	.org $C000
+reset:
+	ldx #$10
+	lda $C1F8,x
+forever:
+	jmp forever
+
+	.org $C100
+	.byte 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0
+	.org $C200
+	.byte 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0
+
+	.org $FFFA
+	.word reset, reset, reset`)
+	cdl := NewCodeDataLogger(nes)
+
+	for i := 0; i < 3; i++ {
+		nes.Step()
+	}
+
+	if cdl.PRG[0x208]&CDLData == 0 {
+		t.Errorf("Expected $C208 to be logged as data, got $%02X", cdl.PRG[0x208])
+	}
+	if cdl.PRG[0x108] != 0 {
+		t.Errorf("Expected the dummy read of $C108 not to be logged, got $%02X", cdl.PRG[0x108])
+	}
+}
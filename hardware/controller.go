@@ -4,117 +4,192 @@ import (
 	"github.com/faiface/pixel/pixelgl"
 )
 
+// Controller - a standard joypad. Buttons holds A, B, Select, Start,
+// Up, Down, Left, Right from bit 7 down to bit 0.
+type Controller struct {
+	Buttons uint8
 
-func (cpu *Cpu) joy1PressButtonA() {
-	cpu.Controller |= 1 << 7
+	// next button to shift out
+	idx uint8
+
+	// while strobe is high the shift register keeps reloading
+	strobe bool
+}
+
+func (joy *Controller) setStrobe(value uint8) {
+	joy.strobe = value&1 == 1
+	if joy.strobe {
+		joy.idx = 0
+	}
+}
+
+// readBit - shifts out the next button, reading 1 once all 8 are out
+func (joy *Controller) readBit() uint8 {
+	val := joy.peekBit()
+
+	if !joy.strobe && joy.idx <= 7 {
+		joy.idx++
+	}
+
+	return val
+}
+
+// peekBit - the bit the next read returns, without shifting
+func (joy *Controller) peekBit() uint8 {
+	if joy.strobe {
+		return (joy.Buttons >> 7) & 1
+	}
+
+	if joy.idx > 7 {
+		return 1
+	}
+
+	return (joy.Buttons >> (7 - joy.idx)) & 1
+}
+
+// controllerPorts - $4016 and $4017. Both pads share the strobe
+// written to $4016, and the upper bits of a read are open bus.
+type controllerPorts struct {
+	bus  *Bus
+	joy1 *Controller
+	joy2 *Controller
+}
+
+func (ports *controllerPorts) read8(addr uint16) uint8 {
+	openBus := ports.bus.OpenBus() & 0xE0
+
+	if addr == 0x4016 {
+		return openBus | ports.joy1.readBit()
+	}
+
+	return openBus | ports.joy2.readBit()
+}
+
+func (ports *controllerPorts) peek8(addr uint16) uint8 {
+	openBus := ports.bus.OpenBus() & 0xE0
+
+	if addr == 0x4016 {
+		return openBus | ports.joy1.peekBit()
+	}
+
+	return openBus | ports.joy2.peekBit()
+}
+
+func (ports *controllerPorts) write8(addr uint16, value uint8) {
+	ports.joy1.setStrobe(value)
+	ports.joy2.setStrobe(value)
+}
+
+func (joy *Controller) pressButtonA() {
+	joy.Buttons |= 1 << 7
 }
 
-func (cpu *Cpu) joy1ReleaseButtonA() {
-	cpu.Controller &= ^uint8(1 << 7)
+func (joy *Controller) releaseButtonA() {
+	joy.Buttons &= ^uint8(1 << 7)
 }
 
-func (cpu *Cpu) joy1PressButtonB() {
-	cpu.Controller |= 1 << 6
+func (joy *Controller) pressButtonB() {
+	joy.Buttons |= 1 << 6
 }
 
-func (cpu *Cpu) joy1ReleaseButtonB() {
-	cpu.Controller &= ^uint8(1 << 6)
+func (joy *Controller) releaseButtonB() {
+	joy.Buttons &= ^uint8(1 << 6)
 }
 
-func (cpu *Cpu) joy1PressButtonSelect() {
-	cpu.Controller |= 1 << 5
+func (joy *Controller) pressButtonSelect() {
+	joy.Buttons |= 1 << 5
 }
 
-func (cpu *Cpu) joy1ReleaseButtonSelect() {
-	cpu.Controller &= ^uint8(1 << 5)
+func (joy *Controller) releaseButtonSelect() {
+	joy.Buttons &= ^uint8(1 << 5)
 }
 
-func (cpu *Cpu) joy1PressButtonStart() {
-	cpu.Controller |= 1 << 4
+func (joy *Controller) pressButtonStart() {
+	joy.Buttons |= 1 << 4
 }
 
-func (cpu *Cpu) joy1ReleaseButtonStart() {
-	cpu.Controller &= ^uint8(1 << 4)
+func (joy *Controller) releaseButtonStart() {
+	joy.Buttons &= ^uint8(1 << 4)
 }
 
-func (cpu *Cpu) joy1PressButtonUp() {
-	cpu.Controller |= 1 << 3
+func (joy *Controller) pressButtonUp() {
+	joy.Buttons |= 1 << 3
 }
 
-func (cpu *Cpu) joy1ReleaseButtonUp() {
-	cpu.Controller &= ^uint8(1 << 3)
+func (joy *Controller) releaseButtonUp() {
+	joy.Buttons &= ^uint8(1 << 3)
 }
 
-func (cpu *Cpu) joy1PressButtonDown() {
-	cpu.Controller |= 1 << 2
+func (joy *Controller) pressButtonDown() {
+	joy.Buttons |= 1 << 2
 }
 
-func (cpu *Cpu) joy1ReleaseButtonDown() {
-	cpu.Controller &= ^uint8(1 << 2)
+func (joy *Controller) releaseButtonDown() {
+	joy.Buttons &= ^uint8(1 << 2)
 }
 
-func (cpu *Cpu) joy1PressButtonLeft() {
-	cpu.Controller |= 1 << 1
+func (joy *Controller) pressButtonLeft() {
+	joy.Buttons |= 1 << 1
 }
 
-func (cpu *Cpu) joy1ReleaseButtonLeft() {
-	cpu.Controller &= ^uint8(1 << 1)
+func (joy *Controller) releaseButtonLeft() {
+	joy.Buttons &= ^uint8(1 << 1)
 }
 
-func (cpu *Cpu) joy1PressButtonRight() {
-	cpu.Controller |= 1 << 0
+func (joy *Controller) pressButtonRight() {
+	joy.Buttons |= 1 << 0
 }
 
-func (cpu *Cpu) joy1ReleaseButtonRight() {
-	cpu.Controller &= ^uint8(1 << 0)
+func (joy *Controller) releaseButtonRight() {
+	joy.Buttons &= ^uint8(1 << 0)
 }
 
-func (cpu *Cpu) CheckControllerPresses(win *pixelgl.Window) {
+func (joy *Controller) CheckControllerPresses(win *pixelgl.Window) {
 	if win.Pressed(pixelgl.KeyZ) {
-		cpu.joy1PressButtonA()
+		joy.pressButtonA()
 	} else {
-		cpu.joy1ReleaseButtonA()
+		joy.releaseButtonA()
 	}
 
 	if win.Pressed(pixelgl.KeyX) {
-		cpu.joy1PressButtonB()
+		joy.pressButtonB()
 	} else {
-		cpu.joy1ReleaseButtonB()
+		joy.releaseButtonB()
 	}
 
 	if win.Pressed(pixelgl.KeyRightShift) {
-		cpu.joy1PressButtonSelect()
+		joy.pressButtonSelect()
 	} else {
-		cpu.joy1ReleaseButtonSelect()
+		joy.releaseButtonSelect()
 	}
 
 	if win.Pressed(pixelgl.KeyS) {
-		cpu.joy1PressButtonStart()
+		joy.pressButtonStart()
 	} else {
-		cpu.joy1ReleaseButtonStart()
+		joy.releaseButtonStart()
 	}
 
 	if win.Pressed(pixelgl.KeyUp) {
-		cpu.joy1PressButtonUp()
+		joy.pressButtonUp()
 	} else {
-		cpu.joy1ReleaseButtonUp()
+		joy.releaseButtonUp()
 	}
 
 	if win.Pressed(pixelgl.KeyDown) {
-		cpu.joy1PressButtonDown()
+		joy.pressButtonDown()
 	} else {
-		cpu.joy1ReleaseButtonDown()
+		joy.releaseButtonDown()
 	}
 
 	if win.Pressed(pixelgl.KeyLeft) {
-		cpu.joy1PressButtonLeft()
+		joy.pressButtonLeft()
 	} else {
-		cpu.joy1ReleaseButtonLeft()
+		joy.releaseButtonLeft()
 	}
 
 	if win.Pressed(pixelgl.KeyRight) {
-		cpu.joy1PressButtonRight()
+		joy.pressButtonRight()
 	} else {
-		cpu.joy1ReleaseButtonRight()
+		joy.releaseButtonRight()
 	}
 }
\ No newline at end of file
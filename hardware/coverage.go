@@ -0,0 +1,262 @@
+package hardware
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"nes-emu/cpu6502"
+	"path/filepath"
+	"strings"
+)
+
+// how much of a line of the report was used
+const (
+	coverageExecuted = "executed"
+	coveragePartial  = "partial"
+	coverageNever    = "never"
+	coverageRead     = "read"
+	coverageUnused   = "unused"
+)
+
+type coverageLine struct {
+	Class string
+	Label string
+	Text  string
+}
+
+type coverageBank struct {
+	Index    int
+	Origin   uint16
+	Offset   int
+	Size     int
+	Code     int
+	Data     int
+	Unused   int
+	NeverRun int
+	Lines    []coverageLine
+}
+
+// coverageTile - one 16 byte tile of CHR rom
+type coverageTile struct {
+	Class string
+	Title string
+}
+
+type coveragePage struct {
+	Offset   int
+	Rendered int
+	Tiles    []coverageTile
+}
+
+type coverageReport struct {
+	Title string
+	Banks []coverageBank
+	Pages []coveragePage
+
+	Code, Data, Unused, Size int
+	NeverRun                 int
+}
+
+func (b coverageBank) Percent() string {
+	return percent(b.Code+b.Data, b.Size)
+}
+
+func (r coverageReport) Percent() string {
+	return percent(r.Code+r.Data, r.Size)
+}
+
+func (p coveragePage) Percent() string {
+	return percent(p.Rendered, len(p.Tiles))
+}
+
+func percent(n, of int) string {
+	if of == 0 {
+		return "-"
+	}
+
+	return fmt.Sprintf("%.1f%%", 100*float64(n)/float64(of))
+}
+
+// cdlExecuted - where instructions start in the runs of code a log has,
+// with the cpu address they ran at, for the disassembler to start from
+func cdlExecuted(prg []byte, flags []uint8) map[int]uint16 {
+	executed := make(map[int]uint16)
+
+	for offset := 0; offset < len(prg); {
+		if flags[offset]&CDLCode == 0 {
+			offset++
+			continue
+		}
+
+		addr := 0x8000 + uint16(flags[offset]&cdlBankMask>>cdlBankShift)*0x2000 + uint16(offset%0x2000)
+		instr := cpu6502.Decode(addr, func(a uint16) uint8 {
+			if i := offset + int(a-addr); i < len(prg) {
+				return prg[i]
+			}
+			return 0
+		})
+		executed[offset] = addr
+		offset += int(instr.Size)
+	}
+
+	return executed
+}
+
+// WriteCoverage - writes an HTML report of how much of the cartridge a
+// code/data log shows was used, with each bank's disassembly marked
+// executed, never run, read as data or unused, and a map of the CHR
+// tiles drawn
+func WriteCoverage(cart *Cartridge, cdl *CodeDataLogger, title string, w io.Writer, options DisasmOptions) error {
+	if len(cdl.PRG) != len(cart.prgRom) || len(cdl.CHR) != len(cart.chrRom) {
+		return fmt.Errorf("code/data log doesn't match the rom's size")
+	}
+
+	executed := cdlExecuted(cart.prgRom, cdl.PRG)
+	for offset, addr := range options.Executed {
+		executed[offset] = addr
+	}
+	options.Executed = executed
+
+	d, err := disassemble(cart, options)
+	if err != nil {
+		return err
+	}
+
+	report := coverageReport{Title: filepath.Base(title)}
+	for i, bank := range d.banks {
+		b := coverageBank{Index: i, Origin: bank.origin, Offset: bank.offset, Size: bank.size}
+		for _, flags := range cdl.PRG[bank.offset : bank.offset+bank.size] {
+			switch {
+			case flags&CDLCode != 0:
+				b.Code++
+			case flags&CDLData != 0:
+				b.Data++
+			default:
+				b.Unused++
+			}
+		}
+
+		for _, line := range d.bankLines(i) {
+			var code, data int
+			for _, flags := range cdl.PRG[line.offset : line.offset+line.size] {
+				if flags&CDLCode != 0 {
+					code++
+				}
+				if flags&CDLData != 0 {
+					data++
+				}
+			}
+
+			class := coverageUnused
+			switch {
+			case code == line.size:
+				class = coverageExecuted
+			case code > 0:
+				class = coveragePartial
+			case line.code:
+				class = coverageNever
+				b.NeverRun++
+			case data > 0:
+				class = coverageRead
+			}
+
+			text := "\t" + line.source
+			if line.comment != "" {
+				text = fmt.Sprintf("\t%-32s; %s", line.source, line.comment)
+			}
+			b.Lines = append(b.Lines, coverageLine{class, line.label, strings.ReplaceAll(text, "\t", "    ")})
+		}
+
+		report.Banks = append(report.Banks, b)
+		report.Code += b.Code
+		report.Data += b.Data
+		report.Unused += b.Unused
+		report.Size += b.Size
+		report.NeverRun += b.NeverRun
+	}
+
+	// 4KB pattern tables of 256 tiles
+	for page := 0; page < len(cdl.CHR); page += 0x1000 {
+		p := coveragePage{Offset: page}
+		for tile := page; tile < page+0x1000 && tile < len(cdl.CHR); tile += 0x10 {
+			var used uint8
+			for _, flags := range cdl.CHR[tile : tile+0x10] {
+				used |= flags
+			}
+
+			class := coverageUnused
+			switch {
+			case used&CDLBackground != 0 && used&CDLSprite != 0:
+				class = "both"
+			case used&CDLBackground != 0:
+				class = "background"
+			case used&CDLSprite != 0:
+				class = "sprite"
+			case used&CDLRendered != 0:
+				class = "rendered"
+			case used&CDLRead != 0:
+				class = coverageRead
+			}
+			if used&CDLRendered != 0 {
+				p.Rendered++
+			}
+			p.Tiles = append(p.Tiles, coverageTile{class, fmt.Sprintf("$%05X tile $%02X: %s", tile, (tile-page)/0x10, class)})
+		}
+		report.Pages = append(report.Pages, p)
+	}
+
+	return coverageTemplate.Execute(w, report)
+}
+
+var coverageTemplate = template.Must(template.New("coverage").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Coverage of {{.Title}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+td, th { padding: 0.2em 0.8em; text-align: right; border-bottom: 1px solid #ddd; }
+pre { font-size: 13px; line-height: 1.3; }
+pre span { display: block; }
+.label { color: #555; font-weight: bold; }
+.executed { background: #d4f4d4; }
+.partial { background: #f4efc4; }
+.never { background: #f6c8c8; }
+.read { background: #d4e4f8; }
+.unused { color: #999; }
+.key span { padding: 0.1em 0.5em; }
+.tiles { display: grid; grid-template-columns: repeat(16, 14px); gap: 1px; margin-bottom: 1em; }
+.tile { display: inline-block; width: 14px; height: 14px; background: #eee; }
+.tile.background { background: #4a8; }
+.tile.sprite { background: #c84; }
+.tile.both { background: #86c; }
+.tile.rendered { background: #888; }
+.tile.read { background: #48c; }
+</style>
+</head>
+<body>
+<h1>Coverage of {{.Title}}</h1>
+<p>{{.Percent}} of PRG rom used: {{.Code}} bytes of code run, {{.Data}} bytes read as data, {{.Unused}} bytes never touched.
+{{.NeverRun}} instructions found by disassembly never ran.</p>
+<p class="key"><span class="executed">executed</span> <span class="partial">partly executed</span> <span class="never">never executed</span> <span class="read">read as data</span> <span class="unused">unused</span></p>
+
+<table>
+<tr><th>bank</th><th>at</th><th>code</th><th>data</th><th>unused</th><th>used</th><th>never run</th></tr>
+{{range .Banks}}<tr><td><a href="#bank{{.Index}}">{{.Index}}</a></td><td>{{printf "$%04X" .Origin}}</td><td>{{.Code}}</td><td>{{.Data}}</td><td>{{.Unused}}</td><td>{{.Percent}}</td><td>{{.NeverRun}}</td></tr>
+{{end}}</table>
+
+{{if .Pages}}<h2>CHR rom</h2>
+<p>Tiles drawn as <span class="tile background"></span> background, <span class="tile sprite"></span> sprites,
+<span class="tile both"></span> both, <span class="tile rendered"></span> drawn in an earlier session,
+or <span class="tile read"></span> read through PPUDATA.</p>
+{{range .Pages}}<h3>{{printf "$%05X" .Offset}}, {{.Percent}} of tiles drawn</h3>
+<div class="tiles">{{range .Tiles}}<div class="tile {{.Class}}" title="{{.Title}}"></div>{{end}}</div>
+{{end}}{{end}}
+
+{{range .Banks}}<h2 id="bank{{.Index}}">PRG bank {{.Index}}, file offset {{printf "$%06X" .Offset}}</h2>
+<pre>{{range .Lines}}{{if .Label}}<span class="label">{{.Label}}:</span>{{end}}<span class="{{.Class}}">{{.Text}}</span>{{end}}</pre>
+{{end}}
+</body>
+</html>
+`))
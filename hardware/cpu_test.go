@@ -1,120 +1,40 @@
 package hardware
 
 import (
-	"bufio"
 	"log"
 	"os"
-	"regexp"
-	"strconv"
 	"strings"
 	"testing"
 )
 
-type expectedState struct {
-	PC uint16
-	A uint8
-	X uint8
-	Y uint8
-	P uint8
-}
-
-func extractHex(s, repattern string) uint64 {
-	re := regexp.MustCompile(repattern)
-	reMatch := strings.Split(re.FindString(s), ":")
-	result, _ := strconv.ParseUint(reMatch[len(reMatch) - 1], 16, 64)
-	return result
-}
-
-// readLines reads a whole file into memory
-// and returns a slice of its lines.
-func readLines(path string) ([]expectedState, error) {
-	file, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer file.Close()
-
-	var expStates []expectedState
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		curStr := scanner.Text()
-		ix := extractHex(curStr, "X:[0-9A-F]{2}")
-		iy := extractHex(curStr, "Y:([0-9A-F]{2})")
-		ia := extractHex(curStr, "A:[0-9A-F]{2}")
-		ip := extractHex(curStr, "P:[0-9A-F]{2}")
-		ipc := extractHex(curStr, "[0-9A-F]{4}")
-
-		curState := expectedState{
-			PC: uint16(ipc),
-			X: uint8(ix),
-			Y: uint8(iy),
-			A: uint8(ia),
-			P: uint8(ip),
-		}
-		expStates = append(expStates, curState)
-	}
-
-
-	return expStates, scanner.Err()
-}
-
 func TestCpu(t *testing.T) {
 	// create new nes
 	nes := NewNES()
 
 	cart, err := CreateCartridge("nestest.nes")
-
-	expected, _ := readLines("nestest.log")
-
-	firstInstruction := uint16(0xC000)
-
-	// Set the PC to be at the address
-	nes.CPU.PC = firstInstruction
-
-	nes.CPU.setCpuInitialState()
-
 	if err != nil {
-		log.Println(err)
-	} else {
-		nes.LoadCartridge(cart)
+		t.Fatal(err)
 	}
+	nes.LoadCartridge(cart)
 
-	// number of instructions ran
-	var numOfInstructions uint = 0
-
-	opcode := nes.CPU.Read8(nes.CPU.PC)
-
-	for opcode != 0x00 {
-		if nes.CPU.PC != expected[numOfInstructions].PC {
-			t.Errorf("Wrong PC. Expected %02x but got %02x\n %+v\nPC:%02x", expected[numOfInstructions].PC, nes.CPU.PC, Instructions[opcode], nes.CPU.PC)
-			log.Printf("Wrong PC. Expected %02x but got %02x\n %+v\nPC:%02x", expected[numOfInstructions].PC, nes.CPU.PC, Instructions[opcode], nes.CPU.PC)
-		}
-
-		if nes.CPU.A != expected[numOfInstructions].A {
-			t.Errorf("Wrong Acc. Expected %02x but got %02x\n %+v\nPC:%02x", expected[numOfInstructions].A, nes.CPU.A, Instructions[opcode], nes.CPU.PC)
-			log.Printf("Wrong Acc. Expected %02x but got %02x\n %+v\nPC:%02x", expected[numOfInstructions].A, nes.CPU.A, Instructions[opcode], nes.CPU.PC)
-		}
-
-		if nes.CPU.X != expected[numOfInstructions].X {
-			t.Errorf("Wrong X. Expected %02x but got %02x\n %+v\nPC:%02x", expected[numOfInstructions].X, nes.CPU.X, Instructions[opcode], nes.CPU.PC)
-			log.Printf("Wrong X. Expected %02x but got %02x\n %+v\nPC:%02x", expected[numOfInstructions].X, nes.CPU.X, Instructions[opcode], nes.CPU.PC)
-		}
-
-		if nes.CPU.Y != expected[numOfInstructions].Y {
-			t.Errorf("Wrong Y. Expected %02x but got %02x\n %+v\nPC:%02x", expected[numOfInstructions].Y, nes.CPU.Y, Instructions[opcode], nes.CPU.PC)
-			log.Printf("Wrong Y. Expected %02x but got %02x\n %+v\nPC:%02x", expected[numOfInstructions].Y, nes.CPU.Y, Instructions[opcode], nes.CPU.PC)
-		}
-
-		if nes.CPU.P != expected[numOfInstructions].P {
-			t.Errorf("Wrong P. Expected %02x but got %02x\n %+v\nPC:%02x", expected[numOfInstructions].P, nes.CPU.P, Instructions[opcode], nes.CPU.PC)
-			log.Printf("Wrong P. Expected %02x but got %02x\n %+v\nPC:%02x", expected[numOfInstructions].P, nes.CPU.P, Instructions[opcode], nes.CPU.PC)
-		}
+	nes.APU.InitAPU(false)
+	nes.PPU.InitFrame(1)
+	nes.Reset()
 
-		nes.CPU.RunInstruction(Instructions[opcode], true)
+	file, err := os.Open("nestest.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
 
-		numOfInstructions++
+	expected, err := ReadTrace(file)
+	if err != nil {
+		t.Fatal(err)
+	}
 
-		opcode = nes.CPU.Read8(nes.CPU.PC)
+	// the log starts at $C000, DiffTrace syncs the cpu to its first line
+	if divergence := DiffTrace(nes, expected, 10); divergence != nil {
+		t.Fatalf("nestest diverged\n%s", divergence)
 	}
 }
 
@@ -132,43 +52,40 @@ func runBlarggTest(filename string) string {
 	nes.CPU.Reset();
 
 	nes.APU.InitAPU(false)
-
-	opcode := nes.CPU.Read8(nes.CPU.PC)
+	nes.PPU.InitFrame(1)
 
 	log.Printf("%+v", nes.CPU.PC)
 
 	testStarted := false
 
 	for !testStarted {
-		nes.CPU.RunInstruction(Instructions[opcode], false)
-		opcode = nes.CPU.Read8(nes.CPU.PC)
+		nes.Step()
 
-		if nes.CPU.Memory[0x6000] == 0x80 {
+		if nes.CPU.Read8(0x6000) == 0x80 {
 			testStarted = true
 		}
 
-		if nes.CPU.Memory[0x6000] == 0x81 {
+		if nes.CPU.Read8(0x6000) == 0x81 {
 			nes.CPU.Reset()
 		}
 	}
 
-	for nes.CPU.Memory[0x6000] > 0x7F {
-		nes.CPU.RunInstruction(Instructions[opcode], false)
-		opcode = nes.CPU.Read8(nes.CPU.PC)
+	for nes.CPU.Read8(0x6000) > 0x7F {
+		nes.Step()
 
-		if nes.CPU.Memory[0x6000] == 0x81 {
+		if nes.CPU.Read8(0x6000) == 0x81 {
 			nes.CPU.Reset()
 		}
 	}
 
 	var testMsgByteArr []byte
 	curIdx := 0x6004
-	curByte := nes.CPU.Memory[curIdx]
+	curByte := nes.CPU.Read8(uint16(curIdx))
 
 	for curByte != 0 {
 		testMsgByteArr = append(testMsgByteArr, curByte)
 		curIdx++
-		curByte = nes.CPU.Memory[curIdx]
+		curByte = nes.CPU.Read8(uint16(curIdx))
 	}
 
 	return string(testMsgByteArr)
@@ -254,4 +171,451 @@ func TestBlarggCpu09(t *testing.T) {
 	if !strings.Contains(strings.ToUpper(resultMsg), "PASSED") {
 		t.Errorf("Blargg Test did not pass\nMESSAGE: %s", resultMsg)
 	}
-}
\ No newline at end of file
+}
+// newTestNES builds an NES running a single 16KB NROM bank and a blank
+// CHR bank. prg is mapped at $C000, and the NMI, reset and IRQ vectors
+// point into it.
+func newTestNES(prg []byte, nmi, reset, irq uint16) *NES {
+	nes := NewNES()
+
+	rom := make([]byte, 0x4000)
+	copy(rom, prg)
+	rom[0x3FFA], rom[0x3FFB] = uint8(nmi), uint8(nmi>>8)
+	rom[0x3FFC], rom[0x3FFD] = uint8(reset), uint8(reset>>8)
+	rom[0x3FFE], rom[0x3FFF] = uint8(irq), uint8(irq>>8)
+
+	nes.LoadCartridge(Cartridge{prgRomBlocks: 1, prgRom: rom, chrRomBlocks: 1, chrRom: make([]byte, 0x2000), mapperType: mapper0})
+	nes.CPU.Reset()
+
+	return nes
+}
+
+func stepCpu(nes *NES) uint8 {
+	return nes.CPU.Step()
+}
+
+// pulledInterruptFrame returns the status and return address an interrupt left on the stack
+func pulledInterruptFrame(nes *NES) (uint8, uint16) {
+	p := nes.CPU.Pop8()
+	return p, nes.CPU.Pop16()
+}
+
+func TestIrqCliLatency(t *testing.T) {
+	// C000 CLI
+	// C001 LDA #$01
+	// C003 NOP
+	// C010 NOP (irq handler)
+	prg := []byte{0x58, 0xA9, 0x01, 0xEA}
+	nes := newTestNES(prg, 0xC020, 0xC000, 0xC010)
+
+	nes.CPU.SetIRQ(IRQMapper)
+
+	stepCpu(nes)
+	if nes.CPU.PC != 0xC001 {
+		t.Fatalf("IRQ taken right after CLI, PC:%04x", nes.CPU.PC)
+	}
+
+	stepCpu(nes)
+	if nes.CPU.A != 0x01 || nes.CPU.PC != 0xC003 {
+		t.Fatalf("Instruction after CLI did not run. A:%02x PC:%04x", nes.CPU.A, nes.CPU.PC)
+	}
+
+	if cycles := stepCpu(nes); cycles != 7 || nes.CPU.PC != 0xC010 {
+		t.Fatalf("Expected IRQ after the instruction following CLI. PC:%04x cycles:%d", nes.CPU.PC, cycles)
+	}
+
+	p, ret := pulledInterruptFrame(nes)
+	if ret != 0xC003 {
+		t.Errorf("Wrong return address. Expected c003 but got %04x", ret)
+	}
+	if p&0x10 != 0 {
+		t.Errorf("IRQ pushed status with B set: %02x", p)
+	}
+	if nes.CPU.P&0x04 == 0 {
+		t.Errorf("IRQ did not set I")
+	}
+}
+
+func TestIrqSeiLatency(t *testing.T) {
+	// C000 CLI
+	// C001 SEI
+	// C002 NOP
+	prg := []byte{0x58, 0x78, 0xEA}
+	nes := newTestNES(prg, 0xC020, 0xC000, 0xC010)
+
+	stepCpu(nes)
+	nes.CPU.SetIRQ(IRQFrameCounter)
+
+	stepCpu(nes)
+	if nes.CPU.PC != 0xC002 {
+		t.Fatalf("SEI did not run, PC:%04x", nes.CPU.PC)
+	}
+
+	// the poll during SEI still saw I clear
+	stepCpu(nes)
+	if nes.CPU.PC != 0xC010 {
+		t.Fatalf("Expected IRQ right after SEI, PC:%04x", nes.CPU.PC)
+	}
+
+	p, ret := pulledInterruptFrame(nes)
+	if ret != 0xC002 {
+		t.Errorf("Wrong return address. Expected c002 but got %04x", ret)
+	}
+	if p&0x04 == 0 {
+		t.Errorf("Pushed status should have I set after SEI: %02x", p)
+	}
+}
+
+func TestIrqPlpLatency(t *testing.T) {
+	// C000 LDA #$04
+	// C002 PHA
+	// C003 CLI
+	// C004 PLP
+	// C005 NOP
+	prg := []byte{0xA9, 0x04, 0x48, 0x58, 0x28, 0xEA}
+	nes := newTestNES(prg, 0xC020, 0xC000, 0xC010)
+
+	nes.CPU.SetIRQ(IRQDMC)
+
+	for i := 0; i < 4; i++ {
+		stepCpu(nes)
+	}
+	if nes.CPU.PC != 0xC005 {
+		t.Fatalf("IRQ taken before PLP finished, PC:%04x", nes.CPU.PC)
+	}
+
+	stepCpu(nes)
+	if nes.CPU.PC != 0xC010 {
+		t.Fatalf("Expected IRQ right after PLP, PC:%04x", nes.CPU.PC)
+	}
+}
+
+func TestIrqInhibited(t *testing.T) {
+	prg := []byte{0xEA, 0xEA, 0xEA}
+	nes := newTestNES(prg, 0xC020, 0xC000, 0xC010)
+
+	nes.CPU.SetIRQ(IRQMapper)
+	nes.CPU.SetIRQ(IRQFrameCounter)
+	nes.CPU.ClearIRQ(IRQMapper)
+
+	if !nes.CPU.IRQAsserted() {
+		t.Errorf("IRQ line released while a source still holds it")
+	}
+
+	for i := 0; i < 3; i++ {
+		stepCpu(nes)
+	}
+	if nes.CPU.PC != 0xC003 {
+		t.Errorf("IRQ taken with I set, PC:%04x", nes.CPU.PC)
+	}
+}
+
+func TestNmiBeforeIrq(t *testing.T) {
+	// C000 CLI
+	// C001 NOP
+	prg := []byte{0x58, 0xEA, 0xEA}
+	nes := newTestNES(prg, 0xC020, 0xC000, 0xC010)
+
+	stepCpu(nes)
+	nes.CPU.SetIRQ(IRQMapper)
+	nes.CPU.HandleNMI()
+
+	stepCpu(nes)
+	if nes.CPU.PC != 0xC020 {
+		t.Fatalf("Expected NMI to win over IRQ, PC:%04x", nes.CPU.PC)
+	}
+}
+
+func TestNmiHijacksBrk(t *testing.T) {
+	// C000 BRK
+	prg := []byte{0x00, 0x00, 0xEA}
+	nes := newTestNES(prg, 0xC020, 0xC000, 0xC010)
+	sp := nes.CPU.SP
+
+	stepCpu(nes)
+
+	// NMI arrives while BRK is still pushing
+	nes.CPU.HandleNMI()
+	stepCpu(nes)
+
+	if nes.CPU.PC != 0xC020 {
+		t.Fatalf("Expected NMI to hijack BRK, PC:%04x", nes.CPU.PC)
+	}
+	if nes.CPU.SP != sp-3 {
+		t.Errorf("Hijacked BRK should push one frame. SP:%02x", nes.CPU.SP)
+	}
+
+	p, ret := pulledInterruptFrame(nes)
+	if ret != 0xC002 {
+		t.Errorf("Wrong return address. Expected c002 but got %04x", ret)
+	}
+	if p&0x10 == 0 {
+		t.Errorf("Hijacked BRK should still push B set: %02x", p)
+	}
+}
+
+func TestNmiHijacksIrq(t *testing.T) {
+	// C000 CLI
+	// C001 NOP
+	prg := []byte{0x58, 0xEA, 0xEA}
+	nes := newTestNES(prg, 0xC020, 0xC000, 0xC010)
+	sp := nes.CPU.SP
+
+	// the IRQ is taken after the instruction following CLI
+	nes.CPU.SetIRQ(IRQMapper)
+	stepCpu(nes)
+	stepCpu(nes)
+	if cycles := stepCpu(nes); cycles != 7 || nes.CPU.PC != 0xC010 {
+		t.Fatalf("Expected the IRQ to be taken, PC:%04x cycles:%d", nes.CPU.PC, cycles)
+	}
+
+	// NMI arrives while the IRQ is still pushing
+	nes.CPU.HandleNMI()
+	stepCpu(nes)
+
+	if nes.CPU.PC != 0xC020 {
+		t.Fatalf("Expected NMI to hijack the IRQ, PC:%04x", nes.CPU.PC)
+	}
+	if nes.CPU.SP != sp-3 {
+		t.Errorf("Hijacked IRQ should push one frame. SP:%02x", nes.CPU.SP)
+	}
+
+	p, ret := pulledInterruptFrame(nes)
+	if ret != 0xC002 {
+		t.Errorf("Wrong return address. Expected c002 but got %04x", ret)
+	}
+	if p&0x10 != 0 {
+		t.Errorf("Hijacked IRQ should push B clear: %02x", p)
+	}
+}
+
+func TestBranchDelaysIrq(t *testing.T) {
+	// C000 CLI
+	// C001 BNE $C003 - taken, same page
+	// C003 NOP
+	// C004 NOP
+	prg := []byte{0x58, 0xD0, 0x00, 0xEA, 0xEA}
+	nes := newTestNES(prg, 0xC020, 0xC000, 0xC010)
+
+	stepCpu(nes)
+	if cycles := stepCpu(nes); cycles != 3 || nes.CPU.PC != 0xC003 {
+		t.Fatalf("Expected the branch to be taken in 3 cycles, PC:%04x cycles:%d", nes.CPU.PC, cycles)
+	}
+
+	// asserted during the branch, after it polled
+	nes.CPU.SetIRQ(IRQFrameCounter)
+	if nes.CPU.InterruptPending() {
+		t.Errorf("IRQ reported pending right after a taken branch")
+	}
+	stepCpu(nes)
+	if nes.CPU.PC != 0xC004 {
+		t.Fatalf("Expected the instruction after the branch to run first, PC:%04x", nes.CPU.PC)
+	}
+
+	stepCpu(nes)
+	if nes.CPU.PC != 0xC010 {
+		t.Fatalf("Expected the IRQ one instruction late, PC:%04x", nes.CPU.PC)
+	}
+	if _, ret := pulledInterruptFrame(nes); ret != 0xC004 {
+		t.Errorf("Wrong return address. Expected c004 but got %04x", ret)
+	}
+}
+
+func TestBranchAcrossPageTakesIrq(t *testing.T) {
+	// C0F0 CLI
+	// C0F1 BNE $C103 - taken, crossing a page
+	prg := make([]byte, 0x110)
+	prg[0], prg[1], prg[2] = 0x4C, 0xF0, 0xC0
+	copy(prg[0xF0:], []byte{0x58, 0xD0, 0x10})
+	prg[0x103] = 0xEA
+	nes := newTestNES(prg, 0xC020, 0xC000, 0xC010)
+
+	stepCpu(nes)
+	stepCpu(nes)
+	if cycles := stepCpu(nes); cycles != 4 || nes.CPU.PC != 0xC103 {
+		t.Fatalf("Expected the branch to cross a page in 4 cycles, PC:%04x cycles:%d", nes.CPU.PC, cycles)
+	}
+
+	// the page fix up cycle polls again, so the IRQ isn't delayed
+	nes.CPU.SetIRQ(IRQFrameCounter)
+	stepCpu(nes)
+	if nes.CPU.PC != 0xC010 {
+		t.Fatalf("Expected the IRQ right after the branch, PC:%04x", nes.CPU.PC)
+	}
+}
+
+// TestBlarggCpuInterrupts - blargg's cpu_interrupts, which isn't in the
+// repository yet. Put it in blargg_cpu_singles to run it.
+func TestBlarggCpuInterrupts(t *testing.T) {
+	const filename = "./blargg_cpu_singles/cpu_interrupts.nes"
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		t.Skipf("%s isn't there", filename)
+	}
+
+	resultMsg := runBlarggTest(filename)
+
+	if !strings.Contains(strings.ToUpper(resultMsg), "PASSED") {
+		t.Errorf("Blargg Test did not pass\nMESSAGE: %s", resultMsg)
+	}
+}
+
+func TestRmwDoubleWrite(t *testing.T) {
+	// C000 INC $5000
+	// C003 ASL $5000
+	prg := []byte{0xEE, 0x00, 0x50, 0x0E, 0x00, 0x50}
+	nes := newTestNES(prg, 0xC020, 0xC000, 0xC010)
+	device := &recordingDevice{value: 0x41}
+	nes.CPU.Bus.Register(0x5000, 0x50FF, device)
+
+	stepCpu(nes)
+	stepCpu(nes)
+
+	expected := []uint8{0x41, 0x42, 0x41, 0x82}
+	if len(device.writes) != len(expected) {
+		t.Fatalf("Expected writes %02x but got %02x", expected, device.writes)
+	}
+	for i := range expected {
+		if device.writes[i] != expected[i] {
+			t.Fatalf("Expected writes %02x but got %02x", expected, device.writes)
+		}
+	}
+}
+
+func TestIndexedDummyRead(t *testing.T) {
+	// C000 LDX #$20
+	// C002 LDA $5000,X
+	// C005 LDA $50F0,X
+	// C008 STA $5000,X
+	// C00B LDY #$20
+	// C00D LDA ($10),Y
+	prg := []byte{0xA2, 0x20, 0xBD, 0x00, 0x50, 0xBD, 0xF0, 0x50, 0x9D, 0x00, 0x50, 0xA0, 0x20, 0xB1, 0x10}
+	nes := newTestNES(prg, 0xC020, 0xC000, 0xC010)
+	nes.CPU.Write16(0x10, 0x50F0)
+	device := &recordingDevice{}
+	nes.CPU.Bus.Register(0x5000, 0x51FF, device)
+
+	checkReads := func(name string, expected ...uint16) {
+		device.readAddrs = nil
+		stepCpu(nes)
+
+		if len(device.readAddrs) != len(expected) {
+			t.Fatalf("%s: expected reads %04x but got %04x", name, expected, device.readAddrs)
+		}
+		for i := range expected {
+			if device.readAddrs[i] != expected[i] {
+				t.Fatalf("%s: expected reads %04x but got %04x", name, expected, device.readAddrs)
+			}
+		}
+	}
+
+	stepCpu(nes)
+	checkReads("LDA abs,X same page", 0x5020)
+	checkReads("LDA abs,X page cross", 0x5010, 0x5110)
+	checkReads("STA abs,X", 0x5020)
+	stepCpu(nes)
+	checkReads("LDA (ind),Y page cross", 0x5010, 0x5110)
+}
+
+func TestKilHaltsCpu(t *testing.T) {
+	// C000 NOP
+	// C001 KIL
+	// C002 NOP
+	prg := []byte{0xEA, 0x02, 0xEA}
+	nes := newTestNES(prg, 0xC020, 0xC000, 0xC010)
+	nes.APU.InitAPU(false)
+	nes.PPU.InitFrame(1)
+
+	stepCpu(nes)
+	stepCpu(nes)
+	if !nes.CPU.Halted() {
+		t.Fatalf("Expected KIL to halt the cpu")
+	}
+
+	// interrupts can't wake a jammed cpu
+	nes.CPU.HandleNMI()
+	for i := 0; i < 3; i++ {
+		if cycles := nes.Step(); cycles != 1 {
+			t.Errorf("Expected a halted cpu to idle one cycle at a time, got %d", cycles)
+		}
+	}
+	if nes.CPU.PC != 0xC001 {
+		t.Errorf("Expected PC to stay on the KIL. PC:%04x", nes.CPU.PC)
+	}
+
+	nes.CPU.Reset()
+	if nes.CPU.Halted() || nes.CPU.PC != 0xC000 {
+		t.Errorf("Expected reset to restart the cpu. PC:%04x", nes.CPU.PC)
+	}
+}
+
+func TestUnofficialImmediates(t *testing.T) {
+	tests := []struct {
+		name      string
+		prg       []byte
+		a, x, p uint8
+	}{
+		// LDA #$FF, ANC #$80
+		{"ANC", []byte{0xA9, 0xFF, 0x0B, 0x80}, 0x80, 0x00, 0xA5},
+		// LDA #$FF, ALR #$03
+		{"ALR", []byte{0xA9, 0xFF, 0x4B, 0x03}, 0x01, 0x00, 0x25},
+		// CLC, LDA #$FF, ARR #$80
+		{"ARR", []byte{0x18, 0xA9, 0xFF, 0x6B, 0x80}, 0x40, 0x00, 0x65},
+		// LDA #$0F, LDX #$FC, AXS #$0D
+		{"AXS", []byte{0xA9, 0x0F, 0xA2, 0xFC, 0xCB, 0x0D}, 0x0F, 0xFF, 0xA4},
+		// LDA #$FF, LDX #$3C, XAA #$F0
+		{"XAA", []byte{0xA9, 0xFF, 0xA2, 0x3C, 0x8B, 0xF0}, 0x30, 0x3C, 0x24},
+	}
+
+	for _, test := range tests {
+		nes := newTestNES(test.prg, 0xC020, 0xC000, 0xC010)
+		for nes.CPU.PC < 0xC000+uint16(len(test.prg)) {
+			stepCpu(nes)
+		}
+
+		if nes.CPU.A != test.a || nes.CPU.X != test.x || nes.CPU.P != test.p {
+			t.Errorf("%s: expected A:%02x X:%02x P:%02x but got A:%02x X:%02x P:%02x",
+				test.name, test.a, test.x, test.p, nes.CPU.A, nes.CPU.X, nes.CPU.P)
+		}
+	}
+}
+
+func TestLasLoadsStackPointer(t *testing.T) {
+	// C000 LDY #$00
+	// C002 LAS $0300,Y
+	prg := []byte{0xA0, 0x00, 0xBB, 0x00, 0x03}
+	nes := newTestNES(prg, 0xC020, 0xC000, 0xC010)
+	nes.CPU.Write8(0x0300, 0xF3)
+
+	stepCpu(nes)
+	stepCpu(nes)
+
+	// SP is $FD after reset
+	if nes.CPU.A != 0xF1 || nes.CPU.X != 0xF1 || nes.CPU.SP != 0xF1 {
+		t.Errorf("Expected A, X and SP to be f1. A:%02x X:%02x SP:%02x", nes.CPU.A, nes.CPU.X, nes.CPU.SP)
+	}
+}
+
+func TestShyHighByteAnd(t *testing.T) {
+	// C000 LDY #$FF
+	// C002 LDX #$10
+	// C004 SHY $0200,X - stores Y & $03 at $0210
+	// C007 LDY #$01
+	// C009 LDX #$20
+	// C00B SHY $02F0,X - crosses the page, so stores Y & $03 at $0110 instead of $0310
+	prg := []byte{0xA0, 0xFF, 0xA2, 0x10, 0x9C, 0x00, 0x02, 0xA0, 0x01, 0xA2, 0x20, 0x9C, 0xF0, 0x02}
+	nes := newTestNES(prg, 0xC020, 0xC000, 0xC010)
+
+	for i := 0; i < 6; i++ {
+		stepCpu(nes)
+	}
+
+	if v := nes.CPU.Read8(0x0210); v != 0x03 {
+		t.Errorf("Expected SHY to store 03 at 0210, got %02x", v)
+	}
+	if v := nes.CPU.Read8(0x0110); v != 0x01 {
+		t.Errorf("Expected page crossing SHY to store 01 at 0110, got %02x", v)
+	}
+	if v := nes.CPU.Read8(0x0310); v != 0x00 {
+		t.Errorf("Expected page crossing SHY to miss 0310, got %02x", v)
+	}
+}
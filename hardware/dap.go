@@ -0,0 +1,853 @@
+package hardware
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// the one thread a DAP client sees
+const dapThreadID = 1
+
+// variablesReference values for the scopes, and for the flags under P
+const (
+	dapRegisters = iota + 1
+	dapPPU
+	dapRAM
+	dapFlags
+)
+
+type dapMessage struct {
+	Seq       int             `json:"seq"`
+	Type      string          `json:"type"`
+	Command   string          `json:"command,omitempty"`
+	Arguments json.RawMessage `json:"arguments,omitempty"`
+}
+
+type dapResponse struct {
+	Seq        int         `json:"seq"`
+	Type       string      `json:"type"`
+	RequestSeq int         `json:"request_seq"`
+	Success    bool        `json:"success"`
+	Command    string      `json:"command"`
+	Message    string      `json:"message,omitempty"`
+	Body       interface{} `json:"body,omitempty"`
+}
+
+type dapEvent struct {
+	Seq   int         `json:"seq"`
+	Type  string      `json:"type"`
+	Event string      `json:"event"`
+	Body  interface{} `json:"body,omitempty"`
+}
+
+type dapSource struct {
+	Name string `json:"name,omitempty"`
+	Path string `json:"path,omitempty"`
+}
+
+type dapBreakpoint struct {
+	ID       int        `json:"id,omitempty"`
+	Verified bool       `json:"verified"`
+	Message  string     `json:"message,omitempty"`
+	Source   *dapSource `json:"source,omitempty"`
+	Line     int        `json:"line,omitempty"`
+}
+
+type dapStackFrame struct {
+	ID                          int        `json:"id"`
+	Name                        string     `json:"name"`
+	Source                      *dapSource `json:"source,omitempty"`
+	Line                        int        `json:"line"`
+	Column                      int        `json:"column"`
+	InstructionPointerReference string     `json:"instructionPointerReference,omitempty"`
+}
+
+type dapVariable struct {
+	Name               string `json:"name"`
+	Value              string `json:"value"`
+	VariablesReference int    `json:"variablesReference"`
+}
+
+type dapLaunchArguments struct {
+	Program     string   `json:"program"`
+	DebugInfo   string   `json:"debugInfo"`
+	Symbols     []string `json:"symbols"`
+	StopOnEntry bool     `json:"stopOnEntry"`
+}
+
+// errDAPEnded - the client disconnected or asked to stop
+var errDAPEnded = fmt.Errorf("debug session ended")
+
+// DAPSession - serves the Debug Adapter Protocol to one client, such as
+// VS Code, over conn. The client launches a rom, and with a ca65 debug
+// file its breakpoints and stack frames are on lines of the source.
+// Like the Debugger, the session has to be driven from the goroutine
+// that owns the NES.
+type DAPSession struct {
+	w   io.Writer
+	seq int
+
+	requests chan *dapMessage
+	quit     chan struct{}
+	ended    bool
+
+	// InitNES - called on the NES the client launches, after it's reset,
+	// to set up its APU and frame
+	InitNES func(nes *NES)
+
+	nes  *NES
+	d    *Debugger
+	info *DebugInfo
+
+	stopOnEntry bool
+
+	// debugger breakpoint ids set from each source path, and from
+	// function breakpoints. A line with code in several places is one
+	// client breakpoint with the id of the first.
+	sourceBreakpoints   map[string][]int
+	functionBreakpoints []int
+	clientIDs           map[int]int
+}
+
+// NewDAPSession - starts reading requests from conn
+func NewDAPSession(conn io.ReadWriter) *DAPSession {
+	s := &DAPSession{
+		w:                 conn,
+		requests:          make(chan *dapMessage, 16),
+		quit:              make(chan struct{}),
+		sourceBreakpoints: map[string][]int{},
+		clientIDs:         map[int]int{},
+	}
+
+	go s.read(bufio.NewReader(conn))
+
+	return s
+}
+
+func (s *DAPSession) read(r *bufio.Reader) {
+	defer close(s.requests)
+
+	for {
+		message, err := readDAPMessage(r)
+		if err != nil {
+			return
+		}
+
+		select {
+		case s.requests <- message:
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// readDAPMessage - reads one message, a Content-Length header then JSON
+func readDAPMessage(r *bufio.Reader) (*dapMessage, error) {
+	length := -1
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+
+		if i := strings.IndexByte(line, ':'); i >= 0 && strings.EqualFold(line[:i], "Content-Length") {
+			if length, err = strconv.Atoi(strings.TrimSpace(line[i+1:])); err != nil {
+				return nil, fmt.Errorf("bad header %q", line)
+			}
+		}
+	}
+	if length < 0 {
+		return nil, fmt.Errorf("message without a Content-Length")
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	message := &dapMessage{}
+	if err := json.Unmarshal(body, message); err != nil {
+		return nil, err
+	}
+
+	return message, nil
+}
+
+func (s *DAPSession) send(message interface{}) {
+	body, err := json.Marshal(message)
+	if err == nil {
+		_, err = fmt.Fprintf(s.w, "Content-Length: %d\r\n\r\n%s", len(body), body)
+	}
+	if err != nil {
+		s.end()
+	}
+}
+
+func (s *DAPSession) nextSeq() int {
+	s.seq++
+	return s.seq
+}
+
+func (s *DAPSession) respond(request *dapMessage, body interface{}) {
+	s.send(&dapResponse{Seq: s.nextSeq(), Type: "response", RequestSeq: request.Seq, Success: true, Command: request.Command, Body: body})
+}
+
+func (s *DAPSession) fail(request *dapMessage, err error) {
+	s.send(&dapResponse{Seq: s.nextSeq(), Type: "response", RequestSeq: request.Seq, Command: request.Command, Message: err.Error()})
+}
+
+func (s *DAPSession) event(event string, body interface{}) {
+	s.send(&dapEvent{Seq: s.nextSeq(), Type: "event", Event: event, Body: body})
+}
+
+func (s *DAPSession) end() {
+	if !s.ended {
+		s.ended = true
+		close(s.quit)
+	}
+}
+
+// Terminate - tells the client the rom has stopped, when it's closed
+// from the emulator's side
+func (s *DAPSession) Terminate() {
+	if !s.ended {
+		s.event("terminated", nil)
+		s.end()
+	}
+}
+
+// Ended - reports whether the client has gone or asked to stop
+func (s *DAPSession) Ended() bool {
+	return s.ended
+}
+
+// NES - the launched NES, nil until the client launches a rom
+func (s *DAPSession) NES() *NES {
+	return s.nes
+}
+
+// Launch - handles requests until the client launches a rom. Returns
+// false if the session ended first.
+func (s *DAPSession) Launch() bool {
+	for s.nes == nil && !s.ended {
+		s.wait()
+	}
+
+	return !s.ended
+}
+
+// wait - blocks for one request and handles it
+func (s *DAPSession) wait() {
+	request, ok := <-s.requests
+	if !ok {
+		s.end()
+		return
+	}
+	s.handle(request)
+}
+
+// Poll - handles the requests waiting without blocking. Returns false
+// once the session has ended.
+func (s *DAPSession) Poll() bool {
+	for !s.ended {
+		select {
+		case request, ok := <-s.requests:
+			if !ok {
+				s.end()
+				break
+			}
+			s.handle(request)
+		default:
+			return true
+		}
+	}
+
+	return false
+}
+
+// RunFrame - runs up to the end of a frame if the client hasn't paused,
+// telling it if something stops the debugger
+func (s *DAPSession) RunFrame() {
+	if s.d == nil || s.d.Paused() {
+		return
+	}
+
+	if s.d.RunFrame() {
+		s.stopped("")
+	}
+}
+
+// Run - drives the launched NES without a window until the session ends
+func (s *DAPSession) Run() {
+	for !s.ended {
+		if s.d.Paused() {
+			s.wait()
+			continue
+		}
+
+		s.RunFrame()
+		s.Poll()
+	}
+}
+
+// stopped - tells the client the debugger paused. reason overrides the
+// one the debugger gives.
+func (s *DAPSession) stopped(reason string) {
+	stop := s.d.LastStop()
+	body := map[string]interface{}{
+		"threadId":          dapThreadID,
+		"allThreadsStopped": true,
+		"description":       stop.String(),
+	}
+
+	if reason == "" {
+		switch stop.Reason {
+		case StopBreakpoint:
+			reason = "breakpoint"
+			if stop.Breakpoint.Kind != BreakExec {
+				reason = "data breakpoint"
+			}
+			if id, ok := s.clientIDs[stop.Breakpoint.ID]; ok {
+				body["hitBreakpointIds"] = []int{id}
+			}
+		case StopHalted:
+			reason = "exception"
+			body["text"] = fmt.Sprintf("cpu halted at $%04X", s.nes.CPU.PC)
+		case StopPause:
+			reason = "pause"
+		default:
+			reason = "step"
+		}
+	}
+	body["reason"] = reason
+
+	s.event("stopped", body)
+}
+
+func (s *DAPSession) handle(request *dapMessage) {
+	if request.Type != "request" {
+		return
+	}
+
+	// everything but setting up needs a rom
+	switch request.Command {
+	case "initialize", "launch", "attach", "disconnect", "terminate":
+	default:
+		if s.nes == nil {
+			s.fail(request, fmt.Errorf("%s before launch", request.Command))
+			return
+		}
+	}
+
+	body, err := s.execute(request)
+	if err == errDAPEnded {
+		s.respond(request, nil)
+		s.end()
+		return
+	}
+	if err != nil {
+		s.fail(request, err)
+		return
+	}
+	s.respond(request, body)
+
+	switch request.Command {
+	case "launch":
+		s.event("initialized", nil)
+
+	case "configurationDone":
+		if s.stopOnEntry {
+			s.stopped("entry")
+		} else {
+			s.d.Continue()
+		}
+
+	case "next", "stepIn", "stepOut", "pause":
+		if s.d.Paused() {
+			s.stopped("")
+		}
+	}
+}
+
+func (s *DAPSession) execute(request *dapMessage) (interface{}, error) {
+	d := s.d
+
+	switch request.Command {
+	case "initialize":
+		return map[string]interface{}{
+			"supportsConfigurationDoneRequest": true,
+			"supportsConditionalBreakpoints":   true,
+			"supportsFunctionBreakpoints":      true,
+			"supportsSetVariable":              true,
+			"supportsEvaluateForHovers":        true,
+			"supportsTerminateRequest":         true,
+		}, nil
+
+	case "launch":
+		return nil, s.launch(request.Arguments)
+
+	case "attach":
+		return nil, fmt.Errorf("attach isn't supported, launch a rom")
+
+	case "disconnect", "terminate":
+		if s.d != nil {
+			s.d.Detach()
+		}
+		s.event("terminated", nil)
+		return nil, errDAPEnded
+
+	case "configurationDone":
+		return nil, nil
+
+	case "setBreakpoints":
+		return s.setBreakpoints(request.Arguments)
+
+	case "setFunctionBreakpoints":
+		return s.setFunctionBreakpoints(request.Arguments)
+
+	case "threads":
+		return map[string]interface{}{
+			"threads": []map[string]interface{}{{"id": dapThreadID, "name": "6502"}},
+		}, nil
+
+	case "stackTrace":
+		return s.stackTrace(request.Arguments)
+
+	case "scopes":
+		return map[string]interface{}{
+			"scopes": []map[string]interface{}{
+				{"name": "Registers", "variablesReference": dapRegisters, "expensive": false},
+				{"name": "PPU", "variablesReference": dapPPU, "expensive": false},
+				{"name": "RAM", "variablesReference": dapRAM, "expensive": false},
+			},
+		}, nil
+
+	case "variables":
+		var args struct {
+			VariablesReference int `json:"variablesReference"`
+		}
+		if err := json.Unmarshal(request.Arguments, &args); err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"variables": s.variables(args.VariablesReference)}, nil
+
+	case "setVariable":
+		return s.setVariable(request.Arguments)
+
+	case "evaluate":
+		var args struct {
+			Expression string `json:"expression"`
+		}
+		if err := json.Unmarshal(request.Arguments, &args); err != nil {
+			return nil, err
+		}
+		value, err := d.Evaluate(args.Expression)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{
+			"result":             fmt.Sprintf("%d ($%X)", value, value),
+			"variablesReference": 0,
+		}, nil
+
+	case "continue":
+		d.Continue()
+		return map[string]interface{}{"allThreadsContinued": true}, nil
+
+	case "next":
+		d.StepOver()
+	case "stepIn":
+		d.Step()
+	case "stepOut":
+		return nil, d.StepOut()
+	case "pause":
+		d.Pause()
+
+	default:
+		return nil, fmt.Errorf("unsupported request %s", request.Command)
+	}
+
+	return nil, nil
+}
+
+// launch - loads the rom and its debug info, paused at reset
+func (s *DAPSession) launch(arguments json.RawMessage) error {
+	if s.nes != nil {
+		return fmt.Errorf("a rom is already running")
+	}
+
+	var args dapLaunchArguments
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return err
+	}
+	if args.Program == "" {
+		return fmt.Errorf("launch needs a program, the rom to run")
+	}
+
+	cart, err := CreateCartridge(args.Program)
+	if err != nil {
+		return err
+	}
+
+	nes := NewNES()
+	if err := nes.LoadCartridge(cart); err != nil {
+		return err
+	}
+	nes.Reset()
+	if s.InitNES != nil {
+		s.InitNES(nes)
+	}
+
+	// game.nes is usually linked alongside game.dbg, which debugInfo
+	// can point somewhere else instead
+	var files []string
+	if args.DebugInfo != "" {
+		files = append(files, args.DebugInfo)
+	}
+	for _, found := range FindSymbolFiles(args.Program) {
+		if args.DebugInfo == "" || filepath.Ext(found) != ".dbg" {
+			files = append(files, found)
+		}
+	}
+	files = append(files, args.Symbols...)
+
+	symbols := NewSymbols()
+	for _, file := range files {
+		if err := symbols.Load(file, &cart); err != nil {
+			return err
+		}
+	}
+	if len(files) > 0 {
+		nes.Symbols = symbols
+		s.info = symbols.DebugInfo()
+	}
+
+	s.nes = nes
+	s.d = NewDebugger(nes)
+	s.stopOnEntry = args.StopOnEntry
+
+	return nil
+}
+
+// clearBreakpoints - removes breakpoints set earlier by the client
+func (s *DAPSession) clearBreakpoints(ids []int) {
+	for _, id := range ids {
+		s.d.RemoveBreakpoint(id)
+		delete(s.clientIDs, id)
+	}
+}
+
+func (s *DAPSession) setBreakpoints(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Source      dapSource `json:"source"`
+		Breakpoints []struct {
+			Line      int    `json:"line"`
+			Condition string `json:"condition"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+
+	s.clearBreakpoints(s.sourceBreakpoints[args.Source.Path])
+	delete(s.sourceBreakpoints, args.Source.Path)
+
+	file, found := "", false
+	if s.info != nil {
+		file, found = s.info.FindFile(args.Source.Path)
+	}
+
+	breakpoints := []dapBreakpoint{}
+	for _, requested := range args.Breakpoints {
+		bp := dapBreakpoint{Line: requested.Line}
+
+		switch {
+		case s.info == nil:
+			bp.Message = "no ca65 debug info was loaded"
+		case !found:
+			bp.Message = "file isn't in the debug info"
+		default:
+			s.addLineBreakpoint(&bp, args.Source.Path, file, requested.Condition)
+		}
+
+		breakpoints = append(breakpoints, bp)
+	}
+
+	return map[string]interface{}{"breakpoints": breakpoints}, nil
+}
+
+// addLineBreakpoint - adds a debugger breakpoint on each place the code
+// for bp's line is, moving bp down to the first line with code
+func (s *DAPSession) addLineBreakpoint(bp *dapBreakpoint, path, file, condition string) {
+	line, addresses := s.info.LineAddresses(file, bp.Line)
+	if len(addresses) == 0 {
+		bp.Message = "no code on or after this line"
+		return
+	}
+	bp.Line = line
+
+	for _, addr := range addresses {
+		var added *Breakpoint
+		var err error
+		if addr.PRG >= 0 {
+			added, err = s.d.AddROMBreakpoint(addr.Addr, addr.PRG, condition)
+		} else {
+			added, err = s.d.AddBreakpoint(BreakExec, addr.Addr, addr.Addr, condition)
+		}
+		if err != nil {
+			bp.Message = err.Error()
+			return
+		}
+
+		if bp.ID == 0 {
+			bp.ID, bp.Verified = added.ID, true
+		}
+		s.clientIDs[added.ID] = bp.ID
+		s.sourceBreakpoints[path] = append(s.sourceBreakpoints[path], added.ID)
+	}
+}
+
+// setFunctionBreakpoints - breakpoints on labels, or addresses given as expressions
+func (s *DAPSession) setFunctionBreakpoints(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		Breakpoints []struct {
+			Name      string `json:"name"`
+			Condition string `json:"condition"`
+		} `json:"breakpoints"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+
+	s.clearBreakpoints(s.functionBreakpoints)
+	s.functionBreakpoints = nil
+
+	breakpoints := []dapBreakpoint{}
+	for _, requested := range args.Breakpoints {
+		bp := dapBreakpoint{}
+
+		added, err := s.d.AddNamedBreakpoint(requested.Name, requested.Condition)
+
+		if err != nil {
+			bp.Message = err.Error()
+		} else {
+			bp.ID, bp.Verified = added.ID, true
+			s.clientIDs[added.ID] = added.ID
+			s.functionBreakpoints = append(s.functionBreakpoints, added.ID)
+		}
+		breakpoints = append(breakpoints, bp)
+	}
+
+	return map[string]interface{}{"breakpoints": breakpoints}, nil
+}
+
+// frame - a stack frame for code at addr, in the routine entered at routine
+func (s *DAPSession) frame(id int, addr uint16, routine string) dapStackFrame {
+	frame := dapStackFrame{
+		ID:                          id,
+		Name:                        routine,
+		InstructionPointerReference: fmt.Sprintf("0x%04X", addr),
+	}
+
+	if s.info != nil {
+		if line, ok := s.info.SourceAt(s.nes, addr); ok {
+			frame.Source = &dapSource{Name: filepath.Base(line.File), Path: line.File}
+			frame.Line, frame.Column = line.Line, 1
+		}
+	}
+	if frame.Source == nil {
+		frame.Name = fmt.Sprintf("%s ($%04X)", routine, addr)
+	}
+
+	return frame
+}
+
+// stackTrace - the instruction at PC, then where each call on the
+// debugger's call stack was made from
+func (s *DAPSession) stackTrace(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		StartFrame int `json:"startFrame"`
+		Levels     int `json:"levels"`
+	}
+	if len(arguments) > 0 {
+		if err := json.Unmarshal(arguments, &args); err != nil {
+			return nil, err
+		}
+	}
+
+	stack := s.d.CallStack()
+	routine := func(depth int) string {
+		if depth < 0 {
+			return "reset"
+		}
+		frame := stack[depth]
+		name := fmt.Sprintf("$%04X", frame.Target)
+		if s.nes.Symbols != nil {
+			if label := s.nes.Symbols.Name(s.nes, frame.Target); label != "" {
+				name = label
+			}
+		}
+		if frame.Kind == FrameCall {
+			return name
+		}
+		return fmt.Sprintf("%s %s", frame.Kind, name)
+	}
+
+	frames := []dapStackFrame{s.frame(0, s.nes.CPU.PC, routine(len(stack)-1))}
+	for i := len(stack) - 1; i >= 0; i-- {
+		frames = append(frames, s.frame(len(frames), stack[i].From, routine(i-1)))
+	}
+
+	total := len(frames)
+	if args.StartFrame > len(frames) {
+		args.StartFrame = len(frames)
+	}
+	frames = frames[args.StartFrame:]
+	if args.Levels > 0 && args.Levels < len(frames) {
+		frames = frames[:args.Levels]
+	}
+
+	return map[string]interface{}{"stackFrames": frames, "totalFrames": total}, nil
+}
+
+func (s *DAPSession) variables(reference int) []dapVariable {
+	cpu := s.nes.CPU
+	ppu := s.nes.PPU
+
+	byteValue := func(name string, value uint8) dapVariable {
+		return dapVariable{Name: name, Value: fmt.Sprintf("$%02X (%d)", value, value)}
+	}
+	boolValue := func(name string, value bool) dapVariable {
+		return dapVariable{Name: name, Value: fmt.Sprint(boolInt(value))}
+	}
+
+	switch reference {
+	case dapRegisters:
+		return []dapVariable{
+			byteValue("A", cpu.A),
+			byteValue("X", cpu.X),
+			byteValue("Y", cpu.Y),
+			byteValue("SP", cpu.SP),
+			{Name: "PC", Value: fmt.Sprintf("$%04X", cpu.PC)},
+			{Name: "P", Value: fmt.Sprintf("$%02X %s", cpu.P, flagString(cpu.P)), VariablesReference: dapFlags},
+		}
+
+	case dapFlags:
+		var flags []dapVariable
+		for i, name := range flagNames {
+			if name == '-' || name == 'B' {
+				continue
+			}
+			flags = append(flags, boolValue(string(name), cpu.P&(0x80>>uint(i)) != 0))
+		}
+		return flags
+
+	case dapPPU:
+		vram := (uint16(ppu.ppuAddrMSB)<<8 | uint16(ppu.ppuAddrLSB)) + ppu.ppuAddrOffset
+		return []dapVariable{
+			{Name: "Scanline", Value: fmt.Sprint(ppu.Scanline)},
+			{Name: "Dot", Value: fmt.Sprint(ppu.Cycle)},
+			{Name: "Frame", Value: fmt.Sprint(ppu.frameCount)},
+			byteValue("PPUSTATUS", ppu.status),
+			{Name: "VRAM address", Value: fmt.Sprintf("$%04X", vram&0x3FFF)},
+			byteValue("OAMADDR", ppu.oamAddr),
+			boolValue("VBlank", ppu.inVBlank()),
+			boolValue("NMI enabled", ppu.ppuctrl.nmiGenerate == 1),
+			boolValue("Background", ppu.ppumask.backgroundEnable),
+			boolValue("Sprites", ppu.ppumask.spriteEnable),
+		}
+
+	case dapRAM:
+		rows := make([]dapVariable, 0, 0x80)
+		for addr := 0; addr < 0x800; addr += 16 {
+			var sb strings.Builder
+			for i := 0; i < 16; i++ {
+				if i > 0 {
+					sb.WriteByte(' ')
+				}
+				fmt.Fprintf(&sb, "%02X", s.d.Peek(uint16(addr+i)))
+			}
+			rows = append(rows, dapVariable{Name: fmt.Sprintf("$%04X", addr), Value: sb.String()})
+		}
+		return rows
+	}
+
+	return []dapVariable{}
+}
+
+// setVariable - edits a register, a flag or a row of RAM
+func (s *DAPSession) setVariable(arguments json.RawMessage) (interface{}, error) {
+	var args struct {
+		VariablesReference int    `json:"variablesReference"`
+		Name               string `json:"name"`
+		Value              string `json:"value"`
+	}
+	if err := json.Unmarshal(arguments, &args); err != nil {
+		return nil, err
+	}
+
+	switch args.VariablesReference {
+	case dapRegisters, dapFlags:
+		// the value shown for P is followed by its flags
+		text := args.Value
+		if args.Name == "P" {
+			text = strings.Fields(text + " ")[0]
+		}
+		value, err := s.d.Evaluate(text)
+		if err != nil {
+			return nil, err
+		}
+
+		if args.VariablesReference == dapRegisters {
+			if value < 0 || value > 0xFFFF {
+				return nil, fmt.Errorf("%s is out of range", args.Value)
+			}
+			if err := s.d.SetRegister(args.Name, uint16(value)); err != nil {
+				return nil, err
+			}
+		} else {
+			bit := strings.IndexByte(flagNames, strings.ToUpper(args.Name)[0])
+			if len(args.Name) != 1 || bit < 0 {
+				return nil, fmt.Errorf("no flag %s", args.Name)
+			}
+			mask := uint8(0x80 >> uint(bit))
+			s.nes.CPU.P &^= mask
+			if value != 0 {
+				s.nes.CPU.P |= mask
+			}
+		}
+
+	case dapRAM:
+		addr, err := strconv.ParseUint(strings.TrimPrefix(args.Name, "$"), 16, 16)
+		if err != nil {
+			return nil, fmt.Errorf("no row %s", args.Name)
+		}
+		for i, field := range strings.Fields(args.Value) {
+			value, err := strconv.ParseUint(strings.TrimPrefix(field, "$"), 16, 8)
+			if err != nil {
+				return nil, fmt.Errorf("%s isn't a hex byte", field)
+			}
+			s.d.Poke(uint16(int(addr)+i), uint8(value))
+		}
+
+	default:
+		return nil, fmt.Errorf("%s can't be changed", args.Name)
+	}
+
+	for _, variable := range s.variables(args.VariablesReference) {
+		if strings.EqualFold(variable.Name, args.Name) {
+			return map[string]interface{}{"value": variable.Value, "variablesReference": variable.VariablesReference}, nil
+		}
+	}
+
+	return map[string]interface{}{"value": args.Value}, nil
+}
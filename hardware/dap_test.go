@@ -0,0 +1,184 @@
+package hardware
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// dapClient - the editor's end of a DAP connection
+type dapClient struct {
+	t      *testing.T
+	conn   net.Conn
+	r      *bufio.Reader
+	seq    int
+	events []map[string]interface{}
+}
+
+// request - sends a request and reads up to its response, keeping events
+func (c *dapClient) request(command string, arguments interface{}) map[string]interface{} {
+	c.seq++
+	body, _ := json.Marshal(map[string]interface{}{"seq": c.seq, "type": "request", "command": command, "arguments": arguments})
+	fmt.Fprintf(c.conn, "Content-Length: %d\r\n\r\n%s", len(body), body)
+
+	for {
+		message := c.readAny()
+		if message["type"] == "response" && message["request_seq"] == float64(c.seq) {
+			if message["success"] != true {
+				c.t.Fatalf("%s failed: %v", command, message["message"])
+			}
+			body, _ := message["body"].(map[string]interface{})
+			return body
+		}
+	}
+}
+
+// readAny - reads a message whole, keeping it if it's an event
+func (c *dapClient) readAny() map[string]interface{} {
+	c.conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+
+	length := 0
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			c.t.Fatal(err)
+		}
+		if line == "\r\n" {
+			break
+		}
+		fmt.Sscanf(line, "Content-Length: %d", &length)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.r, body); err != nil {
+		c.t.Fatal(err)
+	}
+	var message map[string]interface{}
+	if err := json.Unmarshal(body, &message); err != nil {
+		c.t.Fatal(err)
+	}
+
+	if message["type"] == "event" {
+		c.events = append(c.events, message)
+	}
+	return message
+}
+
+// event - waits for the next event called name
+func (c *dapClient) event(name string) map[string]interface{} {
+	for {
+		for i, event := range c.events {
+			if event["event"] == name {
+				c.events = append(c.events[:i], c.events[i+1:]...)
+				body, _ := event["body"].(map[string]interface{})
+				return body
+			}
+		}
+		c.readAny()
+	}
+}
+
+func TestDAPSession(t *testing.T) {
+	rom, _ := assembleROM(t, debugTestSource)
+	dir := filepath.Dir(rom)
+	if err := os.WriteFile(filepath.Join(dir, "test.dbg"), []byte(debugTestInfo), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server, conn := net.Pipe()
+	defer conn.Close()
+
+	done := make(chan struct{})
+	go func() {
+		session := NewDAPSession(server)
+		session.InitNES = func(nes *NES) {
+			nes.APU.InitAPU(false)
+			nes.PPU.InitFrame(1)
+		}
+		if session.Launch() {
+			session.Run()
+		}
+		server.Close()
+		close(done)
+	}()
+
+	c := &dapClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+
+	if body := c.request("initialize", map[string]interface{}{"adapterID": "nes-emu"}); body["supportsConditionalBreakpoints"] != true {
+		t.Errorf("Expected conditional breakpoint support, got %v", body)
+	}
+	c.request("launch", map[string]interface{}{"program": rom, "stopOnEntry": true})
+	c.event("initialized")
+
+	source := filepath.Join(dir, "test.s")
+	body := c.request("setBreakpoints", map[string]interface{}{
+		"source":      map[string]interface{}{"path": source},
+		"breakpoints": []map[string]interface{}{{"line": 18}, {"line": 40}},
+	})
+	breakpoints := body["breakpoints"].([]interface{})
+	inner := breakpoints[0].(map[string]interface{})
+	if inner["verified"] != true || inner["line"] != float64(19) {
+		t.Errorf("Expected the breakpoint on the inner: label to move to 19, got %v", inner)
+	}
+	if missing := breakpoints[1].(map[string]interface{}); missing["verified"] != false {
+		t.Errorf("Expected no breakpoint past the end of the code, got %v", missing)
+	}
+
+	c.request("configurationDone", nil)
+	if stop := c.event("stopped"); stop["reason"] != "entry" {
+		t.Errorf("Expected to stop on entry, got %v", stop)
+	}
+
+	c.request("continue", map[string]interface{}{"threadId": dapThreadID})
+	stop := c.event("stopped")
+	if stop["reason"] != "breakpoint" || fmt.Sprint(stop["hitBreakpointIds"]) != fmt.Sprintf("[%v]", inner["id"]) {
+		t.Fatalf("Expected to stop on the breakpoint, got %v", stop)
+	}
+
+	frames := c.request("stackTrace", map[string]interface{}{"threadId": dapThreadID})["stackFrames"].([]interface{})
+	var lines []string
+	for _, frame := range frames {
+		frame := frame.(map[string]interface{})
+		lines = append(lines, fmt.Sprintf("%v:%v", frame["name"], frame["line"]))
+	}
+	if fmt.Sprint(lines) != "[inner:19 outer:16 reset:9]" {
+		t.Errorf("Expected inner, outer and reset on the stack, got %v", lines)
+	}
+
+	c.request("setVariable", map[string]interface{}{"variablesReference": dapRegisters, "name": "A", "value": "$3F"})
+	c.request("setVariable", map[string]interface{}{"variablesReference": dapFlags, "name": "C", "value": "1"})
+	variables := c.request("variables", map[string]interface{}{"variablesReference": dapRegisters})["variables"].([]interface{})
+	for _, v := range variables {
+		v := v.(map[string]interface{})
+		switch v["name"] {
+		case "A":
+			if v["value"] != "$3F (63)" {
+				t.Errorf("Expected A to be set, got %v", v["value"])
+			}
+		case "P":
+			if v["value"] != "$27 nv-bdIZC" {
+				t.Errorf("Expected the carry to be set, got %v", v["value"])
+			}
+		}
+	}
+	if result := c.request("evaluate", map[string]interface{}{"expression": "A + C"})["result"]; result != "64 ($40)" {
+		t.Errorf("Expected A + C to be 64, got %v", result)
+	}
+
+	c.request("next", map[string]interface{}{"threadId": dapThreadID})
+	c.event("stopped")
+	frames = c.request("stackTrace", map[string]interface{}{"threadId": dapThreadID, "levels": 1})["stackFrames"].([]interface{})
+	if top := frames[0].(map[string]interface{}); len(frames) != 1 || top["line"] != float64(20) {
+		t.Errorf("Expected to step onto the rts on 20, got %v", frames)
+	}
+
+	c.request("disconnect", nil)
+	c.event("terminated")
+	<-done
+}
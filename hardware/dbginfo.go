@@ -0,0 +1,407 @@
+package hardware
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SourceLine - a line of assembly source
+type SourceLine struct {
+	File string
+	Line int
+}
+
+// LineAddress - where the code for a source line is. Code in cartridge
+// space is also pinned to its PRG ROM offset, so a banked line is only
+// matched while its bank is mapped in.
+type LineAddress struct {
+	Addr uint16
+
+	// offset into PRG ROM, or -1 for code that runs from RAM
+	PRG int
+}
+
+type debugLine struct {
+	SourceLine
+	LineAddress
+
+	size int
+
+	// a line of a macro body, less useful than the line that expanded it
+	macro bool
+}
+
+// DebugInfo - the line information and labels from a ca65/ld65 debug
+// file, made with ld65 --dbgfile
+type DebugInfo struct {
+	// source paths by file id, relative paths are resolved against the
+	// debug file's directory
+	Files []string
+
+	// labels, named as they'd be written from outside their scope, like
+	// main::loop or reset@wait
+	Symbols []Symbol
+
+	lines []debugLine
+}
+
+// LoadDebugInfo - reads a ca65 debug file
+func LoadDebugInfo(filename string) (*DebugInfo, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := ParseDebugInfo(file, filepath.Dir(filename))
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", filename, err)
+	}
+
+	return info, nil
+}
+
+type dbgSegment struct {
+	start  int
+	ooffs  int
+	oname  string
+	inFile bool
+}
+
+// prg - the PRG rom offset of offset into the segment, or -1 if it's
+// not in cartridge space. An iNES file starts with its 16 byte header.
+func (seg dbgSegment) prg(offset int) int {
+	if seg.start+offset < 0x8000 || !seg.inFile {
+		return -1
+	}
+
+	prg := seg.ooffs + offset
+	if strings.EqualFold(filepath.Ext(seg.oname), ".nes") {
+		prg -= 16
+	}
+
+	return prg
+}
+
+type dbgSpan struct {
+	seg, start, size int
+}
+
+type dbgScope struct {
+	name   string
+	parent int
+}
+
+type dbgSymbol struct {
+	name                     string
+	value, size, seg, scope  int
+	parent                   int
+	isLabel, inSeg, hasScope bool
+}
+
+type dbgLineRecord struct {
+	file, line int
+	spans      []int
+	macro      bool
+}
+
+// ParseDebugInfo - parses a ca65 debug file. dir is where relative
+// source paths are found from.
+func ParseDebugInfo(r io.Reader, dir string) (*DebugInfo, error) {
+	info := &DebugInfo{}
+
+	files := map[int]string{}
+	segments := map[int]dbgSegment{}
+	spans := map[int]dbgSpan{}
+	scopes := map[int]dbgScope{}
+	symbols := map[int]dbgSymbol{}
+	var records []dbgLineRecord
+
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		kind, fields, err := parseDbgRecord(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+
+		id, _ := fields.int("id")
+		switch kind {
+		case "file":
+			files[id] = fields["name"]
+
+		case "seg":
+			seg := dbgSegment{oname: fields["oname"]}
+			seg.start, _ = fields.int("start")
+			seg.ooffs, seg.inFile = fields.int("ooffs")
+			segments[id] = seg
+
+		case "span":
+			var span dbgSpan
+			span.seg, _ = fields.int("seg")
+			span.start, _ = fields.int("start")
+			span.size, _ = fields.int("size")
+			spans[id] = span
+
+		case "scope":
+			scope := dbgScope{name: fields["name"], parent: -1}
+			if parent, ok := fields.int("parent"); ok {
+				scope.parent = parent
+			}
+			scopes[id] = scope
+
+		case "sym":
+			sym := dbgSymbol{name: fields["name"], parent: -1, isLabel: fields["type"] == "lab"}
+			sym.value, _ = fields.int("val")
+			sym.size, _ = fields.int("size")
+			sym.seg, sym.inSeg = fields.int("seg")
+			sym.scope, sym.hasScope = fields.int("scope")
+			if parent, ok := fields.int("parent"); ok {
+				sym.parent = parent
+			}
+			symbols[id] = sym
+
+		case "line":
+			// lines without code, like comments, have no spans
+			if fields["span"] == "" {
+				continue
+			}
+			var record dbgLineRecord
+			record.file, _ = fields.int("file")
+			record.line, _ = fields.int("line")
+			kind, _ := fields.int("type")
+			record.macro = kind == 2
+			for _, s := range strings.Split(fields["span"], "+") {
+				span, err := strconv.Atoi(s)
+				if err != nil {
+					return nil, fmt.Errorf("line %d: bad span list %q", lineNum, fields["span"])
+				}
+				record.spans = append(record.spans, span)
+			}
+			records = append(records, record)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	maxFile := -1
+	for id := range files {
+		if id > maxFile {
+			maxFile = id
+		}
+	}
+	info.Files = make([]string, maxFile+1)
+	for id, name := range files {
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		info.Files[id] = filepath.Clean(name)
+	}
+
+	for _, record := range records {
+		if record.file < 0 || record.file >= len(info.Files) {
+			return nil, fmt.Errorf("line record for missing file %d", record.file)
+		}
+
+		for _, id := range record.spans {
+			span, ok := spans[id]
+			if !ok {
+				return nil, fmt.Errorf("line record for missing span %d", id)
+			}
+			seg, ok := segments[span.seg]
+			if !ok {
+				return nil, fmt.Errorf("span %d in missing segment %d", id, span.seg)
+			}
+
+			info.lines = append(info.lines, debugLine{
+				SourceLine:  SourceLine{info.Files[record.file], record.line},
+				LineAddress: LineAddress{uint16(seg.start + span.start), seg.prg(span.start)},
+				size:        span.size,
+				macro:       record.macro,
+			})
+		}
+	}
+
+	for id, sym := range symbols {
+		if !sym.isLabel {
+			continue
+		}
+
+		symbol := Symbol{Name: dbgSymbolName(id, symbols, scopes), Addr: uint16(sym.value), PRG: -1, Size: sym.size}
+		if seg, ok := segments[sym.seg]; ok && sym.inSeg {
+			symbol.PRG = seg.prg(sym.value - seg.start)
+		}
+		info.Symbols = append(info.Symbols, symbol)
+	}
+	sort.Slice(info.Symbols, func(i, j int) bool {
+		return info.Symbols[i].Name < info.Symbols[j].Name
+	})
+
+	sort.SliceStable(info.lines, func(i, j int) bool {
+		a, b := info.lines[i], info.lines[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line
+	})
+
+	return info, nil
+}
+
+// dbgSymbolName - a symbol's name qualified by its scopes, or by the
+// label a cheap local like @loop belongs to
+func dbgSymbolName(id int, symbols map[int]dbgSymbol, scopes map[int]dbgScope) string {
+	sym := symbols[id]
+	if parent, ok := symbols[sym.parent]; ok && parent.parent < 0 {
+		return dbgSymbolName(sym.parent, symbols, scopes) + sym.name
+	}
+
+	// the depth limit guards against scopes that are their own parents
+	name := sym.name
+	for depth, id := 0, sym.scope; sym.hasScope && depth < 64; depth++ {
+		scope, ok := scopes[id]
+		if !ok || scope.name == "" {
+			break
+		}
+		name = scope.name + "::" + name
+		id = scope.parent
+	}
+
+	return name
+}
+
+type dbgFields map[string]string
+
+func (fields dbgFields) int(key string) (int, bool) {
+	value, ok := fields[key]
+	if !ok {
+		return 0, false
+	}
+
+	n, err := strconv.ParseInt(value, 0, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return int(n), true
+}
+
+// parseDbgRecord - splits a line like seg<TAB>id=0,name="CODE",start=0x8000
+func parseDbgRecord(text string) (string, dbgFields, error) {
+	fields := dbgFields{}
+
+	kind, rest := text, ""
+	if i := strings.IndexAny(text, " \t"); i >= 0 {
+		kind, rest = text[:i], strings.TrimSpace(text[i+1:])
+	}
+
+	for rest != "" {
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			return "", nil, fmt.Errorf("expected key=value in %q", rest)
+		}
+		key := rest[:eq]
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end < 0 {
+				return "", nil, fmt.Errorf("unterminated string in %q", text)
+			}
+			value, rest = rest[1:end+1], rest[end+2:]
+		} else {
+			end := strings.IndexByte(rest, ',')
+			if end < 0 {
+				end = len(rest)
+			}
+			value, rest = rest[:end], rest[end:]
+		}
+		fields[key] = value
+
+		rest = strings.TrimPrefix(rest, ",")
+	}
+
+	return kind, fields, nil
+}
+
+// SourceAt - the source line of the code at addr, as the cartridge is
+// mapped now
+func (info *DebugInfo) SourceAt(nes *NES, addr uint16) (SourceLine, bool) {
+	prg := -1
+	if nes.CARTIO != nil {
+		prg = nes.CARTIO.prgOffset(addr)
+	}
+
+	var best *debugLine
+	for i := range info.lines {
+		line := &info.lines[i]
+
+		var offset int
+		if line.PRG >= 0 {
+			offset = prg - line.PRG
+		} else {
+			offset = int(addr) - int(line.Addr)
+		}
+		if prg >= 0 && line.PRG < 0 || offset < 0 || offset >= line.size {
+			continue
+		}
+
+		// prefer the line that was written out over a macro body,
+		// then the narrowest span
+		if best == nil || best.macro && !line.macro || best.macro == line.macro && line.size < best.size {
+			best = line
+		}
+	}
+
+	if best == nil {
+		return SourceLine{}, false
+	}
+
+	return best.SourceLine, true
+}
+
+// FindFile - the source file path names. Matches the path the debug file
+// resolves to, or failing that the one file whose path ends the same way.
+func (info *DebugInfo) FindFile(path string) (string, bool) {
+	path = filepath.Clean(path)
+
+	found := ""
+	for _, file := range info.Files {
+		if file == path {
+			return file, true
+		}
+		if strings.HasSuffix(path, string(filepath.Separator)+filepath.Base(file)) || filepath.Base(path) == filepath.Base(file) {
+			if found != "" && found != file {
+				return "", false
+			}
+			found = file
+		}
+	}
+
+	return found, found != ""
+}
+
+// LineAddresses - where the code for a line of file is. Lines without
+// code move down to the next line that has some, which is returned with
+// the addresses.
+func (info *DebugInfo) LineAddresses(file string, line int) (int, []LineAddress) {
+	found := 0
+	var addresses []LineAddress
+
+	for _, l := range info.lines {
+		if l.File != file || l.Line < line || found != 0 && l.Line != found {
+			continue
+		}
+		found = l.Line
+		addresses = append(addresses, l.LineAddress)
+	}
+
+	return found, addresses
+}
@@ -0,0 +1,118 @@
+package hardware
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// debugTestInfo - what ld65 would write for debugTestSource, linked into
+// test.nes. Line 30 is a macro body line covering the same bytes as 19,
+// and @loop a cheap local of reset.
+const debugTestInfo = `version	major=2,minor=0
+info	csym=0,file=1,lib=0,line=8,mod=1,scope=1,seg=3,span=6,sym=6,type=0
+file	id=0,name="test.s",size=300,mtime=0x60000000,mod=0
+line	id=0,file=0,line=4
+line	id=1,file=0,line=5,span=0
+line	id=2,file=0,line=9,span=1
+line	id=3,file=0,line=11,span=2
+line	id=4,file=0,line=16,span=3
+line	id=5,file=0,line=19,span=4
+line	id=6,file=0,line=20,span=5
+line	id=7,file=0,line=30,type=2,count=1,span=4
+mod	id=0,name="test.o",file=0
+seg	id=0,name="HEADER",start=0x000000,size=0x0010,addrsize=absolute,type=ro,oname="test.nes",ooffs=0
+seg	id=1,name="CODE",start=0x00C000,size=0x001B,addrsize=absolute,type=ro,oname="test.nes",ooffs=16
+span	id=0,seg=1,start=0,size=2,type=0
+span	id=1,seg=1,start=8,size=3
+span	id=2,seg=1,start=11,size=2
+span	id=3,seg=1,start=19,size=3
+span	id=4,seg=1,start=23,size=3
+seg	id=2,name="BSS",start=0x000300,size=0x0001,addrsize=absolute,type=rw
+span	id=5,seg=1,start=26,size=1
+scope	id=0,name="",mod=0,size=27
+sym	id=0,name="reset",addrsize=absolute,scope=0,def=3,val=0xC000,seg=1,type=lab
+sym	id=1,name="@loop",addrsize=absolute,parent=0,def=7,val=0xC010,seg=1,type=lab
+sym	id=2,name="outer",addrsize=absolute,scope=0,def=8,val=0xC013,seg=1,type=lab
+sym	id=3,name="inner",addrsize=absolute,scope=0,def=11,val=0xC017,seg=1,type=lab
+sym	id=4,name="counter",addrsize=absolute,size=1,scope=0,def=40,val=0x300,seg=2,type=lab
+sym	id=5,name="PPUCTRL",addrsize=absolute,scope=0,def=41,val=0x2000,type=equ
+`
+
+func TestParseDebugInfo(t *testing.T) {
+	nes, _ := assembleNES(t, debugTestSource)
+
+	info, err := ParseDebugInfo(strings.NewReader(debugTestInfo), "/src")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join("/src", "test.s")
+	if len(info.Files) != 1 || info.Files[0] != file {
+		t.Fatalf("Expected test.s resolved against the debug file, got %v", info.Files)
+	}
+
+	tests := []struct {
+		addr uint16
+		line int
+	}{
+		{0xC000, 5},
+		{0xC001, 5},
+		{0xC008, 9},
+		{0xC017, 19},
+		{0xC019, 19},
+		{0xC01A, 20},
+		// 16KB of PRG is mirrored, so the same code is at $8000
+		{0x8017, 19},
+		{0xC003, 0},
+		{0x0017, 0},
+	}
+	for _, test := range tests {
+		line, ok := info.SourceAt(nes, test.addr)
+		if ok != (test.line != 0) || line.Line != test.line {
+			t.Errorf("$%04X: expected line %d, got %+v %v", test.addr, test.line, line, ok)
+		}
+	}
+
+	if line, addresses := info.LineAddresses(file, 10); line != 11 || len(addresses) != 1 || addresses[0] != (LineAddress{0xC00B, 11}) {
+		t.Errorf("Expected line 10 to move to the lda on 11, got %d %+v", line, addresses)
+	}
+	if line, addresses := info.LineAddresses(file, 21); line != 30 || len(addresses) != 1 {
+		t.Errorf("Expected line 21 to move to the macro line 30, got %d %+v", line, addresses)
+	}
+	if _, addresses := info.LineAddresses(file, 31); len(addresses) != 0 {
+		t.Errorf("Expected no code after line 30, got %+v", addresses)
+	}
+
+	var symbols []string
+	for _, sym := range info.Symbols {
+		symbols = append(symbols, fmt.Sprintf("%s=$%04X/%d", sym.Name, sym.Addr, sym.PRG))
+	}
+	if fmt.Sprint(symbols) != "[counter=$0300/-1 inner=$C017/23 outer=$C013/19 reset=$C000/0 reset@loop=$C010/16]" {
+		t.Errorf("Expected the labels but not the equate, got %v", symbols)
+	}
+
+	for _, path := range []string{file, "/elsewhere/test.s"} {
+		if found, ok := info.FindFile(path); !ok || found != file {
+			t.Errorf("%s: expected to find %s, got %q", path, file, found)
+		}
+	}
+	if _, ok := info.FindFile("/src/other.s"); ok {
+		t.Errorf("Expected other.s not to be found")
+	}
+}
+
+func TestParseDebugInfoErrors(t *testing.T) {
+	for _, bad := range []string{
+		"file\tid=0,name=\"test.s",
+		"line\tid=0,file=0,line=1,span=x",
+		"line\tid=0,file=0,line=1,span=0",
+		"file\tid=0,name=\"a.s\"\nline\tid=0,file=0,line=1,span=0",
+		"seg\tid",
+	} {
+		if _, err := ParseDebugInfo(strings.NewReader(bad), ""); err == nil {
+			t.Errorf("%q: expected an error", bad)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+package hardware
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+const debugHelp = `commands, numbers are decimal or $hex and can be expressions:
+  c, continue              run until a breakpoint
+  p, pause                 stop running
+  s, step [count]          run one instruction, or count of them
+  n, next                  step over a JSR
+  o, out                   run until the current subroutine returns
+  sl, scanline LINE        run until the PPU starts LINE
+  b, break ADDR [END] [if CONDITION]
+                           stop before running ADDR, or ADDR to END
+  rb ADDR [END] [if CONDITION]
+                           stop after reading ADDR
+  wb ADDR [END] [if CONDITION]
+                           stop after writing ADDR
+  bl, breakpoints          list breakpoints
+  d, delete ID             delete a breakpoint
+  enable ID, disable ID    turn a breakpoint on or off
+  r, regs                  show the registers
+  set REG VALUE            set A, X, Y, P, SP or PC
+  m, mem ADDR [LENGTH]     show memory
+  w, poke ADDR VALUE...    write memory
+  bt, stack                show the call stack
+  e, eval EXPR             print an expression, e.g. [$0300] + X
+  q, quit                  stop the emulator
+conditions are expressions on A X Y P SP PC, the flags N V D I Z C,
+SCANLINE DOT FRAME CYCLES, [addr] for memory and, for rb and wb, ADDR
+and VALUE of the access. An empty line repeats a step.
+`
+
+// DebugConsole - a line based command interface to a Debugger, for a
+// terminal or a pipe
+type DebugConsole struct {
+	d   *Debugger
+	out io.Writer
+
+	// the last stepping command, repeated by an empty line
+	repeat string
+}
+
+func NewDebugConsole(d *Debugger, out io.Writer) *DebugConsole {
+	return &DebugConsole{d: d, out: out}
+}
+
+// Report - prints why the debugger stopped and the instruction it's on
+func (c *DebugConsole) Report() {
+	fmt.Fprintf(c.out, "stopped: %s\n%s\n", c.d.LastStop(), c.d.Location())
+}
+
+// RunFrame - runs the debugger up to the end of a frame, reporting if it stops
+func (c *DebugConsole) RunFrame() {
+	if c.d.Paused() {
+		return
+	}
+
+	if c.d.RunFrame() {
+		c.Report()
+	}
+}
+
+// Poll - runs the commands waiting on commands without blocking.
+// Returns false once the user quits or commands is closed.
+func (c *DebugConsole) Poll(commands <-chan string) bool {
+	for {
+		select {
+		case line, ok := <-commands:
+			if !ok || !c.Execute(line) {
+				return false
+			}
+		default:
+			return true
+		}
+	}
+}
+
+// Run - drives the debugger without a window until the user quits or
+// commands is closed. Commands are waited for while paused, and checked
+// between frames while running.
+func (c *DebugConsole) Run(commands <-chan string) {
+	for {
+		if c.d.Paused() {
+			line, ok := <-commands
+			if !ok || !c.Execute(line) {
+				return
+			}
+			continue
+		}
+
+		c.RunFrame()
+		if !c.Poll(commands) {
+			return
+		}
+	}
+}
+
+// Execute - runs one command line. Returns false if it was quit.
+func (c *DebugConsole) Execute(line string) bool {
+	fields := strings.Fields(line)
+	if len(fields) == 0 {
+		if c.repeat == "" {
+			return true
+		}
+		fields = strings.Fields(c.repeat)
+	}
+
+	if err := c.execute(fields[0], fields[1:], line); err != nil {
+		if err == errQuit {
+			return false
+		}
+		fmt.Fprintln(c.out, "error:", err)
+	}
+
+	return true
+}
+
+var errQuit = fmt.Errorf("quit")
+
+func (c *DebugConsole) execute(command string, args []string, line string) error {
+	d := c.d
+
+	c.repeat = ""
+
+	// stepping starts from where the machine is now
+	switch command {
+	case "s", "step", "n", "next", "o", "out":
+		if !d.Paused() {
+			d.Pause()
+		}
+	}
+
+	switch command {
+	case "h", "help", "?":
+		fmt.Fprint(c.out, debugHelp)
+
+	case "c", "continue":
+		d.Continue()
+
+	case "p", "pause":
+		if !d.Paused() {
+			d.Pause()
+			c.Report()
+		}
+
+	case "s", "step":
+		count := 1
+		if len(args) > 0 {
+			value, err := d.Evaluate(strings.Join(args, " "))
+			if err != nil {
+				return err
+			}
+			count = value
+		}
+		for i := 0; i < count; i++ {
+			d.Step()
+			if d.LastStop().Reason != StopStep {
+				break
+			}
+		}
+		c.repeat = "step"
+		c.Report()
+
+	case "n", "next":
+		d.StepOver()
+		c.repeat = "next"
+		if d.Paused() {
+			c.Report()
+		}
+
+	case "o", "out":
+		if err := d.StepOut(); err != nil {
+			return err
+		}
+
+	case "sl", "scanline":
+		value, err := c.number(args, 0, 261)
+		if err != nil {
+			return err
+		}
+		d.RunToScanline(uint16(value))
+
+	case "b", "break", "rb", "wb":
+		kind := BreakExec
+		switch command {
+		case "rb":
+			kind = BreakRead
+		case "wb":
+			kind = BreakWrite
+		}
+		return c.addBreakpoint(kind, args)
+
+	case "bl", "breakpoints":
+		if len(d.Breakpoints()) == 0 {
+			fmt.Fprintln(c.out, "no breakpoints")
+		}
+		for _, bp := range d.Breakpoints() {
+			fmt.Fprintln(c.out, bp)
+		}
+
+	case "d", "delete", "enable", "disable":
+		id, err := c.number(args, 0, 1<<31)
+		if err != nil {
+			return err
+		}
+		if command == "enable" || command == "disable" {
+			return d.EnableBreakpoint(id, command == "enable")
+		}
+		return d.RemoveBreakpoint(id)
+
+	case "r", "regs":
+		fmt.Fprintln(c.out, d.Registers())
+
+	case "set":
+		if len(args) < 2 {
+			return fmt.Errorf("set REG VALUE")
+		}
+		value, err := c.number(args[1:], 0, 0xFFFF)
+		if err != nil {
+			return err
+		}
+		if err := d.SetRegister(args[0], uint16(value)); err != nil {
+			return err
+		}
+		fmt.Fprintln(c.out, d.Registers())
+
+	case "m", "mem":
+		return c.dumpMemory(args)
+
+	case "w", "poke":
+		if len(args) < 2 {
+			return fmt.Errorf("poke ADDR VALUE...")
+		}
+		addr, err := c.number(args[:1], 0, 0xFFFF)
+		if err != nil {
+			return err
+		}
+		for i := range args[1:] {
+			value, err := c.number(args[1+i:2+i], -0x80, 0xFF)
+			if err != nil {
+				return err
+			}
+			d.Poke(uint16(addr+i), uint8(value))
+		}
+
+	case "bt", "stack":
+		stack := d.CallStack()
+		if len(stack) == 0 {
+			fmt.Fprintln(c.out, "not in a subroutine")
+		}
+		for i := len(stack) - 1; i >= 0; i-- {
+			frame := stack[i]
+			fmt.Fprintf(c.out, "#%d %s  %s from %s, SP:%02X\n", len(stack)-1-i, c.addr(frame.Target, false), frame.Kind, c.addr(frame.From, true), frame.SP)
+		}
+
+	case "e", "eval":
+		value, err := d.Evaluate(strings.TrimSpace(line[strings.Index(line, command)+len(command):]))
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(c.out, "%d $%X\n", value, value)
+
+	case "q", "quit":
+		return errQuit
+
+	default:
+		return fmt.Errorf("unknown command %s, try help", command)
+	}
+
+	return nil
+}
+
+// addr - addr in hex, followed by its label, and its source line if
+// source is set, when symbols are loaded
+func (c *DebugConsole) addr(addr uint16, source bool) string {
+	nes := c.d.nes
+	if nes.Symbols != nil {
+		name := nes.Symbols.Name(nes, addr)
+		if source {
+			name = nes.Symbols.Describe(nes, addr)
+		}
+		if name != "" {
+			return fmt.Sprintf("$%04X %s", addr, name)
+		}
+	}
+
+	return fmt.Sprintf("$%04X", addr)
+}
+
+// number - evaluates args as one expression that has to be between min and max
+func (c *DebugConsole) number(args []string, min, max int) (int, error) {
+	if len(args) == 0 {
+		return 0, fmt.Errorf("missing a number")
+	}
+
+	value, err := c.d.Evaluate(strings.Join(args, " "))
+	if err != nil {
+		return 0, err
+	}
+	if value < min || value > max {
+		return 0, fmt.Errorf("%s is out of range", strings.Join(args, " "))
+	}
+
+	return value, nil
+}
+
+// addBreakpoint - parses ADDR [END] [if CONDITION]
+func (c *DebugConsole) addBreakpoint(kind BreakKind, args []string) error {
+	condition := ""
+	for i, arg := range args {
+		if arg == "if" {
+			condition = strings.Join(args[i+1:], " ")
+			args = args[:i]
+			break
+		}
+	}
+
+	if len(args) == 0 || len(args) > 2 {
+		return fmt.Errorf("break ADDR [END] [if CONDITION]")
+	}
+
+	// a label on banked code only stops in its own bank
+	if kind == BreakExec && len(args) == 1 {
+		bp, err := c.d.AddNamedBreakpoint(args[0], condition)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(c.out, "added", bp)
+		return nil
+	}
+
+	start, err := c.number(args[:1], 0, 0xFFFF)
+	if err != nil {
+		return err
+	}
+	end := start
+	if len(args) == 2 {
+		if end, err = c.number(args[1:], 0, 0xFFFF); err != nil {
+			return err
+		}
+	}
+
+	bp, err := c.d.AddBreakpoint(kind, uint16(start), uint16(end), condition)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(c.out, "added", bp)
+
+	return nil
+}
+
+// dumpMemory - prints memory 16 bytes a line, read without side effects
+func (c *DebugConsole) dumpMemory(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("mem ADDR [LENGTH]")
+	}
+
+	addr, err := c.number(args[:1], 0, 0xFFFF)
+	if err != nil {
+		return err
+	}
+	length := 0x40
+	if len(args) > 1 {
+		if length, err = c.number(args[1:], 1, 0x10000); err != nil {
+			return err
+		}
+	}
+
+	for row := 0; row < length; row += 16 {
+		fmt.Fprintf(c.out, "%04X", (addr+row)&0xFFFF)
+		for i := row; i < row+16 && i < length; i++ {
+			fmt.Fprintf(c.out, " %02X", c.d.Peek(uint16(addr+i)))
+		}
+		fmt.Fprintln(c.out)
+	}
+
+	return nil
+}
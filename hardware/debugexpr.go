@@ -0,0 +1,301 @@
+package hardware
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// debugContext - what a breakpoint condition is evaluated against. For
+// read and write breakpoints addr and value are the access that hit.
+type debugContext struct {
+	nes   *NES
+	addr  uint16
+	value uint8
+}
+
+type debugExpr func(ctx *debugContext) int
+
+// registers and other values conditions can name, case doesn't matter
+var debugNames = map[string]debugExpr{
+	"A":  func(ctx *debugContext) int { return int(ctx.nes.CPU.A) },
+	"X":  func(ctx *debugContext) int { return int(ctx.nes.CPU.X) },
+	"Y":  func(ctx *debugContext) int { return int(ctx.nes.CPU.Y) },
+	"P":  func(ctx *debugContext) int { return int(ctx.nes.CPU.P) },
+	"SP": func(ctx *debugContext) int { return int(ctx.nes.CPU.SP) },
+	"PC": func(ctx *debugContext) int { return int(ctx.nes.CPU.PC) },
+
+	"N": func(ctx *debugContext) int { return int(ctx.nes.CPU.P>>7) & 1 },
+	"V": func(ctx *debugContext) int { return int(ctx.nes.CPU.P>>6) & 1 },
+	"D": func(ctx *debugContext) int { return int(ctx.nes.CPU.P>>3) & 1 },
+	"I": func(ctx *debugContext) int { return int(ctx.nes.CPU.P>>2) & 1 },
+	"Z": func(ctx *debugContext) int { return int(ctx.nes.CPU.P>>1) & 1 },
+	"C": func(ctx *debugContext) int { return int(ctx.nes.CPU.P) & 1 },
+
+	"SCANLINE": func(ctx *debugContext) int { return int(ctx.nes.PPU.Scanline) },
+	"DOT":      func(ctx *debugContext) int { return int(ctx.nes.PPU.Cycle) },
+	"FRAME":    func(ctx *debugContext) int { return int(ctx.nes.PPU.frameCount) },
+	"CYCLES":   func(ctx *debugContext) int { return int(ctx.nes.CPU.Cycles()) },
+
+	"ADDR":  func(ctx *debugContext) int { return int(ctx.addr) },
+	"VALUE": func(ctx *debugContext) int { return int(ctx.value) },
+}
+
+// binary operators from loosest to tightest binding
+var debugOperators = [][]string{
+	{"||"},
+	{"&&"},
+	{"|"},
+	{"^"},
+	{"&"},
+	{"==", "!="},
+	{"<=", ">=", "<", ">"},
+	{"<<", ">>"},
+	{"+", "-"},
+	{"*", "/", "%"},
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+func applyOperator(op string, x, y debugExpr) debugExpr {
+	return func(ctx *debugContext) int {
+		a := x(ctx)
+
+		// && and || don't evaluate their right side when they don't need to
+		switch op {
+		case "&&":
+			return boolInt(a != 0 && y(ctx) != 0)
+		case "||":
+			return boolInt(a != 0 || y(ctx) != 0)
+		}
+
+		b := y(ctx)
+		switch op {
+		case "|":
+			return a | b
+		case "^":
+			return a ^ b
+		case "&":
+			return a & b
+		case "==":
+			return boolInt(a == b)
+		case "!=":
+			return boolInt(a != b)
+		case "<=":
+			return boolInt(a <= b)
+		case ">=":
+			return boolInt(a >= b)
+		case "<":
+			return boolInt(a < b)
+		case ">":
+			return boolInt(a > b)
+		case "<<":
+			return a << uint(b&63)
+		case ">>":
+			return a >> uint(b&63)
+		case "+":
+			return a + b
+		case "-":
+			return a - b
+		case "*":
+			return a * b
+		case "/":
+			if b == 0 {
+				return 0
+			}
+			return a / b
+		case "%":
+			if b == 0 {
+				return 0
+			}
+			return a % b
+		}
+		return 0
+	}
+}
+
+type debugParser struct {
+	text    string
+	pos     int
+	symbols *Symbols
+}
+
+// compileCondition - parses a breakpoint condition like
+// A == $3F && [$0300] > 4. Numbers are decimal, or hex with $ and binary
+// with %. [addr] is the byte at addr, read without side effects. Other
+// names are looked up in symbols, which can be nil.
+func compileCondition(text string, symbols *Symbols) (debugExpr, error) {
+	p := &debugParser{text: text, symbols: symbols}
+
+	expr, err := p.binary(0)
+	if err != nil {
+		return nil, err
+	}
+
+	p.skipSpace()
+	if p.pos < len(p.text) {
+		return nil, fmt.Errorf("unexpected %q in %q", p.text[p.pos:], text)
+	}
+
+	return expr, nil
+}
+
+func (p *debugParser) skipSpace() {
+	for p.pos < len(p.text) && (p.text[p.pos] == ' ' || p.text[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *debugParser) binary(level int) (debugExpr, error) {
+	if level == len(debugOperators) {
+		return p.unary()
+	}
+
+	x, err := p.binary(level + 1)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		p.skipSpace()
+
+		op := ""
+		for _, candidate := range debugOperators[level] {
+			if longestOperator(p.text[p.pos:]) == candidate {
+				op = candidate
+			}
+		}
+		if op == "" {
+			return x, nil
+		}
+		p.pos += len(op)
+
+		y, err := p.binary(level + 1)
+		if err != nil {
+			return nil, err
+		}
+		x = applyOperator(op, x, y)
+	}
+}
+
+// longestOperator - the operator text starts with, so < isn't taken
+// from the front of <<
+func longestOperator(text string) string {
+	longest := ""
+	for _, level := range debugOperators {
+		for _, op := range level {
+			if strings.HasPrefix(text, op) && len(op) > len(longest) {
+				longest = op
+			}
+		}
+	}
+
+	return longest
+}
+
+func (p *debugParser) unary() (debugExpr, error) {
+	p.skipSpace()
+	if p.pos == len(p.text) {
+		return nil, fmt.Errorf("%q ends early", p.text)
+	}
+
+	switch op := p.text[p.pos]; op {
+	case '!', '~', '-':
+		p.pos++
+		x, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(ctx *debugContext) int {
+			switch op {
+			case '!':
+				return boolInt(x(ctx) == 0)
+			case '~':
+				return ^x(ctx)
+			}
+			return -x(ctx)
+		}, nil
+	}
+
+	return p.primary()
+}
+
+func (p *debugParser) primary() (debugExpr, error) {
+	c := p.text[p.pos]
+
+	switch {
+	case c == '(' || c == '[':
+		closing := byte(')')
+		if c == '[' {
+			closing = ']'
+		}
+
+		p.pos++
+		x, err := p.binary(0)
+		if err != nil {
+			return nil, err
+		}
+		p.skipSpace()
+		if p.pos == len(p.text) || p.text[p.pos] != closing {
+			return nil, fmt.Errorf("missing %c in %q", closing, p.text)
+		}
+		p.pos++
+
+		if c == '(' {
+			return x, nil
+		}
+		return func(ctx *debugContext) int {
+			return int(ctx.nes.CPU.Bus.Peek8(uint16(x(ctx))))
+		}, nil
+
+	case c == '$' || c == '%' || c >= '0' && c <= '9':
+		start := p.pos
+		base := 10
+		switch c {
+		case '$':
+			base, start = 16, start+1
+		case '%':
+			base, start = 2, start+1
+		}
+
+		p.pos = start
+		for p.pos < len(p.text) && isAlnum(p.text[p.pos]) {
+			p.pos++
+		}
+		value, err := strconv.ParseInt(p.text[start:p.pos], base, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad number %q", p.text[start:p.pos])
+		}
+		return func(*debugContext) int { return int(value) }, nil
+
+	case isAlnum(c) || c == '@':
+		// labels can be scoped, like main::loop or reset@wait
+		start := p.pos
+		for p.pos < len(p.text) && (isAlnum(p.text[p.pos]) || p.text[p.pos] == '@' || p.text[p.pos] == ':') {
+			p.pos++
+		}
+		name := p.text[start:p.pos]
+		if expr, ok := debugNames[strings.ToUpper(name)]; ok {
+			return expr, nil
+		}
+		if p.symbols != nil {
+			if sym, ok := p.symbols.Resolve(name); ok {
+				addr := int(sym.Addr)
+				return func(*debugContext) int { return addr }, nil
+			}
+		}
+		return nil, fmt.Errorf("unknown name %s", name)
+	}
+
+	return nil, fmt.Errorf("unexpected %q in %q", p.text[p.pos:], p.text)
+}
+
+func isAlnum(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
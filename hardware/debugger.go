@@ -0,0 +1,538 @@
+package hardware
+
+import (
+	"fmt"
+	"strings"
+)
+
+// BreakKind - what a breakpoint watches
+type BreakKind uint8
+
+const (
+	// BreakExec - stops before an instruction in the range runs
+	BreakExec BreakKind = iota
+
+	// BreakRead - stops after an instruction that reads the range
+	BreakRead
+
+	// BreakWrite - stops after an instruction that writes the range
+	BreakWrite
+)
+
+func (kind BreakKind) String() string {
+	switch kind {
+	case BreakRead:
+		return "read"
+	case BreakWrite:
+		return "write"
+	}
+
+	return "exec"
+}
+
+// Breakpoint - an address range to stop on, optionally only when a
+// condition holds
+type Breakpoint struct {
+	ID         int
+	Kind       BreakKind
+	Start, End uint16
+	Condition  string
+	Enabled    bool
+	Hits       int
+
+	// for breakpoints on banked code, the PRG ROM offset that has to be
+	// mapped at Start, otherwise -1
+	PRG int
+
+	condition debugExpr
+}
+
+func (bp *Breakpoint) String() string {
+	var sb strings.Builder
+
+	fmt.Fprintf(&sb, "#%d %s $%04X", bp.ID, bp.Kind, bp.Start)
+	if bp.End != bp.Start {
+		fmt.Fprintf(&sb, "-$%04X", bp.End)
+	}
+	if bp.PRG >= 0 {
+		fmt.Fprintf(&sb, " (PRG $%05X)", bp.PRG)
+	}
+	if bp.Condition != "" {
+		fmt.Fprintf(&sb, " if %s", bp.Condition)
+	}
+	if !bp.Enabled {
+		sb.WriteString(" (disabled)")
+	}
+	fmt.Fprintf(&sb, ", %d hits", bp.Hits)
+
+	return sb.String()
+}
+
+// FrameKind - how a call stack frame was entered
+type FrameKind uint8
+
+const (
+	FrameCall FrameKind = iota
+	FrameNMI
+	FrameIRQ
+	FrameBRK
+)
+
+func (kind FrameKind) String() string {
+	return [...]string{"JSR", "NMI", "IRQ", "BRK"}[kind]
+}
+
+// Frame - one entry of the call stack
+type Frame struct {
+	Kind FrameKind
+
+	// address of the JSR or BRK, or of the instruction the interrupt came before
+	From uint16
+
+	// the routine or handler entered
+	Target uint16
+
+	// the stack pointer before the return address was pushed
+	SP uint8
+}
+
+// StopReason - why the debugger paused
+type StopReason uint8
+
+const (
+	StopPause StopReason = iota
+	StopStep
+	StopBreakpoint
+	StopScanline
+	StopHalted
+)
+
+// Stop - where and why the debugger last paused
+type Stop struct {
+	Reason     StopReason
+	Breakpoint *Breakpoint
+
+	// the access that hit a read or write breakpoint
+	Addr  uint16
+	Value uint8
+}
+
+func (s Stop) String() string {
+	switch s.Reason {
+	case StopStep:
+		return "step"
+	case StopBreakpoint:
+		if s.Breakpoint.Kind == BreakExec {
+			return fmt.Sprintf("breakpoint #%d", s.Breakpoint.ID)
+		}
+		return fmt.Sprintf("breakpoint #%d, %s $%04X = %02X", s.Breakpoint.ID, s.Breakpoint.Kind, s.Addr, s.Value)
+	case StopScanline:
+		return "reached scanline"
+	case StopHalted:
+		return "cpu halted"
+	}
+
+	return "paused"
+}
+
+// what the debugger is running towards
+type runMode uint8
+
+const (
+	modePaused runMode = iota
+	modeContinue
+	modeStepOut
+	modeScanline
+)
+
+// Debugger - pauses and steps a NES, and watches its memory. Nothing is
+// run until it's asked to, and it has to be driven from the goroutine
+// that owns the NES.
+type Debugger struct {
+	nes *NES
+
+	breakpoints []*Breakpoint
+	nextID      int
+
+	calls callTracker
+
+	mode runMode
+
+	// call stack depth to get back to for step over and step out
+	depth int
+
+	scanline uint16
+
+	stop Stop
+
+	// a read or write breakpoint hit during the instruction being run
+	memoryHit *Stop
+
+	// removes the debugger's observer from the bus
+	detach func()
+
+	// watchpoints are switched off while the debugger edits memory itself
+	editing bool
+
+	// the next instruction is the one the debugger stopped on, so its
+	// execution breakpoint has already been reported
+	resuming bool
+}
+
+const (
+	brkOpcode = 0x00
+	jsrOpcode = 0x20
+)
+
+// NewDebugger - attaches a paused debugger to nes
+func NewDebugger(nes *NES) *Debugger {
+	d := &Debugger{nes: nes, nextID: 1}
+
+	d.detach = nes.CPU.Bus.Observe(func(addr uint16, value uint8, write bool) {
+		if write {
+			d.access(BreakWrite, addr, value)
+		} else {
+			d.access(BreakRead, addr, value)
+		}
+	})
+
+	return d
+}
+
+// Detach - stops the debugger watching the bus
+func (d *Debugger) Detach() {
+	d.detach()
+}
+
+// AddBreakpoint - adds a breakpoint on start to end inclusive. condition
+// can be empty, or an expression like A == $3F && [$0300] > 4.
+func (d *Debugger) AddBreakpoint(kind BreakKind, start, end uint16, condition string) (*Breakpoint, error) {
+	if end < start {
+		return nil, fmt.Errorf("$%04X-$%04X ends before it starts", start, end)
+	}
+
+	bp := &Breakpoint{ID: d.nextID, Kind: kind, Start: start, End: end, Condition: condition, Enabled: true, PRG: -1}
+	if condition != "" {
+		var err error
+		if bp.condition, err = compileCondition(condition, d.nes.Symbols); err != nil {
+			return nil, err
+		}
+	}
+
+	d.nextID++
+	d.breakpoints = append(d.breakpoints, bp)
+
+	return bp, nil
+}
+
+// AddROMBreakpoint - adds an execution breakpoint on addr that only stops
+// while offset prg of PRG ROM is mapped there
+func (d *Debugger) AddROMBreakpoint(addr uint16, prg int, condition string) (*Breakpoint, error) {
+	bp, err := d.AddBreakpoint(BreakExec, addr, addr, condition)
+	if err != nil {
+		return nil, err
+	}
+	bp.PRG = prg
+
+	return bp, nil
+}
+
+// AddNamedBreakpoint - adds an execution breakpoint on a label, or an
+// address given as an expression. A label on banked code only stops in
+// its own bank.
+func (d *Debugger) AddNamedBreakpoint(name, condition string) (*Breakpoint, error) {
+	if d.nes.Symbols != nil {
+		if sym, ok := d.nes.Symbols.Resolve(name); ok {
+			if sym.PRG >= 0 {
+				return d.AddROMBreakpoint(sym.Addr, sym.PRG, condition)
+			}
+			return d.AddBreakpoint(BreakExec, sym.Addr, sym.Addr, condition)
+		}
+	}
+
+	addr, err := d.Evaluate(name)
+	if err != nil {
+		return nil, err
+	}
+	if addr < 0 || addr > 0xFFFF {
+		return nil, fmt.Errorf("$%X isn't an address", addr)
+	}
+
+	return d.AddBreakpoint(BreakExec, uint16(addr), uint16(addr), condition)
+}
+
+// RemoveBreakpoint - deletes breakpoint id
+func (d *Debugger) RemoveBreakpoint(id int) error {
+	for i, bp := range d.breakpoints {
+		if bp.ID == id {
+			d.breakpoints = append(d.breakpoints[:i], d.breakpoints[i+1:]...)
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no breakpoint #%d", id)
+}
+
+// EnableBreakpoint - turns breakpoint id on or off
+func (d *Debugger) EnableBreakpoint(id int, enabled bool) error {
+	for _, bp := range d.breakpoints {
+		if bp.ID == id {
+			bp.Enabled = enabled
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no breakpoint #%d", id)
+}
+
+// Breakpoints - every breakpoint, in the order they were added
+func (d *Debugger) Breakpoints() []*Breakpoint {
+	return d.breakpoints
+}
+
+// matches - reports whether bp fires for an access to addr
+func (d *Debugger) matches(bp *Breakpoint, kind BreakKind, addr uint16, value uint8) bool {
+	if !bp.Enabled || bp.Kind != kind || addr < bp.Start || addr > bp.End {
+		return false
+	}
+	if bp.PRG >= 0 && d.nes.CARTIO.prgOffset(addr) != bp.PRG {
+		return false
+	}
+
+	if bp.condition != nil && bp.condition(&debugContext{d.nes, addr, value}) == 0 {
+		return false
+	}
+
+	bp.Hits++
+	return true
+}
+
+func (d *Debugger) access(kind BreakKind, addr uint16, value uint8) {
+	if d.editing || d.memoryHit != nil {
+		return
+	}
+
+	for _, bp := range d.breakpoints {
+		if d.matches(bp, kind, addr, value) {
+			d.memoryHit = &Stop{StopBreakpoint, bp, addr, value}
+			return
+		}
+	}
+}
+
+// Paused - reports whether the debugger is waiting to be told what to do
+func (d *Debugger) Paused() bool {
+	return d.mode == modePaused
+}
+
+// LastStop - why the debugger last paused
+func (d *Debugger) LastStop() Stop {
+	return d.stop
+}
+
+// Pause - stops whatever is running at the next instruction
+func (d *Debugger) Pause() {
+	d.pause(Stop{Reason: StopPause})
+}
+
+func (d *Debugger) pause(stop Stop) {
+	d.mode = modePaused
+	d.stop = stop
+}
+
+// Continue - runs until a breakpoint
+func (d *Debugger) Continue() {
+	d.resume(modeContinue)
+}
+
+func (d *Debugger) resume(mode runMode) {
+	d.mode = mode
+	d.resuming = true
+}
+
+// StepOver - runs one instruction, or a whole subroutine if it's a JSR
+func (d *Debugger) StepOver() {
+	if d.nes.CPU.Bus.Peek8(d.nes.CPU.PC) == jsrOpcode && !d.nes.CPU.InterruptPending() {
+		d.resume(modeStepOut)
+		d.depth = len(d.calls.frames)
+		return
+	}
+
+	d.Step()
+}
+
+// StepOut - runs until the current subroutine or interrupt handler returns
+func (d *Debugger) StepOut() error {
+	if len(d.calls.frames) == 0 {
+		return fmt.Errorf("not in a subroutine")
+	}
+
+	d.resume(modeStepOut)
+	d.depth = len(d.calls.frames) - 1
+	return nil
+}
+
+// RunToScanline - runs until the PPU starts scanline
+func (d *Debugger) RunToScanline(scanline uint16) {
+	d.resume(modeScanline)
+	d.scanline = scanline
+}
+
+// Step - runs one instruction, or enters a pending interrupt, and pauses
+func (d *Debugger) Step() {
+	d.step()
+
+	if d.memoryHit != nil {
+		d.pause(*d.memoryHit)
+		d.memoryHit = nil
+		return
+	}
+
+	if d.nes.CPU.Halted() {
+		d.pause(Stop{Reason: StopHalted})
+		return
+	}
+
+	d.pause(Stop{Reason: StopStep})
+}
+
+// step - runs the NES one step, keeping the call stack up to date
+func (d *Debugger) step() {
+	d.calls.before(d.nes.CPU)
+	d.nes.Step()
+	d.calls.after(d.nes.CPU)
+}
+
+// CallStack - the subroutines and interrupt handlers the cpu is in,
+// outermost first
+func (d *Debugger) CallStack() []Frame {
+	return d.calls.frames
+}
+
+// RunFrame - while not paused, runs until the PPU finishes a frame or
+// something stops the debugger. Returns whether it's paused.
+func (d *Debugger) RunFrame() bool {
+	ppu := d.nes.PPU
+	ppu.FrameReady = false
+
+	for d.mode != modePaused {
+		cpu := d.nes.CPU
+		if cpu.Halted() {
+			d.pause(Stop{Reason: StopHalted})
+			break
+		}
+
+		// execution breakpoints, except on the instruction being resumed from
+		if !d.resuming && !cpu.InterruptPending() {
+			for _, bp := range d.breakpoints {
+				if d.matches(bp, BreakExec, cpu.PC, 0) {
+					d.pause(Stop{Reason: StopBreakpoint, Breakpoint: bp, Addr: cpu.PC})
+					return true
+				}
+			}
+		}
+		d.resuming = false
+
+		scanline := ppu.Scanline
+		d.step()
+
+		if d.memoryHit != nil {
+			d.pause(*d.memoryHit)
+			d.memoryHit = nil
+			break
+		}
+
+		switch d.mode {
+		case modeStepOut:
+			if len(d.calls.frames) <= d.depth {
+				d.pause(Stop{Reason: StopStep})
+			}
+		case modeScanline:
+			if ppu.Scanline == d.scanline && scanline != d.scanline {
+				d.pause(Stop{Reason: StopScanline})
+			}
+		}
+
+		if ppu.FrameReady {
+			break
+		}
+	}
+
+	return d.Paused()
+}
+
+// SetRegister - sets A, X, Y, P, SP or PC
+func (d *Debugger) SetRegister(name string, value uint16) error {
+	cpu := d.nes.CPU
+
+	name = strings.ToUpper(name)
+	if name != "PC" && value > 0xFF {
+		return fmt.Errorf("%s is 8 bits, $%X doesn't fit", name, value)
+	}
+
+	switch name {
+	case "A":
+		cpu.A = uint8(value)
+	case "X":
+		cpu.X = uint8(value)
+	case "Y":
+		cpu.Y = uint8(value)
+	case "P":
+		cpu.P = uint8(value)
+	case "SP":
+		cpu.SP = uint8(value)
+	case "PC":
+		cpu.PC = value
+	default:
+		return fmt.Errorf("no register %s", name)
+	}
+
+	return nil
+}
+
+// Peek - reads memory without side effects
+func (d *Debugger) Peek(addr uint16) uint8 {
+	return d.nes.CPU.Bus.Peek8(addr)
+}
+
+// Poke - writes memory through the bus, without setting off write breakpoints
+func (d *Debugger) Poke(addr uint16, value uint8) {
+	d.editing = true
+	d.nes.CPU.Bus.Write8(addr, value)
+	d.editing = false
+}
+
+// Evaluate - the value of an expression, in the language of breakpoint conditions
+func (d *Debugger) Evaluate(expr string) (int, error) {
+	compiled, err := compileCondition(expr, d.nes.Symbols)
+	if err != nil {
+		return 0, err
+	}
+
+	return compiled(&debugContext{nes: d.nes}), nil
+}
+
+// Location - the trace line of the instruction at PC
+func (d *Debugger) Location() string {
+	return traceLine(d.nes)
+}
+
+// flagString - the status flags like nv-bdIzc, set flags in upper case
+func flagString(p uint8) string {
+	flags := []byte(strings.ToLower(flagNames))
+	for i := range flags {
+		if p&(0x80>>uint(i)) != 0 {
+			flags[i] = flagNames[i]
+		}
+	}
+
+	return string(flags)
+}
+
+// Registers - the cpu registers and flags on one line
+func (d *Debugger) Registers() string {
+	cpu := d.nes.CPU
+
+	return fmt.Sprintf("PC:%04X A:%02X X:%02X Y:%02X SP:%02X P:%02X %s CYC:%d PPU:%3d,%3d FRAME:%d",
+		cpu.PC, cpu.A, cpu.X, cpu.Y, cpu.SP, cpu.P, flagString(cpu.P), cpu.Cycles(), d.nes.PPU.Scanline, d.nes.PPU.Cycle, d.nes.PPU.frameCount)
+}
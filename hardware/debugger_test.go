@@ -0,0 +1,279 @@
+package hardware
+
+import (
+	"bytes"
+	"nes-emu/assembler"
+	"strings"
+	"testing"
+)
+
+const debugTestSource = `
+	.bank 0
+	.org $C000
+reset:
+	ldx #$FF
+	txs
+	lda #0
+	sta $0300
+	jsr outer
+after:
+	lda #5
+	sta $0300
+loop:
+	jmp loop
+outer:
+	jsr inner
+	rts
+inner:
+	inc $0300
+	rts
+
+	.org $FFFA
+	.word reset, reset, reset`
+
+func newTestDebugger(t *testing.T) (*Debugger, *assembler.Program) {
+	nes, program := assembleNES(t, debugTestSource)
+
+	return NewDebugger(nes), program
+}
+
+// runUntilPaused gives the debugger a few frames to stop
+func runUntilPaused(t *testing.T, d *Debugger) {
+	for i := 0; i < 10; i++ {
+		if d.RunFrame() {
+			return
+		}
+	}
+
+	t.Fatal("Expected the debugger to stop")
+}
+
+func TestDebuggerExecBreakpoint(t *testing.T) {
+	d, program := newTestDebugger(t)
+	inner := uint16(program.Symbols["inner"])
+
+	d.AddBreakpoint(BreakExec, inner, inner, "")
+	d.Continue()
+	runUntilPaused(t, d)
+
+	if d.nes.CPU.PC != inner || d.LastStop().Reason != StopBreakpoint {
+		t.Fatalf("Expected to stop on inner at %04X, stopped at %04X for %s", inner, d.nes.CPU.PC, d.LastStop())
+	}
+
+	stack := d.CallStack()
+	if len(stack) != 2 || stack[0].Target != uint16(program.Symbols["outer"]) || stack[1].Target != inner {
+		t.Fatalf("Expected outer then inner on the call stack, got %+v", stack)
+	}
+	if stack[1].From != uint16(program.Symbols["outer"]) || stack[1].SP != 0xFD {
+		t.Errorf("Expected inner called from outer with SP FD, got %+v", stack[1])
+	}
+
+	// continuing doesn't stop on the breakpoint it's sitting on
+	d.Continue()
+	d.RunFrame()
+	if d.Paused() {
+		t.Errorf("Expected to keep running, stopped at %04X for %s", d.nes.CPU.PC, d.LastStop())
+	}
+}
+
+func TestDebuggerStepping(t *testing.T) {
+	d, program := newTestDebugger(t)
+
+	// ldx, txs, lda, sta to reach the jsr
+	for i := 0; i < 4; i++ {
+		d.Step()
+	}
+	if d.nes.CPU.Bus.Peek8(d.nes.CPU.PC) != jsrOpcode {
+		t.Fatalf("Expected to be on the JSR, at %04X", d.nes.CPU.PC)
+	}
+
+	d.StepOver()
+	runUntilPaused(t, d)
+	if d.nes.CPU.PC != uint16(program.Symbols["after"]) || len(d.CallStack()) != 0 {
+		t.Fatalf("Expected step over to stop after the JSR, at %04X with %d frames", d.nes.CPU.PC, len(d.CallStack()))
+	}
+	if v := d.Peek(0x0300); v != 1 {
+		t.Errorf("Expected the subroutine to have run, $0300 is %d", v)
+	}
+
+	// step into outer and inner, then out of both
+	d.nes.CPU.PC = uint16(program.Symbols["after"]) - 3
+	d.Step()
+	d.Step()
+	if len(d.CallStack()) != 2 {
+		t.Fatalf("Expected to be two calls deep, got %d", len(d.CallStack()))
+	}
+
+	if err := d.StepOut(); err != nil {
+		t.Fatal(err)
+	}
+	runUntilPaused(t, d)
+	if d.nes.CPU.PC != uint16(program.Symbols["outer"])+3 {
+		t.Errorf("Expected step out to return into outer, at %04X", d.nes.CPU.PC)
+	}
+
+	d.StepOut()
+	runUntilPaused(t, d)
+	if d.nes.CPU.PC != uint16(program.Symbols["after"]) {
+		t.Errorf("Expected step out to return after the JSR, at %04X", d.nes.CPU.PC)
+	}
+
+	if err := d.StepOut(); err == nil {
+		t.Errorf("Expected an error stepping out of the top level")
+	}
+}
+
+func TestDebuggerWriteBreakpoint(t *testing.T) {
+	d, program := newTestDebugger(t)
+
+	// the INC writes the old value, then the new one
+	d.AddBreakpoint(BreakWrite, 0x0300, 0x0300, "VALUE == 5 && A == 5")
+	d.Continue()
+	runUntilPaused(t, d)
+
+	stop := d.LastStop()
+	if stop.Reason != StopBreakpoint || stop.Addr != 0x0300 || stop.Value != 5 {
+		t.Fatalf("Expected a write of 5 to $0300, got %s", stop)
+	}
+	if d.nes.CPU.PC != uint16(program.Symbols["loop"]) {
+		t.Errorf("Expected to stop after the STA, at %04X", d.nes.CPU.PC)
+	}
+	if stop.Breakpoint.Hits != 1 {
+		t.Errorf("Expected one hit, got %d", stop.Breakpoint.Hits)
+	}
+}
+
+func TestDebuggerReadBreakpoint(t *testing.T) {
+	d, program := newTestDebugger(t)
+
+	d.AddBreakpoint(BreakRead, 0x0300, 0x0300, "")
+	d.Continue()
+	runUntilPaused(t, d)
+
+	if stop := d.LastStop(); stop.Reason != StopBreakpoint || stop.Addr != 0x0300 || stop.Breakpoint.Kind != BreakRead {
+		t.Fatalf("Expected the INC to read $0300, got %s", stop)
+	}
+	if d.nes.CPU.PC != uint16(program.Symbols["inner"])+3 {
+		t.Errorf("Expected to stop after the INC, at %04X", d.nes.CPU.PC)
+	}
+}
+
+func TestDebuggerRunToScanline(t *testing.T) {
+	d, _ := newTestDebugger(t)
+
+	d.RunToScanline(100)
+	runUntilPaused(t, d)
+
+	if d.LastStop().Reason != StopScanline || d.nes.PPU.Scanline != 100 {
+		t.Errorf("Expected to stop on scanline 100, on %d for %s", d.nes.PPU.Scanline, d.LastStop())
+	}
+}
+
+func TestDebuggerEditing(t *testing.T) {
+	d, _ := newTestDebugger(t)
+
+	if err := d.SetRegister("a", 0x3F); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetRegister("PC", 0xC123); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetRegister("X", 0x100); err == nil {
+		t.Errorf("Expected X to refuse 9 bits")
+	}
+	if err := d.SetRegister("Q", 1); err == nil {
+		t.Errorf("Expected an error for a missing register")
+	}
+
+	d.AddBreakpoint(BreakWrite, 0x0000, 0xFFFF, "")
+	d.Poke(0x0010, 0x42)
+	if d.memoryHit != nil {
+		t.Errorf("Expected poking not to hit write breakpoints")
+	}
+
+	value, err := d.Evaluate("A == $3F && [$10] > 4 && PC == $C123")
+	if err != nil || value != 1 {
+		t.Errorf("Expected the edits to show, got %d %v", value, err)
+	}
+}
+
+func TestCompileCondition(t *testing.T) {
+	d, _ := newTestDebugger(t)
+	d.nes.CPU.A, d.nes.CPU.X, d.nes.CPU.P = 0x3F, 2, 0x25
+	d.Poke(0x0300, 5)
+
+	tests := []struct {
+		expr     string
+		expected int
+	}{
+		{"A == $3F && [$0300] > 4", 1},
+		{"a == 63 || x", 1},
+		{"[$02FE + X]", 5},
+		{"1 + 2 * 3 << 1", 14},
+		{"(1 + 2) * 3", 9},
+		{"%101 | 2", 7},
+		{"C && I && !Z", 1},
+		{"-1 < 0", 1},
+		{"~0 & $FF", 0xFF},
+		{"X <= 2 && X >= 2 && X != 3", 1},
+		{"5 / 0", 0},
+	}
+
+	for _, test := range tests {
+		value, err := d.Evaluate(test.expr)
+		if err != nil || value != test.expected {
+			t.Errorf("%s: expected %d, got %d %v", test.expr, test.expected, value, err)
+		}
+	}
+
+	for _, bad := range []string{"A ==", "(A", "[1", "Q == 1", "$G", "A B"} {
+		if _, err := compileCondition(bad, nil); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
+
+func TestDebugConsole(t *testing.T) {
+	d, _ := newTestDebugger(t)
+	out := &bytes.Buffer{}
+	console := NewDebugConsole(d, out)
+
+	commands := make(chan string, 16)
+	for _, line := range []string{
+		"b $C017",
+		"c",
+		"bt",
+		"s",
+		"",
+		"set y $12",
+		"poke $10 1 2",
+		"m $10 2",
+		"e [$11] + Y",
+		"bl",
+		"bogus",
+		"q",
+	} {
+		commands <- line
+	}
+	close(commands)
+
+	console.Run(commands)
+
+	for _, want := range []string{
+		"added #1 exec $C017",
+		"stopped: breakpoint #1\nC017",
+		"#0 $C017  JSR from $C013, SP:FD",
+		"#1 $C013  JSR from $C008, SP:FF",
+		"stopped: step\nC01A",
+		"stopped: step\nC016",
+		"Y:12",
+		"0010 01 02\n",
+		"20 $14",
+		"#1 exec $C017, 1 hits",
+		"error: unknown command bogus",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected %q in:\n%s", want, out.String())
+		}
+	}
+}
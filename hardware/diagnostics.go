@@ -0,0 +1,416 @@
+package hardware
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"nes-emu/cpu6502"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// the bus accesses kept for each instruction. An interrupt or a
+// read-modify-write makes 7, OAM DMA makes hundreds and is cut short.
+const historyAccesses = 8
+
+// BusAccess - a read or write the cpu made
+type BusAccess struct {
+	Addr  uint16
+	Value uint8
+	Write bool
+}
+
+// HistoryEntry - an instruction, or an interrupt being serviced, with the
+// registers as they were before it ran and what it did on the bus
+type HistoryEntry struct {
+	PC             uint16
+	A, X, Y, P, SP uint8
+	Cycle          uint64
+	Scanline, Dot  uint16
+	Frame          uint64
+	Interrupt, NMI bool
+	Bytes          [3]uint8
+	Accesses       [historyAccesses]BusAccess
+	NumAccesses    int
+}
+
+// Crash - something the diagnostics caught the NES doing that it won't
+// recover from
+type Crash struct {
+	Reason string
+	PC     uint16
+	Frame  uint64
+
+	// PC's label and source line, with symbols loaded
+	Where string
+
+	// the Go stack, when the emulator itself panicked
+	Stack []byte
+}
+
+func (c *Crash) Error() string {
+	where := fmt.Sprintf("$%04X", c.PC)
+	if c.Where != "" {
+		where += " " + c.Where
+	}
+
+	return fmt.Sprintf("%s at %s, frame %d", c.Reason, where, c.Frame)
+}
+
+// Diagnostics - keeps a history of the last instructions run and watches
+// for a jammed cpu, code running from RAM or IO registers, the stack
+// wrapping and NMIs stopping, so what led up to a crash or hang can be
+// written out. Created with NewDiagnostics, which attaches it to a NES.
+type Diagnostics struct {
+	// frames without an NMI, once there have been some, before the game
+	// is taken to have hung. 0 turns it off.
+	HangFrames uint64
+
+	// treat running code from the internal RAM as a crash. Off by
+	// default, as plenty of games copy routines there.
+	DetectRAMCode bool
+
+	nes *NES
+	err *Crash
+
+	// ring of the last instructions, next is where the one running goes
+	history []HistoryEntry
+	next    int
+	full    bool
+
+	recording bool
+	sp        uint8
+
+	sawNMI   bool
+	nmiFrame uint64
+}
+
+// NewDiagnostics - attaches diagnostics keeping the last size instructions to nes
+func NewDiagnostics(nes *NES, size int) *Diagnostics {
+	d := &Diagnostics{
+		HangFrames: 120,
+		nes:        nes,
+		history:    make([]HistoryEntry, size),
+	}
+
+	nes.CPU.Bus.Observe(d.access)
+	nes.Diagnostics = d
+
+	return d
+}
+
+// Err - what went wrong, nil while the NES is running fine
+func (d *Diagnostics) Err() *Crash {
+	return d.err
+}
+
+// History - the instructions kept, oldest first
+func (d *Diagnostics) History() []HistoryEntry {
+	if !d.full {
+		return append([]HistoryEntry(nil), d.history[:d.next]...)
+	}
+
+	return append(append([]HistoryEntry(nil), d.history[d.next:]...), d.history[:d.next]...)
+}
+
+// Recover - records a panic from running the NES, with the Go stack. Call
+// it with what recover returned, from the function deferred around Step.
+func (d *Diagnostics) Recover(value interface{}) {
+	if value == nil {
+		return
+	}
+
+	d.recording = false
+	d.fail(fmt.Sprintf("emulator panic: %v", value), d.nes.CPU.PC)
+	d.err.Stack = debug.Stack()
+}
+
+func (d *Diagnostics) access(addr uint16, value uint8, write bool) {
+	if !d.recording || len(d.history) == 0 {
+		return
+	}
+
+	entry := &d.history[d.next]
+	if entry.NumAccesses < historyAccesses {
+		entry.Accesses[entry.NumAccesses] = BusAccess{addr, value, write}
+	}
+	entry.NumAccesses++
+}
+
+// before - starts the history entry for the instruction about to run
+func (d *Diagnostics) before(nes *NES) {
+	cpu := nes.CPU
+	d.sp = cpu.SP
+
+	// a jammed cpu does nothing worth keeping, and would push out what
+	// led up to it
+	if len(d.history) == 0 || cpu.Halted() {
+		return
+	}
+
+	entry := &d.history[d.next]
+	*entry = HistoryEntry{
+		PC: cpu.PC, A: cpu.A, X: cpu.X, Y: cpu.Y, P: cpu.P, SP: cpu.SP,
+		Cycle:     cpu.Cycles(),
+		Scanline:  nes.PPU.Scanline,
+		Dot:       uint16(nes.PPU.Cycle),
+		Frame:     nes.PPU.frameCount,
+		Interrupt: cpu.InterruptPending(),
+		NMI:       cpu.NMIPending(),
+	}
+	for i := range entry.Bytes {
+		entry.Bytes[i] = cpu.Bus.Peek8(cpu.PC + uint16(i))
+	}
+	d.recording = true
+}
+
+// after - files the history entry and checks what the instruction did
+func (d *Diagnostics) after(nes *NES) {
+	cpu := nes.CPU
+	frame := nes.PPU.frameCount
+
+	var entry HistoryEntry
+	if d.recording {
+		entry = d.history[d.next]
+		d.next++
+		if d.next == len(d.history) {
+			d.next, d.full = 0, true
+		}
+	}
+	d.recording = false
+
+	if entry.Interrupt && entry.NMI {
+		d.sawNMI, d.nmiFrame = true, frame
+	}
+
+	if d.err != nil {
+		return
+	}
+
+	instr := cpu6502.Decode(entry.PC, func(addr uint16) uint8 {
+		return entry.Bytes[addr-entry.PC]
+	})
+
+	switch {
+	case cpu.Halted():
+		var halt *cpu6502.HaltError
+		if errors.As(cpu.Err(), &halt) {
+			d.fail(halt.Reason, halt.PC)
+		}
+	case entry.Interrupt:
+	case entry.PC < 0x2000 && d.DetectRAMCode:
+		d.fail("running code from RAM", entry.PC)
+	case entry.PC >= 0x2000 && entry.PC < 0x6000:
+		d.fail("running code from IO registers", entry.PC)
+	}
+	if d.err != nil {
+		return
+	}
+
+	// pushes and pulls move SP by 3 at most, so a bigger jump the other
+	// way is it wrapping round the stack page. TXS can put it anywhere.
+	if entry.Interrupt || instr.Code != cpu6502.TXS {
+		switch moved := cpu.SP - d.sp; {
+		case moved >= 0xFD && cpu.SP > d.sp:
+			d.fail(fmt.Sprintf("stack overflow, SP wrapped from $%02X to $%02X", d.sp, cpu.SP), entry.PC)
+		case moved != 0 && moved <= 3 && cpu.SP < d.sp:
+			d.fail(fmt.Sprintf("stack underflow, SP wrapped from $%02X to $%02X", d.sp, cpu.SP), entry.PC)
+		}
+	}
+	if d.err != nil {
+		return
+	}
+
+	if d.HangFrames > 0 && d.sawNMI && frame-d.nmiFrame >= d.HangFrames {
+		d.fail(fmt.Sprintf("hung, no NMI handled for %d frames", frame-d.nmiFrame), cpu.PC)
+	}
+}
+
+func (d *Diagnostics) fail(reason string, pc uint16) {
+	d.err = &Crash{
+		Reason: reason,
+		PC:     pc,
+		Frame:  d.nes.PPU.frameCount,
+		Where:  d.nes.describe(pc),
+	}
+}
+
+// WriteBundle - writes what went wrong into a new directory under dir,
+// returning its path: report.txt with the registers and stack,
+// history.txt with the last instructions, dumps of RAM, VRAM, OAM and
+// any cartridge RAM, and a screenshot
+func (d *Diagnostics) WriteBundle(dir string) (string, error) {
+	path := filepath.Join(dir, "nes-crash-"+time.Now().Format("20060102-150405"))
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return "", err
+	}
+
+	nes := d.nes
+	var oam []byte
+	for _, sprite := range nes.PPU.OAM {
+		oam = append(oam, sprite.yCoord, sprite.tileNum, sprite.attributes, sprite.xCoord)
+	}
+
+	files := []bundleFile{
+		{"report.txt", d.writeReport},
+		{"history.txt", d.writeHistory},
+		{"ram.bin", writeBytes(nes.RAM.data[:])},
+		{"vram.bin", writeBytes(nes.PPU.Memory[:])},
+		{"oam.bin", writeBytes(oam)},
+	}
+	if nes.CART != nil && len(nes.CART.prgRam) > 0 {
+		files = append(files, bundleFile{"prgram.bin", writeBytes(nes.CART.prgRam)})
+	}
+	if nes.CART != nil && len(nes.CART.chrRam) > 0 {
+		files = append(files, bundleFile{"chrram.bin", writeBytes(nes.CART.chrRam)})
+	}
+	if nes.PPU.Frame != nil {
+		files = append(files, bundleFile{"screenshot.png", func(w io.Writer) error {
+			return png.Encode(w, nes.PPU.Frame)
+		}})
+	}
+
+	for _, file := range files {
+		if err := writeBundleFile(filepath.Join(path, file.name), file.write); err != nil {
+			return path, err
+		}
+	}
+
+	return path, nil
+}
+
+// bundleFile - a file in the bundle and what writes it
+type bundleFile struct {
+	name  string
+	write func(w io.Writer) error
+}
+
+func writeBytes(data []byte) func(w io.Writer) error {
+	return func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}
+}
+
+func writeBundleFile(filename string, write func(w io.Writer) error) error {
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+
+	out := bufio.NewWriter(file)
+	if err := write(out); err != nil {
+		file.Close()
+		return err
+	}
+	if err := out.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+
+	return file.Close()
+}
+
+// writeReport - what went wrong, the registers and the stack page
+func (d *Diagnostics) writeReport(w io.Writer) error {
+	nes, cpu := d.nes, d.nes.CPU
+
+	reason := "no crash recorded"
+	if d.err != nil {
+		reason = d.err.Error()
+	}
+	fmt.Fprintf(w, "%s\n\n", reason)
+
+	flags := []byte("nv-bdizc")
+	for i := range flags {
+		if cpu.P&(0x80>>i) != 0 && flags[i] != '-' {
+			flags[i] -= 'a' - 'A'
+		}
+	}
+	fmt.Fprintf(w, "PC:%04X A:%02X X:%02X Y:%02X P:%02X %s SP:%02X CYC:%d\n",
+		cpu.PC, cpu.A, cpu.X, cpu.Y, cpu.P, flags, cpu.SP, cpu.Cycles())
+	fmt.Fprintf(w, "PPU: scanline %d, dot %d, frame %d\n", nes.PPU.Scanline, nes.PPU.Cycle, nes.PPU.frameCount)
+	if where := nes.describe(cpu.PC); where != "" {
+		fmt.Fprintf(w, "at %s\n", where)
+	}
+
+	fmt.Fprintf(w, "\nstack, SP marked with >\n")
+	for row := 0x100; row < 0x200; row += 16 {
+		fmt.Fprintf(w, "%04X ", row)
+		for addr := row; addr < row+16; addr++ {
+			mark := ' '
+			if addr == 0x100+int(cpu.SP) {
+				mark = '>'
+			}
+			fmt.Fprintf(w, "%c%02X", mark, nes.RAM.data[addr])
+		}
+		fmt.Fprintln(w)
+	}
+
+	if d.err != nil && d.err.Stack != nil {
+		fmt.Fprintf(w, "\n%s", d.err.Stack)
+	}
+
+	return nil
+}
+
+// writeHistory - the instructions kept, oldest first, each with what it
+// read and wrote
+//
+// C000  A2 FF     ldx #$FF              A:00 X:00 Y:00 P:24 SP:FD PPU:  0, 21 CYC:7
+func (d *Diagnostics) writeHistory(w io.Writer) error {
+	for _, entry := range d.History() {
+		var text string
+		if entry.Interrupt {
+			text = "IRQ"
+			if entry.NMI {
+				text = "NMI"
+			}
+			text = fmt.Sprintf("%04X  %-8s  %-22s", entry.PC, "", text)
+		} else {
+			instr := cpu6502.Decode(entry.PC, func(addr uint16) uint8 {
+				return entry.Bytes[addr-entry.PC]
+			})
+			var raw []string
+			for _, b := range entry.Bytes[:instr.Size] {
+				raw = append(raw, fmt.Sprintf("%02X", b))
+			}
+			text = fmt.Sprintf("%04X  %-8s  %-22s", entry.PC, strings.Join(raw, " "), instr.Format(func(uint16) string { return "" }))
+		}
+
+		if _, err := fmt.Fprintf(w, "%s A:%02X X:%02X Y:%02X P:%02X SP:%02X PPU:%3d,%3d CYC:%d%s\n",
+			text, entry.A, entry.X, entry.Y, entry.P, entry.SP,
+			entry.Scanline, entry.Dot, entry.Cycle, formatAccesses(entry)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// formatAccesses - the bus accesses an entry made, like  r $0300=$05 w $2006=$20
+func formatAccesses(entry HistoryEntry) string {
+	var b strings.Builder
+	for i := 0; i < entry.NumAccesses && i < historyAccesses; i++ {
+		access := entry.Accesses[i]
+		kind := 'r'
+		if access.Write {
+			kind = 'w'
+		}
+		fmt.Fprintf(&b, " %c $%04X=$%02X", kind, access.Addr, access.Value)
+	}
+	if entry.NumAccesses > historyAccesses {
+		fmt.Fprintf(&b, " +%d more", entry.NumAccesses-historyAccesses)
+	}
+
+	if b.Len() == 0 {
+		return ""
+	}
+
+	return "  " + b.String()
+}
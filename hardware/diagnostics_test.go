@@ -0,0 +1,156 @@
+package hardware
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// diagnosticsTestSource - the body goes after a reset that sets the stack
+// up, with an NMI handler counting frames in $10
+const diagnosticsTestSource = `
+	.bank 0
+	.org $C000
+reset:
+	ldx #$FF
+	txs
+%s
+nmi:
+	inc $10
+	rti
+
+	.org $FFFA
+	.word nmi, reset, reset`
+
+func runDiagnostics(t *testing.T, body string) (*NES, *Diagnostics) {
+	return runDiagnosticsWith(t, body, false)
+}
+
+// runDiagnosticsWith - runDiagnostics, crashing on code run from RAM if
+// detectRAMCode is set
+func runDiagnosticsWith(t *testing.T, body string, detectRAMCode bool) (*NES, *Diagnostics) {
+	nes, _ := assembleNES(t, strings.Replace(diagnosticsTestSource, "%s", body, 1))
+	d := NewDiagnostics(nes, 16)
+	d.HangFrames = 10
+	d.DetectRAMCode = detectRAMCode
+
+	for nes.PPU.frameCount < 30 && d.Err() == nil {
+		nes.Step()
+	}
+
+	return nes, d
+}
+
+func TestDiagnostics(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		reason string
+		pc     uint16
+	}{
+		{"jam", "\tlda #1\n\t.byte $02", "jammed by KIL opcode $02", 0xC005},
+		{"RAM", "\tjmp $0300", "running code from RAM", 0x0300},
+		{"IO", "\tjmp $4020", "running code from IO registers", 0x4020},
+		{"overflow", "\tldx #1\n\ttxs\n\tjsr reset", "stack overflow, SP wrapped from $01 to $FF", 0xC006},
+		{"underflow", "\tpla", "stack underflow, SP wrapped from $FF to $00", 0xC003},
+		// NMIs run for a few frames, then get turned off
+		{"hang", `
+	lda #$80
+	sta $2000
+wait:
+	lda $10
+	cmp #3
+	bne wait
+	lda #0
+	sta $2000
+forever:
+	jmp forever`, "hung, no NMI handled for 10 frames", 0},
+	}
+
+	for _, test := range tests {
+		_, d := runDiagnosticsWith(t, test.body, true)
+		crash := d.Err()
+		if crash == nil {
+			t.Errorf("%s: expected a crash", test.name)
+			continue
+		}
+		if crash.Reason != test.reason || test.pc != 0 && crash.PC != test.pc {
+			t.Errorf("%s: expected %q at $%04X, got %v", test.name, test.reason, test.pc, crash)
+		}
+	}
+
+	// a game that never turns NMIs on isn't hung
+	if _, d := runDiagnostics(t, "forever:\n\tjmp forever"); d.Err() != nil {
+		t.Errorf("Expected no crash without NMIs, got %v", d.Err())
+	}
+
+	// code in RAM is only a crash when asked for
+	if _, d := runDiagnostics(t, "\tjmp $0300"); d.Err() != nil {
+		t.Errorf("Expected no crash running code from RAM by default, got %v", d.Err())
+	}
+}
+
+func TestDiagnosticsHistory(t *testing.T) {
+	_, d := runDiagnostics(t, "\tlda #$42\n\tsta $0300\n\tinc $0300\n\t.byte $02")
+
+	// a jammed cpu isn't kept stepping over the KIL
+	history := d.History()
+	if len(history) != 6 {
+		t.Fatalf("Expected 6 instructions in the history, got %d", len(history))
+	}
+	inc := history[4]
+	if inc.PC != 0xC008 || inc.A != 0x42 || inc.NumAccesses != 6 {
+		t.Errorf("Expected inc at $C008 with A:42 and 6 bus accesses, got %+v", inc)
+	}
+	if last := inc.Accesses[inc.NumAccesses-1]; last != (BusAccess{0x0300, 0x43, true}) {
+		t.Errorf("Expected inc to end writing $43 to $0300, got %+v", last)
+	}
+
+	// the ring keeps the newest, oldest first
+	_, looping := runDiagnostics(t, "forever:\n\tjmp forever")
+	if kept := looping.History(); len(kept) != 16 || kept[15].Cycle != kept[0].Cycle+15*3 {
+		t.Errorf("Expected the last 16 instructions, oldest first")
+	}
+
+	path, err := d.WriteBundle(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, size := range map[string]int64{
+		"ram.bin":        0x800,
+		"vram.bin":       0x4000,
+		"oam.bin":        0x100,
+		"screenshot.png": -1,
+	} {
+		info, err := os.Stat(filepath.Join(path, name))
+		if err != nil {
+			t.Errorf("Expected %s in the bundle: %v", name, err)
+		} else if size >= 0 && info.Size() != size {
+			t.Errorf("Expected %s to be %d bytes, got %d", name, size, info.Size())
+		}
+	}
+
+	report, _ := os.ReadFile(filepath.Join(path, "report.txt"))
+	if !strings.HasPrefix(string(report), "jammed by KIL opcode $02 at $C00B, frame 0") || !strings.Contains(string(report), ">") {
+		t.Errorf("Expected the crash, registers and stack in the report, got\n%s", report)
+	}
+	text, _ := os.ReadFile(filepath.Join(path, "history.txt"))
+	if !strings.Contains(string(text), "EE 00 03  inc $0300") {
+		t.Errorf("Expected the instructions in the history, got\n%s", text)
+	}
+}
+
+func TestDiagnosticsRecover(t *testing.T) {
+	nes, _ := assembleNES(t, strings.Replace(diagnosticsTestSource, "%s", "", 1))
+	d := NewDiagnostics(nes, 16)
+
+	func() {
+		defer func() { d.Recover(recover()) }()
+		panic("bad bank")
+	}()
+
+	if crash := d.Err(); crash == nil || crash.Reason != "emulator panic: bad bank" || len(crash.Stack) == 0 {
+		t.Errorf("Expected the panic to be recorded with its stack, got %+v", crash)
+	}
+}
@@ -0,0 +1,818 @@
+package hardware
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"nes-emu/cpu6502"
+	"sort"
+	"strings"
+)
+
+// DisasmOptions - what Disassemble knows beyond the rom itself
+type DisasmOptions struct {
+	// PRG rom offsets seen running as the start of an instruction, with
+	// the cpu address each ran at. See ExecutedCode.
+	Executed map[int]uint16
+
+	// labels to use instead of made up ones. Labels outside the
+	// cartridge are written out as constants.
+	Symbols *Symbols
+}
+
+// what a byte of PRG rom was found to be
+const (
+	byteUnknown = iota
+	byteOpcode
+	byteOperand
+	byteWord
+	byteWordHigh
+	byteTable
+
+	// past the end of the file, where PRG rom was padded to a whole bank
+	bytePadding
+)
+
+// prgBank - a block of PRG rom and where the cpu sees it
+type prgBank struct {
+	offset, size int
+	origin       uint16
+
+	// always mapped at origin, whatever bank is switched in
+	fixed bool
+
+	// small enough to repeat through all of $8000-$FFFF
+	mirrored bool
+}
+
+func (b prgBank) contains(addr uint16) bool {
+	if b.mirrored {
+		return addr >= 0x8000
+	}
+
+	return addr >= b.origin && int(addr) < int(b.origin)+b.size
+}
+
+type disassembler struct {
+	prg   []byte
+	banks []prgBank
+	kind  []uint8
+
+	// per PRG offset
+	decoded map[int]cpu6502.Decoded
+	labels  map[int]string
+
+	// jump table words that are stored as the target minus one
+	rtsWords map[int]bool
+
+	queue []int
+
+	// JMP (ind) and RTS instructions already checked for jump tables
+	dispatches map[int]bool
+
+	// switchable banks share addresses, so their labels carry the bank
+	bankSuffix bool
+
+	// names for addresses outside PRG rom, and every name given out
+	constants map[uint16]string
+	names     map[string]bool
+}
+
+// prgLayout - splits PRG rom into the banks the mapper switches, each at
+// the address it's normally seen at. MMC1 is taken to be in its power on
+// mode, with the last bank fixed at $C000.
+func prgLayout(cart *Cartridge) ([]prgBank, error) {
+	size := len(cart.prgRom)
+	if size == 0 || size%0x4000 != 0 {
+		return nil, fmt.Errorf("PRG rom is %d bytes, not a multiple of 16KB", size)
+	}
+
+	switch cart.mapperType {
+	case mapper0:
+		switch size {
+		case 0x4000:
+			return []prgBank{{0, 0x4000, 0xC000, true, true}}, nil
+		case 0x8000:
+			return []prgBank{{0, 0x8000, 0x8000, true, false}}, nil
+		}
+		return nil, fmt.Errorf("mapper 0 with %d bytes of PRG rom", size)
+	case mmc1:
+		count := size / 0x4000
+		var banks []prgBank
+		for i := 0; i < count-1; i++ {
+			banks = append(banks, prgBank{i * 0x4000, 0x4000, 0x8000, false, false})
+		}
+		return append(banks, prgBank{(count - 1) * 0x4000, 0x4000, 0xC000, true, count == 1}), nil
+	}
+
+	return nil, fmt.Errorf("can't disassemble mapper %d", cart.mapperType)
+}
+
+// Disassemble - writes the cartridge out as ca65 source that assembles
+// back to the same iNES file. Code is found by walking from the vectors
+// and any executed addresses in options, following branches, calls and
+// jump tables. Everything else is written as data.
+func Disassemble(cart *Cartridge, w io.Writer, options DisasmOptions) error {
+	d, err := disassemble(cart, options)
+	if err != nil {
+		return err
+	}
+
+	return d.write(cart, w)
+}
+
+// disassemble - finds the code and labels in the cartridge's PRG rom
+func disassemble(cart *Cartridge, options DisasmOptions) (*disassembler, error) {
+	banks, err := prgLayout(cart)
+	if err != nil {
+		return nil, err
+	}
+
+	d := &disassembler{
+		prg:        cart.prgRom,
+		banks:      banks,
+		kind:       make([]uint8, len(cart.prgRom)),
+		decoded:    make(map[int]cpu6502.Decoded),
+		labels:     make(map[int]string),
+		rtsWords:   make(map[int]bool),
+		dispatches: make(map[int]bool),
+		bankSuffix: len(banks) > 2,
+		constants:  make(map[uint16]string),
+		names:      make(map[string]bool),
+	}
+
+	for offset := cart.prgSize; offset < len(d.prg); offset++ {
+		d.kind[offset] = bytePadding
+	}
+
+	if options.Symbols != nil {
+		d.addSymbols(options.Symbols)
+	}
+	d.addVectors()
+
+	// executed code goes first, so guesses can't claim its bytes
+	var executed []int
+	for offset := range options.Executed {
+		executed = append(executed, offset)
+	}
+	sort.Ints(executed)
+	for _, offset := range executed {
+		if offset >= 0 && offset < len(d.prg) && d.resolve(options.Executed[offset], d.bankOf(offset)) == offset {
+			d.queue = append(d.queue, offset)
+		}
+	}
+
+	for len(d.queue) > 0 {
+		d.walk()
+		d.findJumpTables()
+	}
+
+	return d, nil
+}
+
+func (d *disassembler) bankOf(offset int) int {
+	for i, bank := range d.banks {
+		if offset >= bank.offset && offset < bank.offset+bank.size {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// addrOf - the cpu address an offset is disassembled at
+func (d *disassembler) addrOf(offset int) uint16 {
+	bank := d.banks[d.bankOf(offset)]
+
+	return bank.origin + uint16(offset-bank.offset)
+}
+
+// resolve - the PRG offset addr reads from while running code in bank,
+// or -1 if it isn't in PRG rom or depends on what's switched in
+func (d *disassembler) resolve(addr uint16, bank int) int {
+	inBank := func(b prgBank) int {
+		if b.mirrored {
+			return b.offset + int(addr-0x8000)%b.size
+		}
+		return b.offset + int(addr-b.origin)
+	}
+
+	if bank >= 0 && d.banks[bank].contains(addr) {
+		return inBank(d.banks[bank])
+	}
+
+	for _, b := range d.banks {
+		if b.fixed && b.contains(addr) {
+			return inBank(b)
+		}
+	}
+
+	return -1
+}
+
+// label - names offset, unless it already has a name
+func (d *disassembler) label(offset int, prefix string) {
+	if _, ok := d.labels[offset]; ok {
+		return
+	}
+
+	name := fmt.Sprintf("%s_%04X", prefix, d.addrOf(offset))
+	if bank := d.bankOf(offset); d.bankSuffix && !d.banks[bank].fixed {
+		name += fmt.Sprintf("_b%d", bank)
+	}
+	d.labels[offset] = d.unique(name)
+}
+
+// unique - name, changed if need be to be a ca65 identifier that hasn't
+// been used yet
+func (d *disassembler) unique(name string) string {
+	ident := []byte(name)
+	for i, c := range ident {
+		if !isAlnum(c) {
+			ident[i] = '_'
+		}
+	}
+	name = string(ident)
+
+	// registers and numbers can't be labels
+	switch strings.ToLower(name) {
+	case "a", "x", "y", "z", "s":
+		name += "_"
+	}
+	if name[0] >= '0' && name[0] <= '9' {
+		name = "_" + name
+	}
+
+	for base, n := name, 2; d.names[name]; n++ {
+		name = fmt.Sprintf("%s_%d", base, n)
+	}
+	d.names[name] = true
+
+	return name
+}
+
+// addSymbols - names PRG rom offsets and other addresses after symbols
+func (d *disassembler) addSymbols(symbols *Symbols) {
+	for _, sym := range symbols.All() {
+		switch {
+		case sym.PRG >= 0 && sym.PRG < len(d.prg):
+			if _, ok := d.labels[sym.PRG]; !ok {
+				d.labels[sym.PRG] = d.unique(sym.Name)
+			}
+		case sym.PRG < 0 && sym.Addr < 0x8000:
+			if _, ok := d.constants[sym.Addr]; !ok {
+				d.constants[sym.Addr] = d.unique(sym.Name)
+			}
+		}
+	}
+}
+
+// addVectors - names the NMI, reset and IRQ handlers and queues them up
+func (d *disassembler) addVectors() {
+	vectors := []struct {
+		addr uint16
+		name string
+	}{
+		{0xFFFA, "nmi"},
+		{0xFFFC, "reset"},
+		{0xFFFE, "irq"},
+	}
+
+	for _, vector := range vectors {
+		offset := d.resolve(vector.addr, -1)
+		if offset < 0 || d.kind[offset+1] == bytePadding {
+			continue
+		}
+
+		target := d.resolve(d.word(offset), d.bankOf(offset))
+		d.kind[offset], d.kind[offset+1] = byteWord, byteWordHigh
+		if target < 0 {
+			continue
+		}
+
+		if _, ok := d.labels[target]; !ok {
+			d.labels[target] = vector.name
+		}
+		d.queue = append(d.queue, target)
+	}
+}
+
+func (d *disassembler) word(offset int) uint16 {
+	return uint16(d.prg[offset+1])<<8 | uint16(d.prg[offset])
+}
+
+// walk - decodes everything reachable from the queue
+func (d *disassembler) walk() {
+	for len(d.queue) > 0 {
+		offset := d.queue[len(d.queue)-1]
+		d.queue = d.queue[:len(d.queue)-1]
+
+		d.walkFrom(offset)
+	}
+}
+
+// walkFrom - decodes one run of instructions, queueing the places it
+// branches to, until it leaves or runs into something already known
+func (d *disassembler) walkFrom(offset int) {
+	bank := d.bankOf(offset)
+	end := d.banks[bank].offset + d.banks[bank].size
+
+	for {
+		if d.kind[offset] != byteUnknown {
+			return
+		}
+
+		base := offset - int(d.addrOf(offset))
+		instr := cpu6502.Decode(d.addrOf(offset), func(addr uint16) uint8 {
+			return d.prg[(base+int(addr))%len(d.prg)]
+		})
+
+		if instr.Code == cpu6502.KIL || offset+int(instr.Size) > end {
+			return
+		}
+		for i := 1; i < int(instr.Size); i++ {
+			if d.kind[offset+i] != byteUnknown {
+				return
+			}
+		}
+
+		d.kind[offset] = byteOpcode
+		for i := 1; i < int(instr.Size); i++ {
+			d.kind[offset+i] = byteOperand
+		}
+		d.decoded[offset] = instr
+
+		target := -1
+		switch instr.Addressing {
+		case cpu6502.Absolute, cpu6502.AbsoluteX, cpu6502.AbsoluteY, cpu6502.Relative:
+			target = d.resolve(instr.Target, bank)
+		}
+
+		switch instr.Flow {
+		case cpu6502.FlowNext:
+			// stores to rom are mapper registers, not data
+			isStore := instr.Code == cpu6502.STA || instr.Code == cpu6502.STX || instr.Code == cpu6502.STY
+			if target >= 0 && !isStore {
+				d.label(target, "dat")
+			}
+		case cpu6502.FlowBranch, cpu6502.FlowJump, cpu6502.FlowCall:
+			if target >= 0 {
+				if instr.Flow == cpu6502.FlowCall {
+					d.label(target, "sub")
+				} else {
+					d.label(target, "loc")
+				}
+				d.queue = append(d.queue, target)
+			}
+		}
+
+		switch instr.Flow {
+		case cpu6502.FlowJump, cpu6502.FlowJumpIndirect, cpu6502.FlowReturn, cpu6502.FlowStop:
+			return
+		}
+
+		offset += int(instr.Size)
+	}
+}
+
+// previous - the instruction that runs straight into the one at offset
+func (d *disassembler) previous(offset int) (int, bool) {
+	for size := 1; size <= 3 && offset-size >= 0; size++ {
+		if instr, ok := d.decoded[offset-size]; ok && int(instr.Size) == size {
+			return offset - size, true
+		}
+	}
+
+	return 0, false
+}
+
+// tableLoad - the table read by the LDA table,X or LDA table,Y that puts
+// the byte in A for the instruction at offset
+func (d *disassembler) tableLoad(offset int) (uint16, bool) {
+	for i := 0; i < 4; i++ {
+		var ok bool
+		if offset, ok = d.previous(offset); !ok {
+			return 0, false
+		}
+
+		instr := d.decoded[offset]
+		switch {
+		case instr.Code == cpu6502.LDA:
+			return indexedLoad(instr)
+		case instr.Flow != cpu6502.FlowNext, instr.Code == cpu6502.PLA, instr.Code == cpu6502.TXA, instr.Code == cpu6502.TYA:
+			return 0, false
+		}
+	}
+
+	return 0, false
+}
+
+// findJumpTables - looks for the two usual ways of dispatching through a
+// table of addresses, and queues every entry of the tables
+//
+//	LDA lo,X / STA ptr / LDA hi,X / STA ptr+1 / JMP (ptr)
+//	LDA hi,X / PHA / LDA lo,X / PHA / RTS
+//
+// The low and high bytes can be interleaved or in two tables.
+func (d *disassembler) findJumpTables() {
+	var offsets []int
+	for offset := range d.decoded {
+		offsets = append(offsets, offset)
+	}
+	sort.Ints(offsets)
+
+	for _, offset := range offsets {
+		instr := d.decoded[offset]
+		if d.dispatches[offset] || (instr.Flow != cpu6502.FlowJumpIndirect && instr.Code != cpu6502.RTS) {
+			continue
+		}
+		d.dispatches[offset] = true
+
+		if instr.Flow == cpu6502.FlowJumpIndirect {
+			var lo, hi uint16
+			var foundLo, foundHi bool
+
+			// look back for the stores that build the pointer
+			at := offset
+			for i := 0; i < 12 && !(foundLo && foundHi); i++ {
+				var ok bool
+				if at, ok = d.previous(at); !ok {
+					break
+				}
+
+				store := d.decoded[at]
+				if store.Flow != cpu6502.FlowNext {
+					break
+				}
+				if store.Code != cpu6502.STA || (store.Addressing != cpu6502.ZeroPage && store.Addressing != cpu6502.Absolute) {
+					continue
+				}
+
+				switch store.Target {
+				case instr.Target:
+					lo, foundLo = d.tableLoad(at)
+				case instr.Target + 1:
+					hi, foundHi = d.tableLoad(at)
+				}
+			}
+
+			if foundLo && foundHi {
+				d.readJumpTable(offset, lo, hi, false)
+			}
+			continue
+		}
+
+		// RTS to an address pushed from a table
+		pushLo, ok := d.previous(offset)
+		if !ok || d.decoded[pushLo].Code != cpu6502.PHA {
+			continue
+		}
+		loadLo, ok := d.previous(pushLo)
+		if !ok {
+			continue
+		}
+		pushHi, ok := d.previous(loadLo)
+		if !ok || d.decoded[pushHi].Code != cpu6502.PHA {
+			continue
+		}
+		loadHi, ok := d.previous(pushHi)
+		if !ok {
+			continue
+		}
+
+		lo, loIndexed := indexedLoad(d.decoded[loadLo])
+		hi, hiIndexed := indexedLoad(d.decoded[loadHi])
+		if loIndexed && hiIndexed {
+			d.readJumpTable(offset, lo, hi, true)
+		}
+	}
+}
+
+// indexedLoad - the table an LDA table,X or LDA table,Y reads
+func indexedLoad(instr cpu6502.Decoded) (uint16, bool) {
+	indexed := instr.Addressing == cpu6502.AbsoluteX || instr.Addressing == cpu6502.AbsoluteY
+
+	return instr.Target, instr.Code == cpu6502.LDA && indexed
+}
+
+// readJumpTable - takes entries from the tables at lo and hi for as long
+// as they look like addresses of code the dispatch at offset can reach
+func (d *disassembler) readJumpTable(offset int, lo, hi uint16, rts bool) {
+	bank := d.bankOf(offset)
+	loStart, hiStart := d.resolve(lo, bank), d.resolve(hi, bank)
+	if loStart < 0 || hiStart < 0 {
+		return
+	}
+
+	interleaved := hi == lo+1
+	stride, count := 1, 256
+	if interleaved {
+		stride, count = 2, 128
+	}
+
+	var entries []int
+	for i := 0; i < count; i++ {
+		loAt, hiAt := loStart+i*stride, hiStart+i*stride
+		if d.bankOf(loAt) != d.bankOf(loStart) || d.bankOf(hiAt) != d.bankOf(hiStart) {
+			break
+		}
+		if d.kind[loAt] != byteUnknown || d.kind[hiAt] != byteUnknown {
+			break
+		}
+
+		// another table starts here, or the low bytes have run into the high ones
+		if i > 0 && (loAt == hiStart || hiAt == loStart) {
+			break
+		}
+		if _, ok := d.labels[loAt]; ok && i > 0 {
+			break
+		}
+
+		addr := uint16(d.prg[hiAt])<<8 | uint16(d.prg[loAt])
+		if rts {
+			addr++
+		}
+		target := d.resolve(addr, bank)
+		if target < 0 || (d.kind[target] != byteUnknown && d.kind[target] != byteOpcode) {
+			break
+		}
+
+		if interleaved {
+			d.kind[loAt], d.kind[hiAt] = byteWord, byteWordHigh
+			d.rtsWords[loAt] = rts
+		} else {
+			d.kind[loAt], d.kind[hiAt] = byteTable, byteTable
+		}
+		entries = append(entries, target)
+	}
+
+	if len(entries) == 0 {
+		return
+	}
+
+	// the loads named the tables as plain data
+	for _, start := range []int{loStart, hiStart} {
+		if strings.HasPrefix(d.labels[start], "dat_") {
+			delete(d.labels, start)
+		}
+	}
+	d.label(loStart, "tbl")
+	if !interleaved {
+		d.label(hiStart, "tbl")
+	}
+	for _, target := range entries {
+		d.label(target, "loc")
+		d.queue = append(d.queue, target)
+	}
+}
+
+// name - the label for addr as seen from bank, or "" to write it as a number
+func (d *disassembler) name(addr uint16, bank int) string {
+	offset := d.resolve(addr, bank)
+	if offset < 0 || d.addrOf(offset) != addr || !d.labelled(offset) {
+		return ""
+	}
+
+	return d.labels[offset]
+}
+
+// constant - the name of an address outside PRG rom, or "". An absolute
+// operand in zero page has to stay absolute.
+func (d *disassembler) constant(addr uint16, instr cpu6502.Decoded) string {
+	name, ok := d.constants[addr]
+	if !ok || addr != instr.Operand {
+		return ""
+	}
+
+	switch instr.Addressing {
+	case cpu6502.Absolute, cpu6502.AbsoluteX, cpu6502.AbsoluteY:
+		if addr < 0x100 {
+			return "a:" + name
+		}
+	}
+
+	return name
+}
+
+// labelled - a label only gets written out at the start of something
+func (d *disassembler) labelled(offset int) bool {
+	_, ok := d.labels[offset]
+
+	switch d.kind[offset] {
+	case byteOperand, byteWordHigh, bytePadding:
+		return false
+	}
+
+	return ok
+}
+
+// assembles - reports whether ca65 would give back the same bytes for instr
+func assembles(instr cpu6502.Decoded) bool {
+	if instr.Unofficial() {
+		return false
+	}
+
+	// a branch that wraps around the address space is out of range to ca65
+	if instr.Addressing == cpu6502.Relative {
+		target := int(instr.Addr) + 2 + int(int8(instr.Operand))
+		return target >= 0 && target <= 0xFFFF
+	}
+
+	return true
+}
+
+// rawBytes - data as it would appear in a hex dump
+func rawBytes(data []byte) string {
+	var values []string
+	for _, value := range data {
+		values = append(values, fmt.Sprintf("%02X", value))
+	}
+
+	return strings.Join(values, " ")
+}
+
+func hexBytes(data []byte) string {
+	var values []string
+	for _, value := range data {
+		values = append(values, fmt.Sprintf("$%02X", value))
+	}
+
+	return strings.Join(values, ",")
+}
+
+// write - writes the source, one bank at a time between the header and CHR rom
+func (d *disassembler) write(cart *Cartridge, out io.Writer) error {
+	w := bufio.NewWriter(out)
+
+	header := cart.HeaderBytes()
+	fmt.Fprintf(w, "; mapper %d, %d x 16KB PRG, %d x 8KB CHR\n", cart.mapperType, cart.prgRomBlocks, cart.chrRomBlocks)
+	fmt.Fprintln(w, "; build with a linker config that writes CODE out flat, e.g.")
+	fmt.Fprintln(w, ";   MEMORY { ROM: start = 0, size = $1000000, file = %O; }")
+	fmt.Fprintln(w, ";   SEGMENTS { CODE: load = ROM, type = ro; }")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "\t.setcpu \"6502\"")
+	fmt.Fprintln(w)
+
+	if len(d.constants) > 0 {
+		var addrs []int
+		for addr := range d.constants {
+			addrs = append(addrs, int(addr))
+		}
+		sort.Ints(addrs)
+
+		fmt.Fprintln(w, "; RAM and registers")
+		for _, addr := range addrs {
+			fmt.Fprintf(w, "%s = $%04X\n", d.constants[uint16(addr)], addr)
+		}
+		fmt.Fprintln(w)
+	}
+	fmt.Fprintln(w, "; iNES header")
+	fmt.Fprintf(w, "\t.byte \"NES\",$1A\n")
+	fmt.Fprintf(w, "\t.byte %s\n", hexBytes(header[4:]))
+
+	// PRG rom starts after the header and trainer
+	prgOffset := 16
+	if cart.trainer != nil {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "; trainer")
+		writeByteRows(w, cart.trainer)
+		prgOffset += len(cart.trainer)
+	}
+
+	for i, bank := range d.banks {
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "; PRG bank %d, file offset $%06X\n", i, prgOffset+bank.offset)
+		fmt.Fprintf(w, "\t.org $%04X\n", bank.origin)
+
+		d.writeBank(w, i)
+	}
+
+	if cart.chrSize > 0 {
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "; CHR rom")
+		writeByteRows(w, cart.chrRom[:cart.chrSize])
+	}
+
+	return w.Flush()
+}
+
+// writeByteRows - data as .byte lines of 16
+func writeByteRows(w *bufio.Writer, data []byte) {
+	for i := 0; i < len(data); i += 16 {
+		end := i + 16
+		if end > len(data) {
+			end = len(data)
+		}
+		fmt.Fprintf(w, "\t.byte %s\n", hexBytes(data[i:end]))
+	}
+}
+
+func (d *disassembler) writeBank(w *bufio.Writer, index int) {
+	for _, line := range d.bankLines(index) {
+		if line.label != "" {
+			fmt.Fprintf(w, "%s:\n", line.label)
+		}
+		if line.comment != "" {
+			fmt.Fprintf(w, "\t%-32s; %s\n", line.source, line.comment)
+		} else {
+			fmt.Fprintf(w, "\t%s\n", line.source)
+		}
+	}
+}
+
+// disasmLine - a line of source and the PRG rom bytes it's for
+type disasmLine struct {
+	// written on a line of its own before, if there is one
+	label string
+
+	source  string
+	comment string
+
+	offset, size int
+	code         bool
+}
+
+// bankLines - the source for a bank
+func (d *disassembler) bankLines(index int) []disasmLine {
+	bank := d.banks[index]
+	end := bank.offset + bank.size
+	// padding isn't in the file, so it isn't written out
+	for end > bank.offset && d.kind[end-1] == bytePadding {
+		end--
+	}
+
+	var lines []disasmLine
+	line := func(source string, offset int, size int) disasmLine {
+		comment := fmt.Sprintf("%04X  %s", d.addrOf(offset), rawBytes(d.prg[offset:offset+size]))
+		return disasmLine{source: source, comment: comment, offset: offset, size: size}
+	}
+
+	for offset := bank.offset; offset < end; {
+		label := ""
+		if d.labelled(offset) {
+			label = d.labels[offset]
+		}
+
+		var next disasmLine
+		switch d.kind[offset] {
+		case byteOpcode:
+			instr := d.decoded[offset]
+			size := int(instr.Size)
+			if assembles(instr) {
+				next = line(instr.Format(func(addr uint16) string {
+					if name := d.name(addr, index); name != "" {
+						return name
+					}
+					return d.constant(addr, instr)
+				}), offset, size)
+			} else {
+				next = line(".byte "+hexBytes(d.prg[offset:offset+size]), offset, size)
+				next.comment = fmt.Sprintf("%04X  %s", d.addrOf(offset), instr.Format(func(uint16) string { return "" }))
+			}
+			next.code = true
+		case byteWord:
+			value := d.word(offset)
+			source := fmt.Sprintf(".word $%04X", value)
+			if d.rtsWords[offset] {
+				if name := d.name(value+1, index); name != "" {
+					source = ".word " + name + "-1"
+				}
+			} else if name := d.name(value, index); name != "" {
+				source = ".word " + name
+			}
+			next = line(source, offset, 2)
+		default:
+			// data runs up to the next label or code, 16 bytes a line
+			run := offset + 1
+			for run < end && run-offset < 16 && !d.labelled(run) && (d.kind[run] == byteUnknown || d.kind[run] == byteTable) {
+				run++
+			}
+			next = disasmLine{source: ".byte " + hexBytes(d.prg[offset:run]), offset: offset, size: run - offset}
+		}
+
+		next.label = label
+		lines = append(lines, next)
+		offset += next.size
+	}
+
+	return lines
+}
+
+// ExecutedCode - runs nes for frames, recording the PRG rom offset of
+// every instruction run and the cpu address it ran at
+func ExecutedCode(nes *NES, frames int) map[int]uint16 {
+	executed := make(map[int]uint16)
+
+	end := nes.PPU.frameCount + uint64(frames)
+	for nes.PPU.frameCount < end && !nes.CPU.Halted() {
+		if !nes.CPU.InterruptPending() {
+			if offset := nes.CARTIO.prgOffset(nes.CPU.PC); offset >= 0 {
+				executed[offset] = nes.CPU.PC
+			}
+		}
+
+		nes.Step()
+	}
+
+	return executed
+}
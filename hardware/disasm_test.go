@@ -0,0 +1,216 @@
+package hardware
+
+import (
+	"bytes"
+	"nes-emu/assembler"
+	"os"
+	"strings"
+	"testing"
+)
+
+// newTestNROM puts code at $C000 of a 16KB NROM cartridge, with the reset
+// vector at reset and the NMI and IRQ vectors at nmi
+func newTestNROM(code map[uint16][]byte, reset, nmi uint16) *Cartridge {
+	prg := make([]byte, 0x4000)
+	for addr, data := range code {
+		copy(prg[addr-0xC000:], data)
+	}
+	prg[0x3FFA], prg[0x3FFB] = uint8(nmi), uint8(nmi>>8)
+	prg[0x3FFC], prg[0x3FFD] = uint8(reset), uint8(reset>>8)
+	prg[0x3FFE], prg[0x3FFF] = uint8(nmi), uint8(nmi>>8)
+
+	return &Cartridge{
+		nesLabel:     [4]byte{'N', 'E', 'S', 0x1A},
+		prgRomBlocks: 1,
+		prgRom:       prg,
+		prgSize:      len(prg),
+		mapperType:   mapper0,
+	}
+}
+
+func TestDisassembleFollowsCode(t *testing.T) {
+	cart := newTestNROM(map[uint16][]byte{
+		// C000 LDX #$00
+		// C002 JSR $C010
+		// C005 LDA $C030,X
+		// C008 BNE $C000
+		// C00A JMP $C00A
+		0xC000: {0xA2, 0x00, 0x20, 0x10, 0xC0, 0xBD, 0x30, 0xC0, 0xD0, 0xF6, 0x4C, 0x0A, 0xC0},
+		// C010 LDA $C041,X
+		// C013 PHA
+		// C014 LDA $C040,X
+		// C017 PHA
+		// C018 RTS
+		0xC010: {0xBD, 0x41, 0xC0, 0x48, 0xBD, 0x40, 0xC0, 0x48, 0x60},
+		// C01A RTI, C01B is data, C01C RTS
+		0xC01A: {0x40, 0xFF, 0x60},
+		0xC030: {0x01, 0x02, 0x03},
+		// jump table of addresses minus one, ended by $FFFF
+		0xC040: {0x19, 0xC0, 0x1B, 0xC0, 0xFF, 0xFF},
+	}, 0xC000, 0xC01A)
+
+	out := &bytes.Buffer{}
+	if err := Disassemble(cart, out, DisasmOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	source := out.String()
+
+	expected := []string{
+		"\t.byte \"NES\",$1A\n\t.byte $01,$00,",
+		"\t.org $C000\nreset:\n\tldx #$00 ",
+		"\tjsr sub_C010 ",
+		"\tlda dat_C030,x ",
+		"\tbne reset ",
+		"loc_C00A:\n\tjmp loc_C00A ",
+		"tbl_C040:\n\t.word nmi-1 ",
+		"\t.word loc_C01C-1 ",
+		"nmi:\n\trti ",
+		"\t.byte $FF\nloc_C01C:\n\trts ",
+		"dat_C030:\n\t.byte $01,$02,$03,",
+		"\t.word nmi ",
+		"\t.word reset ",
+	}
+	for _, want := range expected {
+		if !strings.Contains(source, want) {
+			t.Errorf("Expected %q in:\n%s", want, source)
+		}
+	}
+}
+
+func TestDisassembleKeepsOddBytes(t *testing.T) {
+	cart := newTestNROM(map[uint16][]byte{
+		// C000 LDA $0010 as absolute
+		// C003 SLO $10
+		// C005 BRK
+		0xC000: {0xAD, 0x10, 0x00, 0x07, 0x10, 0x00},
+	}, 0xC000, 0xC000)
+
+	out := &bytes.Buffer{}
+	if err := Disassemble(cart, out, DisasmOptions{}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, want := range []string{"\tlda a:$0010 ", "\t.byte $07,$10 ", "\tbrk "} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected %q in:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestExecutedCode(t *testing.T) {
+	cart, err := CreateCartridge("nestest.nes")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nes := NewNES()
+	nes.LoadCartridge(cart)
+	nes.APU.InitAPU(false)
+	nes.PPU.InitFrame(1)
+	nes.Reset()
+
+	executed := ExecutedCode(nes, 2)
+	if addr, ok := executed[0x0004]; !ok || addr != 0xC004 {
+		t.Errorf("Expected the reset handler at offset 0004 to run at C004, got %v %04X", ok, addr)
+	}
+	if nes.PPU.frameCount != 2 {
+		t.Errorf("Expected to stop after 2 frames, ran %d", nes.PPU.frameCount)
+	}
+}
+
+func TestDisassembleRoundTrip(t *testing.T) {
+	for _, filename := range []string{"nestest.nes", "blargg_official_only.nes"} {
+		cart, err := CreateCartridge(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		out := &bytes.Buffer{}
+		if err := Disassemble(&cart, out, DisasmOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		program, err := assembler.Assemble(out.String())
+		if err != nil {
+			t.Fatalf("%s: %v", filename, err)
+		}
+
+		rom, err := os.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(program.Bytes, rom) {
+			t.Errorf("%s doesn't reassemble to the same bytes", filename)
+		}
+	}
+}
+
+func TestDisassembleTrainerRoundTrip(t *testing.T) {
+	nestest, err := os.ReadFile("nestest.nes")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	trainer := make([]byte, trainerSize)
+	for i := range trainer {
+		trainer[i] = uint8(i)
+	}
+	rom := append(append(append([]byte(nil), nestest[:16]...), trainer...), nestest[16:]...)
+	rom[6] |= 0x04
+
+	cart, err := CreateCartridgeFromBytes(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	if err := Disassemble(&cart, out, DisasmOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "; PRG bank 0, file offset $000210") {
+		t.Errorf("PRG bank 0 should be commented as after the trainer")
+	}
+
+	program, err := assembler.Assemble(out.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(program.Bytes, rom) {
+		t.Errorf("a rom with a trainer doesn't reassemble to the same bytes")
+	}
+}
+
+func TestDisassemblePaddedRoundTrip(t *testing.T) {
+	prg := make([]byte, 0x3000)
+	copy(prg, []byte{0xA9, 0x01, 0x8D, 0x00, 0x02, 0x4C, 0x00, 0xC0})
+	chr := make([]byte, 0x1800)
+	for i := range chr {
+		chr[i] = uint8(i)
+	}
+
+	// NES 2.0 with 2^12 * 3 bytes of PRG rom and 2^11 * 3 of CHR rom, which
+	// are padded to whole banks when loaded
+	rom := []byte{'N', 'E', 'S', 0x1A, 12<<2 | 1, 11<<2 | 1, 0x00, 0x08, 0x00, 0xFF, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+	rom = append(append(rom, prg...), chr...)
+
+	cart, err := loadINES(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	if err := Disassemble(&cart, out, DisasmOptions{Executed: map[int]uint16{0: 0xC000}}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "jmp loc_C000") {
+		t.Errorf("Expected the executed code to be disassembled")
+	}
+
+	program, err := assembler.Assemble(out.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(program.Bytes, rom) {
+		t.Errorf("a rom padded to whole banks reassembles to %d bytes, not %d", len(program.Bytes), len(rom))
+	}
+}
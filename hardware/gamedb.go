@@ -0,0 +1,221 @@
+package hardware
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strconv"
+)
+
+// dbSize - a ram size element
+type dbSize struct {
+	Size int `xml:"size,attr"`
+}
+
+// dbGame - a game in the database, in the NES 2.0 XML database's layout.
+// Elements left out leave what the header says alone. The rom element
+// has the hashes of PRG rom followed by CHR rom.
+type dbGame struct {
+	Name  string `xml:"name,attr"`
+	Board string `xml:"board,attr"`
+
+	ROM struct {
+		CRC32 string `xml:"crc32,attr"`
+		SHA1  string `xml:"sha1,attr"`
+	} `xml:"rom"`
+
+	PCB *struct {
+		Mapper    uint16 `xml:"mapper,attr"`
+		Submapper uint8  `xml:"submapper,attr"`
+		Mirroring string `xml:"mirroring,attr"`
+		Battery   int    `xml:"battery,attr"`
+	} `xml:"pcb"`
+
+	PRGRAM   *dbSize `xml:"prgram"`
+	PRGNVRAM *dbSize `xml:"prgnvram"`
+	CHRRAM   *dbSize `xml:"chrram"`
+	CHRNVRAM *dbSize `xml:"chrnvram"`
+
+	Console *struct {
+		Type   uint8 `xml:"type,attr"`
+		Region uint8 `xml:"region,attr"`
+	} `xml:"console"`
+
+	Expansion *struct {
+		Type uint8 `xml:"type,attr"`
+	} `xml:"expansion"`
+}
+
+// GameDB - known dumps and what their headers should say, by the hashes
+// of their PRG and CHR rom. Read with ParseGameDB.
+type GameDB struct {
+	bySHA1  map[[sha1.Size]byte]*dbGame
+	byCRC32 map[uint32]*dbGame
+}
+
+// ParseGameDB - reads a database in the NES 2.0 XML database's layout,
+// checking every game has a hash and nothing the header can't hold. The
+// name and board attributes are extra, and can be left out.
+func ParseGameDB(r io.Reader) (*GameDB, error) {
+	var file struct {
+		Games []*dbGame `xml:"game"`
+	}
+	if err := xml.NewDecoder(r).Decode(&file); err != nil {
+		return nil, err
+	}
+
+	db := &GameDB{
+		bySHA1:  make(map[[sha1.Size]byte]*dbGame),
+		byCRC32: make(map[uint32]*dbGame),
+	}
+	for i, game := range file.Games {
+		name := game.Name
+		if name == "" {
+			name = fmt.Sprintf("game %d", i+1)
+		}
+		if err := game.check(); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+
+		if game.ROM.SHA1 != "" {
+			var sum [sha1.Size]byte
+			if n, err := hex.Decode(sum[:], []byte(game.ROM.SHA1)); err != nil || n != sha1.Size {
+				return nil, fmt.Errorf("%s: bad SHA-1 %q", name, game.ROM.SHA1)
+			}
+			db.bySHA1[sum] = game
+		}
+		if game.ROM.CRC32 != "" {
+			crc, err := strconv.ParseUint(game.ROM.CRC32, 16, 32)
+			if err != nil {
+				return nil, fmt.Errorf("%s: bad CRC32 %q", name, game.ROM.CRC32)
+			}
+			db.byCRC32[uint32(crc)] = game
+		}
+	}
+
+	return db, nil
+}
+
+func (game *dbGame) check() error {
+	if game.ROM.CRC32 == "" && game.ROM.SHA1 == "" {
+		return fmt.Errorf("no rom hash")
+	}
+	if game.PCB != nil {
+		switch game.PCB.Mirroring {
+		case "", "H", "V", "4":
+		default:
+			return fmt.Errorf("unknown mirroring %q", game.PCB.Mirroring)
+		}
+		if game.PCB.Mapper > 0xFFF || game.PCB.Submapper > 0x0F {
+			return fmt.Errorf("mapper %d.%d is out of range", game.PCB.Mapper, game.PCB.Submapper)
+		}
+	}
+	if game.Console != nil && (game.Console.Type > 3 || game.Console.Region > 3) {
+		return fmt.Errorf("console type %d region %d is out of range", game.Console.Type, game.Console.Region)
+	}
+
+	return nil
+}
+
+// lookup - the game with rom's hashes. A CRC32 match is only believed
+// when the game has no SHA-1 to check.
+func (db *GameDB) lookup(crc uint32, sum [sha1.Size]byte) *dbGame {
+	if game, ok := db.bySHA1[sum]; ok {
+		return game
+	}
+	if game, ok := db.byCRC32[crc]; ok && game.ROM.SHA1 == "" {
+		return game
+	}
+
+	return nil
+}
+
+// romHashes - the CRC32 and SHA-1 of PRG rom followed by CHR rom
+func romHashes(parts ...[]byte) (uint32, [sha1.Size]byte) {
+	var crc uint32
+	hash := sha1.New()
+	for _, part := range parts {
+		crc = crc32.Update(crc, crc32.IEEETable, part)
+		hash.Write(part)
+	}
+
+	var sum [sha1.Size]byte
+	copy(sum[:], hash.Sum(nil))
+	return crc, sum
+}
+
+// correct - header with what the database knows about the game in place
+// of what the dump says
+func (game *dbGame) correct(header Header) Header {
+	if pcb := game.PCB; pcb != nil {
+		header.Mapper = pcb.Mapper
+		header.Submapper = pcb.Submapper
+		switch pcb.Mirroring {
+		case "H":
+			header.VerticalMirroring, header.FourScreen = false, false
+		case "V":
+			header.VerticalMirroring, header.FourScreen = true, false
+		case "4":
+			header.FourScreen = true
+		}
+
+		battery := pcb.Battery != 0
+		// a missing battery flag left the ram counted as volatile
+		if battery && !header.Battery {
+			header.PRGRAMSize, header.PRGNVRAMSize = 0, header.PRGRAMSize+header.PRGNVRAMSize
+		} else if !battery && header.Battery {
+			header.PRGRAMSize, header.PRGNVRAMSize = header.PRGRAMSize+header.PRGNVRAMSize, 0
+		}
+		header.Battery = battery
+	}
+
+	if game.PRGRAM != nil || game.PRGNVRAM != nil || game.CHRRAM != nil || game.CHRNVRAM != nil {
+		header.PRGRAMSize = game.PRGRAM.size()
+		header.PRGNVRAMSize = game.PRGNVRAM.size()
+		header.CHRRAMSize = game.CHRRAM.size()
+		header.CHRNVRAMSize = game.CHRNVRAM.size()
+	}
+
+	if game.Console != nil {
+		header.Console = Console(game.Console.Type)
+		header.Timing = Timing(game.Console.Region)
+	}
+	if game.Expansion != nil {
+		header.DefaultExpansion = game.Expansion.Type
+	}
+
+	return header
+}
+
+func (s *dbSize) size() int {
+	if s == nil {
+		return 0
+	}
+
+	return s.Size
+}
+
+// correctHeader - the header as db says it should be, if it knows the dump
+func (c *Cartridge) correctHeader(db *GameDB) {
+	if db == nil {
+		return
+	}
+
+	game := db.lookup(c.CRC32, c.SHA1)
+	if game == nil {
+		return
+	}
+
+	c.game = game
+	if game.Name != "" {
+		c.Title = game.Name
+	}
+	if game.Board != "" {
+		c.Board = game.Board
+	}
+	c.Header = game.correct(c.Header)
+	c.mapperType = c.Header.Mapper
+}
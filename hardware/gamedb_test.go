@@ -0,0 +1,135 @@
+package hardware
+
+import (
+	"fmt"
+	"nes-emu/assembler"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// loadTestGameDB - the database of the test roms in testdata
+func loadTestGameDB(t *testing.T) *GameDB {
+	file, err := os.Open(filepath.Join("testdata", "gamedb.xml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	db, err := ParseGameDB(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return db
+}
+
+func TestKnownGames(t *testing.T) {
+	db := loadTestGameDB(t)
+
+	cart, err := OpenCartridge("nestest.nes", LoadOptions{GameDB: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cart.InGameDB() || cart.Title != "nestest" || cart.Board != "NROM-128" || cart.CRC32 != 0x158B0388 {
+		t.Errorf("Expected nestest from the game database, got %q %q %08X", cart.Title, cart.Board, cart.CRC32)
+	}
+	if cart.Header != cart.FileHeader {
+		t.Errorf("Expected nestest's header to be right, got %v", cart.Header)
+	}
+
+	// without a database the header is taken as it is
+	if cart, err = CreateCartridge("nestest.nes"); err != nil {
+		t.Fatal(err)
+	}
+	if cart.InGameDB() || cart.Title != "" {
+		t.Errorf("Expected nestest not to be looked up without a database, got %q", cart.Title)
+	}
+}
+
+func TestGameDBFromFile(t *testing.T) {
+	image := assembler.INES([]byte{0xEA}, nil, mapper0)
+	crc, sum := romHashes(image[16:])
+
+	// an NES 2.0 XML database entry, which has no name or board
+	db, err := ParseGameDB(strings.NewReader(fmt.Sprintf(`
+<nes20db>
+	<game>
+		<prgrom size="16384"/>
+		<chrrom size="8192"/>
+		<rom size="24576" crc32="%08X" sha1="%X"/>
+		<pcb mapper="0" submapper="0" mirroring="V" battery="1"/>
+		<prgnvram size="8192"/>
+		<console type="0" region="0"/>
+	</game>
+</nes20db>`, crc, sum)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rom := filepath.Join(t.TempDir(), "game.nes")
+	if err := os.WriteFile(rom, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cart, err := OpenCartridge(rom, LoadOptions{GameDB: db})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cart.InGameDB() || !cart.VerticalMirroring || !cart.Battery || cart.PRGNVRAMSize != 0x2000 {
+		t.Errorf("Expected vertical mirroring and 8KB of battery ram from the database, got %v", cart.Header)
+	}
+	if cart.FileHeader.VerticalMirroring || cart.FileHeader.Battery {
+		t.Errorf("Expected the file's header kept as it was, got %v", cart.FileHeader)
+	}
+}
+
+func TestGameDBCorrection(t *testing.T) {
+	image := assembler.INES([]byte{0xEA}, nil, mapper0)
+	header, err := parseHeader(image[:16], len(image))
+	if err != nil {
+		t.Fatal(err)
+	}
+	crc, sum := romHashes(image[16:])
+
+	db, err := ParseGameDB(strings.NewReader(fmt.Sprintf(`
+<database>
+	<game name="test" board="NROM-128">
+		<rom crc32="%08X" sha1="%X"/>
+		<pcb mapper="1" submapper="0" mirroring="V" battery="1"/>
+		<console type="0" region="1"/>
+		<expansion type="1"/>
+	</game>
+</database>`, crc, sum)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	game := db.lookup(crc, sum)
+	if game == nil {
+		t.Fatal("Expected the rom to be found by its hashes")
+	}
+	if db.lookup(crc, [20]byte{}) != nil {
+		t.Errorf("Expected a CRC32 match with the wrong SHA-1 to be refused")
+	}
+
+	want := header
+	want.Mapper, want.VerticalMirroring, want.Battery = 1, true, true
+	want.PRGRAMSize, want.PRGNVRAMSize = 0, 0x2000
+	want.Timing, want.DefaultExpansion = TimingPAL, 1
+	if got := game.correct(header); got != want {
+		t.Errorf("Expected\n%+v, got\n%+v", want, got)
+	}
+
+	for _, bad := range []string{
+		`<database><game name="x"/></database>`,
+		`<database><game name="x"><rom crc32="nope"/></game></database>`,
+		`<database><game name="x"><rom sha1="12"/></game></database>`,
+		`<database><game name="x"><rom crc32="1"/><pcb mirroring="D"/></game></database>`,
+		`<database><game name="x"><rom crc32="1"/><console type="9"/></game></database>`,
+	} {
+		if _, err := ParseGameDB(strings.NewReader(bad)); err == nil {
+			t.Errorf("Expected %s to be refused", bad)
+		}
+	}
+}
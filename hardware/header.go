@@ -0,0 +1,305 @@
+package hardware
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Timing - which cpu and PPU timing a cartridge was made for
+type Timing uint8
+
+const (
+	TimingNTSC Timing = iota
+	TimingPAL
+	// TimingMulti - works on both NTSC and PAL consoles
+	TimingMulti
+	TimingDendy
+)
+
+func (t Timing) String() string {
+	switch t {
+	case TimingNTSC:
+		return "NTSC"
+	case TimingPAL:
+		return "PAL"
+	case TimingMulti:
+		return "NTSC/PAL"
+	case TimingDendy:
+		return "Dendy"
+	}
+
+	return fmt.Sprintf("timing %d", uint8(t))
+}
+
+// Console - the machine a cartridge runs on
+type Console uint8
+
+const (
+	ConsoleNES Console = iota
+	ConsoleVsSystem
+	ConsolePlayChoice
+	// ConsoleExtended - one of the clones and variants in ExtendedConsole
+	ConsoleExtended
+)
+
+func (c Console) String() string {
+	switch c {
+	case ConsoleNES:
+		return "NES"
+	case ConsoleVsSystem:
+		return "Vs. System"
+	case ConsolePlayChoice:
+		return "PlayChoice-10"
+	case ConsoleExtended:
+		return "extended console"
+	}
+
+	return fmt.Sprintf("console %d", uint8(c))
+}
+
+// Header - what a cartridge's iNES or NES 2.0 header says about it. iNES
+// headers leave out a lot, so those fields are left at their defaults:
+// no submapper, 8KB of PRG ram, 8KB of CHR ram when there's no CHR rom,
+// a plain NES and the standard controllers.
+type Header struct {
+	// NES20 - the header is NES 2.0, not iNES
+	NES20 bool
+
+	// UNIF - there's no header, this is what a UNIF image's chunks say
+	UNIF bool
+
+	Mapper    uint16
+	Submapper uint8
+
+	// sizes in bytes
+	PRGROMSize int
+	CHRROMSize int
+
+	// volatile ram, and ram kept by a battery or flash
+	PRGRAMSize   int
+	PRGNVRAMSize int
+	CHRRAMSize   int
+	CHRNVRAMSize int
+
+	// VerticalMirroring - the nametables are mirrored vertically, for a
+	// horizontal arrangement, unless the mapper controls it
+	VerticalMirroring bool
+	FourScreen        bool
+	Battery           bool
+	Trainer           bool
+
+	Timing  Timing
+	Console Console
+
+	// the Vs. System's PPU and protection hardware, when Console is
+	// ConsoleVsSystem
+	VsPPU      uint8
+	VsHardware uint8
+
+	// which clone or variant, when Console is ConsoleExtended
+	ExtendedConsole uint8
+
+	// the number of ROMs after CHR rom that aren't PRG, CHR or a trainer
+	MiscROMs uint8
+
+	// DefaultExpansion - the controller or other device the game expects
+	// plugged in, as numbered by the NES 2.0 spec. 1 is the standard
+	// controllers, 0 is unspecified.
+	DefaultExpansion uint8
+}
+
+// parseHeader - decodes the 16 byte header of an image romSize bytes
+// long. NES 2.0 is only believed when its sizes fit in the image, like
+// other emulators do, as old dumping tools left junk in those bytes.
+func parseHeader(h []byte, romSize int) (Header, error) {
+	if len(h) < 16 || string(h[0:4]) != "NES\x1a" {
+		return Header{}, fmt.Errorf("%w: not an iNES rom", ErrBadHeader)
+	}
+
+	flags6, flags7 := h[6], h[7]
+	header := Header{
+		Mapper:            uint16(flags7&0xF0 | flags6>>4),
+		VerticalMirroring: flags6&0x01 != 0,
+		Battery:           flags6&0x02 != 0,
+		Trainer:           flags6&0x04 != 0,
+		FourScreen:        flags6&0x08 != 0,
+		Console:           Console(flags7 & 0x03),
+	}
+
+	if flags7&0x0C == 0x08 {
+		nes20 := header
+		if err := nes20.parseNES20(h); err != nil {
+			return header, err
+		}
+
+		size := 16 + nes20.PRGROMSize + nes20.CHRROMSize
+		if nes20.Trainer {
+			size += trainerSize
+		}
+		if size <= romSize {
+			return nes20, nil
+		}
+	}
+
+	// DiskDude! and the like wrote junk over the end of iNES headers, so
+	// nothing from flags 7 on can be trusted
+	if h[12] != 0 || h[13] != 0 || h[14] != 0 || h[15] != 0 {
+		var clean [16]byte
+		copy(clean[:7], h)
+		h = clean[:]
+
+		header.Mapper &= 0x0F
+		header.Console = ConsoleNES
+	}
+
+	header.PRGROMSize = int(h[4]) * 0x4000
+	header.CHRROMSize = int(h[5]) * 0x2000
+
+	// 0 means 8KB, for compatibility with older images
+	header.PRGRAMSize = int(h[8]) * 0x2000
+	if header.PRGRAMSize == 0 {
+		header.PRGRAMSize = 0x2000
+	}
+	if header.Battery {
+		header.PRGRAMSize, header.PRGNVRAMSize = 0, header.PRGRAMSize
+	}
+	if header.CHRROMSize == 0 {
+		header.CHRRAMSize = 0x2000
+	}
+
+	if h[9]&0x01 != 0 {
+		header.Timing = TimingPAL
+	}
+
+	return header, nil
+}
+
+// parseNES20 - fills in what a NES 2.0 header adds
+func (header *Header) parseNES20(h []byte) error {
+	header.NES20 = true
+	header.Mapper |= uint16(h[8]&0x0F) << 8
+	header.Submapper = h[8] >> 4
+
+	var err error
+	if header.PRGROMSize, err = nes20ROMSize(h[4], h[9]&0x0F, 0x4000); err != nil {
+		return fmt.Errorf("%w: PRG rom %v", ErrBadHeader, err)
+	}
+	if header.CHRROMSize, err = nes20ROMSize(h[5], h[9]>>4, 0x2000); err != nil {
+		return fmt.Errorf("%w: CHR rom %v", ErrBadHeader, err)
+	}
+
+	header.PRGRAMSize = nes20RAMSize(h[10] & 0x0F)
+	header.PRGNVRAMSize = nes20RAMSize(h[10] >> 4)
+	header.CHRRAMSize = nes20RAMSize(h[11] & 0x0F)
+	header.CHRNVRAMSize = nes20RAMSize(h[11] >> 4)
+
+	header.Timing = Timing(h[12] & 0x03)
+
+	switch header.Console {
+	case ConsoleVsSystem:
+		header.VsPPU = h[13] & 0x0F
+		header.VsHardware = h[13] >> 4
+	case ConsoleExtended:
+		header.ExtendedConsole = h[13] & 0x0F
+	}
+
+	header.MiscROMs = h[14] & 0x03
+	header.DefaultExpansion = h[15] & 0x3F
+
+	return nil
+}
+
+// nes20ROMSize - a rom size from its low byte and the high nibble from
+// byte 9. A high nibble of $F means the low byte is an exponent and
+// multiplier instead, EEEEEEMM for 2^E * (MM*2+1) bytes.
+func nes20ROMSize(low, high uint8, unit int) (int, error) {
+	if high != 0x0F {
+		return (int(high)<<8 | int(low)) * unit, nil
+	}
+
+	exponent, multiplier := low>>2, int(low&0x03)*2+1
+	if exponent > 30 {
+		return 0, fmt.Errorf("size 2^%d * %d is too big", exponent, multiplier)
+	}
+
+	return (1 << exponent) * multiplier, nil
+}
+
+// nes20RAMSize - a ram size from its shift count, 64 << shift bytes, or
+// none for 0
+func nes20RAMSize(shift uint8) int {
+	if shift == 0 {
+		return 0
+	}
+
+	return 64 << shift
+}
+
+// Format - the kind of header, iNES, NES 2.0 or UNIF
+func (header Header) Format() string {
+	switch {
+	case header.NES20:
+		return "NES 2.0"
+	case header.UNIF:
+		return "UNIF"
+	}
+
+	return "iNES"
+}
+
+func (header Header) String() string {
+	var parts []string
+
+	mapper := fmt.Sprintf("%s, mapper %d", header.Format(), header.Mapper)
+	if header.Mapper == UnknownMapper {
+		mapper = header.Format() + ", unknown mapper"
+	} else if header.NES20 {
+		mapper += fmt.Sprintf(".%d", header.Submapper)
+	}
+	parts = append(parts, mapper)
+
+	sizes := []struct {
+		name string
+		size int
+	}{
+		{"PRG rom", header.PRGROMSize},
+		{"CHR rom", header.CHRROMSize},
+		{"PRG ram", header.PRGRAMSize},
+		{"battery PRG ram", header.PRGNVRAMSize},
+		{"CHR ram", header.CHRRAMSize},
+		{"battery CHR ram", header.CHRNVRAMSize},
+	}
+	for _, s := range sizes {
+		if s.size > 0 {
+			parts = append(parts, fmt.Sprintf("%s %s", formatSize(s.size), s.name))
+		}
+	}
+
+	switch {
+	case header.FourScreen:
+		parts = append(parts, "four screen")
+	case header.VerticalMirroring:
+		parts = append(parts, "vertical mirroring")
+	default:
+		parts = append(parts, "horizontal mirroring")
+	}
+	if header.Trainer {
+		parts = append(parts, "trainer")
+	}
+
+	parts = append(parts, header.Timing.String())
+	if header.Console != ConsoleNES {
+		parts = append(parts, header.Console.String())
+	}
+
+	return strings.Join(parts, ", ")
+}
+
+// formatSize - bytes in KB when they're whole KB
+func formatSize(size int) string {
+	if size%1024 == 0 {
+		return fmt.Sprintf("%dKB", size/1024)
+	}
+
+	return fmt.Sprintf("%d bytes", size)
+}
@@ -0,0 +1,102 @@
+package hardware
+
+import (
+	"errors"
+	"nes-emu/assembler"
+	"reflect"
+	"testing"
+)
+
+func TestParseHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		size   int
+		want   Header
+	}{
+		{
+			"iNES",
+			[]byte{'N', 'E', 'S', 0x1A, 2, 1, 0x13, 0x00, 0, 0, 0, 0, 0, 0, 0, 0},
+			16 + 0x8000 + 0x2000,
+			Header{Mapper: 1, PRGROMSize: 0x8000, CHRROMSize: 0x2000, PRGNVRAMSize: 0x2000,
+				VerticalMirroring: true, Battery: true},
+		},
+		{
+			"iNES with CHR ram and a PAL flag",
+			[]byte{'N', 'E', 'S', 0x1A, 1, 0, 0x08, 0x11, 2, 1, 0, 0, 0, 0, 0, 0},
+			16 + 0x4000,
+			Header{Mapper: 0x10, PRGROMSize: 0x4000, PRGRAMSize: 0x4000, CHRRAMSize: 0x2000,
+				FourScreen: true, Timing: TimingPAL, Console: ConsoleVsSystem},
+		},
+		{
+			// junk at the end of the header means flags 7 can't be trusted
+			"DiskDude!",
+			[]byte{'N', 'E', 'S', 0x1A, 1, 1, 0x40, 'D', 'i', 's', 'k', 'D', 'u', 'd', 'e', '!'},
+			16 + 0x6000,
+			Header{Mapper: 4, PRGROMSize: 0x4000, CHRROMSize: 0x2000, PRGRAMSize: 0x2000},
+		},
+		{
+			"NES 2.0",
+			[]byte{'N', 'E', 'S', 0x1A, 0x02, 0x81, 0x43, 0x09, 0x21, 0x00, 0x70, 0x07, 0x03, 0x00, 0x01, 0x01},
+			16 + 0x8000 + 0x81*0x2000,
+			Header{NES20: true, Mapper: 0x104, Submapper: 2, PRGROMSize: 0x8000, CHRROMSize: 0x81 * 0x2000,
+				PRGNVRAMSize: 0x2000, CHRRAMSize: 0x2000, VerticalMirroring: true, Battery: true,
+				Timing: TimingDendy, Console: ConsoleVsSystem, MiscROMs: 1, DefaultExpansion: 1},
+		},
+		{
+			// 2^7 * 3 bytes of PRG rom
+			"NES 2.0 exponent",
+			[]byte{'N', 'E', 'S', 0x1A, 7<<2 | 1, 0, 0, 0x0B, 0, 0x0F, 0, 0, 0x02, 0x13, 0, 0},
+			16 + 384,
+			Header{NES20: true, PRGROMSize: 384, Timing: TimingMulti, Console: ConsoleExtended, ExtendedConsole: 3},
+		},
+		{
+			// the NES 2.0 sizes don't fit in the file, so it's read as iNES
+			"not really NES 2.0",
+			[]byte{'N', 'E', 'S', 0x1A, 1, 1, 0, 0x08, 0, 0x10, 0, 0, 0, 0, 0, 0},
+			16 + 0x6000,
+			Header{PRGROMSize: 0x4000, CHRROMSize: 0x2000, PRGRAMSize: 0x2000},
+		},
+	}
+
+	for _, test := range tests {
+		header, err := parseHeader(test.header, test.size)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(header, test.want) {
+			t.Errorf("%s: expected\n%+v, got\n%+v", test.name, test.want, header)
+		}
+	}
+
+	if _, err := parseHeader([]byte{'N', 'E', 'S', 0x1A, 0xFF, 0, 0, 0x08, 0, 0x0F, 0, 0, 0, 0, 0, 0}, 1<<20); !errors.Is(err, ErrBadHeader) {
+		t.Errorf("Expected a PRG rom of 2^63 bytes to be refused, got %v", err)
+	}
+}
+
+func TestLoadNES20(t *testing.T) {
+	image := assembler.INES([]byte{0xEA}, nil, mapper0)
+
+	// 2^13 * 1 bytes of PRG rom, mapper 0 with 8KB of battery ram
+	rom := append(append([]byte(nil), image[:16]...), image[16:16+0x2000]...)
+	rom = append(rom, image[16+0x4000:]...)
+	rom[4], rom[7], rom[9], rom[10] = 13<<2, 0x08, 0x0F, 0x70
+
+	cart, err := loadINES(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cart.NES20 || cart.PRGROMSize != 0x2000 || cart.PRGNVRAMSize != 0x2000 {
+		t.Errorf("Expected the NES 2.0 header to be used, got %v", cart.Header)
+	}
+	if len(cart.prgRom) != 0x4000 || cart.prgRomBlocks != 1 || cart.prgRom[0] != 0xEA {
+		t.Errorf("Expected 8KB of PRG rom padded to a 16KB bank, got %d bytes", len(cart.prgRom))
+	}
+	if h := cart.HeaderBytes(); string(h[:]) != string(rom[:16]) {
+		t.Errorf("Expected the header as loaded, got % X", h)
+	}
+	if want := "NES 2.0, mapper 0.0, 8KB PRG rom, 8KB CHR rom, 8KB battery PRG ram, horizontal mirroring, NTSC"; cart.Header.String() != want {
+		t.Errorf("Expected %q, got %q", want, cart.Header.String())
+	}
+}
@@ -0,0 +1,262 @@
+package hardware
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// how a rom matched the DAT
+const (
+	// DumpVerified - the DAT has it as a verified good dump
+	DumpVerified = "verified"
+	// DumpGood - the DAT has it, and doesn't say it's bad
+	DumpGood = "good"
+	// DumpBad - the DAT has it as a bad dump
+	DumpBad = "bad"
+	// DumpUnknown - the DAT doesn't have it, or there's no DAT
+	DumpUnknown = "unknown"
+)
+
+// datROM - a rom in a DAT, with its game's name
+type datROM struct {
+	Game   string
+	Size   int64
+	CRC32  uint32
+	SHA1   string
+	Status string
+}
+
+// DAT - the roms in a No-Intro or GoodNES style XML DAT, by their hashes
+type DAT struct {
+	Name string
+
+	bySHA1  map[string]*datROM
+	byCRC32 map[uint32][]*datROM
+}
+
+// ParseDAT - reads a Logiqx XML DAT, as No-Intro and GoodNES sets come with
+func ParseDAT(r io.Reader) (*DAT, error) {
+	var file struct {
+		Header struct {
+			Name string `xml:"name"`
+		} `xml:"header"`
+		Games []struct {
+			Name string `xml:"name,attr"`
+			ROMs []struct {
+				Size   int64  `xml:"size,attr"`
+				CRC    string `xml:"crc,attr"`
+				SHA1   string `xml:"sha1,attr"`
+				Status string `xml:"status,attr"`
+			} `xml:"rom"`
+		} `xml:"game"`
+	}
+	if err := xml.NewDecoder(r).Decode(&file); err != nil {
+		return nil, err
+	}
+
+	dat := &DAT{
+		Name:    file.Header.Name,
+		bySHA1:  make(map[string]*datROM),
+		byCRC32: make(map[uint32][]*datROM),
+	}
+	for _, game := range file.Games {
+		for _, rom := range game.ROMs {
+			entry := &datROM{Game: game.Name, Size: rom.Size, SHA1: strings.ToUpper(rom.SHA1), Status: rom.Status}
+			if entry.SHA1 != "" {
+				dat.bySHA1[entry.SHA1] = entry
+			}
+			if rom.CRC != "" {
+				crc, err := strconv.ParseUint(rom.CRC, 16, 32)
+				if err != nil {
+					return nil, fmt.Errorf("%s: bad crc %q", game.Name, rom.CRC)
+				}
+				entry.CRC32 = uint32(crc)
+				dat.byCRC32[entry.CRC32] = append(dat.byCRC32[entry.CRC32], entry)
+			}
+		}
+	}
+
+	return dat, nil
+}
+
+// lookup - the DAT's rom for data. CRC32s are only believed with the size
+// and when there's no SHA-1 to check.
+func (dat *DAT) lookup(data []byte) *datROM {
+	sum := sha1.Sum(data)
+	if rom, ok := dat.bySHA1[strings.ToUpper(hex.EncodeToString(sum[:]))]; ok {
+		return rom
+	}
+	for _, rom := range dat.byCRC32[crc32.ChecksumIEEE(data)] {
+		if rom.SHA1 == "" && rom.Size == int64(len(data)) {
+			return rom
+		}
+	}
+
+	return nil
+}
+
+// match - the DAT's rom for a rom file, hashed whole as headered DATs
+// have them and without the 16 byte header as headerless ones do
+func (dat *DAT) match(rom []byte) *datROM {
+	if match := dat.lookup(rom); match != nil {
+		return match
+	}
+	if len(rom) > 16 {
+		return dat.lookup(rom[16:])
+	}
+
+	return nil
+}
+
+// status - how the DAT rates the dump. GoodNES marks bad dumps [b] and
+// verified ones [!] in their names.
+func (rom *datROM) status() string {
+	switch {
+	case rom.Status == "baddump" || strings.Contains(rom.Game, "[b"):
+		return DumpBad
+	case rom.Status == "verified" || strings.Contains(rom.Game, "[!]"):
+		return DumpVerified
+	}
+
+	return DumpGood
+}
+
+// datRegion - the first tag in brackets after a game's name, which No-Intro
+// and GoodNES both put the region in
+var datRegion = regexp.MustCompile(`\(([^)]+)\)`)
+
+// LibraryEntry - a rom found by ScanLibrary
+type LibraryEntry struct {
+	File   string `json:"file"`
+	Title  string `json:"title"`
+	Region string `json:"region"`
+	Format string `json:"format"`
+
+	// Mapper - UnknownMapper for a UNIF board with no mapper number
+	Mapper    uint16 `json:"mapper"`
+	Submapper uint8  `json:"submapper"`
+	Board     string `json:"board"`
+	Battery   bool   `json:"battery"`
+
+	// the hashes of PRG and CHR rom, that the game database goes by
+	CRC32 string `json:"crc32"`
+	SHA1  string `json:"sha1"`
+
+	// Status - DumpVerified, DumpGood, DumpBad or DumpUnknown
+	Status string `json:"status"`
+
+	// Supported - whether LoadCartridge has the mapper
+	Supported bool `json:"supported"`
+
+	// Error - why the rom couldn't be loaded, when it couldn't
+	Error string `json:"error,omitempty"`
+}
+
+// libraryExtensions - the files ScanLibrary looks at
+var libraryExtensions = append([]string{".zip", ".gz"}, romExtensions...)
+
+// ScanLibrary - every rom under dir, loose, zipped or gzipped, matched
+// against dat and with its header corrected from db, if they're not nil. Roms that can't be loaded, and files and
+// directories under dir that can't be read, are listed with the error.
+func ScanLibrary(dir string, dat *DAT, db *GameDB) ([]LibraryEntry, error) {
+	var entries []LibraryEntry
+
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == dir {
+				return err
+			}
+
+			// one bad file or directory doesn't stop the scan
+			entries = append(entries, LibraryEntry{File: path, Status: DumpUnknown, Error: err.Error()})
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || !hasExtension(path, libraryExtensions) {
+			return nil
+		}
+
+		entries = append(entries, scanROM(path, dat, db))
+		return nil
+	})
+
+	return entries, err
+}
+
+// scanROM - what the library knows about the rom in filename
+func scanROM(filename string, dat *DAT, db *GameDB) LibraryEntry {
+	entry := LibraryEntry{File: filename, Status: DumpUnknown}
+
+	data, err := ioutil.ReadFile(filename)
+	if err == nil {
+		data, err = unpackROM(data, "")
+	}
+	if err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+
+	var match *datROM
+	if dat != nil {
+		if match = dat.match(data); match != nil {
+			entry.Title = match.Game
+			entry.Status = match.status()
+			if region := datRegion.FindStringSubmatch(match.Game); region != nil {
+				entry.Region = region[1]
+			}
+		}
+	}
+
+	cart, err := loadROM(data)
+	if err != nil {
+		entry.Error = err.Error()
+		return entry
+	}
+	cart.correctHeader(db)
+
+	if entry.Title == "" {
+		entry.Title = cart.Title
+	}
+	if entry.Title == "" {
+		entry.Title = strings.TrimSuffix(filepath.Base(filename), filepath.Ext(filename))
+	}
+	// iNES headers and UNIF images default to NTSC when they don't say, so
+	// only NES 2.0's is taken as the region
+	if entry.Region == "" && cart.NES20 {
+		entry.Region = cart.Timing.String()
+	}
+
+	entry.Format = cart.Format()
+	entry.Mapper, entry.Submapper = cart.Mapper, cart.Submapper
+	entry.Board = cart.Board
+	entry.Battery = cart.Battery
+	entry.CRC32 = fmt.Sprintf("%08X", cart.CRC32)
+	entry.SHA1 = fmt.Sprintf("%X", cart.SHA1)
+	entry.Supported = SupportedMapper(cart.Mapper)
+
+	return entry
+}
+
+// hasExtension - whether name ends in one of extensions, in any case
+func hasExtension(name string, extensions []string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	for _, e := range extensions {
+		if ext == e {
+			return true
+		}
+	}
+
+	return false
+}
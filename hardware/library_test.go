@@ -0,0 +1,150 @@
+package hardware
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"hash/crc32"
+	"nes-emu/assembler"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestScanLibrary(t *testing.T) {
+	verified := assembler.INES([]byte{0x01}, nil, mapper0)
+	headerless := assembler.INES([]byte{0x02}, nil, mmc1)
+	bad := assembler.INES([]byte{0x03}, nil, mapper0)
+	unsupported := assembler.INES([]byte{0x04}, nil, 4)
+
+	// NES 2.0 saying PAL
+	pal := assembler.INES([]byte{0x05}, nil, mapper0)
+	pal[7], pal[12] = 0x08, 0x01
+
+	// headered and headerless hashes, a bad dump by its status and one by
+	// its GoodNES name with only a CRC32
+	dat, err := ParseDAT(strings.NewReader(fmt.Sprintf(`<?xml version="1.0"?>
+<datafile>
+	<header><name>Nintendo - NES</name></header>
+	<game name="Verified (USA)">
+		<rom name="Verified (USA).nes" size="%d" crc="%08X" sha1="%X" status="verified"/>
+	</game>
+	<game name="Headerless (Japan)">
+		<rom name="Headerless (Japan).nes" size="%d" crc="%08X" sha1="%X"/>
+	</game>
+	<game name="Bad (E) [b1]">
+		<rom name="Bad (E) [b1].nes" size="%d" crc="%08X"/>
+	</game>
+</datafile>`,
+		len(verified), crc32.ChecksumIEEE(verified), sha1.Sum(verified),
+		len(headerless)-16, crc32.ChecksumIEEE(headerless[16:]), sha1.Sum(headerless[16:]),
+		len(bad), crc32.ChecksumIEEE(bad))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dat.Name != "Nintendo - NES" {
+		t.Errorf("Expected the DAT's name, got %q", dat.Name)
+	}
+
+	dir := t.TempDir()
+	files := map[string][]byte{
+		"verified.nes":            verified,
+		"sets/headerless.zip":     zipImage(t, "headerless.nes", headerless),
+		"sets/bad.nes":            bad,
+		"unsupported.nes":         unsupported,
+		"pal.nes":                 pal,
+		"tlrom.unf":               unifImage("MAPR", []byte("NES-TLROM\x00"), "PRG0", make([]byte, 0x4000)),
+		"broken.nes":              []byte("not a rom"),
+		"readme.txt":              []byte("skipped"),
+		"sets/empty/nothing.json": []byte("{}"),
+	}
+	for name, data := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := ScanLibrary(dir, dat, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[string]LibraryEntry)
+	for _, e := range entries {
+		rel, _ := filepath.Rel(dir, e.File)
+		found[filepath.ToSlash(rel)] = e
+	}
+	if len(found) != 7 {
+		t.Errorf("Expected the 7 roms, got %d", len(found))
+	}
+
+	tests := []struct {
+		file      string
+		title     string
+		region    string
+		status    string
+		mapper    uint16
+		supported bool
+	}{
+		{"verified.nes", "Verified (USA)", "USA", DumpVerified, 0, true},
+		{"sets/headerless.zip", "Headerless (Japan)", "Japan", DumpGood, 1, true},
+		{"sets/bad.nes", "Bad (E) [b1]", "E", DumpBad, 0, true},
+		{"unsupported.nes", "unsupported", "", DumpUnknown, 4, false},
+		{"pal.nes", "pal", "PAL", DumpUnknown, 0, true},
+	}
+	for _, test := range tests {
+		e := found[test.file]
+		if e.Title != test.title || e.Region != test.region || e.Status != test.status ||
+			e.Mapper != test.mapper || e.Supported != test.supported || e.Error != "" {
+			t.Errorf("%s: expected %q %q %s mapper %d supported %v, got %+v",
+				test.file, test.title, test.region, test.status, test.mapper, test.supported, e)
+		}
+	}
+
+	// a UNIF board with no mapper is listed, as one that isn't supported
+	if e := found["tlrom.unf"]; e.Board != "NES-TLROM" || e.Format != "UNIF" || e.Mapper != UnknownMapper || e.Supported || e.Error != "" {
+		t.Errorf("Expected tlrom.unf listed with its board as not supported, got %+v", e)
+	}
+
+	if e := found["broken.nes"]; e.Error == "" || e.Status != DumpUnknown {
+		t.Errorf("Expected broken.nes to be listed with its error, got %+v", e)
+	}
+}
+
+func TestScanLibraryUnreadable(t *testing.T) {
+	dir := t.TempDir()
+	locked := filepath.Join(dir, "locked")
+	if err := os.Mkdir(locked, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "game.nes"), assembler.INES([]byte{0x01}, nil, mapper0), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(locked, 0755)
+	if _, err := os.ReadDir(locked); err == nil {
+		t.Skip("the directory can still be read, e.g. running as root")
+	}
+
+	entries, err := ScanLibrary(dir, nil, nil)
+	if err != nil {
+		t.Fatalf("Expected the scan to carry on past the unreadable directory, got %v", err)
+	}
+	found := make(map[string]LibraryEntry)
+	for _, e := range entries {
+		found[filepath.Base(e.File)] = e
+	}
+	if e, ok := found["locked"]; !ok || e.Error == "" {
+		t.Errorf("Expected the unreadable directory listed with its error, got %+v", entries)
+	}
+	if e, ok := found["game.nes"]; !ok || e.Error != "" {
+		t.Errorf("Expected the rom beside it to be scanned, got %+v", entries)
+	}
+
+	if _, err := ScanLibrary(filepath.Join(dir, "missing"), nil, nil); err == nil {
+		t.Errorf("Expected an error scanning a directory that isn't there")
+	}
+}
@@ -1,184 +1,193 @@
 package hardware
 
-import (
-	"encoding/binary"
-)
-
-func (cpu *Cpu) Read8(addr uint16) uint8 {
-	if addr < 0x2000 {
-		return cpu.Memory[addr&0x7FF]
-	} else if addr >= 0x2000 && addr < 0x4000 {
-		truncAddr := addr&0x2007
-		readValue := cpu.Memory[truncAddr]
-		if truncAddr == 0x2002 {
-			cpu.nes.PPU.ClearVBlank()
-			cpu.nes.PPU.ppuAddrCounter = 0
-		}
-		if truncAddr == 0x2007 {
-			readValue = cpu.nes.PPU.DataRead()
+// Device - a chip that answers on the cpu bus for a range of addresses.
+// Devices get the full cpu address, so they handle their own mirroring.
+type Device interface {
+	read8(addr uint16) uint8
+	write8(addr uint16, value uint8)
+}
+
+// peeker - a device whose reads have side effects, like clearing a flag
+// or shifting a register, can say what it would return without them
+type peeker interface {
+	peek8(addr uint16) uint8
+}
+
+// Bus - the cpu address bus. Devices are registered by address range,
+// reads and writes can be routed to different devices, and reading an
+// address nobody answers returns the last value seen on the bus.
+type Bus struct {
+	devices []Device
+
+	// index into devices for every address, 0 means unmapped
+	readMap  [0x10000]uint8
+	writeMap [0x10000]uint8
+
+	// last value driven on the data bus
+	openBus uint8
+
+	// the cpu touches the bus every cycle, so two writes in a row
+	// happened on consecutive cycles
+	lastWasWrite     bool
+	consecutiveWrite bool
+
+	// tools watching memory, called on every read and write in the order
+	// they were added
+	observers []*busObserver
+}
+
+// BusObserver - called with every read on the bus and the value read, and
+// with every write before the device sees it
+type BusObserver func(addr uint16, value uint8, write bool)
+
+// busObserver - an added observer, by pointer so it can be told apart
+// when it's removed
+type busObserver struct {
+	observe BusObserver
+}
+
+func NewBus() *Bus {
+	// slot 0 is reserved for unmapped addresses
+	return &Bus{devices: []Device{nil}}
+}
+
+func (bus *Bus) addDevice(device Device) uint8 {
+	for idx, d := range bus.devices {
+		if idx > 0 && d == device {
+			return uint8(idx)
 		}
-		return readValue
-	} else if addr == 0x4016 {
-		val := (cpu.Controller >> (7 - (cpu.ControllerIdx % 8))) & 1
-		cpu.ControllerIdx++
-		return val
-	} else if addr >= 0x6000 {
-		readFromMapper := cpu.nes.CARTIO.read8(addr)
-		return readFromMapper
-	} else {
-		return cpu.Memory[addr]
 	}
+
+	bus.devices = append(bus.devices, device)
+	return uint8(len(bus.devices) - 1)
 }
 
-func (cpu *Cpu) Read16(addr uint16) uint16 {
+// Register - maps reads and writes from start to end inclusive to device.
+// Later registrations replace earlier ones where they overlap.
+func (bus *Bus) Register(start, end uint16, device Device) {
+	bus.RegisterRead(start, end, device)
+	bus.RegisterWrite(start, end, device)
+}
 
-	// TODO: @artenator this read totally messes up at the end of the address space. Fix it
+// RegisterRead - maps reads from start to end inclusive to device
+func (bus *Bus) RegisterRead(start, end uint16, device Device) {
+	idx := bus.addDevice(device)
+	for addr := uint32(start); addr <= uint32(end); addr++ {
+		bus.readMap[addr] = idx
+	}
+}
 
-	if addr < 0x2000 {
-		return binary.LittleEndian.Uint16(cpu.Memory[addr : uint32(addr)+2])
-	} else if addr >= 0x2000 && addr < 0x4000 {
-		return binary.LittleEndian.Uint16(cpu.Memory[addr&0x2007 : (uint32(addr)&0x2007)+2])
-	} else if addr >= 0x6000 {
-		return cpu.nes.CARTIO.read16(addr)
-	} else {
-		return binary.LittleEndian.Uint16(cpu.Memory[addr : uint32(addr)+2])
+// RegisterWrite - maps writes from start to end inclusive to device
+func (bus *Bus) RegisterWrite(start, end uint16, device Device) {
+	idx := bus.addDevice(device)
+	for addr := uint32(start); addr <= uint32(end); addr++ {
+		bus.writeMap[addr] = idx
 	}
 }
 
-func (cpu *Cpu) Write8(addr uint16, value uint8) {
-	if addr < 0x2000 {
-		cpu.Memory[addr&0x7FF] = value
-	} else if addr >= 0x2000 && addr < 0x4000 {
-		truncAddr := addr & 0x2007
+// OpenBus - the value left on the data bus by the last access
+func (bus *Bus) OpenBus() uint8 {
+	return bus.openBus
+}
 
-		cpu.Memory[truncAddr] = value
+// ConsecutiveWrite - whether the write in progress came on the cycle
+// straight after another write, as with read-modify-write instructions
+func (bus *Bus) ConsecutiveWrite() bool {
+	return bus.consecutiveWrite
+}
 
-		// PPUCTRL
-		if truncAddr == 0x2000 {
-			cpu.nes.PPU.ppuctrl.setValues(value)
-		}
-		// PPUMASK
-		if truncAddr == 0x2001 {
-			cpu.nes.PPU.ppumask.setValues(value)
-		}
-		// PPUADDR
-		if truncAddr == 0x2006 {
-			cpu.nes.PPU.setPpuAddr(value)
-		}
-		// PPUDATA
-		if truncAddr == 0x2007 {
-			cpu.nes.PPU.Write8(value)
-		}
-		// OAMADDR
-		if truncAddr == 0x2003 {
-			cpu.nes.PPU.SetOamAddr(value)
-		}
-		// OAMDATA
-		if truncAddr == 0x2004 {
-			cpu.nes.PPU.WriteOAM8(value)
-		}
-		// PPUSCROLL
-		if truncAddr == 0x2005 {
-			cpu.nes.PPU.setPpuScrollAddr(value)
-			//log.Printf("writing to ppuscroll 0x%x", value)
-			//log.Println(strconv.FormatInt(int64(cpu.Memory[0x2000]), 2))
-			//log.Printf("+%v", cpu.nes.PPU.Memory[0x2000:0x3000])
-		}
-	} else {
-		cpu.Memory[addr] = value
-
-		if addr == 0x4001 {
-			cpu.nes.APU.sweep1.setSweepValues(value)
-		} else if addr == 0x4003 {
-			cpu.nes.APU.pulse1.setTargetTimer()
-		} else if addr == 0x4005 {
-			cpu.nes.APU.sweep2.setSweepValues(value)
-		} else if addr == 0x4007 {
-			cpu.nes.APU.pulse2.setTargetTimer()
-		} else if addr == 0x4008 {
-			cpu.nes.APU.triangle.setLinearCounterValues(value)
-		} else if addr == 0x400B {
-			cpu.nes.APU.triangle.linearReload = true
-			if cpu.nes.APU.enableTriangle {
-				cpu.nes.APU.triangle.setLengthCounter(value)
-			}
-			// OAMDMA at 0x4014 write
-		} else if addr == 0x4014 {
-			// write all the sprites to oam
-			startPos := uint16(value) << 8
-			//log.Printf("start pos is %x", startPos)
-			for idx, _ := range cpu.Memory[startPos:startPos + 0x100] {
-				byteRead := cpu.Read8(startPos+uint16(idx))
-
-				cpu.nes.PPU.WriteOAM8(byteRead)
-			}
-			//log.Printf("OAM %+v", cpu.nes.PPU.OAM)
-			//log.Printf("OAM %s", cpu.nes.PPU.OAM)
-			cpu.nes.PPU.SetOamAddr(0)
-			cpu.nes.PPU.oamSpriteAddr = 0
-
-		} else if addr == 0x4015 {
-			cpu.nes.APU.enablePulseChannel1 = (value >> 0) & 1 == 1
-			if !cpu.nes.APU.enablePulseChannel1 {
-				cpu.nes.APU.pulse1.lengthTimer = 0
-			}
-			cpu.nes.APU.enablePulseChannel2 = (value >> 1) & 1 == 1
-			if !cpu.nes.APU.enablePulseChannel2 {
-				cpu.nes.APU.pulse2.lengthTimer = 0
-			}
-			cpu.nes.APU.enableTriangle = (value >> 2) & 1 == 1
-			if !cpu.nes.APU.enableTriangle {
-				cpu.nes.APU.triangle.lengthCounter = 0
-			}
-		} else if addr == 0x4016 {
-			if value == 0 {
-				cpu.ControllerIdx = 0
+func (bus *Bus) Read8(addr uint16) uint8 {
+	bus.lastWasWrite = false
+
+	if idx := bus.readMap[addr]; idx != 0 {
+		bus.openBus = bus.devices[idx].read8(addr)
+	}
+
+	for _, o := range bus.observers {
+		o.observe(addr, bus.openBus, false)
+	}
+
+	return bus.openBus
+}
+
+// Observe - adds observe to the tools watching the bus. Returns a func
+// that removes it again.
+func (bus *Bus) Observe(observe BusObserver) (remove func()) {
+	added := &busObserver{observe}
+	bus.observers = append(bus.observers[:len(bus.observers):len(bus.observers)], added)
+
+	return func() {
+		// a new slice, so a loop over the old one in a Read8 or Write8
+		// the remove is called from carries on unchanged
+		var kept []*busObserver
+		for _, o := range bus.observers {
+			if o != added {
+				kept = append(kept, o)
 			}
-		} else if addr == 0x4017 {
-			cpu.nes.APU.setFrameCounterValues(value)
-		} else if addr >= 0x6000 {
-			cpu.nes.CARTIO.write8(addr, value)
 		}
+		bus.observers = kept
 	}
 }
 
-func (cpu *Cpu) Write16(addr, value uint16) {
-	if addr < 0x2000 {
-		binary.LittleEndian.PutUint16(cpu.Memory[addr&0x7FF:(addr&0x7FF)+2], value)
-	} else if addr >= 0x2000 && addr < 0x4000 {
-		binary.LittleEndian.PutUint16(cpu.Memory[addr&0x2007:(addr&0x2007)+2], value)
-	} else {
-		binary.LittleEndian.PutUint16(cpu.Memory[addr:addr+2], value)
+// Peek8 - reads addr without side effects on the devices or the open bus,
+// for tracing and debugging
+func (bus *Bus) Peek8(addr uint16) uint8 {
+	idx := bus.readMap[addr]
+	if idx == 0 {
+		return bus.openBus
 	}
-}
 
-func (cpu *Cpu) Push16(value uint16) {
-	high, low := uint8(value>>8), uint8(value&0xFF)
+	if device, ok := bus.devices[idx].(peeker); ok {
+		return device.peek8(addr)
+	}
 
-	cpu.Memory[0x100|uint16(cpu.SP)] = high
-	cpu.Memory[(0x100|uint16(cpu.SP))-1] = low
-	cpu.SP -= 2
+	return bus.devices[idx].read8(addr)
 }
 
-func (cpu *Cpu) Push8(value uint8) {
-	cpu.Memory[0x100|uint16(cpu.SP)] = value
-	cpu.SP--
+func (bus *Bus) Write8(addr uint16, value uint8) {
+	bus.openBus = value
+	bus.consecutiveWrite = bus.lastWasWrite
+	bus.lastWasWrite = true
+
+	for _, o := range bus.observers {
+		o.observe(addr, value, true)
+	}
+
+	if idx := bus.writeMap[addr]; idx != 0 {
+		bus.devices[idx].write8(addr, value)
+	}
 }
 
-func (cpu *Cpu) Pop16() uint16 {
-	cpu.SP++
+// Ram - the 2KB of internal ram, mirrored up to $1FFF
+type Ram struct {
+	data [0x800]uint8
+}
 
-	barr := []uint8{cpu.Memory[(0x100|uint16(cpu.SP))+1], cpu.Memory[0x100|uint16(cpu.SP)]}
+func (ram *Ram) read8(addr uint16) uint8 {
+	return ram.data[addr&0x7FF]
+}
 
-	cpu.SP++
+func (ram *Ram) write8(addr uint16, value uint8) {
+	ram.data[addr&0x7FF] = value
+}
 
-	return binary.BigEndian.Uint16(barr)
+// oamDMA - writing $4014 copies a page of cpu memory into OAM
+type oamDMA struct {
+	nes *NES
 }
 
-func (cpu *Cpu) Pop8() uint8 {
-	cpu.SP++
+func (dma *oamDMA) read8(addr uint16) uint8 {
+	return dma.nes.CPU.Bus.OpenBus()
+}
 
-	b := cpu.Memory[0x100|uint16(cpu.SP)]
+func (dma *oamDMA) write8(addr uint16, value uint8) {
+	// write all the sprites to oam
+	startPos := uint16(value) << 8
+	for idx := uint16(0); idx < 0x100; idx++ {
+		byteRead := dma.nes.CPU.Read8(startPos + idx)
 
-	return uint8(b)
+		dma.nes.PPU.WriteOAM8(byteRead)
+	}
+	dma.nes.PPU.SetOamAddr(0)
+	dma.nes.PPU.oamSpriteAddr = 0
 }
@@ -0,0 +1,194 @@
+package hardware
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// recordingDevice remembers the accesses it saw and answers reads with a fixed value
+type recordingDevice struct {
+	value     uint8
+	lastAddr  uint16
+	lastWrite uint8
+	reads     int
+	readAddrs []uint16
+	writes    []uint8
+}
+
+func (d *recordingDevice) read8(addr uint16) uint8 {
+	d.lastAddr = addr
+	d.reads++
+	d.readAddrs = append(d.readAddrs, addr)
+	return d.value
+}
+
+func (d *recordingDevice) write8(addr uint16, value uint8) {
+	d.lastAddr = addr
+	d.lastWrite = value
+	d.writes = append(d.writes, value)
+}
+
+func TestBusRouting(t *testing.T) {
+	bus := NewBus()
+	reader := &recordingDevice{value: 0x42}
+	writer := &recordingDevice{}
+
+	bus.RegisterRead(0x5000, 0x50FF, reader)
+	bus.RegisterWrite(0x5000, 0x50FF, writer)
+
+	if v := bus.Read8(0x5010); v != 0x42 || reader.lastAddr != 0x5010 {
+		t.Errorf("Read not routed to reader. Got %02x from %04x", v, reader.lastAddr)
+	}
+
+	bus.Write8(0x50FF, 0x99)
+	if writer.lastWrite != 0x99 || writer.lastAddr != 0x50FF {
+		t.Errorf("Write not routed to writer. Got %02x at %04x", writer.lastWrite, writer.lastAddr)
+	}
+	if reader.lastAddr != 0x5010 {
+		t.Errorf("Write reached the read-only device")
+	}
+}
+
+func TestBusOpenBus(t *testing.T) {
+	bus := NewBus()
+	bus.Register(0x8000, 0xFFFF, &recordingDevice{value: 0x5A})
+
+	bus.Read8(0x8000)
+	if v := bus.Read8(0x4018); v != 0x5A {
+		t.Errorf("Unmapped read should return the last bus value. Expected 5a but got %02x", v)
+	}
+
+	bus.Write8(0x4020, 0x11)
+	if v := bus.Read8(0x4020); v != 0x11 {
+		t.Errorf("Unmapped read should return the last write. Expected 11 but got %02x", v)
+	}
+}
+
+func TestBusObservers(t *testing.T) {
+	bus := NewBus()
+	bus.Register(0x8000, 0xFFFF, &recordingDevice{value: 0x5A})
+
+	var first, second []string
+	removeFirst := bus.Observe(func(addr uint16, value uint8, write bool) {
+		first = append(first, fmt.Sprintf("%04X %02X %v", addr, value, write))
+	})
+	removeSecond := bus.Observe(func(addr uint16, value uint8, write bool) {
+		second = append(second, fmt.Sprintf("%04X %02X %v", addr, value, write))
+	})
+
+	bus.Read8(0x8000)
+	bus.Write8(0x9000, 0x11)
+	want := "8000 5A false|9000 11 true"
+	if strings.Join(first, "|") != want || strings.Join(second, "|") != want {
+		t.Errorf("Expected both observers to see %s, got %v and %v", want, first, second)
+	}
+
+	// removing one leaves the other watching
+	removeFirst()
+	bus.Read8(0x8001)
+	if len(first) != 2 || len(second) != 3 {
+		t.Errorf("Expected only the second observer to see the read, got %v and %v", first, second)
+	}
+
+	removeSecond()
+	bus.Read8(0x8002)
+	if len(second) != 3 {
+		t.Errorf("Expected no observers left, got %v", second)
+	}
+}
+
+func TestRamMirroring(t *testing.T) {
+	nes := NewNES()
+
+	nes.CPU.Write8(0x0123, 0xAB)
+	for _, addr := range []uint16{0x0123, 0x0923, 0x1123, 0x1923} {
+		if v := nes.CPU.Read8(addr); v != 0xAB {
+			t.Errorf("Expected ram mirror at %04x to read ab but got %02x", addr, v)
+		}
+	}
+}
+
+func TestRead16UsesBus(t *testing.T) {
+	nes := newTestNES([]byte{0xEA}, 0xC020, 0xC000, 0xC010)
+	nes.CPU.Write8(0x0000, 0x12)
+
+	// the high byte of $FFFF comes from $0000
+	if v := nes.CPU.Read16(0xFFFF); v != 0x12C0 {
+		t.Errorf("Read16 at the end of the address space. Expected 12c0 but got %04x", v)
+	}
+
+	// 16 bit reads of registers have the same side effects as two 8 bit reads
+	nes.PPU.SetVBlank()
+	nes.CPU.Read16(0x2002)
+	if nes.PPU.inVBlank() {
+		t.Errorf("Read16 of $2002 did not clear vblank")
+	}
+}
+
+func TestStackWraps(t *testing.T) {
+	nes := NewNES()
+	nes.CPU.SP = 0x00
+
+	nes.CPU.Push16(0xBEEF)
+	if nes.CPU.SP != 0xFE || nes.CPU.Read8(0x0100) != 0xBE || nes.CPU.Read8(0x01FF) != 0xEF {
+		t.Errorf("Push16 did not wrap inside page 1. SP:%02x", nes.CPU.SP)
+	}
+
+	if v := nes.CPU.Pop16(); v != 0xBEEF || nes.CPU.SP != 0x00 {
+		t.Errorf("Pop16 did not wrap inside page 1. Got %04x SP:%02x", v, nes.CPU.SP)
+	}
+}
+
+func TestControllerPorts(t *testing.T) {
+	nes := NewNES()
+
+	// A, Start and Right held
+	nes.JOY1.Buttons = 0x91
+
+	nes.CPU.Write8(0x4016, 1)
+	nes.CPU.Write8(0x4016, 0)
+
+	expected := []uint8{1, 0, 0, 1, 0, 0, 0, 1, 1, 1}
+	for i, bit := range expected {
+		if v := nes.CPU.Read8(0x4016); v&1 != bit {
+			t.Errorf("Wrong bit %d from $4016. Expected %d but got %d", i, bit, v&1)
+		}
+	}
+
+	if v := nes.CPU.Read8(0x4017); v&1 != 0 {
+		t.Errorf("Empty second port should read 0, got %02x", v)
+	}
+}
+
+func TestControllerOpenBus(t *testing.T) {
+	// C000 LDA $4016
+	nes := newTestNES([]byte{0xAD, 0x16, 0x40}, 0xC020, 0xC000, 0xC010)
+	nes.JOY1.Buttons = 0x80
+
+	nes.CPU.Write8(0x4016, 1)
+	nes.CPU.Write8(0x4016, 0)
+	stepCpu(nes)
+
+	// the upper bits are left over from the $40 address byte
+	if nes.CPU.A != 0x41 {
+		t.Errorf("Expected 41 from $4016 but got %02x", nes.CPU.A)
+	}
+}
+
+func TestPpuRegisterLatch(t *testing.T) {
+	nes := newTestNES([]byte{0xEA}, 0xC020, 0xC000, 0xC010)
+
+	nes.CPU.Write8(0x2000, 0x00)
+	nes.CPU.Write8(0x2001, 0x1E)
+
+	// write only registers read back the PPU's data bus, mirrored every 8 bytes
+	if v := nes.CPU.Read8(0x3FF8); v != 0x1E {
+		t.Errorf("Expected PPUCTRL mirror to read the io latch 1e but got %02x", v)
+	}
+
+	nes.PPU.SetVBlank()
+	if v := nes.CPU.Read8(0x2002); v != 0x9E {
+		t.Errorf("Expected status 9e but got %02x", v)
+	}
+}
@@ -4,19 +4,120 @@ type NES struct {
 	CPU  *Cpu
 	PPU  *Ppu
 	APU  *Apu
+	RAM  *Ram
+	JOY1 *Controller
+	JOY2 *Controller
 	CART *Cartridge
 	CARTIO CartridgeIO
+
+	// when set, every instruction is logged before it runs
+	Tracer *Tracer
+
+	// when set, counts where the cpu spends its cycles
+	Profiler *Profiler
+
+	// when set, records what each byte of PRG and CHR rom is used for
+	CDL *CodeDataLogger
+
+	// when set, keeps a history of the last instructions and watches for
+	// crashes and hangs
+	Diagnostics *Diagnostics
+
+	// when set, addresses in traces, the debugger and errors are shown
+	// with their labels and source lines
+	Symbols *Symbols
 }
 
 func NewNES() *NES {
 	newNes := NES{}
-	newNes.CPU = &Cpu{}
+	newNes.CPU = newCpu(&newNes, NewBus())
 	newNes.PPU = &Ppu{}
 	newNes.APU = &Apu{}
-	newNes.CPU.nes = &newNes
+	newNes.RAM = &Ram{}
+	newNes.JOY1 = &Controller{}
+	newNes.JOY2 = &Controller{}
 	newNes.PPU.nes = &newNes
 	newNes.APU.nes = &newNes
 	newNes.PPU.ppuAddrCounter = 0
+	newNes.CPU.AddrName = newNes.describe
+
+	newNes.mapDevices()
 
 	return &newNes
 }
+
+// describe - addr's label and source line, if symbols are loaded
+func (nes *NES) describe(addr uint16) string {
+	if nes.Symbols == nil {
+		return ""
+	}
+
+	return nes.Symbols.Describe(nes, addr)
+}
+
+// mapDevices - wires the devices into the cpu address space.
+// The cartridge is mapped when it is loaded.
+func (nes *NES) mapDevices() {
+	bus := nes.CPU.Bus
+
+	bus.Register(0x0000, 0x1FFF, nes.RAM)
+	bus.Register(0x2000, 0x3FFF, nes.PPU)
+	bus.Register(0x4000, 0x4013, nes.APU)
+	bus.RegisterWrite(0x4014, 0x4014, &oamDMA{nes})
+	bus.Register(0x4015, 0x4015, nes.APU)
+	bus.Register(0x4016, 0x4017, &controllerPorts{bus, nes.JOY1, nes.JOY2})
+	bus.RegisterWrite(0x4017, 0x4017, nes.APU)
+}
+
+// Reset - resets the cpu, and runs the PPU through the cycles the reset sequence takes
+func (nes *NES) Reset() {
+	nes.CPU.Reset()
+	nes.PPU.RunPPUCycles(3 * 7)
+}
+
+// RunFrame - steps until the PPU finishes a frame. Returns the cpu's
+// error, which wraps ErrCPUHalted, if it halts on the way.
+func (nes *NES) RunFrame() error {
+	for !nes.PPU.FrameReady {
+		nes.Step()
+		if err := nes.CPU.Err(); err != nil {
+			return err
+		}
+	}
+	nes.PPU.FrameReady = false
+
+	return nil
+}
+
+// Step - runs one instruction, or services a pending interrupt, and clocks
+// the PPU and APU for the cycles it took
+func (nes *NES) Step() uint8 {
+	if nes.Tracer != nil {
+		nes.Tracer.trace(nes)
+	}
+	if nes.Profiler != nil {
+		nes.Profiler.before(nes)
+	}
+	if nes.CDL != nil {
+		nes.CDL.before(nes)
+	}
+	if nes.Diagnostics != nil {
+		nes.Diagnostics.before(nes)
+	}
+
+	cycles := nes.CPU.Step()
+	nes.PPU.RunPPUCycles(3 * uint16(cycles))
+	nes.APU.RunAPUCycles(uint16(cycles))
+
+	if nes.Profiler != nil {
+		nes.Profiler.after(nes, cycles)
+	}
+	if nes.CDL != nil {
+		nes.CDL.after(nes)
+	}
+	if nes.Diagnostics != nil {
+		nes.Diagnostics.after(nes)
+	}
+
+	return cycles
+}
@@ -29,6 +29,22 @@ func (ppu *Ppu) WriteOAM8(value uint8) {
 	ppu.oamAddr++
 }
 
+// ReadOAM8 - reads the OAM byte at OAMADDR, the unused attribute bits read back as 0
+func (ppu *Ppu) ReadOAM8() uint8 {
+	sprite := ppu.OAM[ppu.oamAddr/4]
+
+	switch ppu.oamAddr % 4 {
+	case 0:
+		return sprite.yCoord
+	case 1:
+		return sprite.tileNum
+	case 2:
+		return sprite.attributes & 0xE3
+	default:
+		return sprite.xCoord
+	}
+}
+
 func (ppu *Ppu) SetOamAddr(addr uint8) {
 	ppu.oamAddr = addr
 }
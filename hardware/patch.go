@@ -0,0 +1,433 @@
+package hardware
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// errors from applying a patch, wrapped with the details
+var (
+	// ErrBadPatch - the patch isn't IPS, UPS or BPS, or is cut short
+	ErrBadPatch = errors.New("bad patch")
+
+	// ErrPatchMismatch - the patch's checksums say it's for another rom,
+	// or it didn't give the rom it should have
+	ErrPatchMismatch = errors.New("patch doesn't match the rom")
+)
+
+// patchExtensions - the patches FindPatches looks for, in the order they're
+// applied
+var patchExtensions = []string{".ips", ".ups", ".bps"}
+
+// FindPatches - the .ips, .ups and .bps files named after romFile, next to it
+func FindPatches(romFile string) []string {
+	base := strings.TrimSuffix(romFile, filepath.Ext(romFile))
+
+	var patches []string
+	for _, ext := range patchExtensions {
+		if info, err := os.Stat(base + ext); err == nil && !info.IsDir() {
+			patches = append(patches, base+ext)
+		}
+	}
+
+	return patches
+}
+
+// ApplyPatch - rom with an IPS, UPS or BPS patch applied, going by the
+// patch's magic number. rom isn't changed.
+func ApplyPatch(rom, patch []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(patch, []byte("PATCH")):
+		return applyIPS(rom, patch)
+	case bytes.HasPrefix(patch, []byte("UPS1")):
+		return applyUPS(rom, patch)
+	case bytes.HasPrefix(patch, []byte("BPS1")):
+		return applyBPS(rom, patch)
+	}
+
+	return nil, fmt.Errorf("%w: not an IPS, UPS or BPS patch", ErrBadPatch)
+}
+
+// applyIPS - records of an offset and bytes to write there, or a run of
+// one byte, until EOF. A truncated size can follow.
+func applyIPS(rom, patch []byte) ([]byte, error) {
+	out := append([]byte(nil), rom...)
+	p := patch[5:]
+
+	for {
+		if len(p) < 3 {
+			return nil, fmt.Errorf("%w: IPS patch ends without EOF", ErrBadPatch)
+		}
+		if string(p[:3]) == "EOF" {
+			p = p[3:]
+			break
+		}
+		if len(p) < 5 {
+			return nil, fmt.Errorf("%w: IPS record cut short", ErrBadPatch)
+		}
+
+		offset := int(p[0])<<16 | int(p[1])<<8 | int(p[2])
+		size := int(p[3])<<8 | int(p[4])
+		p = p[5:]
+
+		var data []byte
+		if size > 0 {
+			if len(p) < size {
+				return nil, fmt.Errorf("%w: IPS record at $%06X cut short", ErrBadPatch, offset)
+			}
+			data, p = p[:size], p[size:]
+		} else {
+			// a run of one byte
+			if len(p) < 3 {
+				return nil, fmt.Errorf("%w: IPS run at $%06X cut short", ErrBadPatch, offset)
+			}
+			data = bytes.Repeat(p[2:3], int(p[0])<<8|int(p[1]))
+			p = p[3:]
+		}
+
+		if end := offset + len(data); end > len(out) {
+			out = append(out, make([]byte, end-len(out))...)
+		}
+		copy(out[offset:], data)
+	}
+
+	if len(p) >= 3 {
+		if size := int(p[0])<<16 | int(p[1])<<8 | int(p[2]); size < len(out) {
+			out = out[:size]
+		}
+	}
+
+	return out, nil
+}
+
+// patchReader - reads through the body of a UPS or BPS patch, up to the
+// 12 byte checksum footer
+type patchReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *patchReader) done() bool {
+	return r.err != nil || r.pos >= len(r.data)
+}
+
+func (r *patchReader) byte() uint8 {
+	if r.pos >= len(r.data) {
+		if r.err == nil {
+			r.err = fmt.Errorf("%w: patch cut short", ErrBadPatch)
+		}
+		return 0
+	}
+
+	b := r.data[r.pos]
+	r.pos++
+	return b
+}
+
+func (r *patchReader) bytes(n int) []byte {
+	if n > len(r.data)-r.pos {
+		if r.err == nil {
+			r.err = fmt.Errorf("%w: patch cut short", ErrBadPatch)
+		}
+		return nil
+	}
+
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return b
+}
+
+// number - a variable length number, 7 bits a byte with the top bit
+// ending it, as UPS and BPS write them
+func (r *patchReader) number() int {
+	var value, shift uint64 = 0, 1
+	for r.err == nil {
+		b := r.byte()
+		value += uint64(b&0x7F) * shift
+		if b&0x80 != 0 {
+			break
+		}
+		shift <<= 7
+		value += shift
+
+		if shift > 1<<42 {
+			r.err = fmt.Errorf("%w: number too big", ErrBadPatch)
+		}
+	}
+
+	return int(value)
+}
+
+// appendNumber - n in the variable length encoding number reads
+func appendNumber(out []byte, n int) []byte {
+	value := uint64(n)
+	for {
+		b := uint8(value & 0x7F)
+		value >>= 7
+		if value == 0 {
+			return append(out, b|0x80)
+		}
+		out = append(out, b)
+		value--
+	}
+}
+
+// patchFooter - checks a UPS or BPS patch's own checksum, returning its
+// body and the source and target checksums
+func patchFooter(patch []byte, format string) (body []byte, source, target uint32, err error) {
+	if len(patch) < 4+12 {
+		return nil, 0, 0, fmt.Errorf("%w: %s patch cut short", ErrBadPatch, format)
+	}
+
+	footer := patch[len(patch)-12:]
+	if crc32.ChecksumIEEE(patch[:len(patch)-4]) != binary.LittleEndian.Uint32(footer[8:]) {
+		return nil, 0, 0, fmt.Errorf("%w: %s patch is corrupt, its checksum doesn't match", ErrBadPatch, format)
+	}
+
+	return patch[4 : len(patch)-12], binary.LittleEndian.Uint32(footer[0:]), binary.LittleEndian.Uint32(footer[4:]), nil
+}
+
+// checkSource - that rom is what a patch was made from
+func checkSource(rom []byte, size int, crc uint32, format string) error {
+	if len(rom) != size || crc32.ChecksumIEEE(rom) != crc {
+		return fmt.Errorf("%w: the %s patch is for a %d byte rom with CRC32 %08X, not %d bytes with %08X",
+			ErrPatchMismatch, format, size, crc, len(rom), crc32.ChecksumIEEE(rom))
+	}
+
+	return nil
+}
+
+// checkTarget - that a patch gave what it should have
+func checkTarget(out []byte, crc uint32, format string) error {
+	if got := crc32.ChecksumIEEE(out); got != crc {
+		return fmt.Errorf("%w: the %s patch should give CRC32 %08X, got %08X", ErrPatchMismatch, format, crc, got)
+	}
+
+	return nil
+}
+
+// applyUPS - runs of bytes XORed onto the rom, each after a gap
+func applyUPS(rom, patch []byte) ([]byte, error) {
+	body, sourceCRC, targetCRC, err := patchFooter(patch, "UPS")
+	if err != nil {
+		return nil, err
+	}
+
+	r := &patchReader{data: body}
+	sourceSize, targetSize := r.number(), r.number()
+	if r.err != nil {
+		return nil, r.err
+	}
+	if err := checkSource(rom, sourceSize, sourceCRC, "UPS"); err != nil {
+		return nil, err
+	}
+	if targetSize > 1<<30 {
+		return nil, fmt.Errorf("%w: %d byte UPS target is too big", ErrBadPatch, targetSize)
+	}
+
+	out := make([]byte, targetSize)
+	copy(out, rom)
+
+	for pos := 0; !r.done(); pos++ {
+		pos += r.number()
+		for {
+			b := r.byte()
+			if b == 0 || r.err != nil {
+				break
+			}
+			if pos < len(out) {
+				out[pos] ^= b
+			}
+			pos++
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if err := checkTarget(out, targetCRC, "UPS"); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// the BPS actions, in the bottom 2 bits of each
+const (
+	bpsSourceRead = iota
+	bpsTargetRead
+	bpsSourceCopy
+	bpsTargetCopy
+)
+
+// applyBPS - builds the target from runs of the source at the same place,
+// bytes from the patch, and copies from elsewhere in the source or the
+// target so far
+func applyBPS(rom, patch []byte) ([]byte, error) {
+	body, sourceCRC, targetCRC, err := patchFooter(patch, "BPS")
+	if err != nil {
+		return nil, err
+	}
+
+	r := &patchReader{data: body}
+	sourceSize, targetSize := r.number(), r.number()
+	r.bytes(r.number()) // metadata
+	if r.err != nil {
+		return nil, r.err
+	}
+	if err := checkSource(rom, sourceSize, sourceCRC, "BPS"); err != nil {
+		return nil, err
+	}
+	if targetSize > 1<<30 {
+		return nil, fmt.Errorf("%w: %d byte BPS target is too big", ErrBadPatch, targetSize)
+	}
+
+	out := make([]byte, 0, targetSize)
+	sourceOffset, targetOffset := 0, 0
+	for !r.done() {
+		action := r.number()
+		length := action>>2 + 1
+		if len(out)+length > targetSize {
+			return nil, fmt.Errorf("%w: BPS patch writes past the end of the target", ErrBadPatch)
+		}
+
+		switch action & 3 {
+		case bpsSourceRead:
+			if len(out)+length > len(rom) {
+				return nil, fmt.Errorf("%w: BPS patch reads past the end of the source", ErrBadPatch)
+			}
+			out = append(out, rom[len(out):len(out)+length]...)
+		case bpsTargetRead:
+			out = append(out, r.bytes(length)...)
+		case bpsSourceCopy:
+			sourceOffset += signedNumber(r.number())
+			if sourceOffset < 0 || sourceOffset+length > len(rom) {
+				return nil, fmt.Errorf("%w: BPS patch copies from outside the source", ErrBadPatch)
+			}
+			out = append(out, rom[sourceOffset:sourceOffset+length]...)
+			sourceOffset += length
+		case bpsTargetCopy:
+			targetOffset += signedNumber(r.number())
+			if targetOffset < 0 || targetOffset >= len(out) {
+				return nil, fmt.Errorf("%w: BPS patch copies from outside the target", ErrBadPatch)
+			}
+			// the copy can overlap what it's writing, to repeat a pattern
+			for i := 0; i < length; i++ {
+				out = append(out, out[targetOffset])
+				targetOffset++
+			}
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(out) != targetSize {
+		return nil, fmt.Errorf("%w: BPS patch gave %d bytes, not %d", ErrBadPatch, len(out), targetSize)
+	}
+
+	if err := checkTarget(out, targetCRC, "BPS"); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+// signedNumber - a BPS copy offset, with the sign in the bottom bit
+func signedNumber(n int) int {
+	if n&1 != 0 {
+		return -(n >> 1)
+	}
+
+	return n >> 1
+}
+
+// CreateBPS - a BPS patch that turns source into target. Bytes that are
+// the same in both are read from the source, and changed bytes are in
+// the patch, except runs of one byte which copy from the target.
+func CreateBPS(source, target []byte) []byte {
+	patch := []byte("BPS1")
+	patch = appendNumber(patch, len(source))
+	patch = appendNumber(patch, len(target))
+	patch = appendNumber(patch, 0)
+
+	action := func(kind, length int) {
+		patch = appendNumber(patch, (length-1)<<2|kind)
+	}
+
+	// where the last target copy left off
+	targetOffset := 0
+
+	for pos := 0; pos < len(target); {
+		same := 0
+		for pos+same < len(target) && pos+same < len(source) && target[pos+same] == source[pos+same] {
+			same++
+		}
+		if same > 0 {
+			action(bpsSourceRead, same)
+			pos += same
+			continue
+		}
+
+		// a run of the byte before, copied from the target
+		if pos > 0 && startsRun(target, pos) {
+			run := 0
+			for pos+run < len(target) && target[pos+run] == target[pos-1] {
+				run++
+			}
+			action(bpsTargetCopy, run)
+			patch = appendNumber(patch, signedOffset(pos-1-targetOffset))
+			targetOffset = pos - 1 + run
+			pos += run
+			continue
+		}
+
+		// changed bytes, up to where the source matches again or a run
+		// starts
+		end := pos + 1
+		for end < len(target) && (end >= len(source) || target[end] != source[end]) && !startsRun(target, end) {
+			end++
+		}
+		action(bpsTargetRead, end-pos)
+		patch = append(patch, target[pos:end]...)
+		pos = end
+	}
+
+	var footer [12]byte
+	binary.LittleEndian.PutUint32(footer[0:], crc32.ChecksumIEEE(source))
+	binary.LittleEndian.PutUint32(footer[4:], crc32.ChecksumIEEE(target))
+	patch = append(patch, footer[:8]...)
+	binary.LittleEndian.PutUint32(footer[8:], crc32.ChecksumIEEE(patch))
+
+	return append(patch, footer[8:]...)
+}
+
+// startsRun - whether target repeats the byte before pos for long enough
+// to be worth a target copy
+func startsRun(target []byte, pos int) bool {
+	if pos+4 > len(target) {
+		return false
+	}
+	for _, b := range target[pos : pos+4] {
+		if b != target[pos-1] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// signedOffset - n as signedNumber reads it
+func signedOffset(n int) int {
+	if n < 0 {
+		return -n<<1 | 1
+	}
+
+	return n << 1
+}
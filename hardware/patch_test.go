@@ -0,0 +1,195 @@
+package hardware
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// withFooter - patch with the UPS and BPS footer of checksums on the end
+func withFooter(patch, source, target []byte) []byte {
+	var footer [4]byte
+	for _, crc := range []uint32{crc32.ChecksumIEEE(source), crc32.ChecksumIEEE(target)} {
+		binary.LittleEndian.PutUint32(footer[:], crc)
+		patch = append(patch, footer[:]...)
+	}
+	binary.LittleEndian.PutUint32(footer[:], crc32.ChecksumIEEE(patch))
+
+	return append(patch, footer[:]...)
+}
+
+func TestApplyIPS(t *testing.T) {
+	rom := []byte{0, 1, 2, 3, 4, 5, 6, 7}
+
+	patch := []byte("PATCH")
+	// 2 bytes at 1, a run of 3 $AA at 5, and 2 bytes past the end
+	patch = append(patch, 0, 0, 1, 0, 2, 0x11, 0x22)
+	patch = append(patch, 0, 0, 5, 0, 0, 0, 3, 0xAA)
+	patch = append(patch, 0, 0, 9, 0, 2, 0x33, 0x44)
+	patch = append(patch, "EOF"...)
+
+	out, err := ApplyPatch(rom, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0, 0x11, 0x22, 3, 4, 0xAA, 0xAA, 0xAA, 0, 0x33, 0x44}; !bytes.Equal(out, want) {
+		t.Errorf("Expected % X, got % X", want, out)
+	}
+	if rom[1] != 1 {
+		t.Errorf("Expected the rom to be left alone")
+	}
+
+	// truncated to 4 bytes
+	out, err = ApplyPatch(rom, append([]byte("PATCHEOF"), 0, 0, 4))
+	if err != nil || !bytes.Equal(out, rom[:4]) {
+		t.Errorf("Expected the rom cut to 4 bytes, got % X %v", out, err)
+	}
+
+	for _, bad := range [][]byte{[]byte("PATCH"), []byte("PATCH\x00\x00\x01\x00\x04\x11"), []byte("NOTAPATCH")} {
+		if _, err := ApplyPatch(rom, bad); !errors.Is(err, ErrBadPatch) {
+			t.Errorf("Expected %q to be refused, got %v", bad, err)
+		}
+	}
+}
+
+func TestApplyUPS(t *testing.T) {
+	source := []byte{0, 1, 2, 3, 4, 5, 6, 7}
+	target := []byte{0, 1, 9, 3, 4, 5, 6, 7, 8, 9}
+
+	patch := []byte("UPS1")
+	patch = appendNumber(patch, len(source))
+	patch = appendNumber(patch, len(target))
+	// skip 2, XOR 1 byte
+	patch = appendNumber(patch, 2)
+	patch = append(patch, 2^9, 0)
+	// skip from 4 to 8, XOR the 2 new bytes
+	patch = appendNumber(patch, 4)
+	patch = append(patch, 8, 9, 0)
+	patch = withFooter(patch, source, target)
+
+	out, err := ApplyPatch(source, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, target) {
+		t.Errorf("Expected % X, got % X", target, out)
+	}
+
+	if _, err := ApplyPatch(target, patch); !errors.Is(err, ErrPatchMismatch) {
+		t.Errorf("Expected the patch to be refused for another rom, got %v", err)
+	}
+	corrupt := append([]byte(nil), patch...)
+	corrupt[len(corrupt)-14] ^= 0xFF
+	if _, err := ApplyPatch(source, corrupt); !errors.Is(err, ErrBadPatch) {
+		t.Errorf("Expected a corrupt patch to be refused, got %v", err)
+	}
+}
+
+func TestApplyBPS(t *testing.T) {
+	source := []byte("ABCDEFGH")
+	target := []byte("ABxyEFGHCDxyxyxy")
+
+	patch := []byte("BPS1")
+	patch = appendNumber(patch, len(source))
+	patch = appendNumber(patch, len(target))
+	patch = appendNumber(patch, 3)
+	patch = append(patch, "abc"...)
+	patch = appendNumber(patch, (2-1)<<2|bpsSourceRead)
+	patch = appendNumber(patch, (2-1)<<2|bpsTargetRead)
+	patch = append(patch, "xy"...)
+	patch = appendNumber(patch, (4-1)<<2|bpsSourceRead)
+	// CD from the source
+	patch = appendNumber(patch, (2-1)<<2|bpsSourceCopy)
+	patch = appendNumber(patch, signedOffset(2))
+	// xy from the target, then repeated from what's being written
+	patch = appendNumber(patch, (2-1)<<2|bpsTargetCopy)
+	patch = appendNumber(patch, signedOffset(2))
+	patch = appendNumber(patch, (4-1)<<2|bpsTargetCopy)
+	patch = appendNumber(patch, signedOffset(6))
+	patch = withFooter(patch, source, target)
+
+	out, err := ApplyPatch(source, patch)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, target) {
+		t.Errorf("Expected %q, got %q", target, out)
+	}
+}
+
+func TestCreateBPS(t *testing.T) {
+	source := make([]byte, 0x6010)
+	for i := range source {
+		source[i] = byte(i * 7)
+	}
+
+	grown := append(append([]byte(nil), source...), bytes.Repeat([]byte{0xFF}, 0x2000)...)
+	copy(grown[0x100:], "a translation")
+	for i := 0x1000; i < 0x1100; i++ {
+		grown[i] = 0
+	}
+
+	for name, target := range map[string][]byte{
+		"grown":  grown,
+		"shrunk": source[:0x4010],
+		"same":   source,
+		"empty":  nil,
+	} {
+		patch := CreateBPS(source, target)
+		out, err := ApplyPatch(source, patch)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		if !bytes.Equal(out, target) {
+			t.Errorf("%s: expected the patch to give the target back", name)
+		}
+		if len(patch) > 256 {
+			t.Errorf("%s: expected a small patch, got %d bytes", name, len(patch))
+		}
+	}
+
+	if _, err := ApplyPatch(grown, CreateBPS(source, grown)); !errors.Is(err, ErrPatchMismatch) {
+		t.Errorf("Expected the patch to be refused for another rom, got %v", err)
+	}
+}
+
+func TestPatchedCartridge(t *testing.T) {
+	filename, _ := assembleROM(t, `
+	.bank 0
+	.org $C000
+reset:
+	nop`)
+
+	// lda #$42 in place of the nop, from an IPS next to the rom
+	patch := append([]byte("PATCH"), 0, 0, 0x10, 0, 2, 0xA9, 0x42)
+	patch = append(patch, "EOF"...)
+	ipsFile := filepath.Join(filepath.Dir(filename), "test.ips")
+	if err := os.WriteFile(ipsFile, patch, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	patches := FindPatches(filename)
+	if len(patches) != 1 || patches[0] != ipsFile {
+		t.Fatalf("Expected %s to be found, got %v", ipsFile, patches)
+	}
+
+	cart, err := CreateCartridge(filename, patches...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cart.prgRom[0] != 0xA9 || cart.prgRom[1] != 0x42 || len(cart.Patches) != 1 {
+		t.Errorf("Expected the patch applied, got % X", cart.prgRom[:2])
+	}
+
+	if err := os.WriteFile(ipsFile, []byte("PATCH"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := CreateCartridge(filename, ipsFile); !errors.Is(err, ErrBadPatch) {
+		t.Errorf("Expected a bad patch to stop the load, got %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package hardware
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// field numbers from pprof's profile.proto
+const (
+	pprofSampleType        = 1
+	pprofSample            = 2
+	pprofLocation          = 4
+	pprofFunction          = 5
+	pprofStringTable       = 6
+	pprofTimeNanos         = 9
+	pprofDurationNanos     = 10
+	pprofPeriodType        = 11
+	pprofPeriod            = 12
+	pprofComment           = 13
+	pprofDefaultSampleType = 14
+
+	pprofValueTypeType = 1
+	pprofValueTypeUnit = 2
+
+	pprofSampleLocation = 1
+	pprofSampleValue    = 2
+
+	pprofLocationID       = 1
+	pprofLocationAddress  = 3
+	pprofLocationLine     = 4
+	pprofLineFunction     = 1
+	pprofLineLine         = 2
+	pprofFunctionID       = 1
+	pprofFunctionName     = 2
+	pprofFunctionSystem   = 3
+	pprofFunctionFilename = 4
+	pprofFunctionStart    = 5
+)
+
+// protoBuffer - builds a protocol buffer message
+type protoBuffer struct {
+	data []byte
+}
+
+func (b *protoBuffer) varint(v uint64) {
+	for v >= 0x80 {
+		b.data = append(b.data, byte(v)|0x80)
+		v >>= 7
+	}
+	b.data = append(b.data, byte(v))
+}
+
+// uint64 - a varint field, left out when it's 0 like proto3 does
+func (b *protoBuffer) uint64(field int, v uint64) {
+	if v == 0 {
+		return
+	}
+	b.varint(uint64(field)<<3 | 0)
+	b.varint(v)
+}
+
+func (b *protoBuffer) int64(field int, v int64) {
+	b.uint64(field, uint64(v))
+}
+
+func (b *protoBuffer) bytes(field int, data []byte) {
+	b.varint(uint64(field)<<3 | 2)
+	b.varint(uint64(len(data)))
+	b.data = append(b.data, data...)
+}
+
+func (b *protoBuffer) message(field int, message *protoBuffer) {
+	b.bytes(field, message.data)
+}
+
+// packed - a repeated varint field
+func (b *protoBuffer) packed(field int, values []uint64) {
+	var packed protoBuffer
+	for _, v := range values {
+		packed.varint(v)
+	}
+	b.bytes(field, packed.data)
+}
+
+// pprofStrings - the profile's string table, which has to start with ""
+type pprofStrings struct {
+	table []string
+	index map[string]int64
+}
+
+func (s *pprofStrings) id(text string) int64 {
+	if s.index == nil {
+		s.index = map[string]int64{}
+		s.table = []string{""}
+		s.index[""] = 0
+	}
+
+	if id, ok := s.index[text]; ok {
+		return id
+	}
+	s.index[text] = int64(len(s.table))
+	s.table = append(s.table, text)
+
+	return int64(len(s.table) - 1)
+}
+
+// cpuNanos - how long the cycles took on an NTSC NES. Whole seconds are
+// split off first, as cycles*1e9 overflows after a few hours of running.
+func cpuNanos(cycles uint64) int64 {
+	return int64(cycles/cpuClockRate*1e9 + cycles%cpuClockRate*1e9/cpuClockRate)
+}
+
+// WriteProfile - writes what's been counted as a gzipped pprof profile,
+// for go tool pprof. Samples count instructions and cycles, and the
+// profile's duration is the cpu time they took on an NTSC NES.
+func (p *Profiler) WriteProfile(w io.Writer) error {
+	var profile protoBuffer
+	var stringTable pprofStrings
+
+	valueType := func(kind, unit string) *protoBuffer {
+		var message protoBuffer
+		message.int64(pprofValueTypeType, stringTable.id(kind))
+		message.int64(pprofValueTypeUnit, stringTable.id(unit))
+		return &message
+	}
+	profile.message(pprofSampleType, valueType("instructions", "count"))
+	profile.message(pprofSampleType, valueType("cycles", "count"))
+
+	// in a fixed order, so the same run writes the same profile
+	samples := make([]*profileSample, 0, len(p.samples))
+	for _, sample := range p.samples {
+		samples = append(samples, sample)
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		a, b := samples[i].locations, samples[j].locations
+		for k := 0; k < len(a) && k < len(b); k++ {
+			if a[k] != b[k] {
+				return a[k] < b[k]
+			}
+		}
+		return len(a) < len(b)
+	})
+	for _, sample := range samples {
+		var message protoBuffer
+		message.packed(pprofSampleLocation, sample.locations)
+		message.packed(pprofSampleValue, []uint64{uint64(sample.instructions), uint64(sample.cycles)})
+		profile.message(pprofSample, &message)
+	}
+
+	locations := make([]*profileLocation, len(p.locations))
+	for _, location := range p.locations {
+		locations[location.id-1] = location
+	}
+	for _, location := range locations {
+		var line protoBuffer
+		line.uint64(pprofLineFunction, location.function)
+		line.int64(pprofLineLine, int64(location.line))
+
+		var message protoBuffer
+		message.uint64(pprofLocationID, location.id)
+		message.uint64(pprofLocationAddress, uint64(location.addr))
+		message.message(pprofLocationLine, &line)
+		profile.message(pprofLocation, &message)
+	}
+
+	functions := make([]*profileFunction, len(p.functions))
+	for _, function := range p.functions {
+		functions[function.id-1] = function
+	}
+	for _, function := range functions {
+		var message protoBuffer
+		message.uint64(pprofFunctionID, function.id)
+		message.int64(pprofFunctionName, stringTable.id(function.name))
+		message.int64(pprofFunctionSystem, stringTable.id(function.name))
+		message.int64(pprofFunctionFilename, stringTable.id(function.file))
+		message.int64(pprofFunctionStart, int64(function.startLine))
+		profile.message(pprofFunction, &message)
+	}
+
+	comments := []string{fmt.Sprintf("%d frames, %d cycles", len(p.budgets), p.cycles)}
+	if overruns := p.Overruns(); len(overruns) > 0 {
+		comments = append(comments, fmt.Sprintf("%d frames ran the NMI handler past vblank, the first was frame %d", len(overruns), overruns[0].Frame))
+	}
+	for _, comment := range comments {
+		profile.int64(pprofComment, stringTable.id(comment))
+	}
+
+	profile.int64(pprofTimeNanos, p.start.UnixNano())
+	profile.int64(pprofDurationNanos, cpuNanos(p.cycles))
+	profile.message(pprofPeriodType, valueType("cycles", "count"))
+	profile.int64(pprofPeriod, 1)
+	profile.int64(pprofDefaultSampleType, stringTable.id("cycles"))
+
+	for _, text := range stringTable.table {
+		profile.bytes(pprofStringTable, []byte(text))
+	}
+
+	out := gzip.NewWriter(w)
+	if _, err := out.Write(profile.data); err != nil {
+		return err
+	}
+
+	return out.Close()
+}
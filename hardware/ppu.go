@@ -23,11 +23,26 @@ type Ppu struct {
 	Frame		   *image.RGBA
 	FrameReady	   bool
 
+	// frames finished since power on
+	frameCount uint64
+
 	ppumask     PpuMask
 	ppuctrl PpuCtrl
-	NmiOccurred bool
 	PpuReady bool
 
+	// PPUSTATUS, only the top 3 bits are driven
+	status uint8
+
+	// value left on the PPU's data bus by the last register access.
+	// Write only registers read back as this.
+	ioLatch uint8
+
+	// level of the NMI output, the CPU is signalled on its rising edge
+	nmiLine bool
+
+	// $2002 was read on the dot vblank gets set, so skip it this frame
+	suppressVBlank bool
+
 	currentTiles [0x21][8][8]uint8
 	currentAttributes [0x21][2][2]uint8
 
@@ -80,25 +95,99 @@ func (mask *PpuMask) setValues(value uint8) {
 }
 
 func (ppu *Ppu) DataRead() uint8 {
-	ppuAddressArr := []uint8{ppu.ppuAddrMSB, ppu.ppuAddrLSB}
-	ppuWriteAddress := binary.BigEndian.Uint16(ppuAddressArr)
-
-	absReadAddress := ((ppuWriteAddress+ppu.ppuAddrOffset) - 1) % 0x3FFF
+	absReadAddress := ppu.dataReadAddress()
 
 	//log.Printf("reading ppu 0x%x, value: 0x%x, OFFSET: %d", absReadAddress, ppu.Read8(absReadAddress), ppu.ppuAddrOffset)
 
 	ppu.incrementAddress()
 
+	if absReadAddress < 0x2000 {
+		ppu.logCHR(absReadAddress, 1, CDLRead)
+	}
+
 	return ppu.Read8(absReadAddress)
 }
 
-func (ppu *Ppu) Write8(value uint8) {
+func (ppu *Ppu) dataReadAddress() uint16 {
+	ppuAddressArr := []uint8{ppu.ppuAddrMSB, ppu.ppuAddrLSB}
+	ppuWriteAddress := binary.BigEndian.Uint16(ppuAddressArr)
+
+	return ((ppuWriteAddress+ppu.ppuAddrOffset) - 1) % 0x3FFF
+}
+
+// read8 - reads a PPU register from the cpu bus, mirrored every 8 bytes
+func (ppu *Ppu) read8(addr uint16) uint8 {
+	switch addr & 0x2007 {
+	// PPUSTATUS
+	case 0x2002:
+		ppu.ioLatch = ppu.ReadStatus()
+	// OAMDATA
+	case 0x2004:
+		ppu.ioLatch = ppu.ReadOAM8()
+	// PPUDATA
+	case 0x2007:
+		ppu.ioLatch = ppu.DataRead()
+	}
+
+	return ppu.ioLatch
+}
+
+// peek8 - what read8 would return, without clearing vblank or moving the address
+func (ppu *Ppu) peek8(addr uint16) uint8 {
+	switch addr & 0x2007 {
+	case 0x2002:
+		return (ppu.status & 0xE0) | (ppu.ioLatch & 0x1F)
+	case 0x2004:
+		return ppu.ReadOAM8()
+	case 0x2007:
+		return ppu.Read8(ppu.dataReadAddress())
+	}
+
+	return ppu.ioLatch
+}
+
+// write8 - writes a PPU register from the cpu bus, mirrored every 8 bytes
+func (ppu *Ppu) write8(addr uint16, value uint8) {
+	ppu.ioLatch = value
+
+	switch addr & 0x2007 {
+	// PPUCTRL
+	case 0x2000:
+		ppu.ppuctrl.setValues(value)
+		ppu.updateNMI()
+	// PPUMASK
+	case 0x2001:
+		ppu.ppumask.setValues(value)
+	// OAMADDR
+	case 0x2003:
+		ppu.SetOamAddr(value)
+	// OAMDATA
+	case 0x2004:
+		ppu.WriteOAM8(value)
+	// PPUSCROLL
+	case 0x2005:
+		ppu.setPpuScrollAddr(value)
+	// PPUADDR
+	case 0x2006:
+		ppu.setPpuAddr(value)
+	// PPUDATA
+	case 0x2007:
+		ppu.WriteData(value)
+	}
+}
+
+func (ppu *Ppu) WriteData(value uint8) {
 	ppuAddressArr := []uint8{ppu.ppuAddrMSB, ppu.ppuAddrLSB}
 	ppuWriteAddress := binary.BigEndian.Uint16(ppuAddressArr)
 
 	absWriteAddress := (ppuWriteAddress+ppu.ppuAddrOffset) & 0x3FFF
 
-	ppu.Memory[absWriteAddress] = value
+	// pattern tables are on the cartridge
+	if absWriteAddress < 0x2000 {
+		ppu.nes.CARTIO.write8(absWriteAddress, value)
+	} else {
+		ppu.Memory[absWriteAddress] = value
+	}
 
 	switch ppu.nes.CART.mirrorStyle {
 	case horizontal:
@@ -130,7 +219,7 @@ func (ppu *Ppu) Write8(value uint8) {
 }
 
 func (ppu *Ppu) incrementAddress() {
-	incrementDown := (ppu.nes.CPU.Memory[0x2000]>>2)&1 == 1
+	incrementDown := ppu.ppuctrl.vramAddressIncrement == 1
 	if incrementDown {
 		ppu.ppuAddrOffset += 0x20
 	} else {
@@ -171,11 +260,46 @@ func (ppu *Ppu) setPpuScrollAddr(addr uint8) {
 }
 
 func (ppu *Ppu) SetVBlank() {
-	ppu.nes.CPU.Memory[0x2002] |= 1 << 7
+	ppu.status |= 1 << 7
+	ppu.updateNMI()
 }
 
 func (ppu *Ppu) ClearVBlank() {
-	ppu.nes.CPU.Memory[0x2002] &= ^(uint8(1) << 7)
+	ppu.status &= ^(uint8(1) << 7)
+	ppu.updateNMI()
+}
+
+func (ppu *Ppu) inVBlank() bool {
+	return (ppu.status>>7)&1 == 1
+}
+
+// updateNMI - drives the NMI output from the vblank flag and PPUCTRL bit 7.
+// The NMI fires on the rising edge, so it fires at the start of vblank and
+// again if NMIs are enabled while vblank is already set.
+func (ppu *Ppu) updateNMI() {
+	line := ppu.inVBlank() && ppu.ppuctrl.nmiGenerate == 1
+
+	if line && !ppu.nmiLine {
+		ppu.nes.CPU.HandleNMI()
+	}
+
+	ppu.nmiLine = line
+}
+
+// ReadStatus - reads PPUSTATUS, which clears vblank and the address latch
+func (ppu *Ppu) ReadStatus() uint8 {
+	// reading on the dot vblank is set returns it clear, and it never gets set
+	if ppu.Scanline == 241 && ppu.Cycle == 0 {
+		ppu.suppressVBlank = true
+	}
+
+	// the low bits come from whatever was last on the PPU's data bus
+	status := (ppu.status & 0xE0) | (ppu.ioLatch & 0x1F)
+
+	ppu.ClearVBlank()
+	ppu.ppuAddrCounter = 0
+
+	return status
 }
 
 func (ppu *Ppu) get8x8Tile(base uint16, pos uint16) [8][8]uint8 {
@@ -202,6 +326,20 @@ func (ppu *Ppu) get8x8Tile(base uint16, pos uint16) [8][8]uint8 {
 	return result
 }
 
+// logCHR - tells the code/data logger, if there is one, that size bytes
+// of pattern table from addr were used. Tiles fetched with their layer
+// switched off in PPUMASK never make it to the screen.
+func (ppu *Ppu) logCHR(addr uint16, size int, flags uint8) {
+	if ppu.nes.CDL == nil {
+		return
+	}
+	if flags&CDLBackground != 0 && !ppu.ppumask.backgroundEnable || flags&CDLSprite != 0 && !ppu.ppumask.spriteEnable {
+		return
+	}
+
+	ppu.nes.CDL.markCHR(addr, size, flags)
+}
+
 func (ppu *Ppu) get8x16Tile(base uint16, pos uint16) [16][8]uint8 {
 	tile8x8_1 := ppu.get8x8Tile(base, pos)
 	tile8x8_2 := ppu.get8x8Tile(base, pos + 1)
@@ -299,9 +437,9 @@ func (ppu *Ppu) getSpriteColorPalette(pos uint8) [4]Color {
 }
 
 func (ppu *Ppu) getBackgroundColorAtPixel(x, y uint8) Color {
-	backgroundTileBase := uint16((ppu.nes.CPU.Memory[0x2000]>>4)&1) * 0x1000
+	backgroundTileBase := uint16(ppu.ppuctrl.backgroundPatternTableAddr) * 0x1000
 	backgroundTileOffset := (uint16(y/8) * 32) + (uint16(x/8) % 32)
-	nameTableSelect := ppu.nes.CPU.Memory[0x2000] & 0x03
+	nameTableSelect := ppu.ppuctrl.baseNametableAddr
 	nameTableBase := 0x2000 + uint16(uint16(nameTableSelect) * 0x400)
 	backgroundTilePos := ppu.Memory[nameTableBase+backgroundTileOffset]
 
@@ -347,6 +485,7 @@ func (ppu *Ppu) getColorFromSprite(x, y uint8, s Sprite) Color {
 		backgroundTileBase = uint16(ppu.ppuctrl.spritePatternTableAddr) * 0x1000
 		backgroundTilePos = s.tileNum
 		tile8x8 = ppu.get8x8Tile(backgroundTileBase, uint16(backgroundTilePos))
+		ppu.logCHR(backgroundTileBase+uint16(backgroundTilePos)*0x10, 0x10, CDLRendered|CDLSprite)
 
 		xBG := x % 8
 		if flipHorizontal {
@@ -371,6 +510,7 @@ func (ppu *Ppu) getColorFromSprite(x, y uint8, s Sprite) Color {
 		backgroundTileBase = uint16(s.tileNum & 1) * 0x1000
 		backgroundTilePos = s.tileNum & ^uint8(0x01)
 		tile8x16 = ppu.get8x16Tile(backgroundTileBase, uint16(backgroundTilePos))
+		ppu.logCHR(backgroundTileBase+uint16(backgroundTilePos)*0x10, 0x20, CDLRendered|CDLSprite)
 
 		xBG := x % 8
 		if flipHorizontal {
@@ -450,28 +590,29 @@ func (ppu *Ppu) fetchSprites() {
 }
 
 func (ppu *Ppu) is8x16Mode() bool {
-	return (ppu.nes.CPU.Read8(0x2000) >> 5) & 1 == 1
+	return ppu.ppuctrl.spriteSize == 1
 }
 
 func (ppu *Ppu) setSpriteHit() {
-	ppu.nes.CPU.Memory[0x2002] |= 0x40
+	ppu.status |= 0x40
 }
 
 func (ppu *Ppu) clearSpriteHit() {
-	ppu.nes.CPU.Memory[0x2002] &= 0xBF
+	ppu.status &= 0xBF
 }
 
 func (ppu *Ppu) getAllTilesForScanline(nameTableY, nameTableX uint16) {
 	ppu.currentTiles = [0x21][8][8]uint8{}
 	ppu.currentAttributes = [0x21][2][2]uint8{}
-	nameTableSelect := ppu.nes.CPU.Memory[0x2000] & 0x03
+	nameTableSelect := ppu.ppuctrl.baseNametableAddr
 
 	for x := uint16(0); x < 0x21; x++ {
 		backgroundTileOffset := ((nameTableY % 240/8) * 32) + (((nameTableX + 8 * x) % 256 / 8) % 32)
 		nameTableBase := (0x2000 + (uint16(nameTableSelect)*0x400) + (nameTableY / 240) * 0x800 + ((nameTableX + 8 * x) / 256) * 0x400) & 0x2FFF
-		backgroundTileBase := uint16((ppu.nes.CPU.Memory[0x2000]>>4)&1) * 0x1000
+		backgroundTileBase := uint16(ppu.ppuctrl.backgroundPatternTableAddr) * 0x1000
 		backgroundTilePos := ppu.Memory[nameTableBase+backgroundTileOffset]
 		backgroundTile := ppu.get8x8Tile(backgroundTileBase, uint16(backgroundTilePos))
+		ppu.logCHR(backgroundTileBase+uint16(backgroundTilePos)*0x10, 0x10, CDLRendered|CDLBackground)
 		attributePalettePos := uint8((nameTableY % 240/32)*8) + ((uint8((nameTableX + 8 * x) % 256) / 32) % 32)
 		attributeTile := ppu.get2x2Attribute(nameTableBase, attributePalettePos)
 		copy(ppu.currentTiles[x][0:8], backgroundTile[0:8])
@@ -482,7 +623,6 @@ func (ppu *Ppu) getAllTilesForScanline(nameTableY, nameTableX uint16) {
 func (ppu *Ppu) PPURun() {
 
 	if ppu.Scanline == 0 {
-		ppu.NmiOccurred = false
 		ppu.clearSpriteHit()
 	}
 
@@ -522,7 +662,10 @@ func (ppu *Ppu) PPURun() {
 		ppu.ClearVBlank()
 	}
 	if ppu.Scanline == 241 && ppu.Cycle == 0 {
-		ppu.SetVBlank()
+		if !ppu.suppressVBlank {
+			ppu.SetVBlank()
+		}
+		ppu.suppressVBlank = false
 	}
 
 	if ppu.Scanline <= 240 && ppu.Cycle == 257 {
@@ -537,6 +680,7 @@ func (ppu *Ppu) PPURun() {
 	// if a frame is ready, set bool
 	if ppu.Cycle == 0 && ppu.Scanline == 240 {
 		ppu.FrameReady = true
+		ppu.frameCount++
 	}
 }
 
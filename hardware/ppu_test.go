@@ -0,0 +1,112 @@
+package hardware
+
+import (
+	"testing"
+)
+
+// runPPUTo clocks the PPU until it is about to run the given dot
+func runPPUTo(ppu *Ppu, scanline uint16, cycle int64) {
+	for ppu.Scanline != scanline || ppu.Cycle != cycle {
+		ppu.PPURun()
+	}
+}
+
+func newTestPPU() *NES {
+	nes := newTestNES([]byte{0xEA}, 0xC020, 0xC000, 0xC010)
+	nes.PPU.InitFrame(1)
+
+	return nes
+}
+
+func TestNmiAtVBlankStart(t *testing.T) {
+	nes := newTestPPU()
+	nes.CPU.Write8(0x2000, 0x80)
+
+	runPPUTo(nes.PPU, 241, 0)
+	if nes.CPU.NMIPending() {
+		t.Fatalf("NMI fired before vblank")
+	}
+
+	nes.PPU.PPURun()
+	if !nes.CPU.NMIPending() {
+		t.Fatalf("NMI did not fire at the start of vblank")
+	}
+}
+
+func TestNmiNotEnabled(t *testing.T) {
+	nes := newTestPPU()
+
+	runPPUTo(nes.PPU, 241, 5)
+	if nes.CPU.NMIPending() {
+		t.Errorf("NMI fired with PPUCTRL bit 7 clear")
+	}
+}
+
+func TestNmiEnabledDuringVBlank(t *testing.T) {
+	nes := newTestPPU()
+
+	runPPUTo(nes.PPU, 241, 5)
+	nes.CPU.Write8(0x2000, 0x80)
+	if !nes.CPU.NMIPending() {
+		t.Fatalf("Enabling NMI during vblank did not fire it")
+	}
+
+	// the line is already high, so rewriting the bit is not a new edge
+	stepCpu(nes)
+	nes.CPU.Write8(0x2000, 0x80)
+	if nes.CPU.NMIPending() {
+		t.Errorf("NMI fired again without a new edge")
+	}
+
+	// toggling it off and on again is
+	nes.CPU.Write8(0x2000, 0x00)
+	nes.CPU.Write8(0x2000, 0x80)
+	if !nes.CPU.NMIPending() {
+		t.Errorf("Re-enabling NMI during vblank did not fire it")
+	}
+}
+
+func TestNmiSuppressedByStatusRead(t *testing.T) {
+	nes := newTestPPU()
+	nes.CPU.Write8(0x2000, 0x80)
+
+	runPPUTo(nes.PPU, 241, 0)
+	if status := nes.CPU.Read8(0x2002); status&0x80 != 0 {
+		t.Errorf("Status read on the vblank dot should return vblank clear: %02x", status)
+	}
+
+	runPPUTo(nes.PPU, 241, 10)
+	if nes.CPU.NMIPending() {
+		t.Errorf("NMI should be suppressed by the status read")
+	}
+	if nes.PPU.inVBlank() {
+		t.Errorf("vblank should not be set this frame")
+	}
+
+	// the next frame is unaffected
+	runPPUTo(nes.PPU, 241, 1)
+	if !nes.CPU.NMIPending() {
+		t.Errorf("NMI did not fire on the next frame")
+	}
+}
+
+func TestPpuDataDummyReadIncrements(t *testing.T) {
+	// C000 LDX #$F9
+	// C002 LDA $200E,X - dummy read at $2007, real read at $2107
+	// C005 LDX #$00
+	// C007 STA $2007,X - dummy read and write at $2007
+	prg := []byte{0xA2, 0xF9, 0xBD, 0x0E, 0x20, 0xA2, 0x00, 0x9D, 0x07, 0x20}
+	nes := newTestNES(prg, 0xC020, 0xC000, 0xC010)
+
+	stepCpu(nes)
+	stepCpu(nes)
+	if nes.PPU.ppuAddrOffset != 2 {
+		t.Errorf("Expected page crossing read of $2007 to increment twice. Offset: %x", nes.PPU.ppuAddrOffset)
+	}
+
+	stepCpu(nes)
+	stepCpu(nes)
+	if nes.PPU.ppuAddrOffset != 4 {
+		t.Errorf("Expected indexed write to $2007 to increment twice. Offset: %x", nes.PPU.ppuAddrOffset)
+	}
+}
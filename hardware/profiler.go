@@ -0,0 +1,284 @@
+package hardware
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// cpu clock of an NTSC NES, in Hz
+const cpuClockRate = 1789773
+
+// FrameBudget - how the cpu spent one frame, from the end of one picture
+// to the end of the next. The NMI comes at the start of it.
+type FrameBudget struct {
+	Frame uint64
+
+	// cycles run in the frame, and how many of them were in the NMI handler
+	Cycles    uint64
+	NMICycles uint64
+
+	// cycles the NMI handler was still running after vblank ended. PPU
+	// updates made then land mid-picture.
+	Overrun uint64
+}
+
+// profileSite - where code ran, pinned to its PRG offset so banked code
+// is told apart. PRG is -1 outside PRG rom.
+type profileSite struct {
+	addr uint16
+	prg  int
+}
+
+type profileFunction struct {
+	id        uint64
+	name      string
+	file      string
+	startLine int
+}
+
+type profileLocation struct {
+	id       uint64
+	addr     uint16
+	function uint64
+	line     int
+}
+
+type profileSample struct {
+	locations    []uint64
+	instructions int64
+	cycles       int64
+}
+
+// profileFrame - a call stack frame as the profiler sees it
+type profileFrame struct {
+	routine profileSite
+	kind    FrameKind
+
+	// the location of the JSR, or the instruction an interrupt came before
+	from uint64
+}
+
+// Profiler - counts the instructions and cycles run at each PC in each
+// call stack, and what each frame spent, for pprof. Set it as NES.Profiler.
+type Profiler struct {
+	calls  callTracker
+	frames []profileFrame
+
+	// the instruction about to run
+	pc      profileSite
+	inNMI   bool
+	overran bool
+
+	functions map[profileSite]*profileFunction
+	locations map[[2]profileSite]*profileLocation
+	samples   map[string]*profileSample
+	key       []byte
+
+	budgets []FrameBudget
+	budget  FrameBudget
+
+	start  time.Time
+	cycles uint64
+}
+
+func NewProfiler() *Profiler {
+	return &Profiler{
+		functions: make(map[profileSite]*profileFunction),
+		locations: make(map[[2]profileSite]*profileLocation),
+		samples:   make(map[string]*profileSample),
+		start:     time.Now(),
+	}
+}
+
+// site - addr as the cartridge is mapped now
+func (p *Profiler) site(nes *NES, addr uint16) profileSite {
+	prg := -1
+	if nes.CARTIO != nil {
+		prg = nes.CARTIO.prgOffset(addr)
+	}
+
+	return profileSite{addr, prg}
+}
+
+// before - notes the call stack and where in the frame the step about to
+// run is
+func (p *Profiler) before(nes *NES) {
+	p.calls.before(nes.CPU)
+	p.pc = p.site(nes, nes.CPU.PC)
+
+	p.inNMI = p.calls.entering && p.calls.kind == FrameNMI
+	for _, frame := range p.calls.frames {
+		p.inNMI = p.inNMI || frame.Kind == FrameNMI
+	}
+	p.overran = p.inNMI && nes.PPU.Scanline < 241
+}
+
+// after - counts the step's cycles against the stack it ran in
+func (p *Profiler) after(nes *NES, cycles uint8) {
+	if p.budget.Frame != nes.PPU.frameCount {
+		if p.budget.Cycles > 0 {
+			p.budgets = append(p.budgets, p.budget)
+		}
+		p.budget = FrameBudget{Frame: nes.PPU.frameCount}
+	}
+	p.budget.Cycles += uint64(cycles)
+	if p.inNMI {
+		p.budget.NMICycles += uint64(cycles)
+	}
+	if p.overran {
+		p.budget.Overrun += uint64(cycles)
+	}
+	p.cycles += uint64(cycles)
+
+	// the step counts in the stack it started in, so an interrupt's entry
+	// is in the code it interrupted and an RTS in the routine it leaves
+	leaf := p.location(nes, p.pc, p.routine())
+
+	p.key = p.key[:0]
+	p.appendKey(leaf)
+	for i := len(p.frames) - 1; i >= 0; i-- {
+		p.appendKey(p.frames[i].from)
+	}
+	sample, ok := p.samples[string(p.key)]
+	if !ok {
+		sample = &profileSample{locations: []uint64{leaf}}
+		for i := len(p.frames) - 1; i >= 0; i-- {
+			sample.locations = append(sample.locations, p.frames[i].from)
+		}
+		p.samples[string(p.key)] = sample
+	}
+	sample.instructions++
+	sample.cycles += int64(cycles)
+
+	p.calls.after(nes.CPU)
+	if len(p.frames) > len(p.calls.frames) {
+		p.frames = p.frames[:len(p.calls.frames)]
+	}
+	if len(p.frames) < len(p.calls.frames) {
+		frame := p.calls.frames[len(p.calls.frames)-1]
+		from := p.location(nes, p.site(nes, frame.From), p.routine())
+		routine := p.site(nes, frame.Target)
+		p.function(nes, routine, frame.Kind)
+		p.frames = append(p.frames, profileFrame{routine, frame.Kind, from})
+	}
+}
+
+// appendKey - adds a location to the key of the sample being counted
+func (p *Profiler) appendKey(location uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], location)
+	p.key = append(p.key, buf[:n]...)
+}
+
+// routine - the routine the innermost frame is in. The zero site stands
+// for the code reset runs, outside any call.
+func (p *Profiler) routine() profileSite {
+	if len(p.frames) == 0 {
+		return profileSite{}
+	}
+
+	return p.frames[len(p.frames)-1].routine
+}
+
+// function - the function for a routine, named from the symbols or else
+// auto-labelled the way the disassembler would
+func (p *Profiler) function(nes *NES, routine profileSite, kind FrameKind) *profileFunction {
+	if function, ok := p.functions[routine]; ok {
+		return function
+	}
+
+	function := &profileFunction{id: uint64(len(p.functions) + 1)}
+	p.functions[routine] = function
+
+	if routine == (profileSite{}) {
+		function.name = "reset"
+		return function
+	}
+
+	if nes.Symbols != nil {
+		// a routine starting part way into another label is named for itself
+		if sym, offset, ok := nes.Symbols.Lookup(nes, routine.addr); ok && offset == 0 {
+			function.name = sym.Name
+		}
+		if info := nes.Symbols.DebugInfo(); info != nil {
+			if line, ok := info.SourceAt(nes, routine.addr); ok {
+				function.file, function.startLine = line.File, line.Line
+			}
+		}
+	}
+	if function.name == "" {
+		prefix := "sub"
+		switch kind {
+		case FrameNMI:
+			prefix = "nmi"
+		case FrameIRQ, FrameBRK:
+			prefix = "irq"
+		}
+		function.name = fmt.Sprintf("%s_%04X", prefix, routine.addr)
+		if nes.CART != nil && len(nes.CART.prgRom) > 0x8000 && routine.prg >= 0 {
+			function.name += fmt.Sprintf("_b%d", routine.prg/0x4000)
+		}
+	}
+
+	return function
+}
+
+// location - the location for code at site in routine
+func (p *Profiler) location(nes *NES, site, routine profileSite) uint64 {
+	key := [2]profileSite{site, routine}
+	if location, ok := p.locations[key]; ok {
+		return location.id
+	}
+
+	location := &profileLocation{
+		id:       uint64(len(p.locations) + 1),
+		addr:     site.addr,
+		function: p.function(nes, routine, FrameCall).id,
+	}
+	if nes.Symbols != nil && nes.Symbols.DebugInfo() != nil {
+		if line, ok := nes.Symbols.DebugInfo().SourceAt(nes, site.addr); ok {
+			location.line = line.Line
+		}
+	}
+	p.locations[key] = location
+
+	return location.id
+}
+
+// Frames - the budgets of the frames finished so far
+func (p *Profiler) Frames() []FrameBudget {
+	return p.budgets
+}
+
+// Overruns - the frames whose NMI handler ran past the end of vblank
+func (p *Profiler) Overruns() []FrameBudget {
+	var overruns []FrameBudget
+	for _, budget := range p.budgets {
+		if budget.Overrun > 0 {
+			overruns = append(overruns, budget)
+		}
+	}
+
+	return overruns
+}
+
+// WriteFrames - writes a table of the frame budgets
+func (p *Profiler) WriteFrames(w io.Writer) error {
+	if _, err := fmt.Fprintf(w, "%8s %8s %8s %8s\n", "frame", "cycles", "nmi", "overrun"); err != nil {
+		return err
+	}
+
+	for _, budget := range p.budgets {
+		note := ""
+		if budget.Overrun > 0 {
+			note = "  NMI past vblank"
+		}
+		if _, err := fmt.Fprintf(w, "%8d %8d %8d %8d%s\n", budget.Frame, budget.Cycles, budget.NMICycles, budget.Overrun, note); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
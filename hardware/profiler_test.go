@@ -0,0 +1,186 @@
+package hardware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// profileTestSource - a main loop calling a short routine, and an NMI
+// handler that takes longer than vblank
+const profileTestSource = `
+	.bank 0
+	.org $C000
+reset:
+	ldx #$FF
+	txs
+	lda #$80
+	sta $2000
+loop:
+	jsr work
+	jmp loop
+work:
+	ldy #10
+work_loop:
+	dey
+	bne work_loop
+	rts
+nmi:
+	ldy #3
+burn:
+	ldx #0
+burn_inner:
+	dex
+	bne burn_inner
+	dey
+	bne burn
+	rti
+
+	.org $FFFA
+	.word nmi, reset, reset`
+
+// readProto - the fields of a protocol buffer message, varints and
+// length delimited ones only
+func readProto(t *testing.T, data []byte) map[int][]interface{} {
+	fields := map[int][]interface{}{}
+	for len(data) > 0 {
+		key, n := binary.Uvarint(data)
+		data = data[n:]
+		switch key & 7 {
+		case 0:
+			v, n := binary.Uvarint(data)
+			data = data[n:]
+			fields[int(key>>3)] = append(fields[int(key>>3)], v)
+		case 2:
+			length, n := binary.Uvarint(data)
+			data = data[n:]
+			fields[int(key>>3)] = append(fields[int(key>>3)], data[:length])
+			data = data[length:]
+		default:
+			t.Fatalf("Unexpected wire type %d", key&7)
+		}
+	}
+
+	return fields
+}
+
+// readPacked - a packed repeated varint field
+func readPacked(data []byte) []uint64 {
+	var values []uint64
+	for len(data) > 0 {
+		v, n := binary.Uvarint(data)
+		values = append(values, v)
+		data = data[n:]
+	}
+
+	return values
+}
+
+func TestProfiler(t *testing.T) {
+	nes, program := assembleNES(t, profileTestSource)
+	work := uint16(program.Symbols["work"])
+	nes.Symbols = NewSymbols()
+	nes.Symbols.Add(Symbol{Name: "work", Addr: work, PRG: int(work - 0xC000)})
+
+	profiler := NewProfiler()
+	nes.Profiler = profiler
+	for frame := 0; frame < 5; frame++ {
+		for !nes.PPU.FrameReady {
+			nes.Step()
+		}
+		nes.PPU.FrameReady = false
+	}
+
+	frames := profiler.Frames()
+	if len(frames) != 5 {
+		t.Fatalf("Expected 5 frame budgets, got %+v", frames)
+	}
+	for _, budget := range frames[1:] {
+		// three times round 256 dex/bne is about 3800 cycles, vblank is about 2270
+		if budget.NMICycles < 3800 || budget.Overrun < 1000 || budget.Overrun > budget.NMICycles {
+			t.Errorf("Expected the NMI handler to overrun vblank, got %+v", budget)
+		}
+	}
+	if len(profiler.Overruns()) != 4 {
+		t.Errorf("Expected 4 frames to overrun, got %+v", profiler.Overruns())
+	}
+
+	out := &bytes.Buffer{}
+	if err := profiler.WriteProfile(out); err != nil {
+		t.Fatal(err)
+	}
+	r, err := gzip.NewReader(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	profile := readProto(t, data)
+
+	var table []string
+	for _, s := range profile[pprofStringTable] {
+		table = append(table, string(s.([]byte)))
+	}
+
+	names := map[uint64]string{}
+	for _, f := range profile[pprofFunction] {
+		function := readProto(t, f.([]byte))
+		names[function[pprofFunctionID][0].(uint64)] = table[function[pprofFunctionName][0].(uint64)]
+	}
+	functions := map[uint64]string{}
+	for _, l := range profile[pprofLocation] {
+		location := readProto(t, l.([]byte))
+		line := readProto(t, location[pprofLocationLine][0].([]byte))
+		functions[location[pprofLocationID][0].(uint64)] = names[line[pprofLineFunction][0].(uint64)]
+	}
+
+	var cycles uint64
+	stacks := map[string]bool{}
+	for _, s := range profile[pprofSample] {
+		sample := readProto(t, s.([]byte))
+		cycles += readPacked(sample[pprofSampleValue][0].([]byte))[1]
+
+		var stack []string
+		for _, id := range readPacked(sample[pprofSampleLocation][0].([]byte)) {
+			stack = append(stack, functions[id])
+		}
+		stacks[strings.Join(stack, " ")] = true
+	}
+
+	if cycles != profiler.cycles {
+		t.Errorf("Expected the samples to add up to %d cycles, got %d", profiler.cycles, cycles)
+	}
+	// the NMI handler has no symbol so it gets an auto-label
+	nmi := fmt.Sprintf("nmi_%04X", program.Symbols["nmi"])
+	for _, stack := range []string{"reset", "work reset", nmi + " work reset"} {
+		if !stacks[stack] {
+			t.Errorf("Expected a sample in %s, got %v", stack, stacks)
+		}
+	}
+}
+
+func TestCpuNanos(t *testing.T) {
+	tests := []struct {
+		cycles uint64
+		nanos  int64
+	}{
+		{0, 0},
+		{cpuClockRate, int64(time.Second)},
+		{cpuClockRate / 2, 499999720},
+		// a day of running, well past where cycles*1e9 overflows
+		{24 * 60 * 60 * cpuClockRate, int64(24 * time.Hour)},
+		{24*60*60*cpuClockRate + cpuClockRate/2, int64(24*time.Hour) + 499999720},
+	}
+	for _, test := range tests {
+		if nanos := cpuNanos(test.cycles); nanos != test.nanos {
+			t.Errorf("Expected %d cycles to take %dns, got %dns", test.cycles, test.nanos, nanos)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package hardware
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// prgRAMSize - how much PRG ram the header asks for. iNES headers that
+// don't say get 8KB, unless the game database says there's none, as do
+// trainers, which are loaded into it.
+func (c *Cartridge) prgRAMSize() int {
+	size := c.PRGRAMSize + c.PRGNVRAMSize
+	if size == 0 && !c.NES20 && c.game == nil || c.Trainer && size < 0x2000 {
+		size = 0x2000
+	}
+
+	return size
+}
+
+// readRAM - the PRG ram at addr in $6000-$7FFF. Without any the bus
+// floats.
+func (c *Cartridge) readRAM(addr uint16) uint8 {
+	if len(c.prgRam) == 0 {
+		return c.nes.CPU.Bus.OpenBus()
+	}
+
+	return c.prgRam[int(addr-0x6000)%len(c.prgRam)]
+}
+
+func (c *Cartridge) writeRAM(addr uint16, value uint8) {
+	if len(c.prgRam) == 0 {
+		return
+	}
+
+	c.prgRam[int(addr-0x6000)%len(c.prgRam)] = value
+}
+
+// SaveFilename - the .sav file for romFile: the rom's name with .sav in
+// place of its extension, next to it or in dir if that's given
+func SaveFilename(romFile, dir string) string {
+	name := strings.TrimSuffix(romFile, filepath.Ext(romFile)) + ".sav"
+	if dir == "" {
+		return name
+	}
+
+	return filepath.Join(dir, filepath.Base(name))
+}
+
+// BatterySave - keeps a cartridge's battery backed PRG ram in a .sav file.
+// Flush writes it out when it's changed, replacing the file in one go so
+// a crash part way through leaves the last save whole.
+type BatterySave struct {
+	Filename string
+
+	cart *Cartridge
+
+	// the ram as it was last loaded or written
+	saved []byte
+}
+
+// NewBatterySave - loads filename into the cartridge's PRG ram if it
+// exists. Returns nil if the cartridge has no battery.
+func NewBatterySave(cart *Cartridge, filename string) (*BatterySave, error) {
+	if !cart.Battery || len(cart.prgRam) == 0 {
+		return nil, nil
+	}
+
+	data, err := ioutil.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > len(cart.prgRam) {
+		return nil, fmt.Errorf("%s: %d bytes is more than the cartridge's %s of ram", filename, len(data), formatSize(len(cart.prgRam)))
+	}
+	copy(cart.prgRam, data)
+
+	return &BatterySave{
+		Filename: filename,
+		cart:     cart,
+		saved:    append([]byte(nil), cart.prgRam...),
+	}, nil
+}
+
+// Flush - writes the ram out if it's changed since it was last written
+func (s *BatterySave) Flush() error {
+	if bytes.Equal(s.saved, s.cart.prgRam) {
+		return nil
+	}
+
+	if err := writeFileAtomic(s.Filename, s.cart.prgRam); err != nil {
+		return err
+	}
+	copy(s.saved, s.cart.prgRam)
+
+	return nil
+}
+
+// writeFileAtomic - writes data to a temporary file beside filename and
+// renames it over, so filename is always either the old or the new data
+func writeFileAtomic(filename string, data []byte) error {
+	dir := filepath.Dir(filename)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	file, err := ioutil.TempFile(dir, filepath.Base(filename)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(file.Name(), filename)
+}
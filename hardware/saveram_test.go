@@ -0,0 +1,123 @@
+package hardware
+
+import (
+	"bytes"
+	"nes-emu/assembler"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMMC1RAMEnable(t *testing.T) {
+	nes := newTestMMC1(nil)
+	mapper := nes.CARTIO.(*Mapper1CIO)
+	bus := nes.CPU.Bus
+
+	bus.Write8(0x6000, 0x42)
+	mapper.prgBank = 0x10
+	bus.Write8(0x6001, 0x43)
+	if nes.CART.prgRam[1] != 0 {
+		t.Errorf("Expected writes to be ignored with the ram off")
+	}
+	if value := bus.Read8(0x6000); value == 0x42 {
+		t.Errorf("Expected the ram off to leave the bus floating")
+	}
+
+	mapper.prgBank = 0
+	if value := bus.Read8(0x6000); value != 0x42 {
+		t.Errorf("Expected $42 with the ram back on, got $%02X", value)
+	}
+}
+
+func TestPRGRAMSize(t *testing.T) {
+	image := assembler.INES(nil, nil, mapper0)
+	// NES 2.0, 2KB of PRG ram
+	image[7], image[10] = 0x08, 0x05
+
+	cart, err := loadINES(image)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nes := NewNES()
+	if err := nes.LoadCartridge(cart); err != nil {
+		t.Fatal(err)
+	}
+	if len(nes.CART.prgRam) != 0x800 {
+		t.Fatalf("Expected 2KB of PRG ram, got %d bytes", len(nes.CART.prgRam))
+	}
+
+	// mirrored through the window
+	nes.CPU.Bus.Write8(0x6801, 0x42)
+	if value := nes.CPU.Bus.Read8(0x7801); value != 0x42 {
+		t.Errorf("Expected $7801 to mirror $6801, got $%02X", value)
+	}
+}
+
+func TestBatterySave(t *testing.T) {
+	image := assembler.INES(nil, nil, mapper0)
+	load := func(battery bool) *NES {
+		rom := append([]byte(nil), image...)
+		if battery {
+			rom[6] |= 0x02
+		}
+		cart, err := loadINES(rom)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nes := NewNES()
+		if err := nes.LoadCartridge(cart); err != nil {
+			t.Fatal(err)
+		}
+		return nes
+	}
+
+	dir := t.TempDir()
+	filename := SaveFilename("roms/game.nes", dir)
+	if filename != filepath.Join(dir, "game.sav") {
+		t.Errorf("Expected the save in %s, got %s", dir, filename)
+	}
+	if name := SaveFilename("roms/game.nes", ""); name != "roms/game.sav" {
+		t.Errorf("Expected the save next to the rom, got %s", name)
+	}
+
+	if save, err := NewBatterySave(load(false).CART, filename); save != nil || err != nil {
+		t.Errorf("Expected no save without a battery, got %v %v", save, err)
+	}
+
+	nes := load(true)
+	save, err := NewBatterySave(nes.CART, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// nothing's changed, so there's nothing to write
+	if err := save.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Errorf("Expected no save file before the ram changes")
+	}
+
+	nes.CPU.Bus.Write8(0x6000, 0x12)
+	nes.CPU.Bus.Write8(0x7FFF, 0x34)
+	if err := save.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if files, _ := os.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Expected only the save in %s, got %d files", dir, len(files))
+	}
+
+	reloaded := load(true)
+	if _, err := NewBatterySave(reloaded.CART, filename); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(reloaded.CART.prgRam, nes.CART.prgRam) || reloaded.CPU.Bus.Read8(0x7FFF) != 0x34 {
+		t.Errorf("Expected the ram back from the save")
+	}
+
+	if err := os.WriteFile(filename, make([]byte, 0x4000), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewBatterySave(load(true).CART, filename); err == nil {
+		t.Errorf("Expected a save bigger than the ram to be refused")
+	}
+}
@@ -0,0 +1,356 @@
+package hardware
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Symbol - a name for an address
+type Symbol struct {
+	Name string
+	Addr uint16
+
+	// offset into PRG rom for labels on code and data in the cartridge,
+	// which are only matched while their bank is mapped in. -1 for RAM,
+	// registers and anything else named by address alone.
+	PRG int
+
+	// bytes covered, 0 if unknown
+	Size int
+}
+
+// the furthest past a RAM label of unknown size that's still shown as label+offset
+const maxSymbolOffset = 0xFF
+
+// Symbols - names for addresses, from ca65 .dbg, FCEUX .nl and Mesen .mlb
+// files. ROM labels are matched by PRG rom offset, so the same address
+// gets the right name whichever bank is switched in.
+type Symbols struct {
+	// sorted by PRG offset and by address
+	rom  []*Symbol
+	addr []*Symbol
+
+	names map[string]*Symbol
+
+	// source lines, from a .dbg file
+	info *DebugInfo
+}
+
+func NewSymbols() *Symbols {
+	return &Symbols{names: make(map[string]*Symbol)}
+}
+
+// FindSymbolFiles - the symbol files a rom's tools would have left next
+// to it: game.dbg, game.mlb and game.nes.*.nl
+func FindSymbolFiles(rom string) []string {
+	base := strings.TrimSuffix(rom, filepath.Ext(rom))
+
+	var files []string
+	for _, name := range []string{base + ".dbg", base + ".mlb"} {
+		if _, err := os.Stat(name); err == nil {
+			files = append(files, name)
+		}
+	}
+
+	// listed rather than globbed, as dump names are full of [!] and the like
+	dir, prefix := filepath.Split(rom)
+	entries, _ := os.ReadDir(filepath.Clean(dir))
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && len(name) > len(prefix)+len("..nl") && strings.HasPrefix(name, prefix+".") && strings.HasSuffix(name, ".nl") {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+
+	return files
+}
+
+// Load - adds the symbols from a .dbg, .nl or .mlb file. cart is used to
+// place Mesen labels, which only give a PRG rom offset.
+func (s *Symbols) Load(filename string, cart *Cartridge) error {
+	var err error
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".dbg":
+		var info *DebugInfo
+		if info, err = LoadDebugInfo(filename); err == nil {
+			s.AddDebugInfo(info)
+		}
+	case ".nl":
+		err = s.loadNL(filename)
+	case ".mlb":
+		err = s.loadMLB(filename, cart)
+	default:
+		return fmt.Errorf("%s: not a .dbg, .nl or .mlb symbol file", filename)
+	}
+
+	return err
+}
+
+// AddDebugInfo - adds the labels from a ca65 debug file, and uses its
+// line information for source locations
+func (s *Symbols) AddDebugInfo(info *DebugInfo) {
+	for _, sym := range info.Symbols {
+		s.Add(sym)
+	}
+	s.info = info
+}
+
+// DebugInfo - the ca65 debug file loaded, or nil
+func (s *Symbols) DebugInfo() *DebugInfo {
+	return s.info
+}
+
+// Add - adds a symbol. The first symbol given a name keeps it for
+// Resolve, and the first at a place is the one addresses are shown as.
+func (s *Symbols) Add(sym Symbol) {
+	if sym.Name == "" {
+		return
+	}
+
+	added := &sym
+	if _, ok := s.names[sym.Name]; !ok {
+		s.names[sym.Name] = added
+	}
+
+	if sym.PRG >= 0 {
+		i := sort.Search(len(s.rom), func(i int) bool { return s.rom[i].PRG > sym.PRG })
+		s.rom = append(s.rom[:i], append([]*Symbol{added}, s.rom[i:]...)...)
+	} else {
+		i := sort.Search(len(s.addr), func(i int) bool { return s.addr[i].Addr > sym.Addr })
+		s.addr = append(s.addr[:i], append([]*Symbol{added}, s.addr[i:]...)...)
+	}
+}
+
+// All - every symbol, ROM labels first
+func (s *Symbols) All() []*Symbol {
+	return append(append([]*Symbol{}, s.rom...), s.addr...)
+}
+
+// Resolve - the symbol called name
+func (s *Symbols) Resolve(name string) (*Symbol, bool) {
+	sym, ok := s.names[name]
+
+	return sym, ok
+}
+
+// Lookup - the symbol addr is in as the cartridge is mapped now, and how
+// far into it addr is
+func (s *Symbols) Lookup(nes *NES, addr uint16) (*Symbol, int, bool) {
+	prg := -1
+	if nes.CARTIO != nil {
+		prg = nes.CARTIO.prgOffset(addr)
+	}
+
+	if prg >= 0 {
+		// the first symbol at the nearest offset at or below prg
+		i := sort.Search(len(s.rom), func(i int) bool { return s.rom[i].PRG > prg }) - 1
+		for i > 0 && s.rom[i-1].PRG == s.rom[i].PRG {
+			i--
+		}
+		if i >= 0 {
+			sym := s.rom[i]
+			offset := prg - sym.PRG
+
+			// it has to be in the same bank as addr
+			if offset <= int(addr) && nes.CARTIO.prgOffset(addr-uint16(offset)) == sym.PRG && (sym.Size == 0 || offset < sym.Size) {
+				return sym, offset, true
+			}
+		}
+	}
+
+	i := sort.Search(len(s.addr), func(i int) bool { return s.addr[i].Addr > addr }) - 1
+	for i > 0 && s.addr[i-1].Addr == s.addr[i].Addr {
+		i--
+	}
+	if i >= 0 {
+		sym := s.addr[i]
+		offset := int(addr - sym.Addr)
+		if sym.Size > 0 && offset < sym.Size || sym.Size == 0 && offset <= maxSymbolOffset {
+			return sym, offset, true
+		}
+	}
+
+	return nil, 0, false
+}
+
+// Name - addr as label or label+offset, or "" if no symbol covers it
+func (s *Symbols) Name(nes *NES, addr uint16) string {
+	sym, offset, ok := s.Lookup(nes, addr)
+	if !ok {
+		return ""
+	}
+	if offset == 0 {
+		return sym.Name
+	}
+
+	return fmt.Sprintf("%s+%d", sym.Name, offset)
+}
+
+// Describe - addr's label+offset and source file and line, as much as
+// is known of them, like reset+3 (main.s:12). "" if nothing is.
+func (s *Symbols) Describe(nes *NES, addr uint16) string {
+	name := s.Name(nes, addr)
+
+	if s.info != nil {
+		if line, ok := s.info.SourceAt(nes, addr); ok {
+			source := fmt.Sprintf("%s:%d", filepath.Base(line.File), line.Line)
+			if name == "" {
+				return source
+			}
+			return fmt.Sprintf("%s (%s)", name, source)
+		}
+	}
+
+	return name
+}
+
+// parseSymbolAddr - a hex address, or a range like 0300-030F giving a size
+func parseSymbolAddr(text string) (int, int, error) {
+	text = strings.TrimPrefix(strings.TrimSpace(text), "$")
+
+	size := 0
+	if i := strings.IndexAny(text, "-/"); i >= 0 {
+		rest := strings.TrimPrefix(text[i+1:], "$")
+		n, err := strconv.ParseUint(rest, 16, 32)
+		if err != nil {
+			return 0, 0, fmt.Errorf("bad size or range %q", text)
+		}
+		size = int(n)
+		if text[i] == '-' {
+			size = -size
+		}
+		text = text[:i]
+	}
+
+	addr, err := strconv.ParseUint(text, 16, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad address %q", text)
+	}
+
+	// an end address was given rather than a size
+	if size < 0 {
+		size = -size - int(addr) + 1
+		if size <= 0 {
+			return 0, 0, fmt.Errorf("range %q ends before it starts", text)
+		}
+	}
+
+	return int(addr), size, nil
+}
+
+// loadNL - reads an FCEUX name list. game.nes.ram.nl names RAM, and
+// game.nes.N.nl the 16KB PRG bank N, in hex. Lines look like
+// $C000#reset#comment, or $0300/10#buffer# for 16 bytes.
+func (s *Symbols) loadNL(filename string) error {
+	bank := -1
+	parts := strings.Split(strings.ToLower(filepath.Base(filename)), ".")
+	if len(parts) >= 3 && parts[len(parts)-2] != "ram" {
+		n, err := strconv.ParseUint(parts[len(parts)-2], 16, 16)
+		if err != nil {
+			return fmt.Errorf("%s: expected a bank number or ram before .nl", filename)
+		}
+		bank = int(n)
+	}
+
+	return readSymbolLines(filename, func(line string) error {
+		fields := strings.SplitN(line, "#", 3)
+		if len(fields) < 2 || fields[1] == "" {
+			return nil
+		}
+
+		addr, size, err := parseSymbolAddr(fields[0])
+		if err != nil {
+			return err
+		}
+		if addr > 0xFFFF {
+			return fmt.Errorf("$%X isn't an address", addr)
+		}
+
+		sym := Symbol{Name: fields[1], Addr: uint16(addr), PRG: -1, Size: size}
+		if bank >= 0 && addr >= 0x8000 {
+			sym.PRG = bank*0x4000 + addr&0x3FFF
+		}
+		s.Add(sym)
+
+		return nil
+	})
+}
+
+// Mesen's memory types, in both the short and long spellings, and where
+// they start on the cpu bus. PRG rom is placed by the cartridge's layout.
+var mlbMemory = map[string]int{
+	"P": -1, "NesPrgRom": -1,
+	"R": 0x0000, "NesInternalRam": 0x0000,
+	"S": 0x6000, "NesSaveRam": 0x6000,
+	"W": 0x6000, "NesWorkRam": 0x6000,
+	"G": 0x0000, "NesMemory": 0x0000,
+}
+
+// loadMLB - reads a Mesen label file. Lines look like P:0123:reset:comment,
+// where P is PRG rom and 0123 an offset into it, or R:0300-030F:buffer
+func (s *Symbols) loadMLB(filename string, cart *Cartridge) error {
+	var banks []prgBank
+	if cart != nil {
+		banks, _ = prgLayout(cart)
+	}
+
+	return readSymbolLines(filename, func(line string) error {
+		fields := strings.SplitN(line, ":", 4)
+		if len(fields) < 3 || fields[2] == "" {
+			return nil
+		}
+
+		base, ok := mlbMemory[fields[0]]
+		if !ok {
+			// other consoles' memory types
+			return nil
+		}
+
+		offset, size, err := parseSymbolAddr(fields[1])
+		if err != nil {
+			return err
+		}
+
+		sym := Symbol{Name: fields[2], PRG: -1, Size: size}
+		if base >= 0 {
+			sym.Addr = uint16(base + offset)
+		} else {
+			sym.PRG, sym.Addr = offset, 0x8000|uint16(offset&0x7FFF)
+			for _, bank := range banks {
+				if offset >= bank.offset && offset < bank.offset+bank.size {
+					sym.Addr = bank.origin + uint16(offset-bank.offset)
+				}
+			}
+		}
+		s.Add(sym)
+
+		return nil
+	})
+}
+
+// readSymbolLines - calls parse on each line of filename that isn't blank
+func readSymbolLines(filename string, parse func(line string) error) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if err := parse(line); err != nil {
+			return fmt.Errorf("%s: line %d: %v", filename, lineNum, err)
+		}
+	}
+
+	return scanner.Err()
+}
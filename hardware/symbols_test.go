@@ -0,0 +1,215 @@
+package hardware
+
+import (
+	"bytes"
+	"nes-emu/assembler"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestSymbols assembles debugTestSource with the given symbol files
+// next to it, and loads whichever of them are found
+func newTestSymbols(t *testing.T, files map[string]string) (*NES, *Cartridge, *Symbols) {
+	rom, _ := assembleROM(t, debugTestSource)
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(filepath.Dir(rom), name), []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cart, err := CreateCartridge(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nes := NewNES()
+	nes.LoadCartridge(cart)
+	nes.APU.InitAPU(false)
+	nes.PPU.InitFrame(1)
+	nes.Reset()
+
+	symbols := NewSymbols()
+	for _, file := range FindSymbolFiles(rom) {
+		if err := symbols.Load(file, &cart); err != nil {
+			t.Fatal(err)
+		}
+	}
+	nes.Symbols = symbols
+
+	return nes, &cart, symbols
+}
+
+func TestLoadSymbolFiles(t *testing.T) {
+	nes, _, symbols := newTestSymbols(t, map[string]string{
+		"test.nes.0.nl":   "$C013#outer#\n$C017#inner#the innermost\n",
+		"test.nes.ram.nl": "$0300/2#buffer#\n",
+		"test.mlb":        "P:0000:reset\nR:0310-031F:table\nG:2000:PPUCTRL:\nSnesWorkRam:0000:other\n",
+	})
+
+	tests := []struct {
+		addr uint16
+		name string
+	}{
+		{0xC000, "reset"},
+		{0xC003, "reset+3"},
+		{0xC017, "inner"},
+		{0xC019, "inner+2"},
+		// 16KB of PRG is mirrored, so the same code is at $8000
+		{0x8017, "inner"},
+		{0x0300, "buffer"},
+		{0x0301, "buffer+1"},
+		{0x0302, ""},
+		{0x031F, "table+15"},
+		{0x0320, ""},
+		{0x2001, "PPUCTRL+1"},
+	}
+	for _, test := range tests {
+		if name := symbols.Name(nes, test.addr); name != test.name {
+			t.Errorf("$%04X: expected %q, got %q", test.addr, test.name, name)
+		}
+	}
+
+	if sym, ok := symbols.Resolve("outer"); !ok || sym.Addr != 0xC013 || sym.PRG != 0x13 {
+		t.Errorf("Expected outer at $C013, PRG $13, got %+v", sym)
+	}
+	if _, ok := symbols.Resolve("other"); ok {
+		t.Errorf("Expected labels for other consoles' memory to be skipped")
+	}
+}
+
+func TestLoadSymbolFilesErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, contents := range map[string]string{
+		"bad.nes.0.nl":   "$C0ZZ#bad#\n",
+		"bad.nes.ram.nl": "$0310-0300#backwards#\n",
+		"bad.nes.xy.nl":  "$C000#reset#\n",
+		"bad.mlb":        "P:zz:bad\n",
+		"bad.sym":        "",
+	} {
+		filename := filepath.Join(dir, name)
+		if err := os.WriteFile(filename, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := NewSymbols().Load(filename, nil); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestFindSymbolFiles(t *testing.T) {
+	dir := t.TempDir()
+	rom := filepath.Join(dir, "Game (U) [!].nes")
+	for _, name := range []string{
+		"Game (U) [!].nes", "Game (U) [!].nes.0.nl", "Game (U) [!].nes.ram.nl", "Game (U) [!].mlb",
+		"Game (U) [a1].nes.0.nl", "Game (U) [!].nes.nl", "Game (U) [!].nes.0.txt",
+	} {
+		if err := os.WriteFile(filepath.Join(dir, name), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var found []string
+	for _, file := range FindSymbolFiles(rom) {
+		found = append(found, filepath.Base(file))
+	}
+	if want := "Game (U) [!].mlb|Game (U) [!].nes.0.nl|Game (U) [!].nes.ram.nl"; strings.Join(found, "|") != want {
+		t.Errorf("Expected %s, got %s", want, strings.Join(found, "|"))
+	}
+}
+
+func TestDebugInfoSymbols(t *testing.T) {
+	nes, _, symbols := newTestSymbols(t, map[string]string{"test.dbg": debugTestInfo})
+
+	if symbols.DebugInfo() == nil {
+		t.Fatal("Expected test.dbg to be found")
+	}
+
+	for addr, want := range map[uint16]string{
+		0xC008: "reset+8 (test.s:9)",
+		0xC010: "reset@loop",
+		0xC018: "inner+1 (test.s:19)",
+		0x0300: "counter",
+		0x0301: "",
+	} {
+		if got := symbols.Describe(nes, addr); got != want {
+			t.Errorf("$%04X: expected %q, got %q", addr, want, got)
+		}
+	}
+}
+
+func TestTraceWithSymbols(t *testing.T) {
+	nes, _, _ := newTestSymbols(t, map[string]string{"test.dbg": debugTestInfo})
+	out := &bytes.Buffer{}
+	nes.Tracer = NewTracer(out)
+
+	for i := 0; i < 4; i++ {
+		nes.Step()
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if !strings.HasSuffix(lines[0], "  ; reset (test.s:5)") {
+		t.Errorf("Expected the first line to say where it is, got %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[3], "  ; reset+5, $0300 = counter") {
+		t.Errorf("Expected the sta to name its operand, got %q", lines[3])
+	}
+}
+
+func TestDebugConsoleSymbols(t *testing.T) {
+	nes, _, _ := newTestSymbols(t, map[string]string{"test.dbg": debugTestInfo})
+	out := &bytes.Buffer{}
+	console := NewDebugConsole(NewDebugger(nes), out)
+
+	commands := make(chan string, 16)
+	for _, line := range []string{
+		"b inner",
+		"b outer [counter] == 9",
+		"c",
+		"bt",
+		"e counter + 1",
+		"q",
+	} {
+		commands <- line
+	}
+	close(commands)
+
+	console.Run(commands)
+
+	for _, want := range []string{
+		"added #1 exec $C017",
+		"stopped: breakpoint #1\nC017",
+		"#0 $C017 inner  JSR from $C013 outer (test.s:16), SP:FD",
+		"#1 $C013 outer  JSR from $C008 reset+8 (test.s:9), SP:FF",
+		"769 $301",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("Expected %q in:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestDisassembleWithSymbols(t *testing.T) {
+	_, cart, symbols := newTestSymbols(t, map[string]string{"test.dbg": debugTestInfo})
+
+	out := &bytes.Buffer{}
+	if err := Disassemble(cart, out, DisasmOptions{Symbols: symbols}); err != nil {
+		t.Fatal(err)
+	}
+	source := out.String()
+
+	for _, want := range []string{"counter = $0300", "inner:", "reset_loop:", "jsr outer", "inc counter"} {
+		if !strings.Contains(source, want) {
+			t.Errorf("Expected %q in:\n%s", want, source)
+		}
+	}
+
+	program, err := assembler.Assemble(source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(program.Bytes, assembler.INES(cart.prgRom, nil, mapper0)) {
+		t.Errorf("Expected the disassembly to reassemble to the same rom")
+	}
+}
@@ -0,0 +1,101 @@
+package hardware
+
+import (
+	"fmt"
+	"io"
+	"nes-emu/cpu6502"
+	"strings"
+)
+
+// Tracer - writes a nestest style line for each instruction before it runs:
+// address, bytes, disassembly, registers, PPU scanline and dot, and cpu cycle.
+//
+// C000  4C F5 C5  JMP $C5F5                       A:00 X:00 Y:00 P:24 SP:FD PPU:  0, 21 CYC:7
+type Tracer struct {
+	w   io.Writer
+	err error
+
+	// only trace instructions in this range of addresses
+	pcFilter       bool
+	pcStart, pcEnd uint16
+
+	// only trace during this range of frames
+	frameFilter          bool
+	frameStart, frameEnd uint64
+}
+
+func NewTracer(w io.Writer) *Tracer {
+	return &Tracer{w: w}
+}
+
+// SetPCRange - only trace instructions from start to end inclusive
+func (t *Tracer) SetPCRange(start, end uint16) {
+	t.pcFilter = true
+	t.pcStart, t.pcEnd = start, end
+}
+
+// SetFrameRange - only trace from frame start to end inclusive. The first frame is 0.
+func (t *Tracer) SetFrameRange(start, end uint64) {
+	t.frameFilter = true
+	t.frameStart, t.frameEnd = start, end
+}
+
+// Err - the first error from the writer. Nothing more is traced after it.
+func (t *Tracer) Err() error {
+	return t.err
+}
+
+func (t *Tracer) trace(nes *NES) {
+	cpu := nes.CPU
+
+	// interrupts and a jammed cpu don't run the instruction at PC
+	if t.err != nil || cpu.Halted() || cpu.InterruptPending() {
+		return
+	}
+
+	if t.pcFilter && (cpu.PC < t.pcStart || cpu.PC > t.pcEnd) {
+		return
+	}
+
+	frame := nes.PPU.frameCount
+	if t.frameFilter && (frame < t.frameStart || frame > t.frameEnd) {
+		return
+	}
+
+	_, t.err = fmt.Fprintln(t.w, traceLine(nes))
+}
+
+// traceLine - the trace line for the instruction about to run. With
+// symbols loaded it ends with where PC is and the name of the operand,
+// like ; reset+3 (main.s:12), $0300 = buffer
+func traceLine(nes *NES) string {
+	line := fmt.Sprintf("%s PPU:%3d,%3d CYC:%d",
+		nes.CPU.TraceLine(nes.CPU.Bus.Peek8),
+		nes.PPU.Scanline,
+		nes.PPU.Cycle,
+		nes.CPU.Cycles())
+
+	if nes.Symbols == nil {
+		return line
+	}
+
+	var notes []string
+	if where := nes.describe(nes.CPU.PC); where != "" {
+		notes = append(notes, where)
+	}
+
+	instr := cpu6502.Decode(nes.CPU.PC, nes.CPU.Bus.Peek8)
+	switch instr.Addressing {
+	case cpu6502.Implied, cpu6502.Accumulator, cpu6502.Immediate:
+	default:
+		if name := nes.Symbols.Name(nes, instr.Target); name != "" {
+			notes = append(notes, fmt.Sprintf("$%04X = %s", instr.Target, name))
+		}
+	}
+
+	if len(notes) == 0 {
+		return line
+	}
+
+	return line + "  ; " + strings.Join(notes, ", ")
+}
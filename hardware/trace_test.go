@@ -0,0 +1,120 @@
+package hardware
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+func newTracedNestest(t *testing.T) (*NES, *bytes.Buffer) {
+	cart, err := CreateCartridge("nestest.nes")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nes := NewNES()
+	nes.LoadCartridge(cart)
+	nes.APU.InitAPU(false)
+	nes.PPU.InitFrame(1)
+
+	// run headless from $C000
+	nes.Reset()
+	nes.CPU.PC = 0xC000
+
+	out := &bytes.Buffer{}
+	nes.Tracer = NewTracer(out)
+
+	return nes, out
+}
+
+func TestTraceMatchesNestest(t *testing.T) {
+	log, err := os.ReadFile("nestest.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := strings.Split(strings.TrimSpace(strings.ReplaceAll(string(log), "\r", "")), "\n")
+
+	nes, out := newTracedNestest(t)
+	for range expected {
+		nes.Step()
+	}
+
+	traced := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(traced) != len(expected) {
+		t.Fatalf("Expected %d trace lines but got %d", len(expected), len(traced))
+	}
+
+	// everything up to the stack pointer is the same format. The old log's
+	// CYC column is the PPU dot, so check the cycle count on the first line.
+	width := len("C000  4C F5 C5  JMP $C5F5                       A:00 X:00 Y:00 P:24 SP:FD")
+	for i := range expected {
+		want, got := expected[i][:width], traced[i][:width]
+
+		// the log shows its own emulator's idea of the APU and pad registers
+		if strings.Contains(want, " $40") {
+			want, got = want[:strings.Index(want, " = ")], got[:strings.Index(got, " = ")]
+		}
+
+		if got != want {
+			t.Fatalf("Line %d differs\nexpected: %s\n     got: %s", i+1, expected[i], traced[i])
+		}
+	}
+
+	if !strings.HasSuffix(traced[0], "PPU:  0, 21 CYC:7") {
+		t.Errorf("Expected the first line to start after the reset sequence: %s", traced[0])
+	}
+}
+
+// frameWriter notes which frame each trace line was written in
+type frameWriter struct {
+	nes    *NES
+	frames []uint64
+}
+
+func (w *frameWriter) Write(p []byte) (int, error) {
+	w.frames = append(w.frames, w.nes.PPU.frameCount)
+	return len(p), nil
+}
+
+func TestTracePCRange(t *testing.T) {
+	nes, out := newTracedNestest(t)
+	nes.Tracer.SetPCRange(0xC5F5, 0xC5FF)
+
+	for i := 0; i < 8; i++ {
+		nes.Step()
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("Expected the 5 instructions from c5f5 to c5ff but got\n%s", out.String())
+	}
+	for _, line := range lines {
+		if line[:4] < "C5F5" || line[:4] > "C5FF" {
+			t.Errorf("Line outside the pc range: %s", line)
+		}
+	}
+}
+
+func TestTraceFrameRange(t *testing.T) {
+	// C000 NOP
+	// C001 JMP $C000
+	nes := newTestNES([]byte{0xEA, 0x4C, 0x00, 0xC0}, 0xC020, 0xC000, 0xC010)
+	nes.APU.InitAPU(false)
+	nes.PPU.InitFrame(1)
+
+	w := &frameWriter{nes: nes}
+	nes.Tracer = NewTracer(w)
+	nes.Tracer.SetFrameRange(1, 2)
+
+	for nes.PPU.frameCount < 4 {
+		nes.Step()
+	}
+
+	if len(w.frames) == 0 {
+		t.Fatalf("Nothing traced")
+	}
+	if w.frames[0] != 1 || w.frames[len(w.frames)-1] != 2 {
+		t.Errorf("Expected frames 1 to 2 traced, got %d to %d", w.frames[0], w.frames[len(w.frames)-1])
+	}
+}
@@ -0,0 +1,346 @@
+package hardware
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// TraceEntry - the cpu state at the start of one instruction of a trace
+type TraceEntry struct {
+	Line string
+
+	PC uint16
+	A  uint8
+	X  uint8
+	Y  uint8
+	P  uint8
+	SP uint8
+
+	// cpu cycle count. For the old nestest format, where CYC is the PPU dot,
+	// this is the dot and DotCycle is set.
+	Cycle    uint64
+	HasCycle bool
+	DotCycle bool
+}
+
+var (
+	tracePC    = regexp.MustCompile(`^\s*\$?([0-9A-Fa-f]{4})`)
+	traceA     = regexp.MustCompile(`\bA:([0-9A-Fa-f]{2})`)
+	traceX     = regexp.MustCompile(`\bX:([0-9A-Fa-f]{2})`)
+	traceY     = regexp.MustCompile(`\bY:([0-9A-Fa-f]{2})`)
+	traceP     = regexp.MustCompile(`\bP:([A-Za-z-]{8}|[0-9A-Fa-f]{2})\b`)
+	traceSP    = regexp.MustCompile(`\bSP?:([0-9A-Fa-f]{2})`)
+	traceCycle = regexp.MustCompile(`\b(?:CYC|Cycle):\s*(\d+)`)
+)
+
+// ParseTraceLine - reads the registers out of a trace line in the nestest,
+// Mesen or FCEUX style. P can be hex or flag letters like nvUbdIzc.
+func ParseTraceLine(line string) (TraceEntry, error) {
+	entry := TraceEntry{Line: line}
+
+	hex8 := func(re *regexp.Regexp, name string) (uint8, error) {
+		match := re.FindStringSubmatch(line)
+		if match == nil {
+			return 0, fmt.Errorf("no %s in trace line %q", name, line)
+		}
+		value, err := strconv.ParseUint(match[1], 16, 8)
+		return uint8(value), err
+	}
+
+	match := tracePC.FindStringSubmatch(line)
+	if match == nil {
+		return entry, fmt.Errorf("no PC in trace line %q", line)
+	}
+	pc, _ := strconv.ParseUint(match[1], 16, 16)
+	entry.PC = uint16(pc)
+
+	var err error
+	if entry.A, err = hex8(traceA, "A"); err != nil {
+		return entry, err
+	}
+	if entry.X, err = hex8(traceX, "X"); err != nil {
+		return entry, err
+	}
+	if entry.Y, err = hex8(traceY, "Y"); err != nil {
+		return entry, err
+	}
+	if entry.SP, err = hex8(traceSP, "SP"); err != nil {
+		return entry, err
+	}
+
+	match = traceP.FindStringSubmatch(line)
+	if match == nil {
+		return entry, fmt.Errorf("no P in trace line %q", line)
+	}
+	if len(match[1]) == 8 {
+		// NV-BDIZC, upper case is set
+		for i, flag := range match[1] {
+			if flag >= 'A' && flag <= 'Z' {
+				entry.P |= 0x80 >> i
+			}
+		}
+	} else {
+		p, _ := strconv.ParseUint(match[1], 16, 8)
+		entry.P = uint8(p)
+	}
+
+	if match = traceCycle.FindStringSubmatch(line); match != nil {
+		entry.Cycle, _ = strconv.ParseUint(match[1], 10, 64)
+		entry.HasCycle = true
+		entry.DotCycle = strings.HasPrefix(match[0], "CYC") && !strings.Contains(line, "PPU:")
+	}
+
+	return entry, nil
+}
+
+// ReadTrace - parses a whole trace, skipping blank lines
+func ReadTrace(r io.Reader) ([]TraceEntry, error) {
+	var entries []TraceEntry
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		entry, err := ParseTraceLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %v", len(entries)+1, err)
+		}
+		entries = append(entries, entry)
+	}
+
+	return entries, scanner.Err()
+}
+
+// MemoryWrite - a write seen on the cpu bus
+type MemoryWrite struct {
+	Cycle uint64
+	Addr  uint16
+	Value uint8
+}
+
+// Divergence - where a run first stopped matching a reference trace
+type Divergence struct {
+	// index into the reference of the first entry that didn't match
+	Index int
+
+	Expected TraceEntry
+	Got      TraceEntry
+
+	// cycles the previous instruction took here and in the reference,
+	// when the reference has cycle counts
+	GotCycles, ExpectedCycles uint64
+	CycleMismatch             bool
+
+	// reference lines around the divergence, and our lines leading up to it
+	Reference []string
+	Emulator  []string
+
+	// index into the reference of the first line in Reference
+	referenceStart int
+
+	// the last writes before the divergence, oldest first
+	Writes []MemoryWrite
+
+	// the cpu jammed before the reference ran out
+	Halted bool
+}
+
+// flag names for P, bit 7 first
+const flagNames = "NV-BDIZC"
+
+func (d *Divergence) String() string {
+	var sb strings.Builder
+
+	if d.Halted {
+		fmt.Fprintf(&sb, "cpu halted before reference line %d\n", d.Index+1)
+	} else {
+		fmt.Fprintf(&sb, "diverged at reference line %d, after %d matching instructions\n", d.Index+1, d.Index)
+	}
+
+	sb.WriteString("\nreference:\n")
+	for i, line := range d.Reference {
+		marker := "  "
+		if d.referenceStart+i == d.Index {
+			marker = "> "
+		}
+		sb.WriteString(marker + line + "\n")
+	}
+
+	sb.WriteString("\nemulator:\n")
+	for i, line := range d.Emulator {
+		marker := "  "
+		if i == len(d.Emulator)-1 && !d.Halted {
+			marker = "> "
+		}
+		sb.WriteString(marker + line + "\n")
+	}
+
+	if !d.Halted {
+		sb.WriteString("\ndifferences:\n")
+		deltas := []struct {
+			name          string
+			expected, got uint16
+		}{
+			{"PC", d.Expected.PC, d.Got.PC},
+			{"A", uint16(d.Expected.A), uint16(d.Got.A)},
+			{"X", uint16(d.Expected.X), uint16(d.Got.X)},
+			{"Y", uint16(d.Expected.Y), uint16(d.Got.Y)},
+			{"SP", uint16(d.Expected.SP), uint16(d.Got.SP)},
+		}
+		for _, delta := range deltas {
+			if delta.expected != delta.got {
+				fmt.Fprintf(&sb, "  %-2s expected %02X got %02X\n", delta.name, delta.expected, delta.got)
+			}
+		}
+
+		if changed := (d.Expected.P ^ d.Got.P) & comparedFlags; changed != 0 {
+			fmt.Fprintf(&sb, "  P  expected %02X got %02X:", d.Expected.P, d.Got.P)
+			for i := uint(0); i < 8; i++ {
+				bit := uint8(0x80) >> i
+				if changed&bit == 0 {
+					continue
+				}
+				if d.Got.P&bit != 0 {
+					fmt.Fprintf(&sb, " +%c", flagNames[i])
+				} else {
+					fmt.Fprintf(&sb, " -%c", flagNames[i])
+				}
+			}
+			sb.WriteString("\n")
+		}
+
+		if d.CycleMismatch {
+			fmt.Fprintf(&sb, "  previous instruction took %d cycles, expected %d\n", d.GotCycles, d.ExpectedCycles)
+		}
+	}
+
+	if len(d.Writes) > 0 {
+		sb.WriteString("\nlast writes:\n")
+		for _, write := range d.Writes {
+			fmt.Fprintf(&sb, "  CYC:%-8d $%04X = %02X\n", write.Cycle, write.Addr, write.Value)
+		}
+	}
+
+	return sb.String()
+}
+
+// comparedFlags - B and the unused bit aren't real flags, and traces disagree on them
+const comparedFlags = 0xCF
+
+// DiffTrace - runs nes against reference until they disagree. The cpu is
+// synced to the reference's first line, and after that the registers and
+// the cycles each instruction took are compared. window is how many
+// instructions and writes of context to keep. Returns nil if the whole
+// reference matched.
+func DiffTrace(nes *NES, reference []TraceEntry, window int) *Divergence {
+	if len(reference) == 0 {
+		return nil
+	}
+	if window < 1 {
+		window = 1
+	}
+
+	first := reference[0]
+	cpu := nes.CPU
+	cpu.PC, cpu.A, cpu.X, cpu.Y, cpu.P, cpu.SP = first.PC, first.A, first.X, first.Y, first.P, first.SP
+
+	var writes []MemoryWrite
+	defer nes.CPU.Bus.Observe(func(addr uint16, value uint8, write bool) {
+		if !write {
+			return
+		}
+		writes = append(writes, MemoryWrite{cpu.Cycles(), addr, value})
+		if len(writes) > window {
+			writes = writes[1:]
+		}
+	})()
+
+	var ours []string
+	var lastCycle uint64
+
+	for i := 0; i < len(reference); {
+		if cpu.Halted() {
+			return newDivergence(reference, i, TraceEntry{}, ours, writes, window, true)
+		}
+
+		if cpu.InterruptPending() {
+			nes.Step()
+			continue
+		}
+
+		line := traceLine(nes)
+		ours = append(ours, line)
+		if len(ours) > window {
+			ours = ours[1:]
+		}
+
+		got, _ := ParseTraceLine(line)
+		expected := reference[i]
+
+		var gotCycles, expectedCycles uint64
+		cycleMismatch := false
+		if i > 0 && expected.HasCycle && reference[i-1].HasCycle {
+			gotCycles = got.Cycle - lastCycle
+
+			if expected.DotCycle {
+				// the dot wraps every scanline, and runs three times a cycle
+				dots := (expected.Cycle + 341 - reference[i-1].Cycle) % 341
+				expectedCycles = dots / 3
+				cycleMismatch = (gotCycles*3)%341 != dots
+			} else {
+				expectedCycles = expected.Cycle - reference[i-1].Cycle
+				cycleMismatch = gotCycles != expectedCycles
+			}
+		}
+
+		if cycleMismatch || got.PC != expected.PC || got.A != expected.A || got.X != expected.X ||
+			got.Y != expected.Y || got.SP != expected.SP || (got.P^expected.P)&comparedFlags != 0 {
+			d := newDivergence(reference, i, got, ours, writes, window, false)
+			d.GotCycles, d.ExpectedCycles, d.CycleMismatch = gotCycles, expectedCycles, cycleMismatch
+			return d
+		}
+
+		lastCycle = got.Cycle
+		nes.Step()
+		i++
+	}
+
+	return nil
+}
+
+func newDivergence(reference []TraceEntry, index int, got TraceEntry, ours []string, writes []MemoryWrite, window int, halted bool) *Divergence {
+	d := &Divergence{
+		Index:    index,
+		Expected: reference[index],
+		Got:      got,
+		Emulator: append([]string(nil), ours...),
+		Writes:   append([]MemoryWrite(nil), writes...),
+		Halted:   halted,
+	}
+
+	// line our window up with the reference, and show what should have come next
+	start := index - (len(ours) - 1)
+	if halted {
+		start = index - len(ours)
+	}
+	if start < 0 {
+		start = 0
+	}
+	end := index + window/2 + 1
+	if end > len(reference) {
+		end = len(reference)
+	}
+	d.referenceStart = start
+	for _, entry := range reference[start:end] {
+		d.Reference = append(d.Reference, entry.Line)
+	}
+
+	return d
+}
@@ -0,0 +1,119 @@
+package hardware
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseTraceLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		line     string
+		expected TraceEntry
+	}{
+		{
+			"nestest",
+			"C000  4C F5 C5  JMP $C5F5                       A:00 X:00 Y:00 P:24 SP:FD CYC:  0",
+			TraceEntry{PC: 0xC000, P: 0x24, SP: 0xFD, HasCycle: true, DotCycle: true},
+		},
+		{
+			"nestest with ppu",
+			"C5F5  A2 00     LDX #$00                        A:01 X:02 Y:03 P:24 SP:FD PPU:  0, 30 CYC:10",
+			TraceEntry{PC: 0xC5F5, A: 0x01, X: 0x02, Y: 0x03, P: 0x24, SP: 0xFD, Cycle: 10, HasCycle: true},
+		},
+		{
+			"mesen",
+			"8000 $78     SEI                  A:10 X:20 Y:30 S:FD P:nvUbdIzC V:0   H:21  Fr:0 Cycle:7",
+			TraceEntry{PC: 0x8000, A: 0x10, X: 0x20, Y: 0x30, P: 0x25, SP: 0xFD, Cycle: 7, HasCycle: true},
+		},
+		{
+			"fceux",
+			"$C000:4C F5 C5  JMP $C5F5                       A:00 X:00 Y:00 S:FD P:nvUbdIzc",
+			TraceEntry{PC: 0xC000, P: 0x24, SP: 0xFD},
+		},
+	}
+
+	for _, test := range tests {
+		entry, err := ParseTraceLine(test.line)
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		test.expected.Line = test.line
+		if entry != test.expected {
+			t.Errorf("%s: expected %+v but got %+v", test.name, test.expected, entry)
+		}
+	}
+}
+
+func TestDiffTraceStopsAtFirstDivergence(t *testing.T) {
+	log, err := os.ReadFile("nestest.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// break line 100's accumulator
+	lines := strings.Split(strings.ReplaceAll(string(log), "\r", ""), "\n")
+	a := strings.Index(lines[99], "A:") + 2
+	lines[99] = lines[99][:a] + "7E" + lines[99][a+2:]
+
+	reference, err := ReadTrace(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nes, _ := newTracedNestest(t)
+	nes.Tracer = nil
+
+	divergence := DiffTrace(nes, reference, 5)
+	if divergence == nil {
+		t.Fatalf("Expected a divergence")
+	}
+	if divergence.Index != 99 {
+		t.Errorf("Expected to stop at line 100, stopped at %d", divergence.Index+1)
+	}
+
+	report := divergence.String()
+	for _, want := range []string{"reference line 100", "A  expected 7E", "> " + lines[99], "last writes:"} {
+		if !strings.Contains(report, want) {
+			t.Errorf("Expected report to contain %q\n%s", want, report)
+		}
+	}
+	if len(divergence.Emulator) != 5 || len(divergence.Writes) > 5 {
+		t.Errorf("Expected a window of 5, got %d lines and %d writes", len(divergence.Emulator), len(divergence.Writes))
+	}
+}
+
+func TestDiffTraceKeepsWatchpoints(t *testing.T) {
+	file, err := os.Open("nestest.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	reference, err := ReadTrace(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nes, _ := newTracedNestest(t)
+	nes.Tracer = nil
+	d := NewDebugger(nes)
+	if _, err := d.AddBreakpoint(BreakWrite, 0x0000, 0x07FF, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	if divergence := DiffTrace(nes, reference[:200], 5); divergence != nil {
+		t.Fatalf("Expected the first 200 lines to match, got\n%v", divergence)
+	}
+	if d.memoryHit == nil {
+		t.Errorf("Expected the watchpoint to see nestest's writes to ram during the diff")
+	}
+
+	d.memoryHit = nil
+	nes.CPU.Write8(0x0300, 0x01)
+	if d.memoryHit == nil {
+		t.Errorf("Expected the watchpoint to still be there after the diff")
+	}
+}
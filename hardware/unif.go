@@ -0,0 +1,188 @@
+package hardware
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strings"
+)
+
+// unifHeaderSize - the magic, a revision and padding before the chunks
+const unifHeaderSize = 32
+
+// unifBoards - the mapper emulating each UNIF board, by its name without
+// the NES-, HVC- or other maker's prefix
+var unifBoards = map[string]uint16{
+	"NROM":     mapper0,
+	"NROM-128": mapper0,
+	"NROM-256": mapper0,
+
+	"SAROM":  mmc1,
+	"SBROM":  mmc1,
+	"SCROM":  mmc1,
+	"SEROM":  mmc1,
+	"SGROM":  mmc1,
+	"SKROM":  mmc1,
+	"SLROM":  mmc1,
+	"SL1ROM": mmc1,
+	"SNROM":  mmc1,
+	"SOROM":  mmc1,
+	"SUROM":  mmc1,
+	"SXROM":  mmc1,
+}
+
+// unifBoardPrefixes - who made the board, before its name
+var unifBoardPrefixes = []string{"NES-", "HVC-", "UNL-", "BTL-", "BMC-"}
+
+// unifMapper - the mapper for a board name
+func unifMapper(board string) (uint16, bool) {
+	name := strings.ToUpper(board)
+	for _, prefix := range unifBoardPrefixes {
+		name = strings.TrimPrefix(name, prefix)
+	}
+
+	mapper, ok := unifBoards[name]
+	return mapper, ok
+}
+
+// loadUNIF - reads a UNIF image's chunks: the board name in MAPR, PRG rom
+// in PRG0 to PRGF and CHR rom in CHR0 to CHRF, joined in order, and the
+// mirroring, battery and TV system. An iNES header is made up from them.
+func loadUNIF(rom []byte) (Cartridge, error) {
+	var c Cartridge
+
+	if len(rom) < unifHeaderSize {
+		return c, fmt.Errorf("%w: %d bytes is too short for a UNIF header", ErrTruncatedROM, len(rom))
+	}
+
+	header := Header{UNIF: true}
+	var prgChunks, chrChunks [16][]byte
+
+	for data := rom[unifHeaderSize:]; len(data) > 0; {
+		if len(data) < 8 {
+			return c, fmt.Errorf("%w: UNIF chunk header cut short", ErrTruncatedROM)
+		}
+		id, size := string(data[:4]), binary.LittleEndian.Uint32(data[4:8])
+		data = data[8:]
+		if uint64(size) > uint64(len(data)) {
+			return c, fmt.Errorf("%w: UNIF chunk %s is %d bytes, but there are only %d left", ErrTruncatedROM, id, size, len(data))
+		}
+		chunk := data[:size]
+		data = data[size:]
+
+		switch {
+		case id == "MAPR":
+			c.Board = unifString(chunk)
+		case id == "NAME":
+			c.Title = unifString(chunk)
+		case strings.HasPrefix(id, "PRG") || strings.HasPrefix(id, "CHR"):
+			n, ok := unifChunkNumber(id[3])
+			if !ok {
+				continue
+			}
+			if id[0] == 'P' {
+				prgChunks[n] = chunk
+			} else {
+				chrChunks[n] = chunk
+			}
+		case id == "MIRR" && len(chunk) > 0:
+			// 0 and 1 are horizontal and vertical, 2 and 3 one screen and
+			// 5 up to the mapper
+			switch chunk[0] {
+			case 1:
+				header.VerticalMirroring = true
+			case 4:
+				header.FourScreen = true
+			}
+		case id == "BATR":
+			header.Battery = true
+		case id == "TVCI" && len(chunk) > 0:
+			switch chunk[0] {
+			case 1:
+				header.Timing = TimingPAL
+			case 2:
+				header.Timing = TimingMulti
+			}
+		}
+	}
+
+	if c.Board == "" {
+		return c, fmt.Errorf("%w: UNIF image has no MAPR board name", ErrBadHeader)
+	}
+	// boards without a mapper still load, so what they are can be listed,
+	// but LoadCartridge won't run them
+	mapper, ok := unifMapper(c.Board)
+	if !ok {
+		mapper = UnknownMapper
+	}
+	header.Mapper = mapper
+
+	prg, chr := bytes.Join(prgChunks[:], nil), bytes.Join(chrChunks[:], nil)
+	if len(prg) == 0 {
+		return c, fmt.Errorf("%w: no PRG rom", ErrBadHeader)
+	}
+	header.PRGROMSize, header.CHRROMSize = len(prg), len(chr)
+
+	// the boards all have 8KB of PRG ram, or of CHR ram without CHR rom
+	header.PRGRAMSize = 0x2000
+	if header.Battery {
+		header.PRGRAMSize, header.PRGNVRAMSize = 0, header.PRGRAMSize
+	}
+	if len(chr) == 0 {
+		header.CHRRAMSize = 0x2000
+	}
+
+	c.Header = header
+	c.FileHeader = header
+	c.mapperType = header.Mapper
+
+	if err := c.setROM(prg, chr); err != nil {
+		return c, err
+	}
+	c.setINESHeader()
+
+	return c, nil
+}
+
+// unifString - a NUL terminated string chunk
+func unifString(chunk []byte) string {
+	if i := bytes.IndexByte(chunk, 0); i >= 0 {
+		chunk = chunk[:i]
+	}
+
+	return strings.TrimSpace(string(chunk))
+}
+
+// unifChunkNumber - which of PRG0 to PRGF, or CHR0 to CHRF, a chunk is
+func unifChunkNumber(digit byte) (int, bool) {
+	switch {
+	case digit >= '0' && digit <= '9':
+		return int(digit - '0'), true
+	case digit >= 'A' && digit <= 'F':
+		return int(digit-'A') + 10, true
+	}
+
+	return 0, false
+}
+
+// setINESHeader - makes up the iNES header HeaderBytes gives for a
+// cartridge that wasn't loaded from one
+func (c *Cartridge) setINESHeader() {
+	copy(c.nesLabel[:], "NES\x1a")
+
+	c.flags6 = uint8(c.Mapper&0x0F) << 4
+	if c.VerticalMirroring {
+		c.flags6 |= 0x01
+	}
+	if c.Battery {
+		c.flags6 |= 0x02
+	}
+	if c.FourScreen {
+		c.flags6 |= 0x08
+	}
+	c.flags7 = uint8(c.Mapper & 0xF0)
+
+	if c.Timing == TimingPAL {
+		c.flags9 = 0x01
+	}
+}
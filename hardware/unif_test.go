@@ -0,0 +1,137 @@
+package hardware
+
+import (
+	"encoding/binary"
+	"errors"
+	"nes-emu/assembler"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// unifImage - a UNIF image of the chunks, in order
+func unifImage(chunks ...interface{}) []byte {
+	image := append([]byte("UNIF"), 7, 0, 0, 0)
+	image = append(image, make([]byte, unifHeaderSize-8)...)
+
+	for i := 0; i < len(chunks); i += 2 {
+		data := chunks[i+1].([]byte)
+		var size [4]byte
+		binary.LittleEndian.PutUint32(size[:], uint32(len(data)))
+		image = append(image, chunks[i].(string)...)
+		image = append(image, size[:]...)
+		image = append(image, data...)
+	}
+
+	return image
+}
+
+func TestLoadUNIF(t *testing.T) {
+	filename, _ := assembleROM(t, `
+	.bank 0
+	.org $C000
+reset:
+	lda #$42
+	sta $6000
+forever:
+	jmp forever
+
+	.org $FFFA
+	.word reset, reset, reset`)
+	ines, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prg, chr := ines[16:16+0x4000], ines[16+0x4000:]
+
+	// the PRG chunks are joined in number order, not file order
+	image := unifImage(
+		"NAME", []byte("test\x00"),
+		"MAPR", []byte("NES-NROM-256\x00"),
+		"PRG1", prg,
+		"PRG0", make([]byte, 0x4000),
+		"CHR0", chr,
+		"MIRR", []byte{1},
+		"BATR", []byte{1},
+		"DINF", make([]byte, 204),
+	)
+	unifFile := filepath.Join(t.TempDir(), "test.unf")
+	if err := os.WriteFile(unifFile, image, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	cart, err := CreateCartridge(unifFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Header{UNIF: true, Mapper: mapper0, PRGROMSize: 0x8000, CHRROMSize: 0x2000, PRGNVRAMSize: 0x2000,
+		VerticalMirroring: true, Battery: true}
+	if cart.Header != want || cart.Board != "NES-NROM-256" || cart.Title != "test" {
+		t.Errorf("Expected\n%+v, got\n%+v %q %q", want, cart.Header, cart.Board, cart.Title)
+	}
+	if h := cart.HeaderBytes(); h[4] != 2 || h[5] != 1 || h[6] != 0x03 {
+		t.Errorf("Expected a made up iNES header for 32KB of PRG rom, got % X", h)
+	}
+
+	nes := NewNES()
+	if err := nes.LoadCartridge(cart); err != nil {
+		t.Fatal(err)
+	}
+	nes.APU.InitAPU(false)
+	nes.PPU.InitFrame(1)
+	nes.Reset()
+	for i := 0; i < 10; i++ {
+		nes.Step()
+	}
+	if value := nes.CPU.Bus.Peek8(0x6000); value != 0x42 {
+		t.Errorf("Expected the game to run from PRG1 and write $42 to $6000, got $%02X", value)
+	}
+
+	// an MMC1 board with CHR ram
+	cart, err = loadROM(unifImage("MAPR", []byte("HVC-SNROM"), "PRG0", make([]byte, 0x40000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cart.mapperType != mmc1 || cart.CHRRAMSize != 0x2000 || cart.prgRomBlocks != 16 {
+		t.Errorf("Expected 256KB of PRG rom on MMC1 with CHR ram, got %v", cart.Header)
+	}
+}
+
+func TestLoadUNIFErrors(t *testing.T) {
+	prg := make([]byte, 0x4000)
+
+	tests := []struct {
+		name  string
+		image []byte
+		err   error
+	}{
+		{"short header", []byte("UNIF"), ErrTruncatedROM},
+		{"no board", unifImage("PRG0", prg), ErrBadHeader},
+		{"no PRG rom", unifImage("MAPR", []byte("NES-NROM\x00")), ErrBadHeader},
+		{"short chunk", unifImage("MAPR", []byte("NES-NROM\x00"), "PRG0", prg)[:0x3000], ErrTruncatedROM},
+	}
+
+	for _, test := range tests {
+		if _, err := loadROM(test.image); !errors.Is(err, test.err) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+		}
+	}
+
+	// a board without a mapper loads, but can't be run
+	cart, err := loadROM(unifImage("MAPR", []byte("NES-TLROM\x00"), "PRG0", prg))
+	if err != nil {
+		t.Fatalf("Expected a UNIF image on an unknown board to load, got %v", err)
+	}
+	if cart.Board != "NES-TLROM" || cart.Mapper != UnknownMapper || cart.PRGROMSize != len(prg) || SupportedMapper(cart.Mapper) {
+		t.Errorf("Expected the board and header of the unknown board, got %q %v", cart.Board, cart.Header)
+	}
+	if err := NewNES().LoadCartridge(cart); !errors.Is(err, ErrUnsupportedMapper) || !strings.Contains(err.Error(), "NES-TLROM") {
+		t.Errorf("Expected the board to be refused by LoadCartridge, got %v", err)
+	}
+
+	// anything else is taken to be iNES
+	if _, err := loadROM(assembler.INES(nil, nil, mapper0)); err != nil {
+		t.Errorf("Expected an iNES image to load, got %v", err)
+	}
+}